@@ -2,6 +2,7 @@ package ast
 
 import (
 	"bytes"
+	"math/big"
 	"monkey-compiler/token"
 	"strings"
 )
@@ -51,6 +52,14 @@ type LetStatement struct {
 	Token token.Token // the token.LET token
 	Name  *Identifier
 	Value Expression
+
+	// Names are all the names of let a, b = value, which binds them to the elements
+	// of the array value. Name is the first of them. Names is nil for a single name.
+	Names []*Identifier
+
+	// Comments are the comments directly above the statement.
+	// They are only kept when the lexer was made with lexer.NewWithComments.
+	Comments []string
 }
 
 func (ls *LetStatement) statementNode()       {}
@@ -59,7 +68,15 @@ func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(ls.TokenLiteral() + " ")
-	out.WriteString(ls.Name.String())
+	if ls.Names != nil {
+		names := []string{}
+		for _, n := range ls.Names {
+			names = append(names, n.String())
+		}
+		out.WriteString(strings.Join(names, ", "))
+	} else {
+		out.WriteString(ls.Name.String())
+	}
 	out.WriteString(" = ")
 
 	if ls.Value != nil {
@@ -106,6 +123,28 @@ func (es *ExpressionStatement) String() string {
 	return ""
 }
 
+// IndexAssignStatement replaces an element of an array or hash: a[index] = value
+type IndexAssignStatement struct {
+	Token  token.Token // the = token
+	Target *IndexExpression
+	Value  Expression
+}
+
+func (ias *IndexAssignStatement) statementNode()       {}
+func (ias *IndexAssignStatement) TokenLiteral() string { return ias.Token.Literal }
+func (ias *IndexAssignStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(ias.Target.Left.String())
+	out.WriteString("[")
+	out.WriteString(ias.Target.Index.String())
+	out.WriteString("] = ")
+	out.WriteString(ias.Value.String())
+	out.WriteString(";")
+
+	return out.String()
+}
+
 type BlockStatement struct {
 	Token      token.Token // the { token
 	Statements []Statement
@@ -123,15 +162,70 @@ func (bs *BlockStatement) String() string {
 	return out.String()
 }
 
+// DoWhileStatement runs Body, then again for as long as Condition is truthy afterwards
+type DoWhileStatement struct {
+	Token     token.Token // the 'do' token
+	Label     string      // the name a break or continue of an enclosing loop uses for it, if any
+	Body      *BlockStatement
+	Condition Expression
+}
+
+func (ds *DoWhileStatement) statementNode()       {}
+func (ds *DoWhileStatement) TokenLiteral() string { return ds.Token.Literal }
+func (ds *DoWhileStatement) String() string {
+	loop := "do {" + ds.Body.String() + "} while (" + ds.Condition.String() + ")"
+	if ds.Label != "" {
+		return ds.Label + ": " + loop
+	}
+	return loop
+}
+
+// BreakStatement ends the innermost loop it is in, or the one with its Label
+type BreakStatement struct {
+	Token token.Token // the 'break' token
+	Label string      // empty for the innermost loop
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) String() string {
+	if bs.Label != "" {
+		return "break " + bs.Label + ";"
+	}
+	return "break;"
+}
+
+// ContinueStatement skips the rest of the body of the innermost loop it is in, or of the one
+// with its Label, going on with the check of the loop's condition
+type ContinueStatement struct {
+	Token token.Token // the 'continue' token
+	Label string      // empty for the innermost loop
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) String() string {
+	if cs.Label != "" {
+		return "continue " + cs.Label + ";"
+	}
+	return "continue;"
+}
+
 // Expressions
 type Identifier struct {
 	Token token.Token // the token.IDENT token
 	Value string
+	Type  string // the type annotation of a name being bound, like the int of let x: int = 1, if any
 }
 
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
-func (i *Identifier) String() string       { return i.Value }
+func (i *Identifier) String() string {
+	if i.Type != "" {
+		return i.Value + ": " + i.Type
+	}
+	return i.Value
+}
 
 type Boolean struct {
 	Token token.Token
@@ -142,15 +236,34 @@ func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
+type Null struct {
+	Token token.Token
+}
+
+func (n *Null) expressionNode()      {}
+func (n *Null) TokenLiteral() string { return n.Token.Literal }
+func (n *Null) String() string       { return n.Token.Literal }
+
 type IntegerLiteral struct {
 	Token token.Token
 	Value int64
+	// Big holds the value of a literal beyond the range of int64, whose Value is 0
+	Big *big.Int
 }
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode()      {}
+func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
+
 type PrefixExpression struct {
 	Token    token.Token // The prefix token, e.g. !
 	Operator string
@@ -216,10 +329,73 @@ func (ie *IfExpression) String() string {
 	return out.String()
 }
 
+// TryExpression runs Body and, if it fails with an error the program can recover from, binds
+// the error to Name and runs Handler instead. Its value is that of the one which ran last.
+// Finally then runs in any case, also when Body or Handler fail or return; its value is dropped.
+// Name and Handler are nil without catch, Finally is nil without finally.
+type TryExpression struct {
+	Token   token.Token // the 'try' token
+	Body    *BlockStatement
+	Name    *Identifier
+	Handler *BlockStatement
+	Finally *BlockStatement
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("try {")
+	out.WriteString(te.Body.String())
+	out.WriteString("}")
+	if te.Handler != nil {
+		out.WriteString(" catch (")
+		out.WriteString(te.Name.String())
+		out.WriteString(") {")
+		out.WriteString(te.Handler.String())
+		out.WriteString("}")
+	}
+	if te.Finally != nil {
+		out.WriteString(" finally {")
+		out.WriteString(te.Finally.String())
+		out.WriteString("}")
+	}
+
+	return out.String()
+}
+
+// ThrowExpression fails with Value as the error, which a try around it catches as is
+type ThrowExpression struct {
+	Token token.Token // the 'throw' token
+	Value Expression
+}
+
+func (te *ThrowExpression) expressionNode()      {}
+func (te *ThrowExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *ThrowExpression) String() string       { return "throw " + te.Value.String() }
+
+// BlockExpression is a block used as an expression. Its value is that of its last statement,
+// and the names it defines are only visible inside it.
+type BlockExpression struct {
+	Token token.Token // the { token
+	Block *BlockStatement
+}
+
+func (be *BlockExpression) expressionNode()      {}
+func (be *BlockExpression) TokenLiteral() string { return be.Token.Literal }
+func (be *BlockExpression) String() string {
+	return "{" + be.Block.String() + "}"
+}
+
 type FunctionLiteral struct {
 	Token      token.Token // The 'fn' token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	EndLine    int      // the line of the last token of the function
+	ReturnType string   // the type annotation of the result, like the int of fn(): int { 1 }, if any
+	Name       string   // the name the function is bound to by a let statement, if any
+	Comments   []string // the comments of the let statement binding the function, if any
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -235,7 +411,11 @@ func (fl *FunctionLiteral) String() string {
 	out.WriteString(fl.TokenLiteral())
 	out.WriteString("(")
 	out.WriteString(strings.Join(params, ", "))
-	out.WriteString(") ")
+	out.WriteString(")")
+	if fl.ReturnType != "" {
+		out.WriteString(": " + fl.ReturnType)
+	}
+	out.WriteString(" ")
 	out.WriteString(fl.Body.String())
 
 	return out.String()
@@ -245,6 +425,7 @@ type CallExpression struct {
 	Token     token.Token // The '(' token
 	Function  Expression  // Identifier or FunctionLiteral
 	Arguments []Expression
+	Optional  bool // f?.(x), null instead of calling f if it is null
 }
 
 func (ce *CallExpression) expressionNode()      {}
@@ -258,6 +439,9 @@ func (ce *CallExpression) String() string {
 	}
 
 	out.WriteString(ce.Function.String())
+	if ce.Optional {
+		out.WriteString("?.")
+	}
 	out.WriteString("(")
 	out.WriteString(strings.Join(args, ", "))
 	out.WriteString(")")
@@ -297,9 +481,10 @@ func (al *ArrayLiteral) String() string {
 }
 
 type IndexExpression struct {
-	Token token.Token // The [ token
-	Left  Expression
-	Index Expression
+	Token    token.Token // The [ token
+	Left     Expression
+	Index    Expression
+	Optional bool // a?.[k], null instead of indexing a if it is null
 }
 
 func (ie *IndexExpression) expressionNode()      {}
@@ -309,6 +494,9 @@ func (ie *IndexExpression) String() string {
 
 	out.WriteString("(")
 	out.WriteString(ie.Left.String())
+	if ie.Optional {
+		out.WriteString("?.")
+	}
 	out.WriteString("[")
 	out.WriteString(ie.Index.String())
 	out.WriteString("])")
@@ -316,9 +504,21 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// SpreadExpression passes the elements of an array as separate arguments: f(...args)
+type SpreadExpression struct {
+	Token token.Token // the '...' token
+	Value Expression
+}
+
+func (se *SpreadExpression) expressionNode()      {}
+func (se *SpreadExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SpreadExpression) String() string       { return "..." + se.Value.String() }
+
 type HashLiteral struct {
 	Token token.Token // the '{' token
 	Pairs map[Expression]Expression
+	// Keys are the keys of Pairs in source order
+	Keys []Expression
 }
 
 func (hl *HashLiteral) expressionNode()      {}
@@ -327,8 +527,8 @@ func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 
 	pairs := []string{}
-	for key, value := range hl.Pairs {
-		pairs = append(pairs, key.String()+":"+value.String())
+	for _, key := range hl.Keys {
+		pairs = append(pairs, key.String()+":"+hl.Pairs[key].String())
 	}
 
 	out.WriteString("{")
@@ -1,7 +1,9 @@
 package ast
 
 import (
+	"fmt"
 	"monkey-compiler/token"
+	"strings"
 	"testing"
 )
 
@@ -26,3 +28,66 @@ func TestString(t *testing.T) {
 		t.Fatalf("program.String() wrong. got=%q", program.String())
 	}
 }
+
+func TestWalk(t *testing.T) {
+	// let x = 1 + 2;
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Token: token.Token{Type: token.LET, Literal: "let"},
+				Name:  &Identifier{Token: token.Token{Type: token.IDENT, Literal: "x"}, Value: "x"},
+				Value: &InfixExpression{
+					Token:    token.Token{Type: token.PLUS, Literal: "+"},
+					Left:     &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1"}, Value: 1},
+					Operator: "+",
+					Right:    &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "2"}, Value: 2},
+				},
+			},
+		},
+	}
+
+	var visited []string
+	Walk(program, func(node Node) bool {
+		visited = append(visited, fmt.Sprintf("%T", node))
+		return true
+	})
+
+	expected := []string{"*ast.Program", "*ast.LetStatement", "*ast.Identifier",
+		"*ast.InfixExpression", "*ast.IntegerLiteral", "*ast.IntegerLiteral"}
+	if strings.Join(visited, " ") != strings.Join(expected, " ") {
+		t.Errorf("visited wrong nodes.\nwant=%v\ngot= %v", expected, visited)
+	}
+
+	visited = nil
+	Walk(program, func(node Node) bool {
+		visited = append(visited, fmt.Sprintf("%T", node))
+		_, isInfix := node.(*InfixExpression)
+		return !isInfix
+	})
+
+	expected = expected[:4]
+	if strings.Join(visited, " ") != strings.Join(expected, " ") {
+		t.Errorf("visited wrong nodes when not descending into the infix expression.\nwant=%v\ngot= %v", expected, visited)
+	}
+}
+
+func TestWalkSkipsMissingChildren(t *testing.T) {
+	ifExpression := &IfExpression{
+		Condition:   &Boolean{Value: true},
+		Consequence: &BlockStatement{},
+	}
+	try := &TryExpression{Body: &BlockStatement{}, Finally: &BlockStatement{}}
+
+	count := 0
+	for _, node := range []Node{ifExpression, try, &ExpressionStatement{}} {
+		Walk(node, func(node Node) bool {
+			count++
+			return true
+		})
+	}
+
+	// the if, its condition and consequence, the try, its body and finally, the statement
+	if count != 7 {
+		t.Errorf("wrong number of nodes visited. want=7, got=%d", count)
+	}
+}
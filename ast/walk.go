@@ -0,0 +1,98 @@
+package ast
+
+// Walk traverses the tree rooted at node in pre-order: it calls visit with node and, if visit
+// returns true, walks the children of node in source order. Returning false skips the children
+// of a node but not its siblings. Missing children, like the else of an if without one, are
+// not visited.
+//
+// Walk is for tools analysing programs without compiling them, like linters.
+func Walk(node Node, visit func(Node) bool) {
+	if !visit(node) {
+		return
+	}
+
+	switch node := node.(type) {
+	case *Program:
+		for _, stmt := range node.Statements {
+			Walk(stmt, visit)
+		}
+	case *LetStatement:
+		if node.Names != nil {
+			for _, name := range node.Names {
+				Walk(name, visit)
+			}
+		} else {
+			Walk(node.Name, visit)
+		}
+		walkExpression(node.Value, visit)
+	case *ReturnStatement:
+		walkExpression(node.ReturnValue, visit)
+	case *ExpressionStatement:
+		walkExpression(node.Expression, visit)
+	case *IndexAssignStatement:
+		Walk(node.Target, visit)
+		walkExpression(node.Value, visit)
+	case *BlockStatement:
+		for _, stmt := range node.Statements {
+			Walk(stmt, visit)
+		}
+	case *DoWhileStatement:
+		Walk(node.Body, visit)
+		walkExpression(node.Condition, visit)
+	case *PrefixExpression:
+		walkExpression(node.Right, visit)
+	case *InfixExpression:
+		walkExpression(node.Left, visit)
+		walkExpression(node.Right, visit)
+	case *IfExpression:
+		walkExpression(node.Condition, visit)
+		Walk(node.Consequence, visit)
+		if node.Alternative != nil {
+			Walk(node.Alternative, visit)
+		}
+	case *TryExpression:
+		Walk(node.Body, visit)
+		if node.Handler != nil {
+			Walk(node.Name, visit)
+			Walk(node.Handler, visit)
+		}
+		if node.Finally != nil {
+			Walk(node.Finally, visit)
+		}
+	case *ThrowExpression:
+		walkExpression(node.Value, visit)
+	case *BlockExpression:
+		Walk(node.Block, visit)
+	case *FunctionLiteral:
+		for _, param := range node.Parameters {
+			Walk(param, visit)
+		}
+		Walk(node.Body, visit)
+	case *CallExpression:
+		walkExpression(node.Function, visit)
+		for _, arg := range node.Arguments {
+			walkExpression(arg, visit)
+		}
+	case *ArrayLiteral:
+		for _, el := range node.Elements {
+			walkExpression(el, visit)
+		}
+	case *IndexExpression:
+		walkExpression(node.Left, visit)
+		walkExpression(node.Index, visit)
+	case *SpreadExpression:
+		walkExpression(node.Value, visit)
+	case *HashLiteral:
+		for _, key := range node.Keys {
+			walkExpression(key, visit)
+			walkExpression(node.Pairs[key], visit)
+		}
+	}
+}
+
+// walkExpression walks expr unless it is missing, which it is in trees with parse errors
+func walkExpression(expr Expression, visit func(Node) bool) {
+	if expr != nil {
+		Walk(expr, visit)
+	}
+}
@@ -25,29 +25,85 @@ const (
 	OpEqual
 	OpNotEqual
 	OpGreaterThan
+	OpGreaterThanOrEqual
 	OpJumpNotTruthy
 	OpJump
 	OpGetGlobal
 	OpSetGlobal
+	OpCall
+	OpReturnValue
+	OpReturn
+	OpGetLocal
+	OpSetLocal
+	OpGetBuiltin
+	OpClosure
+	OpGetFree
+	OpCurrentClosure
+	OpArray
+	OpHash
+	OpIndex
+	OpSpreadCall
+	OpUnpack
+	OpSetIndex
+	OpJumpNotNull
+	OpDup
+	OpLessThan
+	OpLessThanOrEqual
+	OpZero
+	OpOne
+	OpMinusOne
+	OpSetupCatch
+	OpPopCatch
+	OpThrow
+	OpSetupFinally
+	OpRethrow
 )
 
 // Instructions is byte array representing code
 type Instructions []byte
 
+// String renders ins with OffsetFormatter
 func (ins Instructions) String() string {
+	return ins.Format(OffsetFormatter)
+}
+
+// Formatter renders single instructions for Instructions.Format
+type Formatter interface {
+	// FormatInstruction renders the index-th instruction, at offset in the instructions,
+	// defined by def with operands
+	FormatInstruction(index, offset int, def *Definition, operands []int) string
+}
+
+// FormatterFunc is a function used as a Formatter
+type FormatterFunc func(index, offset int, def *Definition, operands []int) string
+
+// FormatInstruction calls f
+func (f FormatterFunc) FormatInstruction(index, offset int, def *Definition, operands []int) string {
+	return f(index, offset, def, operands)
+}
+
+// OffsetFormatter renders an instruction per line, prefixed by its offset: 0003 OpConstant 2
+var OffsetFormatter Formatter = FormatterFunc(func(index, offset int, def *Definition, operands []int) string {
+	return fmt.Sprintf("%04d %s\n", offset, FormatOperation(def, operands))
+})
+
+// Format renders each instruction of ins with f and concatenates the results.
+// A byte which isn't an opcode is rendered as an error line and skipped.
+func (ins Instructions) Format(f Formatter) string {
 	var out bytes.Buffer
 	offset := 0
 
-	for offset < len(ins) {
+	for index := 0; offset < len(ins); index++ {
 		def, err := Lookup(ins[offset])
 		if err != nil {
 			_, _ = fmt.Fprintf(&out, "ERROR: %s\n", err)
+			offset++
 			continue
 		}
 
 		operands, read := ReadOperands(def, ins[offset+1:])
 
-		_, _ = fmt.Fprintf(&out, "%04d %s\n", offset, fmtInstruction(def, operands))
+		out.WriteString(f.FormatInstruction(index, offset, def, operands))
 
 		offset += 1 + read
 	}
@@ -55,7 +111,8 @@ func (ins Instructions) String() string {
 	return out.String()
 }
 
-func fmtInstruction(def *Definition, operands []int) string {
+// FormatOperation renders the name of the instruction defined by def followed by its operands
+func FormatOperation(def *Definition, operands []int) string {
 	operandCount := len(def.OperandWidths)
 	if len(operands) != operandCount {
 		return fmt.Sprintf("ERROR: number of operands wrong: want=%d, got=%d", operandCount, len(operands))
@@ -66,6 +123,8 @@ func fmtInstruction(def *Definition, operands []int) string {
 		return def.Name
 	case 1:
 		return fmt.Sprintf("%s %d", def.Name, operands[0])
+	case 2:
+		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
 	}
 
 	return fmt.Sprintf("ERROR: unexpected number of operands for %s: %d", def.Name, operandCount)
@@ -78,27 +137,68 @@ type Definition struct {
 }
 
 var definitions = map[Opcode]*Definition{
-	OpConstant:      {"OpConstant", []int{2}},
-	OpPop:           {"OpPop", []int{}},
-	OpAdd:           {"OpAdd", []int{}},
-	OpSub:           {"OpSub", []int{}},
-	OpMul:           {"OpMul", []int{}},
-	OpDiv:           {"OpDiv", []int{}},
-	OpMinus:         {"OpMinus", []int{}},
-	OpBang:          {"OpBang", []int{}},
-	OpTrue:          {"OpTrue", []int{}},
-	OpFalse:         {"OpFalse", []int{}},
-	OpNull:          {"OpNull", []int{}},
-	OpEqual:         {"OpEqual", []int{}},
-	OpNotEqual:      {"OpNotEqual", []int{}},
-	OpGreaterThan:   {"OpGreaterThan", []int{}},
-	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-	OpJump:          {"OpJump", []int{2}},
-	OpGetGlobal:     {"OpGetGlobal", []int{2}},
-	OpSetGlobal:     {"OpSetGlobal", []int{2}},
+	OpConstant:           {"OpConstant", []int{2}},
+	OpPop:                {"OpPop", []int{}},
+	OpAdd:                {"OpAdd", []int{}},
+	OpSub:                {"OpSub", []int{}},
+	OpMul:                {"OpMul", []int{}},
+	OpDiv:                {"OpDiv", []int{}},
+	OpMinus:              {"OpMinus", []int{}},
+	OpBang:               {"OpBang", []int{}},
+	OpTrue:               {"OpTrue", []int{}},
+	OpFalse:              {"OpFalse", []int{}},
+	OpNull:               {"OpNull", []int{}},
+	OpEqual:              {"OpEqual", []int{}},
+	OpNotEqual:           {"OpNotEqual", []int{}},
+	OpGreaterThan:        {"OpGreaterThan", []int{}},
+	OpGreaterThanOrEqual: {"OpGreaterThanOrEqual", []int{}},
+	OpJumpNotTruthy:      {"OpJumpNotTruthy", []int{2}},
+	OpJump:               {"OpJump", []int{2}},
+	OpGetGlobal:          {"OpGetGlobal", []int{2}},
+	OpSetGlobal:          {"OpSetGlobal", []int{2}},
+	OpCall:               {"OpCall", []int{1}},
+	OpReturnValue:        {"OpReturnValue", []int{}},
+	OpReturn:             {"OpReturn", []int{}},
+	OpGetLocal:           {"OpGetLocal", []int{1}},
+	OpSetLocal:           {"OpSetLocal", []int{1}},
+	OpGetBuiltin:         {"OpGetBuiltin", []int{1}},
+	OpClosure:            {"OpClosure", []int{2, 1}},
+	OpGetFree:            {"OpGetFree", []int{1}},
+	OpCurrentClosure:     {"OpCurrentClosure", []int{}},
+	OpArray:              {"OpArray", []int{2}},
+	OpHash:               {"OpHash", []int{2}},
+	OpIndex:              {"OpIndex", []int{}},
+	// OpSpreadCall is OpCall with its last argument an array whose elements are the actual arguments
+	OpSpreadCall: {"OpSpreadCall", []int{1}},
+	// OpUnpack replaces an array of exactly the operand's number of elements with its elements
+	OpUnpack: {"OpUnpack", []int{1}},
+	// OpSetIndex pops a value, an index and a collection and stores the value at the index
+	OpSetIndex: {"OpSetIndex", []int{}},
+	// OpJumpNotNull jumps if the top of the stack isn't null and leaves it there, and pops it otherwise
+	OpJumpNotNull: {"OpJumpNotNull", []int{2}},
+	// OpDup pushes the value on top of the stack again
+	OpDup: {"OpDup", []int{}},
+	// OpLessThan and OpLessThanOrEqual compare the two values on top of the stack in source order
+	OpLessThan:        {"OpLessThan", []int{}},
+	OpLessThanOrEqual: {"OpLessThanOrEqual", []int{}},
+	// OpZero, OpOne and OpMinusOne push the integers 0, 1 and -1 without a constant
+	OpZero:     {"OpZero", []int{}},
+	OpOne:      {"OpOne", []int{}},
+	OpMinusOne: {"OpMinusOne", []int{}},
+	// OpSetupCatch makes a recoverable error jump to the operand, with the stack as it is now and the
+	// error pushed on it, until the matching OpPopCatch or the return of the function
+	OpSetupCatch: {"OpSetupCatch", []int{2}},
+	OpPopCatch:   {"OpPopCatch", []int{}},
+	// OpThrow pops a value and fails with it, see OpSetupCatch
+	OpThrow: {"OpThrow", []int{}},
+	// OpSetupFinally is OpSetupCatch for a finally block: the VM jumps there with the error itself on
+	// the stack, for OpRethrow to pop and fail with again
+	OpSetupFinally: {"OpSetupFinally", []int{2}},
+	OpRethrow:      {"OpRethrow", []int{}},
 }
 
-// Lookup returns definition of passed opcode
+// Lookup returns definition of passed opcode. It takes a byte so that instructions
+// can be decoded with Lookup(ins[offset]).
 func Lookup(opcode byte) (*Definition, error) {
 	def, ok := definitions[Opcode(opcode)]
 	if !ok {
@@ -107,6 +207,16 @@ func Lookup(opcode byte) (*Definition, error) {
 	return def, nil
 }
 
+// OperandWidths returns the width in bytes of each operand of opcode, in order.
+// An instruction is 1 byte of opcode followed by its operands, big-endian.
+func OperandWidths(opcode Opcode) ([]int, error) {
+	def, err := Lookup(byte(opcode))
+	if err != nil {
+		return nil, err
+	}
+	return append([]int{}, def.OperandWidths...), nil
+}
+
 // Make makes instruction byte array from opcode and operands
 func Make(opcode Opcode, operands ...int) []byte {
 	def, ok := definitions[opcode]
@@ -128,6 +238,8 @@ func Make(opcode Opcode, operands ...int) []byte {
 		switch width {
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(operand))
+		case 1:
+			instruction[offset] = byte(operand)
 		}
 		offset += width
 	}
@@ -135,6 +247,8 @@ func Make(opcode Opcode, operands ...int) []byte {
 	return instruction
 }
 
+// ReadOperands decodes the operands of the instruction defined by def from ins, which starts
+// after its opcode, and returns them with the number of bytes they take
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	operands := make([]int, len(def.OperandWidths))
 	offset := 0
@@ -143,6 +257,8 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 		switch width {
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
 		}
 
 		offset += width
@@ -154,3 +270,7 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
+
+func ReadUint8(ins Instructions) uint8 {
+	return uint8(ins[0])
+}
@@ -1,6 +1,7 @@
 package code
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -17,6 +18,12 @@ func TestMake(t *testing.T) {
 		{
 			"oppop", OpPop, []int{}, []byte{byte(OpPop)},
 		},
+		{
+			"opgetlocal", OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255},
+		},
+		{
+			"opclosure", OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -40,13 +47,17 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 1),
 		Make(OpConstant, 2),
 		Make(OpAdd),
+		Make(OpGetLocal, 1),
 		Make(OpConstant, 65535),
+		Make(OpClosure, 65535, 255),
 	}
 
 	expected := `0000 OpConstant 1
 0003 OpConstant 2
 0006 OpAdd
-0007 OpConstant 65535
+0007 OpGetLocal 1
+0009 OpConstant 65535
+0012 OpClosure 65535 255
 `
 
 	concatenated := concatInstructions(instructions)
@@ -56,6 +67,31 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsFormat(t *testing.T) {
+	instructions := concatInstructions([]Instructions{
+		Make(OpConstant, 1),
+		Make(OpAdd),
+		Make(OpClosure, 65535, 255),
+		{255},
+		Make(OpPop),
+	})
+
+	indexed := FormatterFunc(func(index, offset int, def *Definition, operands []int) string {
+		return fmt.Sprintf("%d: %s\n", index, FormatOperation(def, operands))
+	})
+
+	expected := `0: OpConstant 1
+1: OpAdd
+2: OpClosure 65535 255
+ERROR: opcode 255 is not defined
+4: OpPop
+`
+
+	if actual := instructions.Format(indexed); actual != expected {
+		t.Errorf("Instructions.Format() wrong.\nwant=%s\ngot=%s", expected, actual)
+	}
+}
+
 func concatInstructions(instructions []Instructions) Instructions {
 	out := Instructions{}
 	for _, ins := range instructions {
@@ -74,6 +110,12 @@ func TestReadOperands(t *testing.T) {
 		{
 			"opconstant", OpConstant, []int{65535}, 2,
 		},
+		{
+			"opgetlocal", OpGetLocal, []int{255}, 1,
+		},
+		{
+			"opclosure", OpClosure, []int{65535, 255}, 3,
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -100,3 +142,67 @@ func TestReadOperands(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeWithPublicDefinitions(t *testing.T) {
+	ins := concatInstructions([]Instructions{Make(OpConstant, 65534), Make(OpJump, 7), Make(OpPop)})
+
+	widths, err := OperandWidths(OpConstant)
+	if err != nil {
+		t.Fatalf("OperandWidths error: %s", err)
+	}
+	if len(widths) != 1 || widths[0] != 2 {
+		t.Fatalf("operand widths of OpConstant wrong. want=[2], got=%v", widths)
+	}
+	if widths, err := OperandWidths(OpJump); err != nil || len(widths) != 1 || widths[0] != 2 {
+		t.Fatalf("operand widths of OpJump wrong. want=[2], got=%v (%v)", widths, err)
+	}
+	if _, err := OperandWidths(Opcode(255)); err == nil {
+		t.Errorf("expected an error for an undefined opcode")
+	}
+
+	expected := []struct {
+		name     string
+		operands []int
+	}{
+		{"OpConstant", []int{65534}},
+		{"OpJump", []int{7}},
+		{"OpPop", []int{}},
+	}
+
+	offset := 0
+	for _, want := range expected {
+		def, err := Lookup(ins[offset])
+		if err != nil {
+			t.Fatalf("lookup error at %d: %s", offset, err)
+		}
+		operands, read := ReadOperands(def, ins[offset+1:])
+		if def.Name != want.name || fmt.Sprint(operands) != fmt.Sprint(want.operands) {
+			t.Errorf("instruction at %d wrong. want=%s %v, got=%s %v", offset, want.name, want.operands, def.Name, operands)
+		}
+		offset += 1 + read
+	}
+	if offset != len(ins) {
+		t.Errorf("decoded %d bytes of %d", offset, len(ins))
+	}
+}
+
+func TestReadOperandsInvertsMake(t *testing.T) {
+	for opcode, def := range definitions {
+		// the largest operand of each width, which would be truncated by a wrong width
+		operands := make([]int, len(def.OperandWidths))
+		width := 0
+		for i, w := range def.OperandWidths {
+			operands[i] = 1<<(8*uint(w)) - 1 - i
+			width += w
+		}
+
+		instruction := Make(opcode, operands...)
+		operandsRead, n := ReadOperands(def, instruction[1:])
+		if n != width || n != len(instruction)-1 {
+			t.Errorf("%s: number of bytes read wrong. want=%d, got=%d", def.Name, width, n)
+		}
+		if fmt.Sprint(operandsRead) != fmt.Sprint(operands) {
+			t.Errorf("%s: operands wrong. want=%v, got=%v", def.Name, operands, operandsRead)
+		}
+	}
+}
@@ -2,43 +2,133 @@ package compiler
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"monkey-compiler/ast"
 	"monkey-compiler/code"
+	"monkey-compiler/lexer"
 	"monkey-compiler/object"
+	"monkey-compiler/parser"
 )
 
-// ByteCode is byte code generated by compiler
+// ByteCode is byte code generated by compiler.
+// It may be shared by several VMs, so it must be treated as read-only once compiled.
+// Use Clone or the copying accessors to get a version that is safe to modify.
 type ByteCode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
 }
 
+// InstructionsCopy returns a copy of the top-level instructions
+func (b *ByteCode) InstructionsCopy() code.Instructions {
+	return append(code.Instructions{}, b.Instructions...)
+}
+
+// ConstantsCopy returns a copy of the constant pool.
+// Compiled functions are copied as well, other constants are immutable and shared.
+func (b *ByteCode) ConstantsCopy() []object.Object {
+	constants := make([]object.Object, len(b.Constants))
+	for i, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			constant = &object.CompiledFunction{
+				Instructions:  append(code.Instructions{}, fn.Instructions...),
+				NumLocals:     fn.NumLocals,
+				NumParameters: fn.NumParameters,
+				Name:          fn.Name,
+				StartLine:     fn.StartLine,
+				EndLine:       fn.EndLine,
+			}
+		}
+		constants[i] = constant
+	}
+	return constants
+}
+
+// Clone returns a copy of the byte code which can be modified without affecting the original
+func (b *ByteCode) Clone() *ByteCode {
+	return &ByteCode{
+		Instructions: b.InstructionsCopy(),
+		Constants:    b.ConstantsCopy(),
+	}
+}
+
 // Emitted Instruction is an instruction emitted by compiler
 type EmittedInstruction struct {
 	Opcode   code.Opcode
 	Position int
 }
 
+// CompilationScope holds instructions of a function body being compiled
+type CompilationScope struct {
+	instructions        code.Instructions
+	lastInstruction     EmittedInstruction
+	previousInstruction EmittedInstruction
+
+	returnType string // the type the result of the function is annotated with, if any
+
+	// tries are the try expressions being compiled in the function, the innermost last
+	tries []tryContext
+	// loops are the loops being compiled in the function, the innermost last
+	loops []loopContext
+}
+
+// loopContext collects the jumps of the breaks and continues of a loop, for the loop to patch
+// once it knows where they go
+type loopContext struct {
+	label     string // empty for a loop without one
+	tries     int    // the tries of the function the loop is in, which a break or continue stays in
+	breaks    []int
+	continues []int
+}
+
+// tryContext is what a return inside a try expression has to do to leave it
+type tryContext struct {
+	finally  *ast.BlockStatement // nil without a finally block
+	handlers int                 // the handlers of the try the VM has at the return, 0 to 2
+}
+
 // Compiler is compiler of monkey
 type Compiler struct {
-	instructions code.Instructions
-	constants    []object.Object
-	symbolTable  *SymbolTable
+	constants   []object.Object
+	symbolTable *SymbolTable
 
-	lastInstruction     EmittedInstruction
-	previousInstruction EmittedInstruction
+	scopes     []CompilationScope
+	scopeIndex int
+
+	warnings []string
+
+	// chainDepth is the nesting depth of the comparison chains being compiled
+	chainDepth int
+
+	optimization OptimizationLevel
+
+	// keepResult leaves the value of a program's final expression statement on the stack
+	keepResult bool
+
+	// disabledBuiltins are the names of the builtins a program may not use
+	disabledBuiltins map[string]bool
 }
 
 // New returns empty compiler
 func New() *Compiler {
-	return &Compiler{
-		instructions: code.Instructions{},
-		constants:    []object.Object{},
-		symbolTable:  NewSymbolTable(),
-
+	mainScope := CompilationScope{
+		instructions:        code.Instructions{},
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
 	}
+
+	symbolTable := NewSymbolTable()
+	for i, b := range object.BuiltinDefinitions() {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+
+	return &Compiler{
+		constants:   []object.Object{},
+		symbolTable: symbolTable,
+
+		scopes:     []CompilationScope{mainScope},
+		scopeIndex: 0,
+	}
 }
 
 // NewWithState returns compiler made from existing symbol table and constants
@@ -50,15 +140,41 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	return c
 }
 
+// SetKeepResult sets whether the following calls of Compile leave the value of a program's
+// final expression statement on the stack instead of popping it, so that it is the VM's
+// StackTop once run. This suits evaluating expressions; by default the value is popped,
+// as the REPL and programs expect, and can be recovered with the VM's LastPopped.
+// A program ending with any other statement leaves nothing on the stack either way.
+func (c *Compiler) SetKeepResult(keep bool) {
+	c.keepResult = keep
+}
+
+// DisableBuiltins makes using any of the builtins named by names a compile error, for
+// programs which shouldn't be able to call them. A name the program defines itself is not affected.
+func (c *Compiler) DisableBuiltins(names ...string) {
+	if c.disabledBuiltins == nil {
+		c.disabledBuiltins = make(map[string]bool)
+	}
+	for _, name := range names {
+		c.disabledBuiltins[name] = true
+	}
+}
+
 // Compile ...
 func (c *Compiler) Compile(node ast.Node) error {
 	switch node := node.(type) {
 	case *ast.Program:
+		c.typeCheck(node)
 		for _, stmt := range node.Statements {
 			if err := c.Compile(stmt); err != nil {
 				return err
 			}
 		}
+		if c.keepResult && len(node.Statements) > 0 {
+			if _, ok := node.Statements[len(node.Statements)-1].(*ast.ExpressionStatement); ok {
+				c.removeLastPop()
+			}
+		}
 	case *ast.BlockStatement:
 		for _, stmt := range node.Statements {
 			if err := c.Compile(stmt); err != nil {
@@ -71,11 +187,59 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpPop)
 	case *ast.LetStatement:
+		// the names are defined only once the value is compiled, so that the value can't refer
+		// to them: let a = a; is an undefined variable, or the a of an enclosing scope.
+		// A function literal can still call itself, its name is defined in its own scope
 		if err := c.Compile(node.Value); err != nil {
 			return err
 		}
-		symbol := c.symbolTable.Define(node.Name.Value)
-		c.emit(code.OpSetGlobal, symbol.Index)
+		if node.Names != nil {
+			return c.compileDestructuring(node.Names)
+		}
+		if err := c.checkAssignment(node.Name, node.Value); err != nil {
+			return err
+		}
+		c.warnShadowedBuiltin(node.Name.Value)
+		symbol, err := c.symbolTable.defineTyped(node.Name.Value, node.Name.Type)
+		if err != nil {
+			return err
+		}
+		c.storeSymbol(symbol)
+	case *ast.IndexAssignStatement:
+		if err := c.Compile(node.Target.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Target.Index); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		c.emit(code.OpSetIndex)
+	case *ast.ReturnStatement:
+		if err := c.checkReturn(node.ReturnValue); err != nil {
+			return err
+		}
+		if err := c.Compile(node.ReturnValue); err != nil {
+			return err
+		}
+		if err := c.leaveTries(0); err != nil {
+			return err
+		}
+		c.emit(code.OpReturnValue)
+	case *ast.DoWhileStatement:
+		return c.compileDoWhile(node)
+	case *ast.BreakStatement:
+		return c.compileLoopJump(node.TokenLiteral(), node.Label)
+	case *ast.ContinueStatement:
+		return c.compileLoopJump(node.TokenLiteral(), node.Label)
+	case *ast.BlockExpression:
+		c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+		if err := c.Compile(node.Block); err != nil {
+			return err
+		}
+		c.keepBlockValue()
+		c.symbolTable = c.symbolTable.Outer
 	case *ast.IfExpression:
 		if err := c.Compile(node.Condition); err != nil {
 			return err
@@ -85,14 +249,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err := c.Compile(node.Consequence); err != nil {
 			return err
 		}
-		if c.lastInstructionIsPop() {
-			c.removeLastPop()
-		}
+		c.keepBlockValue()
 
 		jumpPos := c.emit(code.OpJump, 9999)
 
-		afterConsequencePos := len(c.instructions)
-		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		if err := c.patchJump(jumpNotTruthyPos); err != nil {
+			return err
+		}
 
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
@@ -100,14 +263,27 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err := c.Compile(node.Alternative); err != nil {
 				return err
 			}
-			if c.lastInstructionIsPop() {
-				c.removeLastPop()
-			}
+			c.keepBlockValue()
 		}
 
-		afterAlternativePos := len(c.instructions)
-		c.changeOperand(jumpPos, afterAlternativePos)
+		if err := c.patchJump(jumpPos); err != nil {
+			return err
+		}
+	case *ast.TryExpression:
+		return c.compileTry(node)
+	case *ast.ThrowExpression:
+		if err := c.Compile(node.Value); err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
 	case *ast.PrefixExpression:
+		if c.compileFolded(node) {
+			return nil
+		}
+		if lit, ok := node.Right.(*ast.IntegerLiteral); ok && node.Operator == "-" && lit.Value == 1 && lit.Big == nil {
+			c.emit(code.OpMinusOne)
+			return nil
+		}
 		if err := c.Compile(node.Right); err != nil {
 			return err
 		}
@@ -120,21 +296,27 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return fmt.Errorf("unknown prefix operator: %s", node.Operator)
 		}
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			if err := c.Compile(node.Right); err != nil {
-				return err
-			}
-			if err := c.Compile(node.Left); err != nil {
-				return err
-			}
-		} else {
-			if err := c.Compile(node.Left); err != nil {
-				return err
-			}
-			if err := c.Compile(node.Right); err != nil {
-				return err
+		if node.Operator == "|>" {
+			return c.Compile(pipelineCall(node))
+		}
+		if node.Operator == "??" {
+			return c.compileNullish(node)
+		}
+		if isOrdering(node.Operator) {
+			if left, ok := node.Left.(*ast.InfixExpression); ok && isOrdering(left.Operator) {
+				return c.compileComparisonChain(node)
 			}
 		}
+		if c.compileFolded(node) {
+			return nil
+		}
+
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		if err := c.Compile(node.Right); err != nil {
+			return err
+		}
 		switch node.Operator {
 		case "+":
 			c.emit(code.OpAdd)
@@ -144,10 +326,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
-		case ">":
-			c.emit(code.OpGreaterThan)
-		case "<":
-			c.emit(code.OpGreaterThan)
+		case ">", "<", ">=", "<=":
+			c.emit(orderingOpcodes[node.Operator])
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
@@ -160,16 +340,157 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if !ok {
 			return fmt.Errorf("undefined variable: %s", node.Value)
 		}
-		c.emit(code.OpGetGlobal, symbol.Index)
+		if symbol.Scope == BuiltinScope && c.disabledBuiltins[symbol.Name] {
+			return fmt.Errorf("builtin disabled: %s", symbol.Name)
+		}
+		c.loadSymbol(symbol)
 	case *ast.IntegerLiteral:
-		integer := &object.Integer{Value: node.Value}
+		if opcode, ok := smallIntegerOpcodes[node.Value]; ok && node.Big == nil {
+			c.emit(opcode)
+			return nil
+		}
+		var integer object.Object = &object.Integer{Value: node.Value}
+		if node.Big != nil {
+			integer = &object.BigInt{Value: node.Big}
+		}
 		c.emit(code.OpConstant, c.addConstant(integer))
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
+	case *ast.StringLiteral:
+		str := &object.String{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(str))
+	case *ast.Null:
+		c.emit(code.OpNull)
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
 		} else {
 			c.emit(code.OpFalse)
 		}
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			if err := c.Compile(el); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpArray, len(node.Elements))
+	case *ast.HashLiteral:
+		// keys are expressions like any other, evaluated at run time in source order
+		for _, k := range node.Keys {
+			if err := c.Compile(k); err != nil {
+				return err
+			}
+			if err := c.Compile(node.Pairs[k]); err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpHash, len(node.Keys)*2)
+	case *ast.IndexExpression:
+		if err := c.Compile(node.Left); err != nil {
+			return err
+		}
+		var endGuard func() error
+		if node.Optional {
+			endGuard = c.guardNull()
+		}
+		if err := c.Compile(node.Index); err != nil {
+			return err
+		}
+		c.emit(code.OpIndex)
+		if endGuard != nil {
+			return endGuard()
+		}
+	case *ast.FunctionLiteral:
+		if err := checkTypeName(node.ReturnType, "function result"); err != nil {
+			return err
+		}
+		c.enterScope()
+		c.scopes[c.scopeIndex].returnType = node.ReturnType
+
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+		for _, p := range node.Parameters {
+			if err := checkTypeName(p.Type, p.Value); err != nil {
+				return err
+			}
+			c.warnShadowedBuiltin(p.Value)
+			if _, err := c.symbolTable.defineTyped(p.Value, p.Type); err != nil {
+				return err
+			}
+		}
+
+		if err := c.Compile(node.Body); err != nil {
+			return err
+		}
+		if n := len(node.Body.Statements); n > 0 {
+			if last, ok := node.Body.Statements[n-1].(*ast.ExpressionStatement); ok {
+				if err := c.checkReturn(last.Expression); err != nil {
+					return err
+				}
+			}
+		}
+
+		// the value of the last expression statement is the implicit return value
+		if c.lastInstructionIs(code.OpPop) {
+			c.replaceLastPopWithReturn()
+		}
+		if !c.lastInstructionIs(code.OpReturnValue) {
+			c.emit(code.OpReturn)
+		}
+
+		freeSymbols := c.symbolTable.FreeSymbols
+		if len(freeSymbols) > MaxLocals {
+			return fmt.Errorf("too many free variables")
+		}
+		numLocals := c.symbolTable.numDefinitions
+		instructions := c.leaveScope()
+
+		for _, s := range freeSymbols {
+			c.loadSymbol(s)
+		}
+
+		compiledFn := &object.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     numLocals,
+			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			StartLine:     node.Token.Line,
+			EndLine:       node.EndLine,
+		}
+		c.emit(code.OpClosure, c.addConstant(compiledFn), len(freeSymbols))
+	case *ast.CallExpression:
+		if err := c.Compile(node.Function); err != nil {
+			return err
+		}
+		var endGuard func() error
+		if node.Optional {
+			endGuard = c.guardNull()
+		}
+		spread := false
+		for i, arg := range node.Arguments {
+			if s, ok := arg.(*ast.SpreadExpression); ok {
+				if i != len(node.Arguments)-1 {
+					return fmt.Errorf("spread is only allowed as the last argument of a call")
+				}
+				spread = true
+				arg = s.Value
+			}
+			if err := c.Compile(arg); err != nil {
+				return err
+			}
+		}
+		if spread {
+			c.emit(code.OpSpreadCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
+		if endGuard != nil {
+			return endGuard()
+		}
+	case *ast.SpreadExpression:
+		return fmt.Errorf("spread is only allowed as the last argument of a call")
 	}
 
 	return nil
@@ -178,11 +499,123 @@ func (c *Compiler) Compile(node ast.Node) error {
 // ByteCode ...
 func (c *Compiler) ByteCode() *ByteCode {
 	return &ByteCode{
-		Instructions: c.instructions,
+		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
 	}
 }
 
+// CompileReader reads the whole program from r, then parses and compiles it with a new compiler.
+// If the program doesn't parse, the error is the parser.ErrorList of all parser errors.
+func CompileReader(r io.Reader) (*ByteCode, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+
+	c := New()
+	if err := c.Compile(program); err != nil {
+		return nil, err
+	}
+
+	return c.ByteCode(), nil
+}
+
+// Warnings returns diagnostics about code which compiles but is likely a mistake.
+// Unlike errors, warnings never stop compilation.
+func (c *Compiler) Warnings() []string {
+	return c.warnings
+}
+
+func (c *Compiler) warnShadowedBuiltin(name string) {
+	if object.GetBuiltinByName(name) != nil {
+		c.warnings = append(c.warnings, fmt.Sprintf("%s shadows the builtin function of the same name", name))
+	}
+}
+
+func (c *Compiler) currentInstructions() code.Instructions {
+	return c.scopes[c.scopeIndex].instructions
+}
+
+func (c *Compiler) enterScope() {
+	scope := CompilationScope{
+		instructions:        code.Instructions{},
+		lastInstruction:     EmittedInstruction{},
+		previousInstruction: EmittedInstruction{},
+	}
+	c.scopes = append(c.scopes, scope)
+	c.scopeIndex++
+
+	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
+}
+
+// returns instructions of the left scope
+func (c *Compiler) leaveScope() code.Instructions {
+	instructions := c.currentInstructions()
+
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.scopeIndex--
+
+	c.symbolTable = c.symbolTable.Outer
+
+	return instructions
+}
+
+// compileDestructuring binds names to the elements of the array on top of the stack.
+// OpUnpack leaves the last element on top, so the names are stored in reverse.
+func (c *Compiler) compileDestructuring(names []*ast.Identifier) error {
+	if len(names) > math.MaxUint8 {
+		return fmt.Errorf("too many names to destructure: %d", len(names))
+	}
+	c.emit(code.OpUnpack, len(names))
+
+	symbols := make([]Symbol, len(names))
+	for i, name := range names {
+		if err := checkTypeName(name.Type, name.Value); err != nil {
+			return err
+		}
+		c.warnShadowedBuiltin(name.Value)
+		symbol, err := c.symbolTable.defineTyped(name.Value, name.Type)
+		if err != nil {
+			return err
+		}
+		symbols[i] = symbol
+	}
+	for i := len(symbols) - 1; i >= 0; i-- {
+		c.storeSymbol(symbols[i])
+	}
+
+	return nil
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	if s.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, s.Index)
+	} else {
+		c.emit(code.OpSetLocal, s.Index)
+	}
+}
+
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case BuiltinScope:
+		c.emit(code.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(code.OpGetFree, s.Index)
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
+
 // returns position of start of added instruction
 func (c *Compiler) emit(opcode code.Opcode, operands ...int) int {
 	ins := code.Make(opcode, operands...)
@@ -192,8 +625,8 @@ func (c *Compiler) emit(opcode code.Opcode, operands ...int) int {
 }
 
 func (c *Compiler) addInstruction(ins []byte) int {
-	pos := len(c.instructions)
-	c.instructions = append(c.instructions, ins...)
+	pos := len(c.currentInstructions())
+	c.scopes[c.scopeIndex].instructions = append(c.currentInstructions(), ins...)
 	return pos
 }
 
@@ -204,30 +637,395 @@ func (c *Compiler) addConstant(obj object.Object) int {
 }
 
 func (c *Compiler) setLastInstruction(opcode code.Opcode, pos int) {
-	previous := c.lastInstruction
+	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: opcode, Position: pos}
 
-	c.previousInstruction = previous
-	c.lastInstruction = last
+	c.scopes[c.scopeIndex].previousInstruction = previous
+	c.scopes[c.scopeIndex].lastInstruction = last
+}
+
+func (c *Compiler) lastInstructionIs(opcode code.Opcode) bool {
+	if len(c.currentInstructions()) == 0 {
+		return false
+	}
+	return c.scopes[c.scopeIndex].lastInstruction.Opcode == opcode
+}
+
+// compileTry compiles try { body } catch (e) { handler } as
+//
+//	OpSetupCatch handler, body, OpPopCatch, OpJump end, handler: store e, handler, end:
+//
+// The body and the handler are blocks whose names are only visible inside them, e is the
+// handler's. Should the body fail, the VM jumps to the handler with the error on the stack.
+//
+// A finally block is compiled twice, once for when the body or the handler completes, and once
+// for when either fails. The latter runs under an OpSetupFinally handler set up around both,
+// which the VM enters with the error on the stack for OpRethrow to fail with again. It is also
+// where the errors no catch gets, exit and failed assertions, go:
+//
+//	OpSetupFinally failed, OpSetupCatch handler, body, OpPopCatch, OpJump caught,
+//	handler: store e, handler, caught: OpPopCatch, OpJump done,
+//	failed: finally, OpRethrow, done: finally
+//
+// Without a finally, OpSetupCatch is the only handler, and without a catch, OpSetupFinally. A
+// return compiles the finally blocks it leaves once more, see leaveTries.
+func (c *Compiler) compileTry(node *ast.TryExpression) error {
+	try := tryContext{finally: node.Finally}
+	var failedPos, handlerPos int
+	if node.Finally != nil {
+		failedPos = c.emit(code.OpSetupFinally, 9999)
+		try.handlers++
+	}
+	if node.Handler != nil {
+		handlerPos = c.emit(code.OpSetupCatch, 9999)
+		try.handlers++
+	}
+	c.scopes[c.scopeIndex].tries = append(c.scopes[c.scopeIndex].tries, try)
+
+	if err := c.compileBlock(node.Body); err != nil {
+		return err
+	}
+	c.keepBlockValue()
+
+	if node.Handler != nil {
+		c.emit(code.OpPopCatch)
+		caughtPos := c.emit(code.OpJump, 9999)
+		if err := c.patchJump(handlerPos); err != nil {
+			return err
+		}
+
+		tries := c.scopes[c.scopeIndex].tries
+		tries[len(tries)-1].handlers--
+
+		c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+		c.warnShadowedBuiltin(node.Name.Value)
+		symbol, err := c.symbolTable.Define(node.Name.Value)
+		if err != nil {
+			return err
+		}
+		c.storeSymbol(symbol)
+		if err := c.Compile(node.Handler); err != nil {
+			return err
+		}
+		c.keepBlockValue()
+		c.symbolTable = c.symbolTable.Outer
+
+		if err := c.patchJump(caughtPos); err != nil {
+			return err
+		}
+	}
+
+	tries := c.scopes[c.scopeIndex].tries
+	c.scopes[c.scopeIndex].tries = tries[:len(tries)-1]
+
+	if node.Finally == nil {
+		return nil
+	}
+	c.emit(code.OpPopCatch)
+	donePos := c.emit(code.OpJump, 9999)
+	if err := c.patchJump(failedPos); err != nil {
+		return err
+	}
+	if err := c.compileBlock(node.Finally); err != nil {
+		return err
+	}
+	c.emit(code.OpRethrow)
+	if err := c.patchJump(donePos); err != nil {
+		return err
+	}
+	return c.compileBlock(node.Finally)
+}
+
+// compileDoWhile compiles do { body } while (condition) as
+//
+//	start: body, continue: condition, OpJumpNotTruthy end, OpJump start, end:
+//
+// The body is a block whose names are only visible inside it, each time it runs. A break jumps
+// to end and a continue to the condition. A break or continue inside an operand, like the one in
+// 1 + if (c) { break } else { 2 }, leaves the operands before it on the stack.
+func (c *Compiler) compileDoWhile(node *ast.DoWhileStatement) error {
+	start := len(c.currentInstructions())
+	c.scopes[c.scopeIndex].loops = append(c.scopes[c.scopeIndex].loops,
+		loopContext{label: node.Label, tries: len(c.scopes[c.scopeIndex].tries)})
+
+	if err := c.compileBlock(node.Body); err != nil {
+		return err
+	}
+
+	loops := c.scopes[c.scopeIndex].loops
+	loop := loops[len(loops)-1]
+	c.scopes[c.scopeIndex].loops = loops[:len(loops)-1]
+
+	for _, pos := range loop.continues {
+		if err := c.patchJump(pos); err != nil {
+			return err
+		}
+	}
+	if err := c.Compile(node.Condition); err != nil {
+		return err
+	}
+	endPos := c.emit(code.OpJumpNotTruthy, 9999)
+	if start > math.MaxUint16 {
+		return fmt.Errorf("too much code to jump back over: target %d exceeds %d", start, math.MaxUint16)
+	}
+	c.emit(code.OpJump, start)
+
+	if err := c.patchJump(endPos); err != nil {
+		return err
+	}
+	for _, pos := range loop.breaks {
+		if err := c.patchJump(pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileLoopJump compiles a break or continue, as named by keyword, of the loop with label,
+// or of the innermost loop if label is empty. Of nested loops with the same label the
+// innermost is meant. The jump is patched by the loop once compiled.
+func (c *Compiler) compileLoopJump(keyword, label string) error {
+	loops := c.scopes[c.scopeIndex].loops
+	target := len(loops) - 1
+	for label != "" && target >= 0 && loops[target].label != label {
+		target--
+	}
+	if target < 0 {
+		if label != "" {
+			return fmt.Errorf("%s outside loop %s", keyword, label)
+		}
+		return fmt.Errorf("%s outside loop", keyword)
+	}
+
+	if err := c.leaveTries(loops[target].tries); err != nil {
+		return err
+	}
+	// the finally blocks left may have had loops of their own
+	loop := &c.scopes[c.scopeIndex].loops[target]
+	pos := c.emit(code.OpJump, 9999)
+	if keyword == "break" {
+		loop.breaks = append(loop.breaks, pos)
+	} else {
+		loop.continues = append(loop.continues, pos)
+	}
+	return nil
 }
 
-func (c *Compiler) lastInstructionIsPop() bool {
-	return c.lastInstruction.Opcode == code.OpPop
+// compileBlock compiles block with its own names, without keeping its value
+func (c *Compiler) compileBlock(block *ast.BlockStatement) error {
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+	defer func() { c.symbolTable = c.symbolTable.Outer }()
+	return c.Compile(block)
+}
+
+// leaveTries makes a return, or a break or continue, leave the try expressions of the function
+// it is in but the first depth. Innermost first, it drops their handlers and runs their finally
+// blocks, with the returned value on the stack.
+func (c *Compiler) leaveTries(depth int) error {
+	tries := c.scopes[c.scopeIndex].tries
+	defer func() { c.scopes[c.scopeIndex].tries = tries }()
+
+	for i := len(tries) - 1; i >= depth; i-- {
+		for j := 0; j < tries[i].handlers; j++ {
+			c.emit(code.OpPopCatch)
+		}
+		if tries[i].finally != nil {
+			// a return in the finally block only leaves the tries around this one
+			c.scopes[c.scopeIndex].tries = tries[:i]
+			if err := c.compileBlock(tries[i].finally); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keepBlockValue leaves the value of a just compiled block on the stack as the value of an if expression.
+// That is the value of its last expression statement, or Null if the block doesn't end with one.
+func (c *Compiler) keepBlockValue() {
+	switch {
+	case c.lastInstructionIs(code.OpPop):
+		c.removeLastPop()
+	case !c.lastInstructionIs(code.OpReturnValue):
+		c.emit(code.OpNull)
+	}
 }
 
 func (c *Compiler) removeLastPop() {
-	c.instructions = c.instructions[:c.lastInstruction.Position]
-	c.lastInstruction = c.previousInstruction
+	last := c.scopes[c.scopeIndex].lastInstruction
+	previous := c.scopes[c.scopeIndex].previousInstruction
+
+	c.scopes[c.scopeIndex].instructions = c.currentInstructions()[:last.Position]
+	c.scopes[c.scopeIndex].lastInstruction = previous
+}
+
+func (c *Compiler) replaceLastPopWithReturn() {
+	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+
+	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
+}
+
+// compileNullish compiles a ?? b, which only evaluates b when a is null
+func (c *Compiler) compileNullish(node *ast.InfixExpression) error {
+	if err := c.Compile(node.Left); err != nil {
+		return err
+	}
+	// emit jump op with bogus operand
+	jumpPos := c.emit(code.OpJumpNotNull, 9999)
+	if err := c.Compile(node.Right); err != nil {
+		return err
+	}
+
+	return c.patchJump(jumpPos)
+}
+
+// guardNull makes the null on top of the stack the value of an optional index or call,
+// skipping the instructions emitted until the returned function is called
+func (c *Compiler) guardNull() (end func() error) {
+	// emit jump ops with bogus operands
+	notNullPos := c.emit(code.OpJumpNotNull, 9999)
+	c.emit(code.OpNull)
+	jumpPos := c.emit(code.OpJump, 9999)
+	if err := c.patchJump(notNullPos); err != nil {
+		return func() error { return err }
+	}
+
+	return func() error {
+		return c.patchJump(jumpPos)
+	}
+}
+
+// patchJump makes the jump at opPos land at the end of the instructions emitted so far.
+// Jump operands are two bytes wide, so it fails if that end is beyond their range
+// rather than making the jump land somewhere else.
+func (c *Compiler) patchJump(opPos int) error {
+	target := len(c.currentInstructions())
+	if target > math.MaxUint16 {
+		return fmt.Errorf("too much code to jump over: target %d exceeds %d", target, math.MaxUint16)
+	}
+	c.changeOperand(opPos, target)
+	return nil
 }
 
 func (c *Compiler) changeOperand(opPos int, operand int) {
-	opcode := code.Opcode(c.instructions[opPos])
+	opcode := code.Opcode(c.currentInstructions()[opPos])
 	newInstruction := code.Make(opcode, operand)
 	c.replaceInstruction(opPos, newInstruction)
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
+	ins := c.currentInstructions()
 	for i := 0; i < len(newInstruction); i++ {
-		c.instructions[pos+i] = newInstruction[i]
+		ins[pos+i] = newInstruction[i]
+	}
+}
+
+// smallIntegerOpcodes are the opcodes pushing integers common enough to spare a constant
+var smallIntegerOpcodes = map[int64]code.Opcode{
+	0:  code.OpZero,
+	1:  code.OpOne,
+	-1: code.OpMinusOne,
+}
+
+// orderingOpcodes are the opcodes of the comparisons that order their operands
+var orderingOpcodes = map[string]code.Opcode{
+	">":  code.OpGreaterThan,
+	">=": code.OpGreaterThanOrEqual,
+	"<":  code.OpLessThan,
+	"<=": code.OpLessThanOrEqual,
+}
+
+func isOrdering(operator string) bool {
+	_, ok := orderingOpcodes[operator]
+	return ok
+}
+
+// compileComparisonChain compiles a chain of ordering comparisons like a < b <= c,
+// which the parser reads as (a < b) <= c. It is compiled as a < b && b <= c instead:
+// every operand is evaluated once, from left to right, and the chain stops at the
+// first comparison that is false. Since booleans can't be ordered, (a < b) <= c
+// written with parentheses means the same.
+//
+// Each operand but the first and last is needed by two comparisons, so it is
+// kept in a hidden variable until the next comparison loads it again.
+func (c *Compiler) compileComparisonChain(node *ast.InfixExpression) error {
+	var operands []ast.Expression
+	var operators []string
+	var expr ast.Expression = node
+	for {
+		infix, ok := expr.(*ast.InfixExpression)
+		if !ok || !isOrdering(infix.Operator) {
+			break
+		}
+		operands = append([]ast.Expression{infix.Right}, operands...)
+		operators = append([]string{infix.Operator}, operators...)
+		expr = infix.Left
+	}
+	operands = append([]ast.Expression{expr}, operands...)
+
+	c.chainDepth++
+	defer func() { c.chainDepth-- }()
+	temp, err := c.chainTemp()
+	if err != nil {
+		return err
+	}
+
+	if err := c.Compile(operands[0]); err != nil {
+		return err
+	}
+
+	var jumpNotTruthyPositions []int
+	for i, operator := range operators {
+		if i > 0 {
+			c.loadSymbol(temp)
+		}
+		if err := c.Compile(operands[i+1]); err != nil {
+			return err
+		}
+
+		last := i == len(operators)-1
+		if !last {
+			c.emit(code.OpDup)
+			c.storeSymbol(temp)
+		}
+		c.emit(orderingOpcodes[operator])
+
+		if !last {
+			jumpNotTruthyPositions = append(jumpNotTruthyPositions, c.emit(code.OpJumpNotTruthy, 9999))
+		}
 	}
+
+	// the last comparison is the value of the chain, unless an earlier one was false
+	jumpPos := c.emit(code.OpJump, 9999)
+	for _, pos := range jumpNotTruthyPositions {
+		if err := c.patchJump(pos); err != nil {
+			return err
+		}
+	}
+	c.emit(code.OpFalse)
+
+	return c.patchJump(jumpPos)
+}
+
+// chainTemp returns the hidden variable of the comparison chain being compiled.
+// Its name can't clash with an identifier, and it is defined once per scope and depth.
+func (c *Compiler) chainTemp() (Symbol, error) {
+	name := fmt.Sprintf("$chain%d", c.chainDepth)
+	if symbol, ok := c.symbolTable.store[name]; ok {
+		return symbol, nil
+	}
+	return c.symbolTable.Define(name)
+}
+
+// pipelineCall turns x |> f into the call f(x). If the right side is a call already,
+// x is passed as its first argument: x |> f(y) is f(x, y). The operator is left-associative,
+// so x |> f |> g is g(f(x)). Either way x is evaluated once, as the argument of the call.
+func pipelineCall(node *ast.InfixExpression) *ast.CallExpression {
+	if call, ok := node.Right.(*ast.CallExpression); ok {
+		arguments := append([]ast.Expression{node.Left}, call.Arguments...)
+		return &ast.CallExpression{Token: call.Token, Function: call.Function, Arguments: arguments}
+	}
+
+	return &ast.CallExpression{Token: node.Token, Function: node.Right, Arguments: []ast.Expression{node.Left}}
 }
@@ -1,12 +1,17 @@
 package compiler
 
 import (
+	"errors"
+	"fmt"
 	"monkey-compiler/ast"
 	"monkey-compiler/code"
 	"monkey-compiler/lexer"
 	"monkey-compiler/object"
 	"monkey-compiler/parser"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 type compilerTestCase struct {
@@ -21,10 +26,10 @@ func TestIntegerArithmetic(t *testing.T) {
 		{
 			desc:              "1+2",
 			input:             "1 + 2",
-			expectedConstants: []interface{}{1, 2},
+			expectedConstants: []interface{}{2},
 			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpConstant, 1),
 				code.Make(code.OpAdd),
 				code.Make(code.OpPop),
 			},
@@ -32,21 +37,89 @@ func TestIntegerArithmetic(t *testing.T) {
 		{
 			desc:              "1;2",
 			input:             "1; 2",
-			expectedConstants: []interface{}{1, 2},
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "-2",
+			input:             "-2;",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "small integers",
+			input:             "0; 1; -1",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpZero),
+				code.Make(code.OpPop),
+				code.Make(code.OpOne),
+				code.Make(code.OpPop),
+				code.Make(code.OpMinusOne),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "x + 1",
+			input:             "let x = 5; x + 1",
+			expectedConstants: []interface{}{5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),  // 0000
+				code.Make(code.OpSetGlobal, 0), // 0003
+				code.Make(code.OpGetGlobal, 0), // 0006
+				code.Make(code.OpOne),          // 0009
+				code.Make(code.OpAdd),          // 0010
+				code.Make(code.OpPop),          // 0011
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestIntegerBases(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "hex-binary-octal",
+			input:             "0xFF; 0b1010; 0o17; 0XfF",
+			expectedConstants: []interface{}{255, 10, 15, 255},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpPop),
 				code.Make(code.OpConstant, 1),
 				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpPop),
 			},
 		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestDigitSeparators(t *testing.T) {
+	testCases := []compilerTestCase{
 		{
-			desc:              "-1",
-			input:             "-1;",
-			expectedConstants: []interface{}{1},
+			desc:              "separated",
+			input:             "1_000_000; 0xFF_FF; 1_2",
+			expectedConstants: []interface{}{1000000, 65535, 12},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
-				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
 				code.Make(code.OpPop),
 			},
 		},
@@ -89,11 +162,33 @@ func TestBooleanExpression(t *testing.T) {
 		{
 			desc:              "5<3",
 			input:             "5 < 3;",
-			expectedConstants: []interface{}{3, 5},
+			expectedConstants: []interface{}{5, 3},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "5>=3",
+			input:             "5 >= 3;",
+			expectedConstants: []interface{}{5, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterThanOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "5<=3",
+			input:             "5 <= 3;",
+			expectedConstants: []interface{}{5, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThanOrEqual),
 				code.Make(code.OpPop),
 			},
 		},
@@ -134,6 +229,71 @@ func TestBooleanExpression(t *testing.T) {
 	runCompilerTests(t, testCases)
 }
 
+func TestComparisonChains(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "2<3<4",
+			input:             "2 < 3 < 4;",
+			expectedConstants: []interface{}{2, 3, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),       // 0000
+				code.Make(code.OpConstant, 1),       // 0003
+				code.Make(code.OpDup),               // 0006
+				code.Make(code.OpSetGlobal, 0),      // 0007
+				code.Make(code.OpLessThan),          // 0010
+				code.Make(code.OpJumpNotTruthy, 24), // 0011
+				code.Make(code.OpGetGlobal, 0),      // 0014
+				code.Make(code.OpConstant, 2),       // 0017
+				code.Make(code.OpLessThan),          // 0020
+				code.Make(code.OpJump, 25),          // 0021
+				code.Make(code.OpFalse),             // 0024
+				code.Make(code.OpPop),               // 0025
+			},
+		},
+		{
+			desc:  "chain in function",
+			input: "fn(x) { 2 <= x > 3 }",
+			expectedConstants: []interface{}{
+				2,
+				3,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),       // 0000
+					code.Make(code.OpGetLocal, 0),       // 0003
+					code.Make(code.OpDup),               // 0005
+					code.Make(code.OpSetLocal, 1),       // 0006
+					code.Make(code.OpLessThanOrEqual),   // 0008
+					code.Make(code.OpJumpNotTruthy, 21), // 0009
+					code.Make(code.OpGetLocal, 1),       // 0012
+					code.Make(code.OpConstant, 1),       // 0014
+					code.Make(code.OpGreaterThan),       // 0017
+					code.Make(code.OpJump, 22),          // 0018
+					code.Make(code.OpFalse),             // 0021
+					code.Make(code.OpReturnValue),       // 0022
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "comparison followed by == is not a chain",
+			input:             "2 < 3 == true;",
+			expectedConstants: []interface{}{2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpTrue),
+				code.Make(code.OpEqual),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
 func TestConditional(t *testing.T) {
 	testCases := []compilerTestCase{
 		{
@@ -166,9 +326,394 @@ func TestConditional(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			desc:              "if-statement-with-empty-consequence",
+			input:             "if (true) { };",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),             // 0000
+				code.Make(code.OpJumpNotTruthy, 8), // 0001
+				code.Make(code.OpNull),             // 0004
+				code.Make(code.OpJump, 9),          // 0005
+				code.Make(code.OpNull),             // 0008
+				code.Make(code.OpPop),              // 0009
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestTryCatch(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "try-catch",
+			input:             "try { 1 / 0 } catch (e) { e }; 3",
+			expectedConstants: []interface{}{3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpSetupCatch, 10), // 0000
+				code.Make(code.OpOne),            // 0003
+				code.Make(code.OpZero),           // 0004
+				code.Make(code.OpDiv),            // 0005
+				code.Make(code.OpPopCatch),       // 0006
+				code.Make(code.OpJump, 16),       // 0007
+				code.Make(code.OpSetGlobal, 0),   // 0010
+				code.Make(code.OpGetGlobal, 0),   // 0013
+				code.Make(code.OpPop),            // 0016
+				code.Make(code.OpConstant, 0),    // 0017
+				code.Make(code.OpPop),            // 0020
+			},
+		},
+		{
+			desc:              "try-finally",
+			input:             "try { 1 } finally { 2 }",
+			expectedConstants: []interface{}{2, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpSetupFinally, 8), // 0000
+				code.Make(code.OpOne),             // 0003
+				code.Make(code.OpPopCatch),        // 0004
+				code.Make(code.OpJump, 13),        // 0005
+				code.Make(code.OpConstant, 0),     // 0008
+				code.Make(code.OpPop),             // 0011
+				code.Make(code.OpRethrow),         // 0012
+				code.Make(code.OpConstant, 1),     // 0013
+				code.Make(code.OpPop),             // 0016
+				code.Make(code.OpPop),             // 0017
+			},
+		},
+		{
+			desc:              "try-catch-finally",
+			input:             "try { 1 } catch (e) { e } finally { 2 }",
+			expectedConstants: []interface{}{2, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpSetupFinally, 21), // 0000
+				code.Make(code.OpSetupCatch, 11),   // 0003
+				code.Make(code.OpOne),              // 0006
+				code.Make(code.OpPopCatch),         // 0007
+				code.Make(code.OpJump, 17),         // 0008
+				code.Make(code.OpSetGlobal, 0),     // 0011
+				code.Make(code.OpGetGlobal, 0),     // 0014
+				code.Make(code.OpPopCatch),         // 0017
+				code.Make(code.OpJump, 26),         // 0018
+				code.Make(code.OpConstant, 0),      // 0021
+				code.Make(code.OpPop),              // 0024
+				code.Make(code.OpRethrow),          // 0025
+				code.Make(code.OpConstant, 1),      // 0026
+				code.Make(code.OpPop),              // 0029
+				code.Make(code.OpPop),              // 0030
+			},
+		},
+		{
+			desc:  "return-through-finally",
+			input: "fn() { try { return 1 } finally { 2 } }",
+			expectedConstants: []interface{}{
+				2, 2, 2,
+				[]code.Instructions{
+					code.Make(code.OpSetupFinally, 14), // 0000
+					code.Make(code.OpOne),              // 0003
+					code.Make(code.OpPopCatch),         // 0004
+					code.Make(code.OpConstant, 0),      // 0005 the finally block of the return
+					code.Make(code.OpPop),              // 0008
+					code.Make(code.OpReturnValue),      // 0009
+					code.Make(code.OpPopCatch),         // 0010
+					code.Make(code.OpJump, 19),         // 0011
+					code.Make(code.OpConstant, 1),      // 0014
+					code.Make(code.OpPop),              // 0017
+					code.Make(code.OpRethrow),          // 0018
+					code.Make(code.OpConstant, 2),      // 0019
+					code.Make(code.OpPop),              // 0022
+					code.Make(code.OpReturnValue),      // 0023
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "throw",
+			input:             "throw 1",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpThrow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:  "try-catch-in-function",
+			input: "fn() { try { } catch (e) { } }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpSetupCatch, 8), // 0000
+					code.Make(code.OpNull),          // 0003
+					code.Make(code.OpPopCatch),      // 0004
+					code.Make(code.OpJump, 11),      // 0005
+					code.Make(code.OpSetLocal, 0),   // 0008
+					code.Make(code.OpNull),          // 0010
+					code.Make(code.OpReturnValue),   // 0011
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestDoWhile(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "do-while",
+			input:             "do { 2 } while (true)",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),       // 0000
+				code.Make(code.OpPop),               // 0003
+				code.Make(code.OpTrue),              // 0004
+				code.Make(code.OpJumpNotTruthy, 11), // 0005
+				code.Make(code.OpJump, 0),           // 0008
+			},
+		},
+		{
+			desc:              "break-and-continue",
+			input:             "do { break; continue } while (false)",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpJump, 13),          // 0000
+				code.Make(code.OpJump, 6),           // 0003
+				code.Make(code.OpFalse),             // 0006
+				code.Make(code.OpJumpNotTruthy, 13), // 0007
+				code.Make(code.OpJump, 0),           // 0010
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+
+	for _, input := range []string{"break", "continue", "do { fn() { break } } while (false)"} {
+		err := New().Compile(parse(input))
+		if err == nil || !strings.HasSuffix(err.Error(), "outside loop") {
+			t.Errorf("wrong error for %q. want break or continue outside loop, got=%v", input, err)
+		}
+	}
+}
+
+func TestLabeledLoops(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "break-and-continue-outer",
+			input:             "outer: do { do { break outer; continue outer } while (true) } while (false)",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpJump, 20),          // 0000
+				code.Make(code.OpJump, 13),          // 0003
+				code.Make(code.OpTrue),              // 0006
+				code.Make(code.OpJumpNotTruthy, 13), // 0007
+				code.Make(code.OpJump, 0),           // 0010
+				code.Make(code.OpFalse),             // 0013
+				code.Make(code.OpJumpNotTruthy, 20), // 0014
+				code.Make(code.OpJump, 0),           // 0017
+			},
+		},
 	}
 
 	runCompilerTests(t, testCases)
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break outer", "break outside loop outer"},
+		{"outer: do { do { continue inner } while (true) } while (true)", "continue outside loop inner"},
+		{"outer: do { fn() { do { break outer } while (true) } } while (false)", "break outside loop outer"},
+	}
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestNestedConditionalJumpTargets(t *testing.T) {
+	// nest := if (c) { nest } else { i }, with some levels lacking an else
+	// or sitting in a function, a comparison chain, ?? or ?.
+	nested := "1"
+	for i := 0; i < 40; i++ {
+		switch i % 5 {
+		case 0:
+			nested = fmt.Sprintf("if (c) { %s }", nested)
+		case 1:
+			nested = fmt.Sprintf("if (c) { %s } else { %d }", nested, i)
+		case 2:
+			nested = fmt.Sprintf("fn() { if (1 < %d < 3) { %s } else { if (c) { %d } } }()", i, nested, i)
+		case 3:
+			nested = fmt.Sprintf("if (c ?? %s) { %s; } else { null?.[%d] }", nested, nested, i)
+		case 4:
+			nested = fmt.Sprintf("if (if (c) { c } else { %s }) { let x = %s; x } else { c }", nested, nested)
+		}
+		if len(nested) > 1<<16 {
+			break
+		}
+	}
+
+	compiler := New()
+	if err := compiler.Compile(parse("let c = true; " + nested + "; 0")); err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+
+	testJumpTargets(t, compiler.ByteCode())
+}
+
+func TestJumpTargetOutOfRange(t *testing.T) {
+	// each c is an OpGetGlobal, three bytes, so these take more than 65535 bytes
+	statements := strings.Repeat("c; ", 25000)
+	array := "[" + strings.Repeat("c, ", 25000) + "c]"
+	tests := []struct {
+		input  string
+		target int
+	}{
+		{"if (c) { " + statements + " }", 100012},
+		{"if (c) { 2 } else { " + statements + " }", 100015},
+		{"c ?? " + array, 75016},
+		{"c?.[" + array + "]", 75021},
+		{"c < " + array + " < c", 75031},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse("let c = true; " + tt.input))
+		want := fmt.Sprintf("too much code to jump over: target %d exceeds 65535", tt.target)
+		if err == nil || err.Error() != want {
+			t.Errorf("compile error wrong. want=%q, got=%v", want, err)
+		}
+	}
+}
+
+func TestEvalConst(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{} // nil when the expression can't be folded
+	}{
+		{"2 * 3", 6},
+		{"-(1 + 2) * 4 - 10 / 5", -14},
+		{"9223372036854775806 + 1", 9223372036854775807},
+		{"-9223372036854775807 - 1", -9223372036854775808},
+		{"4611686018427387903 * 2", 9223372036854775806},
+		// results beyond int64 are big integers, which aren't folded
+		{"9223372036854775807 + 1", nil},
+		{"-9223372036854775807 - 2", nil},
+		{"4611686018427387904 * 2", nil},
+		{"(-9223372036854775807 - 1) / -1", nil},
+		{"-9223372036854775808", nil},
+		{"2 * x", nil},
+		{"7 / 0", nil},
+		{"2 * 3.0", nil},
+		{"\"a\" + \"b\"", nil},
+		{"let a = 2 * 3", nil},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		value, ok := EvalConst(program.Statements[0])
+		if tt.expected == nil {
+			if ok {
+				t.Errorf("%q folded to %s, expected it not to be foldable", tt.input, value.Inspect())
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%q not folded, expected %v", tt.input, tt.expected)
+			continue
+		}
+		testIntegerObject(t, int64(tt.expected.(int)), value)
+	}
+}
+
+func TestFoldConstants(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "arithmetic-on-literals",
+			input:             "60 * 60 * 24",
+			expectedConstants: []interface{}{86400},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0), // 0000
+				code.Make(code.OpPop),         // 0003
+			},
+		},
+		{
+			desc:              "negative-literal",
+			input:             "-5 + 1",
+			expectedConstants: []interface{}{-4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0), // 0000
+				code.Make(code.OpPop),         // 0003
+			},
+		},
+		{
+			desc:              "literal-part-of-unknown-operand",
+			input:             "let x = 1; x * (2 + 2) + 0",
+			expectedConstants: []interface{}{4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),          // 0000
+				code.Make(code.OpSetGlobal, 0), // 0001
+				code.Make(code.OpGetGlobal, 0), // 0004
+				code.Make(code.OpConstant, 0),  // 0007
+				code.Make(code.OpMul),          // 0010
+				code.Make(code.OpZero),         // 0011
+				code.Make(code.OpAdd),          // 0012
+				code.Make(code.OpPop),          // 0013
+			},
+		},
+		{
+			desc:              "division-by-zero",
+			input:             "7 / 0",
+			expectedConstants: []interface{}{7},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0), // 0000
+				code.Make(code.OpZero),        // 0003
+				code.Make(code.OpDiv),         // 0004
+				code.Make(code.OpPop),         // 0005
+			},
+		},
+		{
+			desc:              "overflow",
+			input:             "9223372036854775807 + 1",
+			expectedConstants: []interface{}{9223372036854775807},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0), // 0000
+				code.Make(code.OpOne),         // 0003
+				code.Make(code.OpAdd),         // 0004
+				code.Make(code.OpPop),         // 0005
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			compiler := New()
+			compiler.SetOptimizationLevel(FoldConstants)
+			if err := compiler.Compile(parse(tc.input)); err != nil {
+				t.Fatalf("compile error: %s", err)
+			}
+
+			byteCode := compiler.ByteCode()
+			expectedInstructions := concatInstructions(tc.expectedInstructions)
+			if byteCode.Instructions.String() != expectedInstructions.String() {
+				t.Fatalf("instruction wrong.\nwant=%s\ngot=%s", expectedInstructions, byteCode.Instructions)
+			}
+			if len(byteCode.Constants) != len(tc.expectedConstants) {
+				t.Fatalf("constants wrong. want=%+v, got=%+v", tc.expectedConstants, byteCode.Constants)
+			}
+			for i, c := range tc.expectedConstants {
+				testIntegerObject(t, int64(c.(int)), byteCode.Constants[i])
+			}
+		})
+	}
 }
 
 func TestGlobalLetStatement(t *testing.T) {
@@ -179,11 +724,11 @@ func TestGlobalLetStatement(t *testing.T) {
 			let one = 1;
 			let two = 2;
 			`,
-			expectedConstants: []interface{}{1, 2},
+			expectedConstants: []interface{}{2},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
+				code.Make(code.OpOne),
 				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 0),
 				code.Make(code.OpSetGlobal, 1),
 			},
 		},
@@ -193,9 +738,9 @@ func TestGlobalLetStatement(t *testing.T) {
 			let one = 1;
 			one;
 			`,
-			expectedConstants: []interface{}{1},
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
+				code.Make(code.OpOne),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpPop),
@@ -208,9 +753,9 @@ func TestGlobalLetStatement(t *testing.T) {
 			let two = one;
 			two;
 			`,
-			expectedConstants: []interface{}{1},
+			expectedConstants: []interface{}{},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
+				code.Make(code.OpOne),
 				code.Make(code.OpSetGlobal, 0),
 				code.Make(code.OpGetGlobal, 0),
 				code.Make(code.OpSetGlobal, 1),
@@ -223,45 +768,1322 @@ func TestGlobalLetStatement(t *testing.T) {
 	runCompilerTests(t, testCases)
 }
 
-func runCompilerTests(t *testing.T, testCases []compilerTestCase) {
-	t.Helper()
-
-	for _, tc := range testCases {
-		t.Run(tc.desc, func(t *testing.T) {
-			program := parse(tc.input)
-
-			compiler := New()
-			err := compiler.Compile(program)
-			if err != nil {
-				t.Fatalf("compile error: %s", err.Error())
-			}
-
-			byteCode := compiler.ByteCode()
-
-			expectedInstructions := concatInstructions(tc.expectedInstructions)
-			if len(byteCode.Instructions) != len(expectedInstructions) {
-				t.Fatalf("instruction wrong.\nwant=%s\ngot=%s", expectedInstructions, byteCode.Instructions)
-			}
-			for i, b := range byteCode.Instructions {
-				if b != expectedInstructions[i] {
-					t.Fatalf("instruction wrong\nwant=%s\ngot=%s", expectedInstructions, byteCode.Instructions)
-					break
-				}
-			}
-
-			if len(byteCode.Constants) != len(tc.expectedConstants) {
-				t.Fatalf("constants wrong. want=%+v, got=%+v", tc.expectedConstants, byteCode.Constants)
-			}
+func TestStringLiterals(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "plain string",
+			input:             `"monkey"`,
+			expectedConstants: []interface{}{"monkey"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "escape sequences",
+			input:             `"\x41\tb\n\"c\"\\"`,
+			expectedConstants: []interface{}{"A\tb\n\"c\"\\"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "raw string",
+			input:             "`a\\n\\x41`",
+			expectedConstants: []interface{}{`a\n\x41`},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "concatenation",
+			input:             `"mon" + "key"`,
+			expectedConstants: []interface{}{"mon", "key"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestArrayLiterals(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "empty",
+			input:             "[]",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "expressions",
+			input:             "[1 + 2, 3]",
+			expectedConstants: []interface{}{2, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestHashLiterals(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "empty",
+			input:             "{}",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpHash, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "keys in source order",
+			input:             "{3: 4, 1: 2}",
+			expectedConstants: []interface{}{3, 4, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpOne),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpHash, 4),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "computed keys",
+			input:             `{1 + 1: "two", "a" + "b": 3 * 4}`,
+			expectedConstants: []interface{}{"two", "a", "b", 3, 4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpOne),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpConstant, 4),
+				code.Make(code.OpMul),
+				code.Make(code.OpHash, 4),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestIndexExpressions(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "array",
+			input:             "[1, 2][1 - 1]",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpOne),
+				code.Make(code.OpOne),
+				code.Make(code.OpSub),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "hash",
+			input:             "{1: 2}[1]",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpHash, 2),
+				code.Make(code.OpOne),
+				code.Make(code.OpIndex),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestIndexAssignment(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "array element",
+			input:             "let a = [1]; a[0] = 2;",
+			expectedConstants: []interface{}{2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpZero),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetIndex),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestFunctions(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:  "implicit-return",
+			input: "fn() { 5 + 10 }",
+			expectedConstants: []interface{}{
+				5,
+				10,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:  "empty-body",
+			input: "fn() { }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:  "call-with-arguments",
+			input: "let f = fn(a) { let b = a; b }; f(3);",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+				3,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:  "builtin",
+			input: "fn() { puts(len) }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetBuiltin, 1),
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestLambdasCompileLikeFunctionLiterals(t *testing.T) {
+	tests := []struct {
+		lambda   string
+		function string
+	}{
+		{"|x| x + 1", "fn(x) { x + 1 }"},
+		{"|| 5", "fn() { 5 }"},
+		{"let add = |a, b| a + b; add(1, 2)", "let add = fn(a, b) { a + b }; add(1, 2)"},
+		{"|a| |b| a + b", "fn(a) { fn(b) { a + b } }"},
+		{"let f = || f(); f", "let f = fn() { f() }; f"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lambda, func(t *testing.T) {
+			lambda := New()
+			if err := lambda.Compile(parse(tt.lambda)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			function := New()
+			if err := function.Compile(parse(tt.function)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			got, want := lambda.ByteCode(), function.ByteCode()
+			if got.Instructions.String() != want.Instructions.String() {
+				t.Fatalf("instructions differ.\nlambda=%s\nfn=%s", got.Instructions, want.Instructions)
+			}
+			if len(got.Constants) != len(want.Constants) {
+				t.Fatalf("number of constants differs. lambda=%d, fn=%d", len(got.Constants), len(want.Constants))
+			}
+			for i, c := range want.Constants {
+				if fn, ok := c.(*object.CompiledFunction); ok {
+					lambdaFn := got.Constants[i].(*object.CompiledFunction)
+					if lambdaFn.Instructions.String() != fn.Instructions.String() {
+						t.Fatalf("constant %d differs.\nlambda=%s\nfn=%s", i, lambdaFn.Instructions, fn.Instructions)
+					}
+					continue
+				}
+				if got.Constants[i].Inspect() != c.Inspect() {
+					t.Fatalf("constant %d differs. lambda=%s, fn=%s", i, got.Constants[i].Inspect(), c.Inspect())
+				}
+			}
+		})
+	}
+}
+
+func TestPipelines(t *testing.T) {
+	tests := []struct {
+		pipeline string
+		call     string
+	}{
+		{"let f = fn(x) { x }; 1 |> f", "let f = fn(x) { x }; f(1)"},
+		{"let f = fn(x) { x }; 1 + 2 |> f |> f", "let f = fn(x) { x }; f(f(1 + 2))"},
+		{"let f = fn(x, y) { x - y }; 1 |> f(2)", "let f = fn(x, y) { x - y }; f(1, 2)"},
+		{"[1] |> push(2) |> len", "len(push([1], 2))"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pipeline, func(t *testing.T) {
+			pipeline := New()
+			if err := pipeline.Compile(parse(tt.pipeline)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			call := New()
+			if err := call.Compile(parse(tt.call)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			got, want := pipeline.ByteCode().Instructions, call.ByteCode().Instructions
+			if got.String() != want.String() {
+				t.Fatalf("instructions differ.\npipeline=%s\ncall=%s", got, want)
+			}
+		})
+	}
+}
+
+func TestNewlinesEndStatements(t *testing.T) {
+	tests := []struct {
+		newlines   string
+		semicolons string
+	}{
+		{"1 + 2\n3 + 4", "1 + 2; 3 + 4;"},
+		{"let a = 1\nlet b = a\nb", "let a = 1; let b = a; b;"},
+		{"let f = fn(x) { x }\nf\n(1)", "let f = fn(x) { x }; f; (1);"},
+		{"let a = [1]\na\n[0]", "let a = [1]; a; [0];"},
+		{"let f = fn(x) {\n  let y = x\n  y\n  -1\n}", "let f = fn(x) { let y = x; y; -1; };"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.semicolons, func(t *testing.T) {
+			p := parser.New(lexer.New(tt.newlines))
+			p.SetNewlineEnds(true)
+			newlines := New()
+			if err := newlines.Compile(p.ParseProgram()); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			semicolons := New()
+			if err := semicolons.Compile(parse(tt.semicolons)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			got, want := newlines.ByteCode(), semicolons.ByteCode()
+			if got.Instructions.String() != want.Instructions.String() {
+				t.Fatalf("instructions differ.\nnewlines=%s\nsemicolons=%s", got.Instructions, want.Instructions)
+			}
+			if len(got.Constants) != len(want.Constants) {
+				t.Fatalf("number of constants differs. newlines=%d, semicolons=%d", len(got.Constants), len(want.Constants))
+			}
+			for i, c := range want.Constants {
+				if fn, ok := c.(*object.CompiledFunction); ok {
+					newlinesFn := got.Constants[i].(*object.CompiledFunction)
+					if newlinesFn.Instructions.String() != fn.Instructions.String() {
+						t.Fatalf("constant %d differs.\nnewlines=%s\nsemicolons=%s", i, newlinesFn.Instructions, fn.Instructions)
+					}
+					continue
+				}
+				if got.Constants[i].Inspect() != c.Inspect() {
+					t.Fatalf("constant %d differs. newlines=%s, semicolons=%s", i, got.Constants[i].Inspect(), c.Inspect())
+				}
+			}
+		})
+	}
+}
+
+func TestNullish(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "null coalescing",
+			input:             "null ?? 3; 2",
+			expectedConstants: []interface{}{3, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),           // 0000
+				code.Make(code.OpJumpNotNull, 7), // 0001
+				code.Make(code.OpConstant, 0),    // 0004
+				code.Make(code.OpPop),            // 0007
+				code.Make(code.OpConstant, 1),    // 0008
+				code.Make(code.OpPop),            // 0011
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestOptionalAccess(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "optional index",
+			input:             "null?.[3]",
+			expectedConstants: []interface{}{3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),           // 0000
+				code.Make(code.OpJumpNotNull, 8), // 0001
+				code.Make(code.OpNull),           // 0004
+				code.Make(code.OpJump, 12),       // 0005
+				code.Make(code.OpConstant, 0),    // 0008
+				code.Make(code.OpIndex),          // 0011
+				code.Make(code.OpPop),            // 0012
+			},
+		},
+		{
+			desc:              "optional call",
+			input:             "len?.([])",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltin, 0),  // 0000
+				code.Make(code.OpJumpNotNull, 9), // 0002
+				code.Make(code.OpNull),           // 0005
+				code.Make(code.OpJump, 14),       // 0006
+				code.Make(code.OpArray, 0),       // 0009
+				code.Make(code.OpCall, 1),        // 0012
+				code.Make(code.OpPop),            // 0014
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestSpreadCalls(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "spread last argument",
+			input:             "len(3, ...[2])",
+			expectedConstants: []interface{}{3, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpGetBuiltin, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSpreadCall, 2),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+
+	for _, input := range []string{"len(...[1], 2)", "[...[1]]", "...[1]"} {
+		err := New().Compile(parse(input))
+		if err == nil {
+			t.Fatalf("expected compile error for %q but got none", input)
+		}
+		if err.Error() != "spread is only allowed as the last argument of a call" {
+			t.Fatalf("compile error for %q wrong. got=%q", input, err)
+		}
+	}
+}
+
+func TestDestructuring(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "global names",
+			input:             "let a, b = [3, 2];",
+			expectedConstants: []interface{}{3, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpUnpack, 2),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			desc:  "local names of returned values",
+			input: "fn() { let a, b = fn() { return 3, 2 }(); a }",
+			expectedConstants: []interface{}{
+				3,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpArray, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpClosure, 2, 0),
+					code.Make(code.OpCall, 0),
+					code.Make(code.OpUnpack, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestClosures(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:  "free-variable",
+			input: "fn(a) { fn(b) { a + b } }",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:  "recursive",
+			input: "let f = fn(x) { f(x) };",
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+}
+
+func TestShadowedBuiltinWarnings(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		input    string
+		expected []string
+	}{
+		{
+			desc:     "global-let",
+			input:    "let len = 1; len",
+			expected: []string{"len shadows the builtin function of the same name"},
+		},
+		{
+			desc:     "local-let-and-parameter",
+			input:    "fn(puts) { let first = puts; first }",
+			expected: []string{"puts shadows the builtin function of the same name", "first shadows the builtin function of the same name"},
+		},
+		{
+			desc:     "no-shadowing",
+			input:    "let length = fn(x) { len(x) };",
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			compiler := New()
+			if err := compiler.Compile(parse(tc.input)); err != nil {
+				t.Fatalf("compile error: %s", err.Error())
+			}
+
+			warnings := compiler.Warnings()
+			if len(warnings) != len(tc.expected) {
+				t.Fatalf("warnings wrong. want=%q, got=%q", tc.expected, warnings)
+			}
+			for i, w := range warnings {
+				if w != tc.expected[i] {
+					t.Fatalf("warnings wrong. want=%q, got=%q", tc.expected, warnings)
+				}
+			}
+		})
+	}
+}
+
+func TestTypeWarnings(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		input    string
+		expected []string
+	}{
+		{
+			desc:     "string-minus-integer",
+			input:    `"a" - 1`,
+			expected: []string{"line 1: cannot apply - to string and int"},
+		},
+		{
+			desc:     "inferred-from-let",
+			input:    "let s = \"a\" + \"b\";\nlet n = s / 2;\n-s",
+			expected: []string{"line 2: cannot apply / to string and int", "line 3: cannot apply - to string"},
+		},
+		{
+			desc:     "annotated-parameter",
+			input:    "fn(a: int, b: bool) { a < b }",
+			expected: []string{"line 1: cannot apply < to int and bool"},
+		},
+		{
+			desc:     "float-arithmetic",
+			input:    "let x = 1.5 * 2; let y = x < 3; x - true",
+			expected: []string{"line 1: cannot apply - to float and bool"},
+		},
+		{
+			desc:     "chain-compares-neighbours",
+			input:    `1 < 2 <= "c"`,
+			expected: []string{"line 1: cannot apply <= to int and string"},
+		},
+		{
+			desc:     "try-catch",
+			input:    "try { let s = \"a\"; -s } catch (e) { e + 1 }",
+			expected: []string{"line 1: cannot apply - to string"},
+		},
+		{
+			desc:     "array-ordered-with-int",
+			input:    "[1] < 2",
+			expected: []string{"line 1: cannot apply < to array and int"},
+		},
+		{
+			desc:     "index-and-call",
+			input:    `let n = 5; n[0]; [1]["a"]; {}[[]]; n(1)`,
+			expected: []string{"line 1: cannot index int", "line 1: cannot index array with string", "line 1: cannot use array as hash key", "line 1: cannot call int"},
+		},
+		{
+			desc:     "outer-name-in-function",
+			input:    `let n = 5; let f = fn() { n + "x" };`,
+			expected: []string{"line 1: cannot apply + to int and string"},
+		},
+		{
+			desc:     "dynamic-code",
+			input:    "let add = fn(a, b) { a + b }; add(1, 2); add(\"a\", \"b\"); let head = fn(x) { x[0] }; head([1]); head({0: 1})",
+			expected: []string{},
+		},
+		{
+			desc:     "valid-operations",
+			input:    `let n = 1 + 2 * 3; let s = "a" + "b"; [n < 4, n == s, -1.5, !s, [1][n], {"a": 1}[s], 1 < n <= 9, s * n, [0] * 3, [1] < [2]]`,
+			expected: []string{},
+		},
+		{
+			desc:     "let-in-branch-is-unknown-after-it",
+			input:    `let x = 5; if (len([])) { let x = "a"; x + 1 }; x - 1`,
+			expected: []string{"line 1: cannot apply + to string and int"},
+		},
+		{
+			desc:     "let-in-block-is-scoped",
+			input:    `let x = 5; let y = { let x = "a"; x }; x - 1`,
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			compiler := New()
+			if err := compiler.Compile(parse(tc.input)); err != nil {
+				t.Fatalf("compile error: %s", err.Error())
+			}
+
+			warnings := compiler.Warnings()
+			if len(warnings) != len(tc.expected) {
+				t.Fatalf("warnings wrong. want=%q, got=%q", tc.expected, warnings)
+			}
+			for i, w := range warnings {
+				if w != tc.expected[i] {
+					t.Fatalf("warnings wrong. want=%q, got=%q", tc.expected, warnings)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockExpressions(t *testing.T) {
+	testCases := []compilerTestCase{
+		{
+			desc:              "global names",
+			input:             "let x = { let a = 1; a + 1 }; x",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpOne),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:              "ending with a let",
+			input:             "{ let a = 1; }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpOne),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			desc:  "local names",
+			input: "fn() { let a = { let b = 2; b }; a }",
+			expectedConstants: []interface{}{
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, testCases)
+
+	for _, input := range []string{"{ let a = 1; a }; a", "fn() { { let a = 1; }; a }"} {
+		err := New().Compile(parse(input))
+		if err == nil || err.Error() != "undefined variable: a" {
+			t.Errorf("compile error for %q wrong. want=%q, got=%v", input, "undefined variable: a", err)
+		}
+	}
+}
+
+func TestDisableBuiltins(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"exit(1)", "builtin disabled: exit"},
+		{"fn() { puts(1) }", "builtin disabled: puts"},
+		{"find([1], exit)", "builtin disabled: exit"},
+		{"len([1]); first([1])", ""},
+		{"let exit = fn(code) { code }; exit(1)", ""},
+	}
+
+	for _, tt := range tests {
+		c := New()
+		c.DisableBuiltins("exit", "puts")
+		err := c.Compile(parse(tt.input))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("compile error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("compile error for %q wrong. want=%q, got=%v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestUseBeforeDefinition(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"let a = a;", "undefined variable: a"},
+		{"fn() { let a = a + 1; }", "undefined variable: a"},
+		{"let a, b = [1, b];", "undefined variable: b"},
+		{"let f = fn() { b }; let b = 1;", "undefined variable: b"},
+		{"let f = fn() { g() }; let g = fn() { f() };", "undefined variable: g"},
+		// recursive functions are the exception
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } };", ""},
+		{"fn() { let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; }", ""},
+		// the value refers to the a defined before
+		{"let a = 1; let a = a + 1;", ""},
+		{"let a = 1; fn() { let a = a + 1; a }", ""},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("compile error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("compile error for %q wrong. want=%q, got=%v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestTypeAnnotations(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"let x: int = 5;", ""},
+		{"let x: int = 5; let y: int = x * 2 + -x;", ""},
+		{`let s: string = "a" + "b"; let b: bool = s == "ab";`, ""},
+		{"let f: fn = fn(a: int, b: array): int { a + len(b) };", ""},
+		{"let f = fn(a: int): hash { if (a > 0) { return {}; } {1: a} };", ""},
+		{"let g = |x: int| x * 3;", ""},
+		{"let a: int, b: string = [1, 2];", ""},
+		// null and values of unknown type can be assigned to anything
+		{"let x: int = null; let y: string = len([]);", ""},
+		{"let x: float = 1.5 * 2; let y: float = x / 3;", ""},
+		{"let x: int = 1 + 0.5;", "cannot assign float to x of type int"},
+		{`let x: int = "five";`, "cannot assign string to x of type int"},
+		{"let x: int = 5; let y: string = x;", "cannot assign int to y of type string"},
+		{"let x: bool = 1 < 2 < 3; let y: int = !x;", "cannot assign bool to y of type int"},
+		{"let f = fn(a: int) { let s: string = -a; s };", "cannot assign int to s of type string"},
+		{"let f = fn(): int { true };", "cannot return bool from function returning int"},
+		{"let f = fn(): int { if (true) { return [1]; } 1 };", "cannot return array from function returning int"},
+		{"let x: string = fn(): int { 1 }();", "cannot assign int to x of type string"},
+		// an annotated outer name is known in a nested function
+		{"let n: int = 1; let f = fn() { fn() { let s: string = n; } };", "cannot assign int to s of type string"},
+		{"let x: integer = 5;", "unknown type integer of x"},
+		{"fn(a: text) { a };", "unknown type text of a"},
+		{"fn(): void { 1 };", "unknown type void of function result"},
+		{"let a, b: str = [1, 2];", "unknown type str of b"},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("compile error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("compile error for %q wrong. want=%q, got=%v", tt.input, tt.err, err)
+		}
+	}
+}
+
+func TestTypeAnnotationsCompileAway(t *testing.T) {
+	annotated := New()
+	if err := annotated.Compile(parse("let f = fn(a: int, b: int): int { a + b }; let x: int = f(2, 3);")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	plain := New()
+	if err := plain.Compile(parse("let f = fn(a, b) { a + b }; let x = f(2, 3);")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// the decompilation covers the instructions of the functions among the constants too
+	if got, want := Decompile(annotated.ByteCode()), Decompile(plain.ByteCode()); got != want {
+		t.Errorf("annotations changed the program.\nwant=\n%s\ngot=\n%s", want, got)
+	}
+}
+
+func TestTooManyGlobals(t *testing.T) {
+	symbolTable := NewSymbolTable()
+	for i := 0; i < MaxGlobals; i++ {
+		if _, err := symbolTable.Define(fmt.Sprintf("g%d", i)); err != nil {
+			t.Fatalf("define error at %d: %s", i, err)
+		}
+	}
+
+	compiler := NewWithState(symbolTable, []object.Object{})
+	err := compiler.Compile(parse("let x = 1;"))
+	if err == nil {
+		t.Fatalf("expected compile error but got none")
+	}
+	if err.Error() != "too many global variables" {
+		t.Fatalf("compile error wrong. want=%q, got=%q", "too many global variables", err)
+	}
+}
+
+func TestTooManyLocals(t *testing.T) {
+	var body strings.Builder
+	for i := 0; i <= MaxLocals; i++ {
+		fmt.Fprintf(&body, "let %s = %d; ", identifier(i), i)
+	}
+	input := fmt.Sprintf("fn() { %s }", body.String())
+
+	err := New().Compile(parse(input))
+	if err == nil {
+		t.Fatalf("expected compile error but got none")
+	}
+	if err.Error() != "too many local variables" {
+		t.Fatalf("compile error wrong. want=%q, got=%q", "too many local variables", err)
+	}
+}
+
+func TestTooManyFreeVariables(t *testing.T) {
+	// no single function has too many locals, but the innermost one captures all of them
+	var outer, middle, inner strings.Builder
+	for i := 0; i <= MaxLocals; i++ {
+		if i < MaxLocals/2 {
+			fmt.Fprintf(&outer, "let %s = %d; ", identifier(i), i)
+		} else {
+			fmt.Fprintf(&middle, "let %s = %d; ", identifier(i), i)
+		}
+		fmt.Fprintf(&inner, "%s; ", identifier(i))
+	}
+	input := fmt.Sprintf("fn() { %s fn() { %s fn() { %s } } }", outer.String(), middle.String(), inner.String())
+
+	err := New().Compile(parse(input))
+	if err == nil {
+		t.Fatalf("expected compile error but got none")
+	}
+	if err.Error() != "too many free variables" {
+		t.Fatalf("compile error wrong. want=%q, got=%q", "too many free variables", err)
+	}
+}
+
+// identifier returns a distinct identifier for i. Identifiers can't contain digits,
+// so i is spelled in letters behind a prefix that keeps clear of the keywords.
+func identifier(i int) string {
+	name := ""
+	for {
+		name = string(rune('a'+i%26)) + name
+		i = i/26 - 1
+		if i < 0 {
+			return "v" + name
+		}
+	}
+}
+
+// registerProbe registers the builtin TestConcurrentCompilation registers only once,
+// since builtins can't be registered twice and the test may run more than once
+var registerProbe sync.Once
+
+// TestConcurrentCompilation is meant to be run with -race
+func TestConcurrentCompilation(t *testing.T) {
+	expected := concatInstructions([]code.Instructions{
+		code.Make(code.OpGetBuiltin, 0),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpArray, 1),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := New()
+			if err := c.Compile(parse("len([2])")); err != nil {
+				errs <- err
+				return
+			}
+			if got := c.ByteCode().Instructions; got.String() != expected.String() {
+				errs <- fmt.Errorf("wrong instructions.\nwant=%q\ngot=%q", expected, got)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		registerProbe.Do(func() {
+			probe := &object.Builtin{Fn: func(host object.Host, args ...object.Object) object.Object { return nil }}
+			if _, err := object.RegisterBuiltin("probe", probe); err != nil {
+				errs <- err
+			}
+		})
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if err := New().Compile(parse("probe()")); err != nil {
+		t.Errorf("registered builtin not resolved: %s", err)
+	}
+}
+
+func TestKeepResult(t *testing.T) {
+	tests := []struct {
+		keep     bool
+		input    string
+		expected []code.Instructions
+	}{
+		{false, "1 + 2", []code.Instructions{
+			code.Make(code.OpOne),
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpAdd),
+			code.Make(code.OpPop),
+		}},
+		{true, "1 + 2", []code.Instructions{
+			code.Make(code.OpOne),
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpAdd),
+		}},
+		{true, "1; 2", []code.Instructions{
+			code.Make(code.OpOne),
+			code.Make(code.OpPop),
+			code.Make(code.OpConstant, 0),
+		}},
+		{true, "let a = 2;", []code.Instructions{
+			code.Make(code.OpConstant, 0),
+			code.Make(code.OpSetGlobal, 0),
+		}},
+	}
+
+	for _, tt := range tests {
+		c := New()
+		c.SetKeepResult(tt.keep)
+		if err := c.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		expected := concatInstructions(tt.expected)
+		if got := c.ByteCode().Instructions; got.String() != expected.String() {
+			t.Errorf("keep=%t, input=%q: wrong instructions.\nwant=%q\ngot=%q", tt.keep, tt.input, expected, got)
+		}
+	}
+}
+
+func TestFunctionMetadata(t *testing.T) {
+	input := `let add = fn(a, b) {
+	let sum = a + b;
+	sum
+};
+let twice = |x|
+	x * 2;
+fn() { 1 }`
+	tests := []struct {
+		name          string
+		numParameters int
+		numLocals     int
+		startLine     int
+		endLine       int
+	}{
+		{"add", 2, 3, 1, 4},
+		{"twice", 1, 1, 5, 6},
+		{"", 0, 0, 7, 7},
+	}
+
+	c := New()
+	if err := c.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var fns []*object.CompiledFunction
+	for _, constant := range c.ByteCode().Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			fns = append(fns, fn)
+		}
+	}
+	if len(fns) != len(tests) {
+		t.Fatalf("wrong number of compiled functions. want=%d, got=%d", len(tests), len(fns))
+	}
+
+	for i, tt := range tests {
+		fn := fns[i]
+		if fn.Name != tt.name {
+			t.Errorf("function %d: wrong name. want=%q, got=%q", i, tt.name, fn.Name)
+		}
+		if fn.NumParameters != tt.numParameters {
+			t.Errorf("function %d: wrong number of parameters. want=%d, got=%d", i, tt.numParameters, fn.NumParameters)
+		}
+		if fn.NumLocals != tt.numLocals {
+			t.Errorf("function %d: wrong number of locals. want=%d, got=%d", i, tt.numLocals, fn.NumLocals)
+		}
+		if fn.StartLine != tt.startLine || fn.EndLine != tt.endLine {
+			t.Errorf("function %d: wrong span. want=%d-%d, got=%d-%d", i, tt.startLine, tt.endLine, fn.StartLine, fn.EndLine)
+		}
+	}
+}
+
+func TestDecompile(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input: `let x = 5; if (x > 3) { puts("big\n"); x * 2 } else { 0 }`,
+			expected: `let g_a = 5;
+if (g_a > 3) {
+	puts("big\n");
+	(g_a * 2)
+} else {
+	0
+};
+`,
+		},
+		{
+			input: "if (true) { 1 }; 2",
+			expected: `if (true) {
+	1
+};
+2;
+`,
+		},
+		{
+			input: "let fact = fn(n) { if (n < 2) { return 1; } n * fact(n - 1) }; fact(5)",
+			expected: `let fact = fn(l_a) {
+	if (l_a < 2) {
+		return 1;
+	};
+	(l_a * fact((l_a - 1)))
+};
+fact(5);
+`,
+		},
+		{
+			input: "let adder = fn(x) { fn(y) { let sum = x + y; sum } }; adder(1)(2)",
+			expected: `let adder = fn(l_a) {
+	fn(ll_a) {
+		let ll_b = (l_a + ll_a);
+		ll_b
+	}
+};
+adder(1)(2);
+`,
+		},
+		{
+			input: "let f = fn(x) { try { 10 / x } catch (e) { -1 } }; try { f(0) } catch (e) { e }",
+			expected: `let f = fn(l_a) {
+	try {
+		(10 / l_a)
+	} catch (l_b) {
+		-1
+	}
+};
+try {
+	f(0)
+} catch (g_b) {
+	g_b
+};
+`,
+		},
+		{
+			input: `let a = [1, 2]; let h = {"k": a[0]}; let x, y = a; a[1] = -x; h?.["k"] ?? len(...[a])`,
+			expected: `let g_a = [1, 2];
+let g_b = {"k": (g_a[0])};
+let g_c, g_d = g_a;
+g_a[1] = (-g_c);
+((g_b?.["k"]) ?? len(...[g_a]));
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		c := New()
+		if err := c.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		decompiled := Decompile(c.ByteCode())
+		if decompiled != tt.expected {
+			t.Errorf("wrong decompilation of %q.\nwant=\n%s\ngot=\n%s", tt.input, tt.expected, decompiled)
+			continue
+		}
+
+		// the decompiled source compiles to the same program
+		c = New()
+		if err := c.Compile(parse(decompiled)); err != nil {
+			t.Fatalf("compiler error for decompiled %q: %s", tt.input, err)
+		}
+		if again := Decompile(c.ByteCode()); again != decompiled {
+			t.Errorf("decompiled %q doesn't compile to the same program.\nwant=\n%s\ngot=\n%s", tt.input, decompiled, again)
+		}
+	}
+}
+
+func TestDecompileUnrecognized(t *testing.T) {
+	byteCode := &ByteCode{
+		Instructions: concatInstructions([]code.Instructions{
+			code.Make(code.OpTrue),
+			code.Make(code.OpJump, 0),
+		}),
+	}
+
+	expected := "// 0001: unexpected OpJump\ntrue\n"
+	if decompiled := Decompile(byteCode); decompiled != expected {
+		t.Errorf("wrong decompilation.\nwant=%q\ngot=%q", expected, decompiled)
+	}
+}
+
+func TestCompileReader(t *testing.T) {
+	input := "let add = fn(a, b) { a + b }; add(1, 2)"
+
+	byteCode, err := CompileReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+
+	compiler := New()
+	if err := compiler.Compile(parse(input)); err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+	want := compiler.ByteCode()
+	if byteCode.Instructions.String() != want.Instructions.String() {
+		t.Fatalf("instructions differ.\nreader=%s\nprogram=%s", byteCode.Instructions, want.Instructions)
+	}
+	if len(byteCode.Constants) != len(want.Constants) {
+		t.Fatalf("number of constants differs. reader=%d, program=%d", len(byteCode.Constants), len(want.Constants))
+	}
+
+	for input, want := range map[string]string{
+		"let = 1; let x 2;": "line 1: expected next token to be IDENT, got = instead\n" +
+			"line 1: no prefix parse function for = found\n" +
+			"line 1: expected next token to be =, got INT instead",
+		"x + 1": "undefined variable: x",
+	} {
+		_, err := CompileReader(strings.NewReader(input))
+		if err == nil || err.Error() != want {
+			t.Errorf("error for %q wrong. want=%q, got=%v", input, want, err)
+		}
+	}
+
+	_, err = CompileReader(strings.NewReader("let x 1; let y 2;"))
+	var parseErrors parser.ErrorList
+	if !errors.As(err, &parseErrors) || len(parseErrors) != 2 {
+		t.Errorf("parser errors wrong. want an ErrorList of 2, got=%#v", err)
+	}
+
+	readErr := errors.New("connection reset")
+	if _, err := CompileReader(iotest.ErrReader(readErr)); err != readErr {
+		t.Errorf("read error wrong. want=%v, got=%v", readErr, err)
+	}
+}
+
+func runCompilerTests(t *testing.T, testCases []compilerTestCase) {
+	t.Helper()
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			program := parse(tc.input)
+
+			compiler := New()
+			err := compiler.Compile(program)
+			if err != nil {
+				t.Fatalf("compile error: %s", err.Error())
+			}
+
+			byteCode := compiler.ByteCode()
+
+			expectedInstructions := concatInstructions(tc.expectedInstructions)
+			if len(byteCode.Instructions) != len(expectedInstructions) {
+				t.Fatalf("instruction wrong.\nwant=%s\ngot=%s", expectedInstructions, byteCode.Instructions)
+			}
+			for i, b := range byteCode.Instructions {
+				if b != expectedInstructions[i] {
+					t.Fatalf("instruction wrong\nwant=%s\ngot=%s", expectedInstructions, byteCode.Instructions)
+					break
+				}
+			}
+
+			if len(byteCode.Constants) != len(tc.expectedConstants) {
+				t.Fatalf("constants wrong. want=%+v, got=%+v", tc.expectedConstants, byteCode.Constants)
+			}
 			for i, c := range tc.expectedConstants {
 				switch c := c.(type) {
 				case int:
 					testIntegerObject(t, int64(c), byteCode.Constants[i])
+				case string:
+					testStringObject(t, c, byteCode.Constants[i])
+				case []code.Instructions:
+					testCompiledFunction(t, c, byteCode.Constants[i])
 				}
 			}
+
+			testJumpTargets(t, byteCode)
 		})
 	}
 }
 
+// testJumpTargets checks that every jump of the top-level instructions and of the compiled
+// functions among the constants lands on the start of an instruction or on the end
+func testJumpTargets(t *testing.T, byteCode *ByteCode) {
+	t.Helper()
+
+	check := func(name string, ins code.Instructions) {
+		starts := make(map[int]bool)
+		var jumps []int
+		for offset := 0; offset < len(ins); {
+			def, err := code.Lookup(ins[offset])
+			if err != nil {
+				t.Fatalf("%s: %04d: %s", name, offset, err)
+			}
+			operands, read := code.ReadOperands(def, ins[offset+1:])
+			switch code.Opcode(ins[offset]) {
+			case code.OpJump, code.OpJumpNotTruthy, code.OpJumpNotNull:
+				jumps = append(jumps, offset, operands[0])
+			}
+			starts[offset] = true
+			offset += 1 + read
+		}
+		for i := 0; i < len(jumps); i += 2 {
+			if target := jumps[i+1]; target != len(ins) && !starts[target] {
+				t.Fatalf("%s: %04d: jump target %d is not the start of an instruction\n%s", name, jumps[i], target, ins)
+			}
+		}
+	}
+
+	check("main", byteCode.Instructions)
+	for i, c := range byteCode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			check(fmt.Sprintf("constant %d", i), fn.Instructions)
+		}
+	}
+}
+
 func parse(input string) *ast.Program {
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -288,3 +2110,72 @@ func testIntegerObject(t *testing.T, expected int64, actual object.Object) {
 		t.Fatalf("integer valud wrong. want=%d, got=%d", expected, actualInteger.Value)
 	}
 }
+
+func testStringObject(t *testing.T, expected string, actual object.Object) {
+	t.Helper()
+
+	actualString, ok := actual.(*object.String)
+	if !ok {
+		t.Fatalf("could not convert to String: %+v", actual)
+	}
+
+	if actualString.Value != expected {
+		t.Fatalf("String value wrong. want=%q, got=%q", expected, actualString.Value)
+	}
+}
+
+func testCompiledFunction(t *testing.T, expected []code.Instructions, actual object.Object) {
+	t.Helper()
+
+	fn, ok := actual.(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("could not convert to CompiledFunction: %+v", actual)
+	}
+
+	expectedInstructions := concatInstructions(expected)
+	if fn.Instructions.String() != expectedInstructions.String() {
+		t.Fatalf("function instructions wrong.\nwant=%s\ngot=%s", expectedInstructions, fn.Instructions)
+	}
+}
+
+func TestModule(t *testing.T) {
+	parts := []string{
+		"let a = 1;",
+		"let f = fn(x) { if (x > a) { x } else { a } };",
+		"f(5) + a",
+	}
+
+	together := New()
+	if err := together.Compile(parse(strings.Join(parts, "\n"))); err != nil {
+		t.Fatalf("compile error: %s", err)
+	}
+
+	module := NewModule()
+	for _, part := range parts {
+		if err := module.Add(parse(part)); err != nil {
+			t.Fatalf("compile error in %q: %s", part, err)
+		}
+		// a failing part changes nothing
+		if err := module.Add(parse("let b = 2; b + c")); err == nil {
+			t.Fatalf("expected an error for an undefined variable")
+		}
+	}
+
+	want, got := together.ByteCode(), module.ByteCode()
+	if want.Instructions.String() != got.Instructions.String() {
+		t.Errorf("instructions wrong.\nwant=%s\ngot=%s", want.Instructions, got.Instructions)
+	}
+	if len(want.Constants) != len(got.Constants) {
+		t.Fatalf("constants wrong. want=%+v, got=%+v", want.Constants, got.Constants)
+	}
+	for i, constant := range want.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			gotFn, ok := got.Constants[i].(*object.CompiledFunction)
+			if !ok || fn.Instructions.String() != gotFn.Instructions.String() {
+				t.Errorf("constant %d wrong. want=%s, got=%s", i, fn.Instructions, got.Constants[i].Inspect())
+			}
+		} else if constant.Inspect() != got.Constants[i].Inspect() {
+			t.Errorf("constant %d wrong. want=%s, got=%s", i, constant.Inspect(), got.Constants[i].Inspect())
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey-compiler/code"
+	"monkey-compiler/object"
+	"strings"
+)
+
+// Decompile returns Monkey source reconstructed from byteCode, for reading what compiled code
+// does. It is best-effort and only knows the shapes of code the compiler emits: conditionals,
+// ?? and optional access come back as such, but the names of variables are lost. Globals are
+// g_a, g_b, ... and the locals of a function l_a, l_b, ..., with ll_a, ... for functions nested
+// in it and so on, its parameters being its first locals. Variables bound to named functions
+// get their name back. A block expression comes back as its statements, and a comparison chain of two
+// comparisons as the conditional it compiles to; longer chains aren't recognized.
+//
+// Instructions it can't make sense of end their block with a comment saying so.
+func Decompile(byteCode *ByteCode) string {
+	d := &decompiler{constants: byteCode.Constants, globals: make(map[int]string)}
+	stmts, stack := d.decompile(byteCode.Instructions, 0, len(byteCode.Instructions), &decompiledFunction{})
+
+	var out strings.Builder
+	for _, line := range blockLines(stmts, stack) {
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+type decompiler struct {
+	constants []object.Object
+	globals   map[int]string // the names of globals bound to named functions
+}
+
+// decompiledFunction is the function whose instructions are being decompiled
+type decompiledFunction struct {
+	fn     *object.CompiledFunction // nil for the main program
+	depth  int
+	free   []string       // the expressions the function captured
+	locals map[int]string // the names of locals bound to named functions
+}
+
+func (f *decompiledFunction) localName(index int) string {
+	if name, ok := f.locals[index]; ok {
+		return name
+	}
+	return strings.Repeat("l", f.depth) + "_" + letters(index)
+}
+
+// decompiledValue is an expression on the stack of the decompiled instructions
+type decompiledValue struct {
+	text     string
+	fnName   string // the name of the function the expression makes, if any
+	optional bool   // whether the value is guarded by a following ?. index or call
+}
+
+// decompile reconstructs the instructions of f from start to end. It returns the statements
+// they make and the expressions they leave on the stack.
+func (d *decompiler) decompile(ins code.Instructions, start, end int, f *decompiledFunction) ([]string, []decompiledValue) {
+	var stmts []string
+	var stack []decompiledValue
+
+	pop := func() decompiledValue {
+		if len(stack) == 0 {
+			return decompiledValue{text: "?"}
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	popN := func(n int) []string {
+		texts := make([]string, n)
+		for i := n - 1; i >= 0; i-- {
+			texts[i] = pop().text
+		}
+		return texts
+	}
+	push := func(text string) {
+		stack = append(stack, decompiledValue{text: text})
+	}
+	unknown := func(ip int, format string, a ...interface{}) ([]string, []decompiledValue) {
+		stmts = append(stmts, fmt.Sprintf("// %04d: "+format, append([]interface{}{ip}, a...)...))
+		return stmts, stack
+	}
+
+	for ip := start; ip < end; {
+		def, err := code.Lookup(ins[ip])
+		if err != nil {
+			return unknown(ip, "%s", err)
+		}
+		operands, read := code.ReadOperands(def, ins[ip+1:])
+		next := ip + 1 + read
+
+		switch opcode := code.Opcode(ins[ip]); opcode {
+		case code.OpConstant:
+			push(d.constant(operands[0]))
+		case code.OpZero:
+			push("0")
+		case code.OpOne:
+			push("1")
+		case code.OpMinusOne:
+			push("-1")
+		case code.OpTrue:
+			push("true")
+		case code.OpFalse:
+			push("false")
+		case code.OpNull:
+			push("null")
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpEqual, code.OpNotEqual,
+			code.OpGreaterThan, code.OpGreaterThanOrEqual, code.OpLessThan, code.OpLessThanOrEqual:
+			right := pop()
+			left := pop()
+			push("(" + left.text + " " + decompiledOperators[opcode] + " " + right.text + ")")
+		case code.OpMinus:
+			push("(-" + pop().text + ")")
+		case code.OpBang:
+			push("(!" + pop().text + ")")
+		case code.OpThrow:
+			push("throw " + pop().text)
+		case code.OpPop:
+			stmts = append(stmts, statement(pop().text))
+		case code.OpDup:
+			v := pop()
+			stack = append(stack, v, v)
+		case code.OpGetGlobal:
+			push(d.globalName(operands[0]))
+		case code.OpSetGlobal:
+			v := pop()
+			if _, named := d.globals[operands[0]]; !named && v.fnName != "" {
+				d.globals[operands[0]] = v.fnName
+			}
+			stmts = append(stmts, "let "+d.globalName(operands[0])+" = "+statement(v.text))
+		case code.OpGetLocal:
+			push(f.localName(operands[0]))
+		case code.OpSetLocal:
+			v := pop()
+			if _, named := f.locals[operands[0]]; !named && v.fnName != "" {
+				f.locals[operands[0]] = v.fnName
+			}
+			stmts = append(stmts, "let "+f.localName(operands[0])+" = "+statement(v.text))
+		case code.OpGetBuiltin:
+			definitions := object.BuiltinDefinitions()
+			if operands[0] >= len(definitions) {
+				return unknown(ip, "builtin %d is not defined", operands[0])
+			}
+			push(definitions[operands[0]].Name)
+		case code.OpGetFree:
+			if operands[0] >= len(f.free) {
+				return unknown(ip, "free variable %d is not captured", operands[0])
+			}
+			push(f.free[operands[0]])
+		case code.OpCurrentClosure:
+			if f.fn == nil || f.fn.Name == "" {
+				return unknown(ip, "current closure of an anonymous function")
+			}
+			push(f.fn.Name)
+		case code.OpClosure:
+			fn, ok := d.constants[operands[0]].(*object.CompiledFunction)
+			if !ok {
+				return unknown(ip, "closure of constant %d, which is not a function", operands[0])
+			}
+			free := popN(operands[1])
+			stack = append(stack, decompiledValue{text: d.function(fn, f.depth+1, free), fnName: fn.Name})
+		case code.OpArray:
+			push("[" + strings.Join(popN(operands[0]), ", ") + "]")
+		case code.OpHash:
+			texts := popN(operands[0])
+			pairs := make([]string, 0, len(texts)/2)
+			for i := 0; i+1 < len(texts); i += 2 {
+				pairs = append(pairs, texts[i]+": "+texts[i+1])
+			}
+			push("{" + strings.Join(pairs, ", ") + "}")
+		case code.OpIndex:
+			index := pop()
+			left := pop()
+			push("(" + left.text + optionalMark(left) + "[" + index.text + "])")
+		case code.OpSetIndex:
+			value := pop()
+			index := pop()
+			left := pop()
+			stmts = append(stmts, left.text+"["+index.text+"] = "+statement(value.text))
+		case code.OpCall, code.OpSpreadCall:
+			args := popN(operands[0])
+			if opcode == code.OpSpreadCall && len(args) > 0 {
+				args[len(args)-1] = "..." + args[len(args)-1]
+			}
+			callee := pop()
+			push(callee.text + optionalMark(callee) + "(" + strings.Join(args, ", ") + ")")
+		case code.OpUnpack:
+			// the names are stored by the instructions which follow, the last one first
+			value := pop()
+			names := make([]string, operands[0])
+			for i := len(names) - 1; i >= 0; i-- {
+				if next >= end {
+					return unknown(ip, "destructuring without names")
+				}
+				storeDef, err := code.Lookup(ins[next])
+				if err != nil {
+					return unknown(next, "%s", err)
+				}
+				store, storeRead := code.ReadOperands(storeDef, ins[next+1:])
+				switch code.Opcode(ins[next]) {
+				case code.OpSetGlobal:
+					names[i] = d.globalName(store[0])
+				case code.OpSetLocal:
+					names[i] = f.localName(store[0])
+				default:
+					return unknown(ip, "destructuring without names")
+				}
+				next += 1 + storeRead
+			}
+			stmts = append(stmts, "let "+strings.Join(names, ", ")+" = "+statement(value.text))
+		case code.OpReturnValue:
+			v := pop()
+			if f.fn != nil && next == len(ins) {
+				// the implicit return of the value of the last expression
+				stmts = append(stmts, v.text)
+			} else {
+				stmts = append(stmts, "return "+statement(v.text))
+			}
+		case code.OpReturn:
+			if next != len(ins) {
+				stmts = append(stmts, "return null;")
+			}
+		case code.OpJumpNotTruthy:
+			// condition, OpJumpNotTruthy else, consequence, OpJump end, else: alternative, end:
+			target := operands[0]
+			if target-3 < next || target > end || code.Opcode(ins[target-3]) != code.OpJump {
+				return unknown(ip, "conditional jump to %04d", target)
+			}
+			after := int(code.ReadUint16(ins[target-2:]))
+			if after < target || after > end {
+				return unknown(ip, "conditional jump to %04d", target)
+			}
+			condition := pop()
+			consequence := blockLines(d.decompile(ins, next, target-3, f))
+			alternative := blockLines(d.decompile(ins, target, after, f))
+			push(conditional(condition.text, consequence, alternative))
+			next = after
+		case code.OpSetupCatch:
+			// OpSetupCatch handler, body, OpPopCatch, OpJump end, handler: store name, handler, end:
+			target := operands[0]
+			if target-4 < next || target >= end || code.Opcode(ins[target-4]) != code.OpPopCatch ||
+				code.Opcode(ins[target-3]) != code.OpJump {
+				return unknown(ip, "try with handler at %04d", target)
+			}
+			after := int(code.ReadUint16(ins[target-2:]))
+			storeDef, err := code.Lookup(ins[target])
+			if err != nil || after < target || after > end {
+				return unknown(ip, "try with handler at %04d", target)
+			}
+			store, storeRead := code.ReadOperands(storeDef, ins[target+1:])
+			var name string
+			switch code.Opcode(ins[target]) {
+			case code.OpSetGlobal:
+				name = d.globalName(store[0])
+			case code.OpSetLocal:
+				name = f.localName(store[0])
+			default:
+				return unknown(ip, "try with handler at %04d", target)
+			}
+			body := blockLines(d.decompile(ins, next, target-4, f))
+			handler := blockLines(d.decompile(ins, target+1+storeRead, after, f))
+			push("try " + block(body) + " catch (" + name + ") " + block(handler))
+			next = after
+		case code.OpJumpNotNull:
+			target := operands[0]
+			if target < next || target > end {
+				return unknown(ip, "jump to %04d", target)
+			}
+			// left, OpJumpNotNull index, OpNull, OpJump end, index: the index or call, end:
+			if next+4 == target && code.Opcode(ins[next]) == code.OpNull && code.Opcode(ins[next+1]) == code.OpJump {
+				if len(stack) > 0 {
+					stack[len(stack)-1].optional = true
+				}
+				next = target
+				break
+			}
+			// left, OpJumpNotNull end, right, end:
+			left := pop()
+			rightStmts, rightStack := d.decompile(ins, next, target, f)
+			if len(rightStmts) != 0 || len(rightStack) != 1 {
+				return unknown(ip, "jump to %04d", target)
+			}
+			push("(" + left.text + " ?? " + rightStack[0].text + ")")
+			next = target
+		default:
+			return unknown(ip, "unexpected %s", def.Name)
+		}
+
+		ip = next
+	}
+
+	return stmts, stack
+}
+
+// function reconstructs a function literal nested depth functions deep, which captured free
+func (d *decompiler) function(fn *object.CompiledFunction, depth int, free []string) string {
+	f := &decompiledFunction{fn: fn, depth: depth, free: free, locals: make(map[int]string)}
+
+	params := make([]string, fn.NumParameters)
+	for i := range params {
+		params[i] = f.localName(i)
+	}
+	lines := blockLines(d.decompile(fn.Instructions, 0, len(fn.Instructions), f))
+
+	return "fn(" + strings.Join(params, ", ") + ") " + block(lines)
+}
+
+func (d *decompiler) globalName(index int) string {
+	if name, ok := d.globals[index]; ok {
+		return name
+	}
+	return "g_" + letters(index)
+}
+
+// letters spells index with letters, as identifiers can't have digits: a, ..., z, aa, ab, ...
+func letters(index int) string {
+	var spelled []byte
+	for index++; index > 0; index = (index - 1) / 26 {
+		spelled = append([]byte{byte('a' + (index-1)%26)}, spelled...)
+	}
+	return string(spelled)
+}
+
+func (d *decompiler) constant(index int) string {
+	if str, ok := d.constants[index].(*object.String); ok {
+		return quote(str.Value)
+	}
+	return d.constants[index].Inspect()
+}
+
+var decompiledOperators = map[code.Opcode]string{
+	code.OpAdd:                "+",
+	code.OpSub:                "-",
+	code.OpMul:                "*",
+	code.OpDiv:                "/",
+	code.OpEqual:              "==",
+	code.OpNotEqual:           "!=",
+	code.OpGreaterThan:        ">",
+	code.OpGreaterThanOrEqual: ">=",
+	code.OpLessThan:           "<",
+	code.OpLessThanOrEqual:    "<=",
+}
+
+func optionalMark(v decompiledValue) string {
+	if v.optional {
+		return "?."
+	}
+	return ""
+}
+
+// blockLines are the lines of a block made of stmts, ending with the expressions left on the stack
+func blockLines(stmts []string, stack []decompiledValue) []string {
+	lines := stmts
+	for _, v := range stack {
+		lines = append(lines, v.text)
+	}
+	return lines
+}
+
+// statement ends the expression text as a statement. A conditional needs the semicolon too,
+// as a following line starting with ( would otherwise call it.
+func statement(text string) string {
+	return text + ";"
+}
+
+func conditional(condition string, consequence, alternative []string) string {
+	if !parenthesized(condition) {
+		condition = "(" + condition + ")"
+	}
+	text := "if " + condition + " " + block(consequence)
+	if len(alternative) == 1 && alternative[0] == "null" {
+		// the value of an if without else
+		return text
+	}
+	return text + " else " + block(alternative)
+}
+
+// parenthesized reports whether the expression text is entirely between parentheses
+func parenthesized(text string) bool {
+	depth := 0
+	inString := false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 && i != len(text)-1 {
+				return false
+			}
+		}
+	}
+	return strings.HasPrefix(text, "(") && depth == 0
+}
+
+// block puts lines between braces, indented
+func block(lines []string) string {
+	if len(lines) == 0 {
+		return "{}"
+	}
+
+	var out strings.Builder
+	out.WriteString("{\n")
+	for _, line := range lines {
+		for _, l := range strings.Split(line, "\n") {
+			out.WriteString("\t" + l + "\n")
+		}
+	}
+	out.WriteString("}")
+	return out.String()
+}
+
+// quote returns s as a string literal, escaped the way the parser unescapes it
+func quote(s string) string {
+	var out strings.Builder
+	out.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\n':
+			out.WriteString(`\n`)
+		case c == '\t':
+			out.WriteString(`\t`)
+		case c == '\r':
+			out.WriteString(`\r`)
+		case c == '\\' || c == '"':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&out, `\x%02x`, c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
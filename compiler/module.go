@@ -0,0 +1,60 @@
+package compiler
+
+import (
+	"monkey-compiler/ast"
+	"monkey-compiler/code"
+	"monkey-compiler/object"
+)
+
+// Module compiles a program given in several parts, like the inputs of a REPL, into a single
+// ByteCode. Each part can use the names defined by the earlier ones, and the ByteCode of the
+// module is the same as that of the parts compiled together as one program.
+type Module struct {
+	instructions code.Instructions
+	constants    []object.Object
+	symbolTable  *SymbolTable
+	warnings     []string
+}
+
+// NewModule returns an empty module
+func NewModule() *Module {
+	c := New()
+	return &Module{
+		instructions: code.Instructions{},
+		constants:    c.constants,
+		symbolTable:  c.symbolTable,
+	}
+}
+
+// Add compiles program as the next part of the module. A part which fails to compile
+// leaves the module as it was, so that a corrected version can be added instead.
+func (m *Module) Add(program *ast.Program) error {
+	// the part is compiled after a copy of the module's instructions so that its jumps
+	// point into the module's instructions
+	symbolTable := m.symbolTable.Clone()
+	c := NewWithState(symbolTable, append([]object.Object{}, m.constants...))
+	c.scopes[0].instructions = append(code.Instructions{}, m.instructions...)
+
+	if err := c.Compile(program); err != nil {
+		return err
+	}
+
+	m.instructions = c.currentInstructions()
+	m.constants = c.constants
+	m.symbolTable = symbolTable
+	m.warnings = append(m.warnings, c.warnings...)
+	return nil
+}
+
+// ByteCode returns the byte code of the parts added so far
+func (m *Module) ByteCode() *ByteCode {
+	return &ByteCode{
+		Instructions: m.instructions,
+		Constants:    m.constants,
+	}
+}
+
+// Warnings returns the warnings of the parts added so far
+func (m *Module) Warnings() []string {
+	return m.warnings
+}
@@ -0,0 +1,125 @@
+package compiler
+
+import (
+	"monkey-compiler/ast"
+	"monkey-compiler/code"
+	"monkey-compiler/object"
+)
+
+// OptimizationLevel is how far Compile rewrites a program to make it run faster.
+// At every level the program gives the same results and errors as without optimization.
+type OptimizationLevel int
+
+const (
+	// NoOptimization compiles the program as written. It is the default.
+	NoOptimization OptimizationLevel = iota
+	// FoldConstants computes integer arithmetic on literals at compile time, so that
+	// 60 * 60 * 24 is a single constant and x * 1 + 0 costs nothing when x is a literal.
+	//
+	// + 0 and * 1 aren't dropped when the other operand is not known at compile time:
+	// "a" + 0 is an error that dropping + 0 would turn into "a".
+	// Division by zero is left for the VM to report when the program runs, and so is
+	// arithmetic overflowing int64, which the VM promotes to a big integer.
+	FoldConstants
+)
+
+// SetOptimizationLevel sets the optimizations applied by the following calls of Compile
+func (c *Compiler) SetOptimizationLevel(level OptimizationLevel) {
+	c.optimization = level
+}
+
+// EvalConst returns the value of node if it is integer arithmetic on literals, like 60 * 60 * 24,
+// and reports whether it is. It computes the value the compiler folds node into at the
+// FoldConstants level, which is the value the VM would compute. Arithmetic whose result doesn't
+// fit in int64, which the VM turns into a big integer, isn't folded, nor is division by zero, so
+// that it is left for the VM to report. An expression statement has the value of its expression.
+func EvalConst(node ast.Node) (object.Object, bool) {
+	if stmt, ok := node.(*ast.ExpressionStatement); ok {
+		node = stmt.Expression
+	}
+	expr, ok := node.(ast.Expression)
+	if !ok {
+		return nil, false
+	}
+
+	value, ok := evalConstInteger(expr)
+	if !ok {
+		return nil, false
+	}
+	return &object.Integer{Value: value}, true
+}
+
+// fold returns the value of node if the optimization level allows folding it into a constant
+func (c *Compiler) fold(node ast.Expression) (int64, bool) {
+	if c.optimization < FoldConstants {
+		return 0, false
+	}
+	return evalConstInteger(node)
+}
+
+// evalConstInteger returns the value of node if it is integer arithmetic on literals that
+// can be computed at compile time and fits in int64.
+func evalConstInteger(node ast.Expression) (int64, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return node.Value, node.Big == nil
+	case *ast.PrefixExpression:
+		if node.Operator != "-" {
+			return 0, false
+		}
+		right, ok := evalConstInteger(node.Right)
+		if !ok {
+			return 0, false
+		}
+		return integerValue(object.NegateInteger(right))
+	case *ast.InfixExpression:
+		left, ok := evalConstInteger(node.Left)
+		if !ok {
+			return 0, false
+		}
+		right, ok := evalConstInteger(node.Right)
+		if !ok {
+			return 0, false
+		}
+
+		switch node.Operator {
+		case "+":
+			return integerValue(object.AddIntegers(left, right))
+		case "-":
+			return integerValue(object.SubtractIntegers(left, right))
+		case "*":
+			return integerValue(object.MultiplyIntegers(left, right))
+		case "/":
+			if right == 0 {
+				return 0, false
+			}
+			return integerValue(object.DivideIntegers(left, right))
+		}
+	}
+
+	return 0, false
+}
+
+// integerValue returns the value of result if it is an Integer rather than a big integer
+func integerValue(result object.Object) (int64, bool) {
+	integer, ok := result.(*object.Integer)
+	if !ok {
+		return 0, false
+	}
+	return integer.Value, true
+}
+
+// compileFolded emits node as a single constant if it can be folded, and reports whether it was
+func (c *Compiler) compileFolded(node ast.Expression) bool {
+	value, ok := c.fold(node)
+	if !ok {
+		return false
+	}
+
+	if opcode, ok := smallIntegerOpcodes[value]; ok {
+		c.emit(opcode)
+		return true
+	}
+	c.emit(code.OpConstant, c.addConstant(&object.Integer{Value: value}))
+	return true
+}
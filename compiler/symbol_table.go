@@ -1,34 +1,176 @@
 package compiler
 
+import (
+	"errors"
+	"math"
+)
+
 type SymbolScope string
 
 const (
-	GlobalScope SymbolScope = "GLOBAL"
+	GlobalScope   SymbolScope = "GLOBAL"
+	LocalScope    SymbolScope = "LOCAL"
+	BuiltinScope  SymbolScope = "BUILTIN"
+	FreeScope     SymbolScope = "FREE"
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
+// MaxGlobals is the number of globals addressable by the uint16 operand of OpGetGlobal and OpSetGlobal
+const MaxGlobals = math.MaxUint16 + 1
+
+// MaxLocals is the number of locals addressable by the uint8 operand of OpGetLocal and OpSetLocal,
+// and likewise the number of free variables addressable by OpGetFree
+const MaxLocals = math.MaxUint8 + 1
+
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	Type  string // the type the name is annotated with, if any
 }
 
 type SymbolTable struct {
+	Outer *SymbolTable
+
 	store          map[string]Symbol
 	numDefinitions int
+
+	// FreeSymbols are the symbols of enclosing scopes referenced from this one, in capture order
+	FreeSymbols []Symbol
+
+	// block is set for the table of a block expression, whose names are stored with those of
+	// the enclosing function or the globals but can only be resolved inside the block
+	block bool
 }
 
 func NewSymbolTable() *SymbolTable {
-	return &SymbolTable{store: make(map[string]Symbol), numDefinitions: 0}
+	return &SymbolTable{store: make(map[string]Symbol), numDefinitions: 0, FreeSymbols: []Symbol{}}
 }
 
-func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Scope: GlobalScope, Index: s.numDefinitions}
+// NewEnclosedSymbolTable returns symbol table for a function body nested in outer
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewSymbolTable()
+	s.Outer = outer
+	return s
+}
+
+// NewBlockSymbolTable returns symbol table for a block expression nested in outer
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	return s
+}
+
+// Define defines name in the scope of the table.
+// It returns an error when the scope has no index left for a new symbol.
+func (s *SymbolTable) Define(name string) (Symbol, error) {
+	return s.defineTyped(name, "")
+}
+
+// defineTyped defines name in the scope of the table, annotated with typ.
+// A global defined again in the same table keeps its index, so that the functions using it,
+// like those defined by earlier inputs of the REPL, see the new value.
+func (s *SymbolTable) defineTyped(name, typ string) (Symbol, error) {
+	symbol, ok := s.store[name]
+	if !ok || symbol.Scope != GlobalScope {
+		var err error
+		if symbol, err = s.allocate(name); err != nil {
+			return Symbol{}, err
+		}
+	}
+	symbol.Type = typ
+
 	s.store[name] = symbol
+	return symbol, nil
+}
+
+// allocate returns a symbol for name with the next free index of the scope, without defining it
+func (s *SymbolTable) allocate(name string) (Symbol, error) {
+	if s.block {
+		return s.Outer.allocate(name)
+	}
+
+	symbol := Symbol{Name: name, Index: s.numDefinitions}
+	if s.Outer == nil {
+		if s.numDefinitions >= MaxGlobals {
+			return Symbol{}, errors.New("too many global variables")
+		}
+		symbol.Scope = GlobalScope
+	} else {
+		if s.numDefinitions >= MaxLocals {
+			return Symbol{}, errors.New("too many local variables")
+		}
+		symbol.Scope = LocalScope
+	}
+
 	s.numDefinitions++
+	return symbol, nil
+}
+
+// Clone returns a copy of the table which can be defined into without affecting the original.
+// The outer tables are shared.
+func (s *SymbolTable) Clone() *SymbolTable {
+	store := make(map[string]Symbol, len(s.store))
+	for name, symbol := range s.store {
+		store[name] = symbol
+	}
+
+	return &SymbolTable{
+		Outer:          s.Outer,
+		store:          store,
+		numDefinitions: s.numDefinitions,
+		FreeSymbols:    append([]Symbol{}, s.FreeSymbols...),
+		block:          s.block,
+	}
+}
+
+func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
+	symbol := Symbol{Name: name, Scope: BuiltinScope, Index: index}
+	s.store[name] = symbol
+	return symbol
+}
+
+// DefineFunctionName defines the name a function literal is bound to, so that its body can refer to itself
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Scope: FunctionScope, Index: 0}
+	s.store[name] = symbol
 	return symbol
 }
 
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Scope: FreeScope, Index: len(s.FreeSymbols) - 1, Type: original.Type}
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+// resolveType returns the type name is annotated with where it is resolved, if any.
+// Unlike Resolve it never makes name a free variable of the table.
+func (s *SymbolTable) resolveType(name string) string {
+	for table := s; table != nil; table = table.Outer {
+		if symbol, ok := table.store[name]; ok {
+			return symbol.Type
+		}
+	}
+	return ""
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	symbol, ok := s.store[name]
-	return symbol, ok
+	if ok || s.Outer == nil {
+		return symbol, ok
+	}
+
+	symbol, ok = s.Outer.Resolve(name)
+	if !ok || s.block {
+		// a block is run in the frame of the enclosing function, so its symbols are the same
+		return symbol, ok
+	}
+
+	if symbol.Scope == GlobalScope || symbol.Scope == BuiltinScope {
+		return symbol, ok
+	}
+
+	return s.defineFree(symbol), true
 }
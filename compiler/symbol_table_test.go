@@ -1,6 +1,9 @@
 package compiler
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestDefine(t *testing.T) {
 	expected := map[string]Symbol{
@@ -10,12 +13,78 @@ func TestDefine(t *testing.T) {
 
 	global := NewSymbolTable()
 
-	a := global.Define("a")
+	a, err := global.Define("a")
+	if err != nil {
+		t.Fatalf("define error: %s", err)
+	}
 	if a != expected["a"] {
 		t.Fatalf("want a=%+v, got a=%+v", expected["a"], a)
 	}
 }
 
+func TestRedefine(t *testing.T) {
+	global := NewSymbolTable()
+	first, _ := global.Define("a")
+	global.Define("b")
+	again, err := global.Define("a")
+	if err != nil {
+		t.Fatalf("define error: %s", err)
+	}
+	if again != first {
+		t.Errorf("redefined global wrong. want=%+v, got=%+v", first, again)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("a")
+	again, _ = local.Define("a")
+	if want := (Symbol{Name: "a", Scope: LocalScope, Index: 1}); again != want {
+		t.Errorf("redefined local wrong. want=%+v, got=%+v", want, again)
+	}
+}
+
+func TestDefineTooManyGlobals(t *testing.T) {
+	global := NewSymbolTable()
+
+	for i := 0; i < MaxGlobals; i++ {
+		if _, err := global.Define(fmt.Sprintf("g%d", i)); err != nil {
+			t.Fatalf("define error at %d: %s", i, err)
+		}
+	}
+
+	_, err := global.Define("overflow")
+	if err == nil {
+		t.Fatalf("expected error but got none")
+	}
+	if err.Error() != "too many global variables" {
+		t.Fatalf("error wrong. want=%q, got=%q", "too many global variables", err)
+	}
+	if _, ok := global.Resolve("overflow"); ok {
+		t.Fatalf("overflowing symbol was defined")
+	}
+}
+
+func TestClone(t *testing.T) {
+	global := NewSymbolTable()
+	if _, err := global.Define("a"); err != nil {
+		t.Fatalf("define error: %s", err)
+	}
+
+	clone := global.Clone()
+	b, err := clone.Define("b")
+	if err != nil {
+		t.Fatalf("define error: %s", err)
+	}
+	if b.Index != 1 {
+		t.Errorf("index of b in clone wrong. want=1, got=%d", b.Index)
+	}
+	if _, ok := clone.Resolve("a"); !ok {
+		t.Errorf("a not resolvable in clone")
+	}
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("b defined in clone is resolvable in original")
+	}
+}
+
 func TestResolveGlobal(t *testing.T) {
 	global := NewSymbolTable()
 	global.Define("a")
@@ -36,3 +105,93 @@ func TestResolveGlobal(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveLocal(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("b")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "b", Scope: LocalScope, Index: 0},
+	}
+
+	for _, expSym := range expected {
+		actual, ok := local.Resolve(expSym.Name)
+		if !ok {
+			t.Fatalf("name '%s' could not be resolved", expSym.Name)
+		}
+		if actual != expSym {
+			t.Fatalf("resolved '%s' wrong. want=%+v, got=%+v", expSym.Name, expSym, actual)
+		}
+	}
+}
+
+func TestResolveFree(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+
+	first := NewEnclosedSymbolTable(global)
+	first.Define("a")
+
+	second := NewEnclosedSymbolTable(first)
+	second.Define("b")
+
+	expected := []Symbol{
+		{Name: "len", Scope: BuiltinScope, Index: 0},
+		{Name: "a", Scope: FreeScope, Index: 0},
+		{Name: "b", Scope: LocalScope, Index: 0},
+	}
+
+	for _, expSym := range expected {
+		actual, ok := second.Resolve(expSym.Name)
+		if !ok {
+			t.Fatalf("name '%s' could not be resolved", expSym.Name)
+		}
+		if actual != expSym {
+			t.Fatalf("resolved '%s' wrong. want=%+v, got=%+v", expSym.Name, expSym, actual)
+		}
+	}
+
+	if len(second.FreeSymbols) != 1 || second.FreeSymbols[0] != (Symbol{Name: "a", Scope: LocalScope, Index: 0}) {
+		t.Fatalf("free symbols wrong. got=%+v", second.FreeSymbols)
+	}
+}
+
+func TestResolveBlock(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("b")
+
+	block := NewBlockSymbolTable(local)
+	block.Define("c")
+	local.Define("d")
+
+	expected := []Symbol{
+		{Name: "a", Scope: GlobalScope, Index: 0},
+		{Name: "b", Scope: LocalScope, Index: 0},
+		{Name: "c", Scope: LocalScope, Index: 1},
+		{Name: "d", Scope: LocalScope, Index: 2},
+	}
+
+	for _, expSym := range expected {
+		actual, ok := block.Resolve(expSym.Name)
+		if !ok {
+			t.Fatalf("name '%s' could not be resolved", expSym.Name)
+		}
+		if actual != expSym {
+			t.Fatalf("resolved '%s' wrong. want=%+v, got=%+v", expSym.Name, expSym, actual)
+		}
+	}
+
+	if _, ok := local.Resolve("c"); ok {
+		t.Fatalf("name 'c' of the block resolved outside of it")
+	}
+	if len(block.FreeSymbols) != 0 {
+		t.Fatalf("free symbols wrong. got=%+v", block.FreeSymbols)
+	}
+}
@@ -0,0 +1,252 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey-compiler/ast"
+)
+
+// typeChecker infers the types of expressions of a program from its literals and annotations,
+// and warns about operations which fail for those types whenever they are evaluated. It is
+// conservative: a type is only known when every value of the expression has it, so programs
+// relying on dynamic typing get no warnings.
+type typeChecker struct {
+	c *Compiler // for the annotated names defined by earlier compilations
+
+	// scopes map the names defined so far to their types, "" when unknown.
+	// The innermost scope is last.
+	scopes []map[string]string
+}
+
+// typeCheck runs the type checker over program, adding its findings to the warnings
+func (c *Compiler) typeCheck(program *ast.Program) {
+	tc := &typeChecker{c: c, scopes: []map[string]string{{}}}
+	for _, stmt := range program.Statements {
+		tc.statement(stmt)
+	}
+}
+
+func (tc *typeChecker) warn(line int, format string, a ...interface{}) {
+	tc.c.warnings = append(tc.c.warnings, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, a...))
+}
+
+func (tc *typeChecker) define(name, typ string) {
+	tc.scopes[len(tc.scopes)-1][name] = typ
+}
+
+func (tc *typeChecker) lookup(name string) string {
+	for i := len(tc.scopes) - 1; i >= 0; i-- {
+		if typ, ok := tc.scopes[i][name]; ok {
+			return typ
+		}
+	}
+	return tc.c.symbolTable.resolveType(name)
+}
+
+func (tc *typeChecker) statements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		tc.statement(stmt)
+	}
+}
+
+func (tc *typeChecker) statement(stmt ast.Statement) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		typ := tc.expression(stmt.Value)
+		if stmt.Names != nil {
+			for _, name := range stmt.Names {
+				tc.define(name.Value, name.Type)
+			}
+			return
+		}
+		if stmt.Name.Type != "" {
+			typ = stmt.Name.Type
+		}
+		tc.define(stmt.Name.Value, typ)
+	case *ast.ExpressionStatement:
+		tc.expression(stmt.Expression)
+	case *ast.ReturnStatement:
+		tc.expression(stmt.ReturnValue)
+	case *ast.IndexAssignStatement:
+		tc.expression(stmt.Target.Left)
+		tc.expression(stmt.Target.Index)
+		tc.expression(stmt.Value)
+	case *ast.DoWhileStatement:
+		tc.scopes = append(tc.scopes, map[string]string{})
+		tc.statements(stmt.Body.Statements)
+		tc.scopes = tc.scopes[:len(tc.scopes)-1]
+		tc.expression(stmt.Condition)
+	}
+}
+
+// branch checks a block which may not run. Its lets define names of the enclosing scope,
+// whose types are unknown after it.
+func (tc *typeChecker) branch(block *ast.BlockStatement) {
+	if block == nil {
+		return
+	}
+
+	tc.scopes = append(tc.scopes, map[string]string{})
+	tc.statements(block.Statements)
+	defined := tc.scopes[len(tc.scopes)-1]
+	tc.scopes = tc.scopes[:len(tc.scopes)-1]
+
+	for name := range defined {
+		tc.define(name, "")
+	}
+}
+
+// expression checks expr and returns its type, "" when it isn't known
+func (tc *typeChecker) expression(expr ast.Expression) string {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean:
+		return tc.c.staticType(expr)
+	case *ast.Identifier:
+		return tc.lookup(expr.Value)
+	case *ast.ArrayLiteral:
+		for _, el := range expr.Elements {
+			tc.expression(el)
+		}
+		return "array"
+	case *ast.HashLiteral:
+		for _, key := range expr.Keys {
+			tc.expression(key)
+			tc.expression(expr.Pairs[key])
+		}
+		return "hash"
+	case *ast.PrefixExpression:
+		right := tc.expression(expr.Right)
+		switch expr.Operator {
+		case "!":
+			return "bool"
+		case "-":
+			if right == "int" || right == "float" {
+				return right
+			}
+			if right != "" {
+				tc.warn(expr.Token.Line, "cannot apply - to %s", right)
+			}
+		}
+	case *ast.InfixExpression:
+		return tc.infix(expr)
+	case *ast.IndexExpression:
+		tc.index(expr)
+	case *ast.CallExpression:
+		callee := tc.expression(expr.Function)
+		for _, arg := range expr.Arguments {
+			tc.expression(arg)
+		}
+		if callee != "" && callee != "fn" {
+			tc.warn(expr.Token.Line, "cannot call %s", callee)
+		}
+		if fn, ok := expr.Function.(*ast.FunctionLiteral); ok && !expr.Optional {
+			return fn.ReturnType
+		}
+	case *ast.SpreadExpression:
+		tc.expression(expr.Value)
+	case *ast.ThrowExpression:
+		tc.expression(expr.Value)
+	case *ast.IfExpression:
+		tc.expression(expr.Condition)
+		tc.branch(expr.Consequence)
+		tc.branch(expr.Alternative)
+	case *ast.BlockExpression:
+		tc.scopes = append(tc.scopes, map[string]string{})
+		tc.statements(expr.Block.Statements)
+		tc.scopes = tc.scopes[:len(tc.scopes)-1]
+	case *ast.TryExpression:
+		tc.scopes = append(tc.scopes, map[string]string{})
+		tc.statements(expr.Body.Statements)
+		if expr.Handler != nil {
+			tc.scopes[len(tc.scopes)-1] = map[string]string{expr.Name.Value: ""}
+			tc.statements(expr.Handler.Statements)
+		}
+		if expr.Finally != nil {
+			tc.scopes[len(tc.scopes)-1] = map[string]string{}
+			tc.statements(expr.Finally.Statements)
+		}
+		tc.scopes = tc.scopes[:len(tc.scopes)-1]
+	case *ast.FunctionLiteral:
+		tc.scopes = append(tc.scopes, map[string]string{})
+		if expr.Name != "" {
+			tc.define(expr.Name, "fn")
+		}
+		for _, p := range expr.Parameters {
+			tc.define(p.Value, p.Type)
+		}
+		tc.statements(expr.Body.Statements)
+		tc.scopes = tc.scopes[:len(tc.scopes)-1]
+		return "fn"
+	}
+	return ""
+}
+
+// infix checks the operation of expr, given the types of its operands.
+// Both the VM and the evaluator only do arithmetic on numbers, which is on floats if either
+// operand is a float, concatenate strings with +, repeat strings and arrays with * and order
+// numbers and arrays, any two values can be compared for equality.
+func (tc *typeChecker) infix(expr *ast.InfixExpression) string {
+	if isOrdering(expr.Operator) {
+		tc.ordering(expr)
+		return "bool"
+	}
+
+	left := tc.expression(expr.Left)
+	right := tc.expression(expr.Right)
+
+	switch expr.Operator {
+	case "+", "-", "*", "/":
+		switch {
+		case left == "int" && right == "int":
+			return "int"
+		case isNumber(left) && isNumber(right):
+			return "float"
+		case left == "string" && right == "string" && expr.Operator == "+":
+			return "string"
+		case (left == "string" || left == "array") && right == "int" && expr.Operator == "*":
+			return left
+		case left != "" && right != "":
+			tc.warn(expr.Token.Line, "cannot apply %s to %s and %s", expr.Operator, left, right)
+		}
+	case "==", "!=":
+		return "bool"
+	}
+	return ""
+}
+
+// ordering checks the ordering comparison expr and returns the type of its right operand.
+// In a chain like a < b < c, the left operand of b < c is b, not a < b.
+func (tc *typeChecker) ordering(expr *ast.InfixExpression) string {
+	var left string
+	if chain, ok := expr.Left.(*ast.InfixExpression); ok && isOrdering(chain.Operator) {
+		left = tc.ordering(chain)
+	} else {
+		left = tc.expression(expr.Left)
+	}
+	right := tc.expression(expr.Right)
+
+	if left != "" && right != "" && !(isNumber(left) && isNumber(right)) && (left != right || left != "array") {
+		tc.warn(expr.Token.Line, "cannot apply %s to %s and %s", expr.Operator, left, right)
+	}
+	return right
+}
+
+// index checks the index expression expr, given the types of its operands.
+// Only arrays are indexed, by integers, and hashes, by values usable as hash keys.
+func (tc *typeChecker) index(expr *ast.IndexExpression) {
+	left := tc.expression(expr.Left)
+	index := tc.expression(expr.Index)
+
+	switch left {
+	case "":
+	case "array":
+		if index != "" && index != "int" {
+			tc.warn(expr.Token.Line, "cannot index array with %s", index)
+		}
+	case "hash":
+		if index == "array" || index == "hash" || index == "fn" {
+			tc.warn(expr.Token.Line, "cannot use %s as hash key", index)
+		}
+	default:
+		tc.warn(expr.Token.Line, "cannot index %s", left)
+	}
+}
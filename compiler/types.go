@@ -0,0 +1,108 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey-compiler/ast"
+)
+
+// annotationTypes are the types a let, a parameter or the result of a function can be annotated with
+var annotationTypes = map[string]bool{
+	"int":    true,
+	"float":  true,
+	"string": true,
+	"bool":   true,
+	"array":  true,
+	"hash":   true,
+	"fn":     true,
+}
+
+// checkTypeName fails if typ, the annotation of what, is not a type
+func checkTypeName(typ, what string) error {
+	if typ != "" && !annotationTypes[typ] {
+		return fmt.Errorf("unknown type %s of %s", typ, what)
+	}
+	return nil
+}
+
+// checkAssignment fails if the value of the let binding name obviously doesn't have
+// the type name is annotated with
+func (c *Compiler) checkAssignment(name *ast.Identifier, value ast.Expression) error {
+	if err := checkTypeName(name.Type, name.Value); err != nil {
+		return err
+	}
+	if typ := c.staticType(value); name.Type != "" && typ != "" && typ != name.Type {
+		return fmt.Errorf("cannot assign %s to %s of type %s", typ, name.Value, name.Type)
+	}
+	return nil
+}
+
+// checkReturn fails if value obviously doesn't have the result type of the function being compiled
+func (c *Compiler) checkReturn(value ast.Expression) error {
+	returnType := c.scopes[c.scopeIndex].returnType
+	if typ := c.staticType(value); returnType != "" && typ != "" && typ != returnType {
+		return fmt.Errorf("cannot return %s from function returning %s", typ, returnType)
+	}
+	return nil
+}
+
+// staticType returns the type expr has whenever it is evaluated without an error, as far as
+// it is known at compile time: the type of a literal, of operations on known types and of
+// names annotated with a type. It returns "" when the type isn't known. Null has any type.
+func (c *Compiler) staticType(expr ast.Expression) string {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral:
+		return "int"
+	case *ast.FloatLiteral:
+		return "float"
+	case *ast.StringLiteral:
+		return "string"
+	case *ast.Boolean:
+		return "bool"
+	case *ast.ArrayLiteral:
+		return "array"
+	case *ast.HashLiteral:
+		return "hash"
+	case *ast.FunctionLiteral:
+		return "fn"
+	case *ast.Identifier:
+		return c.symbolTable.resolveType(expr.Value)
+	case *ast.PrefixExpression:
+		switch expr.Operator {
+		case "!":
+			return "bool"
+		case "-":
+			if right := c.staticType(expr.Right); right == "int" || right == "float" {
+				return right
+			}
+		}
+	case *ast.InfixExpression:
+		switch expr.Operator {
+		case "==", "!=", "<", ">", "<=", ">=":
+			return "bool"
+		case "+", "-", "*", "/":
+			left, right := c.staticType(expr.Left), c.staticType(expr.Right)
+			if (left == "string" || left == "array") && right == "int" && expr.Operator == "*" {
+				return left
+			}
+			if isNumber(left) && isNumber(right) && left != right {
+				return "float"
+			}
+			if left != right {
+				return ""
+			}
+			if isNumber(left) || left == "string" && expr.Operator == "+" {
+				return left
+			}
+		}
+	case *ast.CallExpression:
+		if fn, ok := expr.Function.(*ast.FunctionLiteral); ok && !expr.Optional {
+			return fn.ReturnType
+		}
+	}
+	return ""
+}
+
+// isNumber reports whether typ is a type arithmetic is done on
+func isNumber(typ string) bool {
+	return typ == "int" || typ == "float"
+}
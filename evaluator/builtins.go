@@ -1,117 +1,122 @@
 package evaluator
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"monkey-compiler/object"
+	"os"
+	"sync"
+	"time"
 )
 
 var builtins = map[string]*object.Builtin{
-	"len": {Fn: func(args ...object.Object) object.Object {
-		if len(args) != 1 {
-			return newError("wrong number of arguments. got=%d, want=1",
-				len(args))
-		}
-
-		switch arg := args[0].(type) {
-		case *object.Array:
-			return &object.Integer{Value: int64(len(arg.Elements))}
-		case *object.String:
-			return &object.Integer{Value: int64(len(arg.Value))}
-		default:
-			return newError("argument to `len` not supported, got %s",
-				args[0].Type())
-		}
-	},
-	},
-	"puts": {
-		Fn: func(args ...object.Object) object.Object {
-			for _, arg := range args {
-				fmt.Println(arg.Inspect())
-			}
-
-			return NULL
-		},
-	},
-	"first": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1",
-					len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `first` must be ARRAY, got %s",
-					args[0].Type())
-			}
-
-			arr := args[0].(*object.Array)
-			if len(arr.Elements) > 0 {
-				return arr.Elements[0]
-			}
-
-			return NULL
-		},
-	},
-	"last": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1",
-					len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `last` must be ARRAY, got %s",
-					args[0].Type())
-			}
-
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
-			if length > 0 {
-				return arr.Elements[length-1]
-			}
-
-			return NULL
-		},
-	},
-	"rest": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1",
-					len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `rest` must be ARRAY, got %s",
-					args[0].Type())
-			}
-
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
-			if length > 0 {
-				newElements := make([]object.Object, length-1, length-1)
-				copy(newElements, arr.Elements[1:length])
-				return &object.Array{Elements: newElements}
-			}
-
-			return NULL
-		},
-	},
-	"push": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 2 {
-				return newError("wrong number of arguments. got=%d, want=2",
-					len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `push` must be ARRAY, got %s",
-					args[0].Type())
-			}
-
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
-
-			newElements := make([]object.Object, length+1, length+1)
-			copy(newElements, arr.Elements)
-			newElements[length] = args[1]
-
-			return &object.Array{Elements: newElements}
-		},
-	},
+	"len":             object.GetBuiltinByName("len"),
+	"puts":            object.GetBuiltinByName("puts"),
+	"first":           object.GetBuiltinByName("first"),
+	"last":            object.GetBuiltinByName("last"),
+	"rest":            object.GetBuiltinByName("rest"),
+	"push":            object.GetBuiltinByName("push"),
+	"newArrayBuilder": object.GetBuiltinByName("newArrayBuilder"),
+	"append":          object.GetBuiltinByName("append"),
+	"build":           object.GetBuiltinByName("build"),
+	"zip":             object.GetBuiltinByName("zip"),
+	"reverse":         object.GetBuiltinByName("reverse"),
+	"take":            object.GetBuiltinByName("take"),
+	"drop":            object.GetBuiltinByName("drop"),
+	"flatten":         object.GetBuiltinByName("flatten"),
+	"flattenDeep":     object.GetBuiltinByName("flattenDeep"),
+	"groupBy":         object.GetBuiltinByName("groupBy"),
+	"find":            object.GetBuiltinByName("find"),
+	"findIndex":       object.GetBuiltinByName("findIndex"),
+	"all":             object.GetBuiltinByName("all"),
+	"any":             object.GetBuiltinByName("any"),
+	"keys":            object.GetBuiltinByName("keys"),
+	"values":          object.GetBuiltinByName("values"),
+	"min":             object.GetBuiltinByName("min"),
+	"max":             object.GetBuiltinByName("max"),
+	"abs":             object.GetBuiltinByName("abs"),
+	"clamp":           object.GetBuiltinByName("clamp"),
+	"equals":          object.GetBuiltinByName("equals"),
+	"rand":            object.GetBuiltinByName("rand"),
+	"now":             object.GetBuiltinByName("now"),
+	"exit":            object.GetBuiltinByName("exit"),
+	"assert":          object.GetBuiltinByName("assert"),
+	"partial":         object.GetBuiltinByName("partial"),
+	"memoize":         object.GetBuiltinByName("memoize"),
+	"clone":           object.GetBuiltinByName("clone"),
+	"freeze":          object.GetBuiltinByName("freeze"),
+	"float":           object.GetBuiltinByName("float"),
+	"int":             object.GetBuiltinByName("int"),
+	"newBuilder":      object.GetBuiltinByName("newBuilder"),
+	"toString":        object.GetBuiltinByName("toString"),
+	"ord":             object.GetBuiltinByName("ord"),
+	"chr":             object.GetBuiltinByName("chr"),
+	"substr":          object.GetBuiltinByName("substr"),
+}
+
+// stdoutHost is the host builtins see when called from the evaluator.
+// A new one is made for every call, to record whether the builtin exited.
+type stdoutHost struct {
+	exit *Exit
+}
+
+func (*stdoutHost) Out() io.Writer { return os.Stdout }
+
+// evalRand is the source of rand in the evaluator, which has no state of its own to keep it in.
+// It is shared by every program being evaluated, so its source is locked.
+var evalRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+// lockedSource is a rand.Source safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+func (*stdoutHost) Rand() *rand.Rand { return evalRand }
+
+func (*stdoutHost) Now() time.Time { return time.Now() }
+
+// Exit records the code, the builtin call then results in an *Exit
+func (h *stdoutHost) Exit(code int) { h.exit = &Exit{Code: code} }
+
+// Fail does nothing, the error the builtin returns stops the evaluator already
+func (*stdoutHost) Fail(message string) {}
+
+// EXIT_OBJ is the type of *Exit
+const EXIT_OBJ = "EXIT"
+
+// Exit is what a program that called exit evaluates to. Like an error, it ends the evaluation.
+type Exit struct {
+	Code int
+}
+
+func (e *Exit) Type() object.ObjectType { return EXIT_OBJ }
+func (e *Exit) Inspect() string         { return fmt.Sprintf("exit(%d)", e.Code) }
+
+// Call applies fn for a builtin calling back into the program. An exit in fn is recorded
+// as if the builtin itself had called exit.
+func (h *stdoutHost) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	switch result := applyFunction(fn, args).(type) {
+	case *object.Error:
+		return nil, errors.New(result.Message)
+	case *Exit:
+		h.exit = result
+		return nil, fmt.Errorf("exit status %d", result.Code)
+	default:
+		return result, nil
+	}
 }
@@ -2,14 +2,15 @@ package evaluator
 
 import (
 	"fmt"
+	"math/big"
 	"monkey-compiler/ast"
 	"monkey-compiler/object"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
 func Eval(node ast.Node, env *object.Environment) object.Object {
@@ -32,17 +33,29 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return &object.ReturnValue{Value: val}
 
+	case *ast.IndexAssignStatement:
+		return evalIndexAssignStatement(node, env)
+
 	case *ast.LetStatement:
 		val := Eval(node.Value, env)
 		if isError(val) {
 			return val
 		}
+		if node.Names != nil {
+			return evalDestructuring(node.Names, val, env)
+		}
 		env.Set(node.Name.Value, val)
 
 	// Expressions
 	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			return &object.BigInt{Value: node.Big}
+		}
 		return &object.Integer{Value: node.Value}
 
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
+
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 
@@ -56,11 +69,17 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return evalPrefixExpression(node.Operator, right)
 
+	case *ast.Null:
+		return NULL
+
 	case *ast.InfixExpression:
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
+		if node.Operator == "??" && left != NULL {
+			return left
+		}
 
 		right := Eval(node.Right, env)
 		if isError(right) {
@@ -72,6 +91,32 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
 
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
+
+	case *ast.DoWhileStatement:
+		return evalDoWhileStatement(node, env)
+
+	case *ast.BreakStatement:
+		return &loopSignal{keyword: "break", label: node.Label}
+
+	case *ast.ContinueStatement:
+		return &loopSignal{keyword: "continue", label: node.Label}
+
+	case *ast.ThrowExpression:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return &object.Error{Message: "uncaught throw: " + val.Inspect(), Thrown: val}
+
+	case *ast.BlockExpression:
+		result := evalBlockStatement(node.Block, object.NewEnclosedEnvironment(env))
+		if result == nil {
+			return NULL
+		}
+		return result
+
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
 
@@ -80,13 +125,19 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		body := node.Body
 		return &object.Function{Parameters: params, Env: env, Body: body}
 
+	case *ast.SpreadExpression:
+		return newError("spread is only allowed as the last argument of a call")
+
 	case *ast.CallExpression:
 		function := Eval(node.Function, env)
 		if isError(function) {
 			return function
 		}
+		if node.Optional && function == NULL {
+			return NULL
+		}
 
-		args := evalExpressions(node.Arguments, env)
+		args := evalArguments(node.Arguments, env)
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
@@ -105,6 +156,9 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(left) {
 			return left
 		}
+		if node.Optional && left == NULL {
+			return NULL
+		}
 		index := Eval(node.Index, env)
 		if isError(index) {
 			return index
@@ -130,6 +184,10 @@ func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 			return result.Value
 		case *object.Error:
 			return result
+		case *Exit:
+			return result
+		case *loopSignal:
+			return result.outsideLoop()
 		}
 	}
 
@@ -147,7 +205,7 @@ func evalBlockStatement(
 
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == EXIT_OBJ || rt == loopSignalObj {
 				return result
 			}
 		}
@@ -179,10 +237,27 @@ func evalInfixExpression(
 	left, right object.Object,
 ) object.Object {
 	switch {
+	case operator == "??":
+		// left is null, or it would have been returned without evaluating right
+		return right
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
+	case object.IsBigIntegerOperation(left, right):
+		return evalBigIntegerInfixExpression(operator, left, right)
+	case object.IsFloatOperation(left, right):
+		return evalFloatInfixExpression(operator, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(operator, left, right)
+	case operator == "*" && right.Type() == object.INTEGER_OBJ &&
+		(left.Type() == object.STRING_OBJ || left.Type() == object.ARRAY_OBJ):
+		repeated, err := object.Repeat(left, right.(*object.Integer).Value)
+		if err != nil {
+			return newError("%s", err)
+		}
+		return repeated
+	case left.Type() == object.ARRAY_OBJ && right.Type() == object.ARRAY_OBJ &&
+		operator != "==" && operator != "!=":
+		return evalArrayInfixExpression(operator, left, right)
 	case operator == "==":
 		return nativeBoolToBooleanObject(left == right)
 	case operator == "!=":
@@ -196,6 +271,31 @@ func evalInfixExpression(
 	}
 }
 
+// evalArrayInfixExpression orders two arrays lexicographically, see object.CompareArrays
+func evalArrayInfixExpression(
+	operator string,
+	left, right object.Object,
+) object.Object {
+	cmp, err := object.CompareArrays(left.(*object.Array), right.(*object.Array))
+	if err != nil {
+		return newError("%s", err)
+	}
+
+	switch operator {
+	case "<":
+		return nativeBoolToBooleanObject(cmp < 0)
+	case "<=":
+		return nativeBoolToBooleanObject(cmp <= 0)
+	case ">":
+		return nativeBoolToBooleanObject(cmp > 0)
+	case ">=":
+		return nativeBoolToBooleanObject(cmp >= 0)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
 func evalBangOperatorExpression(right object.Object) object.Object {
 	switch right {
 	case TRUE:
@@ -210,12 +310,16 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return object.NegateInteger(right.Value)
+	case *object.BigInt:
+		return object.NewBigInteger(new(big.Int).Neg(right.Value))
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
-
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
 }
 
 func evalIntegerInfixExpression(
@@ -227,17 +331,24 @@ func evalIntegerInfixExpression(
 
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return object.AddIntegers(leftVal, rightVal)
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return object.SubtractIntegers(leftVal, rightVal)
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return object.MultiplyIntegers(leftVal, rightVal)
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return object.DivideIntegers(leftVal, rightVal)
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -248,18 +359,142 @@ func evalIntegerInfixExpression(
 	}
 }
 
-func evalStringInfixExpression(
+func evalBigIntegerInfixExpression(
+	operator string,
+	left, right object.Object,
+) object.Object {
+	leftVal, _ := object.BigValue(left)
+	rightVal, _ := object.BigValue(right)
+
+	switch operator {
+	case "+":
+		return object.NewBigInteger(leftVal.Add(leftVal, rightVal))
+	case "-":
+		return object.NewBigInteger(leftVal.Sub(leftVal, rightVal))
+	case "*":
+		return object.NewBigInteger(leftVal.Mul(leftVal, rightVal))
+	case "/":
+		if rightVal.Sign() == 0 {
+			return newError("division by zero")
+		}
+		return object.NewBigInteger(leftVal.Quo(leftVal, rightVal))
+	case "<":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) < 0)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) > 0)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) <= 0)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) >= 0)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) == 0)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) != 0)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
+func evalFloatInfixExpression(
 	operator string,
 	left, right object.Object,
 ) object.Object {
-	if operator != "+" {
+	leftVal, _ := object.FloatValue(left)
+	rightVal, _ := object.FloatValue(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return &object.Float{Value: leftVal / rightVal}
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
 		return newError("unknown operator: %s %s %s",
 			left.Type(), operator, right.Type())
 	}
+}
 
+func evalStringInfixExpression(
+	operator string,
+	left, right object.Object,
+) object.Object {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
-	return &object.String{Value: leftVal + rightVal}
+
+	switch operator {
+	case "+":
+		return &object.String{Value: leftVal + rightVal}
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
+func evalDestructuring(
+	names []*ast.Identifier,
+	val object.Object,
+	env *object.Environment,
+) object.Object {
+	array, ok := val.(*object.Array)
+	if !ok {
+		return newError("cannot destructure %s", val.Type())
+	}
+	if len(array.Elements) != len(names) {
+		return newError("cannot destructure ARRAY of length %d into %d names",
+			len(array.Elements), len(names))
+	}
+
+	for i, name := range names {
+		env.Set(name.Value, array.Elements[i])
+	}
+
+	return nil
+}
+
+func evalIndexAssignStatement(
+	node *ast.IndexAssignStatement,
+	env *object.Environment,
+) object.Object {
+	left := Eval(node.Target.Left, env)
+	if isError(left) {
+		return left
+	}
+	index := Eval(node.Target.Index, env)
+	if isError(index) {
+		return index
+	}
+	value := Eval(node.Value, env)
+	if isError(value) {
+		return value
+	}
+
+	if err := object.SetIndex(left, index, value); err != nil {
+		return newError("%s", err)
+	}
+	return nil
 }
 
 func evalIfExpression(
@@ -271,7 +506,7 @@ func evalIfExpression(
 		return condition
 	}
 
-	if isTruthy(condition) {
+	if object.IsTruthy(condition) {
 		return Eval(ie.Consequence, env)
 	} else if ie.Alternative != nil {
 		return Eval(ie.Alternative, env)
@@ -280,6 +515,91 @@ func evalIfExpression(
 	}
 }
 
+// evalTryExpression evaluates the body of te and, if it results in an error, the handler with
+// the error, or the value thrown, bound to the name of te. Both have their own environment, like
+// block expressions. Errors are the objects the evaluator stops on, so unlike in the VM any use
+// of an error other than a thrown value by the handler fails again with it. The finally block
+// is evaluated last whatever the result, which it only replaces if it fails itself.
+func evalTryExpression(
+	te *ast.TryExpression,
+	env *object.Environment,
+) object.Object {
+	result := evalBlockStatement(te.Body, object.NewEnclosedEnvironment(env))
+	if err, ok := result.(*object.Error); ok && te.Handler != nil {
+		// an *Exit is not caught, like in the VM, though the finally block runs for it
+		caught := result
+		if err.Thrown != nil {
+			caught = err.Thrown
+		}
+		handlerEnv := object.NewEnclosedEnvironment(env)
+		handlerEnv.Set(te.Name.Value, caught)
+		result = evalBlockStatement(te.Handler, handlerEnv)
+	}
+	if te.Finally != nil {
+		finally := evalBlockStatement(te.Finally, object.NewEnclosedEnvironment(env))
+		if isError(finally) {
+			return finally
+		}
+	}
+	if result == nil {
+		return NULL
+	}
+	return result
+}
+
+const loopSignalObj = "LOOP_SIGNAL"
+
+// loopSignal is what a break or continue results in. Like a return value, it ends the blocks
+// it is in up to the loop, which tells the two apart by keyword. A labeled one also ends the
+// loops without its label.
+type loopSignal struct {
+	keyword string
+	label   string
+}
+
+func (s *loopSignal) Type() object.ObjectType { return loopSignalObj }
+func (s *loopSignal) Inspect() string         { return s.keyword }
+
+// outsideLoop is the error of a break or continue which left every loop, or was in none
+func (s *loopSignal) outsideLoop() *object.Error {
+	if s.label != "" {
+		return newError("%s outside loop %s", s.keyword, s.label)
+	}
+	return newError("%s outside loop", s.keyword)
+}
+
+// evalDoWhileStatement runs the body of ds with its own environment, then again for as long as
+// the condition is truthy. A break ends the loop, a continue goes on with the condition. Those
+// with the label of another loop end this one and are left to the loops around it.
+func evalDoWhileStatement(
+	ds *ast.DoWhileStatement,
+	env *object.Environment,
+) object.Object {
+	for {
+		result := evalBlockStatement(ds.Body, object.NewEnclosedEnvironment(env))
+		if signal, ok := result.(*loopSignal); ok {
+			if signal.label != "" && signal.label != ds.Label {
+				return signal
+			}
+			if signal.keyword == "break" {
+				return nil
+			}
+		} else if result != nil {
+			if rt := result.Type(); rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ || rt == EXIT_OBJ {
+				return result
+			}
+		}
+
+		condition := Eval(ds.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !object.IsTruthy(condition) {
+			return nil
+		}
+	}
+}
+
 func evalIdentifier(
 	node *ast.Identifier,
 	env *object.Environment,
@@ -291,34 +611,57 @@ func evalIdentifier(
 	if builtin, ok := builtins[node.Value]; ok {
 		return builtin
 	}
-
-	return newError("identifier not found: " + node.Value)
-}
-
-func isTruthy(obj object.Object) bool {
-	switch obj {
-	case NULL:
-		return false
-	case TRUE:
-		return true
-	case FALSE:
-		return false
-	default:
-		return true
+	if builtin := object.GetBuiltinByName(node.Value); builtin != nil {
+		// registered with object.RegisterBuiltin after the evaluator's table was built
+		return builtin
 	}
+
+	return newError("identifier not found: %s", node.Value)
 }
 
 func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
+// isError reports whether obj ends the evaluation, which an exit does too
 func isError(obj object.Object) bool {
 	if obj != nil {
-		return obj.Type() == object.ERROR_OBJ
+		return obj.Type() == object.ERROR_OBJ || obj.Type() == EXIT_OBJ
 	}
 	return false
 }
 
+// evalArguments evaluates the arguments of a call, expanding the array of a spread last argument
+func evalArguments(
+	exps []ast.Expression,
+	env *object.Environment,
+) []object.Object {
+	if len(exps) == 0 {
+		return nil
+	}
+	last := len(exps) - 1
+	spread, ok := exps[last].(*ast.SpreadExpression)
+	if !ok {
+		return evalExpressions(exps, env)
+	}
+
+	args := evalExpressions(exps[:last], env)
+	if len(args) == 1 && isError(args[0]) {
+		return args
+	}
+
+	evaluated := Eval(spread.Value, env)
+	if isError(evaluated) {
+		return []object.Object{evaluated}
+	}
+	array, ok := evaluated.(*object.Array)
+	if !ok {
+		return []object.Object{newError("spread argument must be ARRAY, got %s", evaluated.Type())}
+	}
+
+	return append(args, array.Elements...)
+}
+
 func evalExpressions(
 	exps []ast.Expression,
 	env *object.Environment,
@@ -345,7 +688,37 @@ func applyFunction(fn object.Object, args []object.Object) object.Object {
 		return unwrapReturnValue(evaluated)
 
 	case *object.Builtin:
-		return fn.Fn(args...)
+		host := &stdoutHost{}
+		result := fn.Call(host, args...)
+		if host.exit != nil {
+			return host.exit
+		}
+
+		switch result := result.(type) {
+		case nil:
+			return NULL
+		case *object.Boolean:
+			return nativeBoolToBooleanObject(result.Value)
+		default:
+			return result
+		}
+
+	case *object.Partial:
+		return applyFunction(fn.Fn, append(append([]object.Object{}, fn.Args...), args...))
+
+	case *object.Memoized:
+		key, ok := fn.Key(args)
+		if !ok {
+			return applyFunction(fn.Fn, args)
+		}
+		if result, cached := fn.Cache[key]; cached {
+			return result
+		}
+		result := applyFunction(fn.Fn, args)
+		if !isError(result) {
+			fn.Cache[key] = result
+		}
+		return result
 
 	default:
 		return newError("not a function: %s", fn.Type())
@@ -369,6 +742,9 @@ func unwrapReturnValue(obj object.Object) object.Object {
 	if returnValue, ok := obj.(*object.ReturnValue); ok {
 		return returnValue.Value
 	}
+	if signal, ok := obj.(*loopSignal); ok {
+		return signal.outsideLoop()
+	}
 
 	return obj
 }
@@ -402,7 +778,8 @@ func evalHashLiteral(
 ) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 
-	for keyNode, valueNode := range node.Pairs {
+	for _, keyNode := range node.Keys {
+		valueNode := node.Pairs[keyNode]
 		key := Eval(keyNode, env)
 		if isError(key) {
 			return key
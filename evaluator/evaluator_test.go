@@ -4,6 +4,7 @@ import (
 	"monkey-compiler/lexer"
 	"monkey-compiler/object"
 	"monkey-compiler/parser"
+	"sync"
 	"testing"
 )
 
@@ -27,6 +28,12 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"-9223372036854775808", -9223372036854775808},
+		{"100000000000000000000 / 100000000000000000000", 1},
+		{"100000000000000000000 * 100000000000000000000 / 100000000000000000000 - 99999999999999999999", 1},
+		{"9223372036854775807 + 1 - 1", 9223372036854775807},
+		{"(-9223372036854775807 - 1) * -1 / -1", -9223372036854775808},
+		{"-(-9223372036854775807 - 1) - 1", 9223372036854775807},
 	}
 
 	for _, tt := range tests {
@@ -46,6 +53,10 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"1 > 2", false},
 		{"1 < 1", false},
 		{"1 > 1", false},
+		{"1 <= 1", true},
+		{"1 >= 2", false},
+		{"2 >= 1", true},
+		{"2 <= 1", false},
 		{"1 == 1", true},
 		{"1 != 1", false},
 		{"1 == 2", false},
@@ -59,6 +70,9 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"9223372036854775807 + 1 > 9223372036854775807", true},
+		{"3037000500 * 3037000500 == 9223372037000250000", true},
+		{"-9223372036854775807 - 2 < -9223372036854775807 - 1", true},
 	}
 
 	for _, tt := range tests {
@@ -217,6 +231,14 @@ if (10 > 1) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			"let a = freeze([1]); a[0] = 2;",
+			"cannot assign to frozen ARRAY",
+		},
+		{
+			"1 / (2 - 2)",
+			"division by zero",
+		},
 		{
 			`999[1]`,
 			"index operator not supported: INTEGER",
@@ -249,6 +271,12 @@ func TestLetStatements(t *testing.T) {
 		{"let a = 5 * 5; a;", 25},
 		{"let a = 5; let b = a; b;", 5},
 		{"let a = 5; let b = a; let c = a + b + 5; c;", 15},
+		{"let a, b = fn() { return 1, 2 }(); a - b;", -1},
+		{"let a = [1, 2]; a[1] = 5; a[0] + a[1];", 6},
+		{"let a = null ?? 2; let b = 3 ?? a; a + b;", 5},
+		{"let a = null?.[0] ?? null?.(1) ?? 4; a + [1]?.[0];", 5},
+		{"let x = { let a = 1; a + 1 }; x", 2},
+		{"let a = 5; { let a = 1; a } + a", 6},
 	}
 
 	for _, tt := range tests {
@@ -342,6 +370,121 @@ func TestStringLiteral(t *testing.T) {
 	}
 }
 
+func TestRepetition(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"ab" * 3`, "ababab"},
+		{`"ab" * 0`, ""},
+		{"[0] * 3", "[0, 0, 0]"},
+		{"[1, 2] * 0", "[]"},
+		{`"ab" * -1`, "ERROR: negative repeat count: -1"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestArrayComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2] < [1, 3]", "true"},
+		{"[1] < [1, 0]", "true"},
+		{"[1, 2] >= [1, 2]", "true"},
+		{"[2] <= [1, 5]", "false"},
+		{"[true] < [false]", "ERROR: cannot compare BOOLEAN and BOOLEAN"},
+		{"let a = [0]; a[0] = a; a < a", "ERROR: cannot compare an array nested in itself"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { 1 / 0 } catch (e) { e }", "ERROR: division by zero"},
+		{"try { 10 / 2 } catch (e) { 0 }", "5"},
+		{"try { } catch (e) { 1 }", "null"},
+		{"1 + try { 1 + true } catch (e) { 2 } + 3", "6"},
+		{"let f = fn(x) { try { return 10 / x } catch (e) { -1 } }; f(0) + f(5)", "1"},
+		{"let e = 1; try { 1 / 0 } catch (e) { 2 }; e", "1"},
+		{"try { 1 / 0 } catch (e) { 1 + true }", "ERROR: type mismatch: INTEGER + BOOLEAN"},
+		{`try { throw "boom" } catch (e) { e + "!" }`, "boom!"},
+		{"let f = fn() { throw [1, 2] }; try { f() } catch (e) { e[1] }", "2"},
+		{`throw "boom"`, "ERROR: uncaught throw: boom"},
+		{`let h = {}; let r = try { 1 } finally { h["ran"] = true }; [r, h["ran"]]`, "[1, true]"},
+		{`let h = {}; let r = try { 1 / 0 } catch (e) { 2 } finally { h["ran"] = true }; [r, h["ran"]]`, "[2, true]"},
+		{`let h = {}; let f = fn() { try { return 1 } finally { h["ran"] = true } }; [f(), h["ran"]]`, "[1, true]"},
+		{`try { 1 / 0 } finally { 1 }`, "ERROR: division by zero"},
+		{`try { 1 } finally { throw "finally" }`, "ERROR: uncaught throw: finally"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestDoWhile(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1 } while (false); h["n"]`, "1"},
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1 } while (h["n"] < 5); h["n"]`, "5"},
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1; if (h["n"] == 3) { break } } while (true); h["n"]`, "3"},
+		{`let h = {"n": 0, "odd": 0}; do { h["n"] = h["n"] + 1; if (h["n"] / 2 * 2 == h["n"]) { continue }; h["odd"] = h["odd"] + 1 } while (h["n"] < 10); h["odd"]`, "5"},
+		{`let f = fn() { let h = {"n": 0}; do { h["n"] = h["n"] + 1; if (h["n"] == 4) { return 40 } } while (true) }; f()`, "40"},
+		{"break", "ERROR: break outside loop"},
+		{"let f = fn() { continue }; f()", "ERROR: continue outside loop"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestLabeledLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let h = {"i": 0, "n": 0}; outer: do { h["i"] = h["i"] + 1; let j = {"v": 0}; do { j["v"] = j["v"] + 1; h["n"] = h["n"] + 1; if (h["i"] == 2) { if (j["v"] == 2) { break outer } } } while (j["v"] < 3) } while (h["i"] < 5); [h["i"], h["n"]]`, "[2, 5]"},
+		{`let h = {"i": 0, "n": 0}; outer: do { h["i"] = h["i"] + 1; let j = {"v": 0}; do { j["v"] = j["v"] + 1; if (j["v"] == 2) { continue outer }; h["n"] = h["n"] + 1 } while (true) } while (h["i"] < 3); [h["i"], h["n"]]`, "[3, 3]"},
+		{`let h = {"a": 0, "b": 0, "c": 0}; a: do { h["a"] = h["a"] + 1; b: do { h["b"] = h["b"] + 1; do { h["c"] = h["c"] + 1; if (h["c"] == 5) { break a }; if (h["b"] < 3) { continue b } } while (false) } while (h["b"] < 3) } while (true); [h["a"], h["b"], h["c"]]`, "[3, 5, 5]"},
+		{`let h = {"i": 0, "n": 0}; l: do { h["i"] = h["i"] + 1; l: do { h["n"] = h["n"] + 1; break l } while (true) } while (h["i"] < 2); [h["i"], h["n"]]`, "[2, 2]"},
+		{"break outer", "ERROR: break outside loop outer"},
+		{"outer: do { do { continue inner } while (true) } while (true)", "ERROR: continue outside loop inner"},
+		{"outer: do { let f = fn() { do { break outer } while (true) }; f() } while (false)", "ERROR: break outside loop outer"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestStringConcatenation(t *testing.T) {
 	input := `"Hello" + " " + "World!"`
 
@@ -356,6 +499,49 @@ func TestStringConcatenation(t *testing.T) {
 	}
 }
 
+func TestStringComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{`"a" == "a"`, true},
+		{`"a" == "b"`, false},
+		{`"a" != "a"`, false},
+		{`"a" != "b"`, true},
+		{`"mon" + "key" == "monkey"`, true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1.5 + 2.0", "3.5"},
+		{"1 + 0.5", "1.5"},
+		{"3.0 / 2", "1.5"},
+		{"1.5 * 4.0 - 1", "5.0"},
+		{"1.5 < 2.0", "true"},
+		{"1 >= 1.0", "true"},
+		{"1.0 == 1.0", "true"},
+		{"1.0 != 1.0", "false"},
+		{"1.5 / 0", "ERROR: division by zero"},
+		{"1.5 + true", "ERROR: type mismatch: FLOAT + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -364,21 +550,48 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
-		{`len(1)`, "argument to `len` not supported, got INTEGER"},
+		{`len(1)`, "argument 1 to `len` must be ARRAY or STRING, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
 		{`len([1, 2, 3])`, 3},
 		{`len([])`, 0},
 		{`puts("hello", "world!")`, nil},
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, nil},
-		{`first(1)`, "argument to `first` must be ARRAY, got INTEGER"},
+		{`first(1)`, "argument 1 to `first` must be ARRAY, got INTEGER"},
 		{`last([1, 2, 3])`, 3},
 		{`last([])`, nil},
-		{`last(1)`, "argument to `last` must be ARRAY, got INTEGER"},
+		{`last(1)`, "argument 1 to `last` must be ARRAY, got INTEGER"},
 		{`rest([1, 2, 3])`, []int{2, 3}},
 		{`rest([])`, nil},
 		{`push([], 1)`, []int{1}},
-		{`push(1, 1)`, "argument to `push` must be ARRAY, got INTEGER"},
+		{`push(1, 1)`, "argument 1 to `push` must be ARRAY, got INTEGER"},
+		{`keys({2: 0, 1: 0})`, []int{1, 2}},
+		{`values({2: 20, 1: 10})`, []int{10, 20}},
+		{`keys(1)`, "argument 1 to `keys` must be HASH, got INTEGER"},
+		{`if (equals({"a": [1]}, {"a": [1]})) { 1 } else { 2 }`, 1},
+		{`if (equals({"a": [1]}, {"a": [2]})) { 1 } else { 2 }`, 2},
+		{`assert(true)`, nil},
+		{`len(...[[1, 2]])`, 2},
+		{`let add = fn(a, b) { a + b }; partial(add, 5)(3)`, 8},
+		{`partial(partial(fn(a, b, c) { a - b - c }, 10), 3)(2)`, 5},
+		{`let calls = [0]; let f = memoize(fn(n) { calls[0] = calls[0] + 1; n }); f(2); f(3); f(2); calls[0]`, 2},
+		{`memoize(1)`, "argument to `memoize` must be a function, got INTEGER"},
+		{`find([1, 4, 6], fn(x) { x > 3 })`, 4},
+		{`findIndex([1, 4, 6], fn(x) { x > 6 })`, -1},
+		{`find([1], fn(x) { x + true })`, "type mismatch: INTEGER + BOOLEAN"},
+		{`if (all([1, 2], fn(x) { x > 0 })) { 1 } else { 2 }`, 1},
+		{`if (any([1, 2], fn(x) { x > 2 })) { 1 } else { 2 }`, 2},
+		{`all([1], fn(x) { x + true })`, "type mismatch: INTEGER + BOOLEAN"},
+		{`max(1, ...[5, 3])`, 5},
+		{`len(...1)`, "spread argument must be ARRAY, got INTEGER"},
+		{`len(...[1], 2)`, "spread is only allowed as the last argument of a call"},
+		{`assert(1 > 2, "nope"); 1`, "assertion failed: nope"},
+		{`let b = newBuilder(); append(b, "ab"); append(b, "c"); len(toString(b))`, 3},
+		{`append(newBuilder(), 1)`, "argument 2 to `append` must be STRING for a STRING_BUILDER, got INTEGER"},
+		{`ord("A")`, 65},
+		{`ord(chr(66))`, 66},
+		{`chr(256)`, "argument to `chr` must be 0 to 255, got 256"},
+		{`len(substr("hello", -3, 10))`, 3},
 	}
 
 	for _, tt := range tests {
@@ -582,6 +795,74 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+func TestHashIterationOrder(t *testing.T) {
+	input := `let h = {"b": 1, 3: 2, true: 3, "a": 4, 1: 5, false: 6};`
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input + "h", `{false: 6, true: 3, 1: 5, 3: 2, a: 4, b: 1}`},
+		{input + "keys(h)", `[false, true, 1, 3, a, b]`},
+		{input + "values(h)", `[6, 3, 5, 2, 4, 1]`},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			evaluated := testEval(tt.input)
+			if evaluated.Inspect() != tt.expected {
+				t.Fatalf("run %d of %q wrong. want=%s, got=%s",
+					i, tt.input, tt.expected, evaluated.Inspect())
+			}
+		}
+	}
+}
+
+func TestRandConcurrently(t *testing.T) {
+	// every program evaluated shares one source, go test -race checks it is locked
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				n, ok := testEval("rand(10)").(*object.Integer)
+				if !ok || n.Value < 0 || n.Value >= 10 {
+					t.Errorf("rand(10) wrong. got=%+v", n)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestExit(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"exit(2); 5", 2},
+		{"let f = fn() { exit(3); 1 }; f(); 2", 3},
+		{"[1, exit(4), 3]", 4},
+		{"if (true) { exit(0) } 1", 0},
+		{"find([1, 2], fn(x) { exit(5) }); 6", 5},
+		{"try { exit(6) } catch (e) { 7 }", 6},
+		{"do { exit(8) } while (true)", 8},
+		{"try { exit(1) } catch (e) { 2 } finally { exit(7) }", 7},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		exit, ok := evaluated.(*Exit)
+		if !ok {
+			t.Fatalf("%q did not exit. got=%T (%+v)", tt.input, evaluated, evaluated)
+		}
+		if exit.Code != tt.expected {
+			t.Errorf("exit code of %q wrong. want=%d, got=%d", tt.input, tt.expected, exit.Code)
+		}
+	}
+}
+
 func testEval(input string) object.Object {
 	l := lexer.New(input)
 	p := parser.New(l)
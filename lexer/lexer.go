@@ -1,24 +1,53 @@
 package lexer
 
-import "monkey-compiler/token"
+import (
+	"monkey-compiler/token"
+	"strings"
+)
 
 type Lexer struct {
 	input        string
 	position     int  // current position in input (points to current char)
 	readPosition int  // current reading position in input (after current char)
 	ch           byte // current char under examination
+	line         int  // line of the current char, starting at 1
+	lineStart    int  // position of the first char of the current line
+
+	keepComments bool
+	comments     []string // comments read since the last call of TakeComments
+	lastLine     int      // line of the last token returned
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
+// NewWithComments returns a lexer which keeps the text of leading comments
+// so that it can be retrieved with TakeComments. Comments never produce tokens.
+func NewWithComments(input string) *Lexer {
+	l := New(input)
+	l.keepComments = true
+	return l
+}
+
+// TakeComments returns the comments read before the last token returned by NextToken
+// and forgets them. A comment on the same line as the preceding token is a
+// trailing comment and is not kept.
+func (l *Lexer) TakeComments() []string {
+	comments := l.comments
+	l.comments = nil
+	return comments
+}
+
 func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
-	l.skipWhitespace()
+	l.skipWhitespaceAndComments()
+
+	line, column := l.line, l.position-l.lineStart+1
+	defer func() { l.lastLine = line }()
 
 	switch l.ch {
 	case '=':
@@ -48,9 +77,44 @@ func (l *Lexer) NextToken() token.Token {
 	case '*':
 		tok = newToken(token.ASTERISK, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.LT_EQ, Literal: "<="}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.GT_EQ, Literal: ">="}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '>' {
+			l.readChar()
+			tok = token.Token{Type: token.PIPELINE, Literal: "|>"}
+		} else {
+			tok = newToken(token.PIPE, l.ch)
+		}
+	case '?':
+		if l.peekChar() == '?' {
+			l.readChar()
+			tok = token.Token{Type: token.NULLISH, Literal: "??"}
+		} else if l.peekChar() == '.' {
+			l.readChar()
+			tok = token.Token{Type: token.OPTIONAL, Literal: "?."}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '.':
+		if strings.HasPrefix(l.input[l.position:], "...") {
+			l.readChar()
+			l.readChar()
+			tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case ':':
@@ -68,6 +132,9 @@ func (l *Lexer) NextToken() token.Token {
 	case '"':
 		tok.Type = token.STRING
 		tok.Literal = l.readString()
+	case '`':
+		tok.Type = token.RAW_STRING
+		tok.Literal = l.readRawString()
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
@@ -79,10 +146,16 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Line, tok.Column = line, column
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Type = token.INT
 			tok.Literal = l.readNumber()
+			if l.ch == '.' && isDigit(l.peekChar()) && !strings.ContainsAny(tok.Literal, "xXbBoO") {
+				tok.Type = token.FLOAT
+				tok.Literal += l.readFraction()
+			}
+			tok.Line, tok.Column = line, column
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
@@ -90,16 +163,48 @@ func (l *Lexer) NextToken() token.Token {
 	}
 
 	l.readChar()
+	tok.Line, tok.Column = line, column
 	return tok
 }
 
+func (l *Lexer) skipWhitespaceAndComments() {
+	l.comments = nil
+
+	for {
+		l.skipWhitespace()
+		if l.ch != '/' || l.peekChar() != '/' {
+			return
+		}
+
+		line := l.line
+		comment := l.readComment()
+		if l.keepComments && line != l.lastLine {
+			l.comments = append(l.comments, comment)
+		}
+	}
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
 	}
 }
 
+// readComment reads a // comment up to the end of line and returns its text
+func (l *Lexer) readComment() string {
+	position := l.position + 2
+	for l.ch != '\n' && l.ch != 0 {
+		l.readChar()
+	}
+	return strings.TrimSpace(l.input[position:l.position])
+}
+
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.lineStart = l.readPosition
+	}
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -125,18 +230,47 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
+// readNumber reads a decimal literal, or a 0x, 0b or 0o prefixed literal.
+// Underscores are kept in the literal. The parser checks and removes them.
+// Any letters or digits after a base prefix belong to the literal, so that the parser reports
+// malformed literals like 0xZZ as a whole.
 func (l *Lexer) readNumber() string {
 	position := l.position
-	for isDigit(l.ch) {
+	if l.ch == '0' && isBasePrefix(l.peekChar()) {
+		l.readChar()
+		l.readChar()
+		for isLetter(l.ch) || isDigit(l.ch) {
+			l.readChar()
+		}
+		return l.input[position:l.position]
+	}
+
+	for isDigit(l.ch) || l.ch == '_' {
+		l.readChar()
+	}
+	return l.input[position:l.position]
+}
+
+// readFraction reads the . and the digits after it of a float literal like 3.14
+func (l *Lexer) readFraction() string {
+	position := l.position
+	l.readChar()
+	for isDigit(l.ch) || l.ch == '_' {
 		l.readChar()
 	}
 	return l.input[position:l.position]
 }
 
+// readString reads the contents of a double-quoted string. Escape sequences are
+// left as they are for the parser to decode, only an escaped quote doesn't end the string.
 func (l *Lexer) readString() string {
 	position := l.position + 1
 	for {
 		l.readChar()
+		if l.ch == '\\' && l.peekChar() != 0 {
+			l.readChar()
+			continue
+		}
 		if l.ch == '"' || l.ch == 0 {
 			break
 		}
@@ -144,6 +278,18 @@ func (l *Lexer) readString() string {
 	return l.input[position:l.position]
 }
 
+// readRawString reads the contents of a backquoted string, which may span lines
+func (l *Lexer) readRawString() string {
+	position := l.position + 1
+	for {
+		l.readChar()
+		if l.ch == '`' || l.ch == 0 {
+			break
+		}
+	}
+	return l.input[position:l.position]
+}
+
 func isLetter(ch byte) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
 }
@@ -152,6 +298,14 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
+func isBasePrefix(ch byte) bool {
+	switch ch {
+	case 'x', 'X', 'b', 'B', 'o', 'O':
+		return true
+	}
+	return false
+}
+
 func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
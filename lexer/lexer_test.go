@@ -25,10 +25,15 @@ if (5 < 10) {
 
 10 == 10;
 10 != 9;
+10 <= 9 >= 8;
+f(...xs);
+a ?? null;
+a?.[0];
 "foobar"
 "foo bar"
 [1, 2];
 {"foo": "bar"}
+3.14 1_000.5
 `
 
 	tests := []struct {
@@ -108,6 +113,28 @@ if (5 < 10) {
 		{token.NOT_EQ, "!="},
 		{token.INT, "9"},
 		{token.SEMICOLON, ";"},
+		{token.INT, "10"},
+		{token.LT_EQ, "<="},
+		{token.INT, "9"},
+		{token.GT_EQ, ">="},
+		{token.INT, "8"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "f"},
+		{token.LPAREN, "("},
+		{token.ELLIPSIS, "..."},
+		{token.IDENT, "xs"},
+		{token.RPAREN, ")"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.NULLISH, "??"},
+		{token.NULL, "null"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.OPTIONAL, "?."},
+		{token.LBRACKET, "["},
+		{token.INT, "0"},
+		{token.RBRACKET, "]"},
+		{token.SEMICOLON, ";"},
 		{token.STRING, "foobar"},
 		{token.STRING, "foo bar"},
 		{token.LBRACKET, "["},
@@ -121,6 +148,8 @@ if (5 < 10) {
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.FLOAT, "3.14"},
+		{token.FLOAT, "1_000.5"},
 		{token.EOF, ""},
 	}
 
@@ -140,3 +169,128 @@ if (5 < 10) {
 		}
 	}
 }
+
+func TestTokenPosition(t *testing.T) {
+	input := `let a = 1;
+
+a + "b
+c";
+`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1},
+		{"a", 1, 5},
+		{"=", 1, 7},
+		{"1", 1, 9},
+		{";", 1, 10},
+		{"a", 3, 1},
+		{"+", 3, 3},
+		{"b\nc", 3, 5},
+		{";", 4, 3},
+		{"", 5, 1},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+
+		if tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - line wrong. expected=%d, got=%d",
+				i, tt.expectedLine, tok.Line)
+		}
+
+		if tok.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - column wrong. expected=%d, got=%d",
+				i, tt.expectedColumn, tok.Column)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// leading
+// second line
+let a = 1; // trailing
+//   other
+a`
+
+	tests := []struct {
+		expectedLiteral  string
+		expectedComments []string
+	}{
+		{"let", []string{"leading", "second line"}},
+		{"a", nil},
+		{"=", nil},
+		{"1", nil},
+		{";", nil},
+		{"a", []string{"other"}},
+		{"", nil},
+	}
+
+	for _, keep := range []bool{false, true} {
+		var l *Lexer
+		if keep {
+			l = NewWithComments(input)
+		} else {
+			l = New(input)
+		}
+
+		for i, tt := range tests {
+			tok := l.NextToken()
+			if tok.Literal != tt.expectedLiteral {
+				t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+					i, tt.expectedLiteral, tok.Literal)
+			}
+
+			comments := l.TakeComments()
+			if !keep {
+				if len(comments) != 0 {
+					t.Fatalf("tests[%d] - comments kept without NewWithComments: %q", i, comments)
+				}
+				continue
+			}
+
+			if len(comments) != len(tt.expectedComments) {
+				t.Fatalf("tests[%d] - comments wrong. expected=%q, got=%q",
+					i, tt.expectedComments, comments)
+			}
+			for j, c := range comments {
+				if c != tt.expectedComments[j] {
+					t.Fatalf("tests[%d] - comments wrong. expected=%q, got=%q",
+						i, tt.expectedComments, comments)
+				}
+			}
+		}
+	}
+}
+
+func TestIntegerLiterals(t *testing.T) {
+	input := `0xFF 0b1010 0o17 0 0x 0xZZ 10 1_000 1__0_ 0xFF_FF`
+
+	expected := []string{"0xFF", "0b1010", "0o17", "0", "0x", "0xZZ", "10", "1_000", "1__0_", "0xFF_FF"}
+
+	l := New(input)
+
+	for i, literal := range expected {
+		tok := l.NextToken()
+
+		if tok.Type != token.INT {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q",
+				i, token.INT, tok.Type)
+		}
+
+		if tok.Literal != literal {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q",
+				i, literal, tok.Literal)
+		}
+	}
+}
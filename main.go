@@ -1,13 +1,40 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"monkey-compiler/repl"
+	"monkey-compiler/vm"
 	"os"
 	"os/user"
+	"path/filepath"
 )
 
+// historyFile is the file in the home directory the lines entered in the REPL are kept in
+const historyFile = ".monkey_history"
+
 func main() {
+	newlineEnds := flag.Bool("newlines", false, "end statements at newlines before (, [ and -")
+	flag.Parse()
+
+	var opts []repl.Option
+	if *newlineEnds {
+		opts = append(opts, repl.NewlineEnds())
+	}
+
+	if flag.NArg() > 0 {
+		if err := repl.RunFile(flag.Arg(0), os.Stdout, opts...); err != nil {
+			var exit *vm.ExitError
+			if errors.As(err, &exit) {
+				os.Exit(exit.Code)
+			}
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	usr, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -15,5 +42,15 @@ func main() {
 	fmt.Printf("Hello %s! This is the Monkey programming language!\n",
 		usr.Username)
 	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+
+	// history is only kept for someone typing, not for input piped in
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		path := filepath.Join(usr.HomeDir, historyFile)
+		err := repl.StartWithHistory(os.Stdin, os.Stdout, path, opts...)
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "history is not kept: %s\n", err)
+	}
+	repl.Start(os.Stdin, os.Stdout, opts...)
 }
@@ -0,0 +1,894 @@
+package object
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Host is the machine a builtin function is called from
+type Host interface {
+	// Out returns the writer puts prints to
+	Out() io.Writer
+	// Rand returns the source of the numbers rand returns
+	Rand() *rand.Rand
+	// Now returns the time now returns
+	Now() time.Time
+	// Exit stops the program with code once the builtin calling it returns
+	Exit(code int)
+	// Fail stops the program with an error once the builtin calling it returns
+	Fail(message string)
+	// Call calls the function fn with args and returns its result. If the call fails,
+	// the program stops with the error once the builtin calling it returns,
+	// so the builtin should return as soon as it can.
+	Call(fn Object, args ...Object) (Object, error)
+}
+
+// BuiltinDefinition is a builtin function together with the name programs call it by
+type BuiltinDefinition struct {
+	Name    string
+	Builtin *Builtin
+}
+
+// MaxBuiltins is the number of builtins OpGetBuiltin can refer to
+const MaxBuiltins = math.MaxUint8 + 1
+
+// builtinsMu guards builtins. Compilers and VMs are never shared between goroutines,
+// but all of them share the builtins, which RegisterBuiltin may add to at any time.
+var builtinsMu sync.RWMutex
+
+// builtins is the list of builtin functions shared by the evaluator and the compiler.
+// The compiler refers to a builtin by its index, so new builtins must be appended.
+var builtins = []BuiltinDefinition{
+	{
+		"len",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ, STRING_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			switch arg := args[0].(type) {
+			case *Array:
+				return &Integer{Value: int64(len(arg.Elements))}
+			default:
+				return &Integer{Value: int64(len(arg.(*String).Value))}
+			}
+		},
+			Usage: "len(x)",
+			Doc:   "returns the number of elements of an array or bytes of a string",
+		},
+	},
+	{
+		"puts",
+		&Builtin{Fn: func(host Host, args ...Object) Object {
+			for _, arg := range args {
+				fmt.Fprintln(host.Out(), arg.Inspect())
+			}
+
+			return nil
+		},
+			Usage: "puts(values...)",
+			Doc:   "prints each value on a line of its own",
+		},
+	},
+	{
+		"first",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			arr := args[0].(*Array)
+			if len(arr.Elements) > 0 {
+				return arr.Elements[0]
+			}
+
+			return nil
+		},
+			Usage: "first(array)",
+			Doc:   "returns the first element of array, or null if it is empty",
+		},
+	},
+	{
+		"last",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			arr := args[0].(*Array)
+			length := len(arr.Elements)
+			if length > 0 {
+				return arr.Elements[length-1]
+			}
+
+			return nil
+		},
+			Usage: "last(array)",
+			Doc:   "returns the last element of array, or null if it is empty",
+		},
+	},
+	{
+		"rest",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			arr := args[0].(*Array)
+			length := len(arr.Elements)
+			if length > 0 {
+				newElements := make([]Object, length-1, length-1)
+				copy(newElements, arr.Elements[1:length])
+				return &Array{Elements: newElements}
+			}
+
+			return nil
+		},
+			Usage: "rest(array)",
+			Doc:   "returns array without its first element, or null if it is empty",
+		},
+	},
+	{
+		"push",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {}}, Fn: func(host Host, args ...Object) Object {
+			arr := args[0].(*Array)
+			length := len(arr.Elements)
+
+			newElements := make([]Object, length+1, length+1)
+			copy(newElements, arr.Elements)
+			newElements[length] = args[1]
+
+			return &Array{Elements: newElements}
+		},
+			Usage: "push(array, value)",
+			Doc:   "returns a copy of array with value appended",
+		},
+	},
+	{
+		"keys",
+		&Builtin{Params: []ParamType{{HASH_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			pairs := args[0].(*Hash).SortedPairs()
+			keys := make([]Object, len(pairs))
+			for i, pair := range pairs {
+				keys[i] = pair.Key
+			}
+
+			return &Array{Elements: keys}
+		},
+			Usage: "keys(hash)",
+			Doc:   "returns the keys of hash in canonical order",
+		},
+	},
+	{
+		"values",
+		&Builtin{Params: []ParamType{{HASH_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			pairs := args[0].(*Hash).SortedPairs()
+			values := make([]Object, len(pairs))
+			for i, pair := range pairs {
+				values[i] = pair.Value
+			}
+
+			return &Array{Elements: values}
+		},
+			Usage: "values(hash)",
+			Doc:   "returns the values of hash in the order of its keys",
+		},
+	},
+	{
+		"min",
+		&Builtin{Fn: func(host Host, args ...Object) Object {
+			return extremum("min", args, func(cmp int) bool { return cmp < 0 })
+		},
+			Usage: "min(numbers...)",
+			Doc:   "returns the smallest of its arguments, or of the elements of a single array",
+		},
+	},
+	{
+		"max",
+		&Builtin{Fn: func(host Host, args ...Object) Object {
+			return extremum("max", args, func(cmp int) bool { return cmp > 0 })
+		},
+			Usage: "max(numbers...)",
+			Doc:   "returns the largest of its arguments, or of the elements of a single array",
+		},
+	},
+	{
+		"abs",
+		&Builtin{Params: []ParamType{{INTEGER_OBJ, FLOAT_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			if float, ok := args[0].(*Float); ok {
+				return &Float{Value: math.Abs(float.Value)}
+			}
+			integer := args[0].(*Integer)
+			if integer.Value < 0 {
+				return NegateInteger(integer.Value)
+			}
+			return integer
+		},
+			Usage: "abs(n)",
+			Doc:   "returns the absolute value of n",
+		},
+	},
+	{
+		"clamp",
+		&Builtin{Params: []ParamType{{INTEGER_OBJ}, {INTEGER_OBJ}, {INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			n := args[0].(*Integer)
+			lo := args[1].(*Integer)
+			hi := args[2].(*Integer)
+			if lo.Value > hi.Value {
+				return newError("lower bound of `clamp` is greater than upper bound: %d > %d",
+					lo.Value, hi.Value)
+			}
+
+			switch {
+			case n.Value < lo.Value:
+				return lo
+			case n.Value > hi.Value:
+				return hi
+			default:
+				return n
+			}
+		},
+			Usage: "clamp(n, lo, hi)",
+			Doc:   "returns n limited to the range from lo to hi",
+		},
+	},
+	{
+		"equals",
+		&Builtin{Params: []ParamType{{}, {}}, Fn: func(host Host, args ...Object) Object {
+			eq, err := Equals(args[0], args[1])
+			if err != nil {
+				return newError("%s", err)
+			}
+			if eq {
+				return TRUE
+			}
+			return FALSE
+		},
+			Usage: "equals(a, b)",
+			Doc:   "reports whether a and b are deeply equal",
+		},
+	},
+	{
+		"rand",
+		&Builtin{Params: []ParamType{{INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			n := args[0].(*Integer).Value
+			if n <= 0 {
+				return newError("argument to `rand` must be positive, got %d", n)
+			}
+
+			return &Integer{Value: host.Rand().Int63n(n)}
+		},
+			Usage: "rand(n)",
+			Doc:   "returns a random integer from 0 up to but excluding n",
+		},
+	},
+	{
+		"now",
+		&Builtin{Params: []ParamType{}, Fn: func(host Host, args ...Object) Object {
+			return &Integer{Value: host.Now().UnixMilli()}
+		},
+			Usage: "now()",
+			Doc:   "returns the current time in milliseconds since the Unix epoch",
+		},
+	},
+	{
+		"exit",
+		&Builtin{Params: []ParamType{{INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			host.Exit(int(args[0].(*Integer).Value))
+			return nil
+		},
+			Usage: "exit(code)",
+			Doc:   "stops the program with the exit code",
+		},
+	},
+	{
+		"assert",
+		&Builtin{Fn: func(host Host, args ...Object) Object {
+			if len(args) != 1 && len(args) != 2 {
+				return newError("wrong number of arguments. got=%d, want=1 or 2",
+					len(args))
+			}
+
+			message := "assertion failed"
+			if len(args) == 2 {
+				msg, ok := args[1].(*String)
+				if !ok {
+					return newError("argument 2 to `assert` must be STRING, got %s",
+						args[1].Type())
+				}
+				message += ": " + msg.Value
+			}
+
+			if IsTruthy(args[0]) {
+				return nil
+			}
+			host.Fail(message)
+			return newError("%s", message)
+		},
+			Usage: "assert(cond, message)",
+			Doc:   "stops the program with an error unless cond is truthy, message is optional",
+		},
+	},
+	{
+		"partial",
+		&Builtin{Fn: func(host Host, args ...Object) Object {
+			if len(args) == 0 {
+				return newError("wrong number of arguments. got=0, want at least 1")
+			}
+
+			// args may be backed by the VM's stack, the bound arguments have to outlive the call
+			fn, bound := args[0], append([]Object{}, args[1:]...)
+			var numParameters int
+			switch fn := fn.(type) {
+			case *Closure:
+				numParameters = fn.Fn.NumParameters
+			case *Function:
+				numParameters = len(fn.Parameters)
+			case *Builtin, *Partial, *Memoized:
+				return &Partial{Fn: fn, Args: bound}
+			default:
+				return newError("argument 1 to `partial` must be a function, got %s", fn.Type())
+			}
+
+			if len(bound) > numParameters {
+				return newError("too many arguments to bind: want at most %d, got %d",
+					numParameters, len(bound))
+			}
+			return &Partial{Fn: fn, Args: bound}
+		},
+			Usage: "partial(f, args...)",
+			Doc:   "returns f with its first arguments bound to args",
+		},
+	},
+	{
+		"clone",
+		&Builtin{Params: []ParamType{{}}, Fn: func(host Host, args ...Object) Object {
+			copied, err := Clone(args[0])
+			if err != nil {
+				return newError("%s", err)
+			}
+			return copied
+		},
+			Usage: "clone(x)",
+			Doc:   "returns a deep copy of an array or hash, anything else as it is",
+		},
+	},
+	{
+		"freeze",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ, HASH_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			switch arg := args[0].(type) {
+			case *Array:
+				arg.Frozen = true
+			case *Hash:
+				arg.Frozen = true
+			}
+			return args[0]
+		},
+			Usage: "freeze(x)",
+			Doc:   "makes an array or hash reject index assignment and returns it",
+		},
+	},
+	{
+		"float",
+		&Builtin{Params: []ParamType{{INTEGER_OBJ, FLOAT_OBJ, STRING_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			switch arg := args[0].(type) {
+			case *Integer:
+				return &Float{Value: float64(arg.Value)}
+			case *String:
+				value, err := strconv.ParseFloat(arg.Value, 64)
+				if err != nil {
+					return newError("could not parse %q as float", arg.Value)
+				}
+				return &Float{Value: value}
+			default:
+				return arg
+			}
+		},
+			Usage: "float(x)",
+			Doc:   "converts an integer or a numeric string to a float",
+		},
+	},
+	{
+		"int",
+		&Builtin{Params: []ParamType{{INTEGER_OBJ, FLOAT_OBJ, STRING_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			switch arg := args[0].(type) {
+			case *Float:
+				// truncate toward zero, as Go's conversion does, but refuse what doesn't fit
+				value := math.Trunc(arg.Value)
+				if math.IsNaN(value) || value < math.MinInt64 || value >= math.MaxInt64 {
+					return newError("float %s out of range of INTEGER", arg.Inspect())
+				}
+				return &Integer{Value: int64(value)}
+			case *String:
+				value, err := strconv.ParseInt(arg.Value, 10, 64)
+				if err != nil {
+					return newError("could not parse %q as integer", arg.Value)
+				}
+				return &Integer{Value: value}
+			default:
+				return arg
+			}
+		},
+			Usage: "int(x)",
+			Doc:   "converts a float, truncating toward zero, or a decimal string to an integer",
+		},
+	},
+	{
+		"memoize",
+		&Builtin{Params: []ParamType{{}}, Fn: func(host Host, args ...Object) Object {
+			switch fn := args[0].(type) {
+			case *Closure, *Function, *Builtin, *Partial, *Memoized:
+				return &Memoized{Fn: fn, Cache: make(map[string]Object)}
+			default:
+				return newError("argument to `memoize` must be a function, got %s", fn.Type())
+			}
+		},
+			Usage: "memoize(f)",
+			Doc:   "returns f caching its result for each list of hashable arguments",
+		},
+	},
+	{
+		"newArrayBuilder",
+		&Builtin{Params: []ParamType{}, Fn: func(host Host, args ...Object) Object {
+			return &ArrayBuilder{}
+		},
+			Usage: "newArrayBuilder()",
+			Doc:   "returns an empty builder to append the elements of an array to",
+		},
+	},
+	{
+		"append",
+		&Builtin{Params: []ParamType{{ARRAY_BUILDER_OBJ, STRING_BUILDER_OBJ}, {}}, Fn: func(host Host, args ...Object) Object {
+			switch builder := args[0].(type) {
+			case *StringBuilder:
+				str, ok := args[1].(*String)
+				if !ok {
+					return newError("argument 2 to `append` must be STRING for a STRING_BUILDER, got %s", args[1].Type())
+				}
+				builder.Builder.WriteString(str.Value)
+				return builder
+			case *ArrayBuilder:
+				builder.Elements = append(builder.Elements, args[1])
+				return builder
+			}
+			return nil
+		},
+			Usage: "append(builder, value)",
+			Doc:   "appends value to an array builder, or a string to a string builder, in place and returns builder",
+		},
+	},
+	{
+		"build",
+		&Builtin{Params: []ParamType{{ARRAY_BUILDER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			// the array is a copy, so that appending to the builder afterwards doesn't change it
+			elements := args[0].(*ArrayBuilder).Elements
+			return &Array{Elements: append([]Object{}, elements...)}
+		},
+			Usage: "build(builder)",
+			Doc:   "returns an array of the elements appended to builder so far",
+		},
+	},
+	{
+		"zip",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {ARRAY_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			a, b := args[0].(*Array).Elements, args[1].(*Array).Elements
+			if len(b) < len(a) {
+				a = a[:len(b)]
+			}
+
+			pairs := make([]Object, len(a))
+			for i := range a {
+				pairs[i] = &Array{Elements: []Object{a[i], b[i]}}
+			}
+			return &Array{Elements: pairs}
+		},
+			Usage: "zip(a, b)",
+			Doc:   "returns an array of the pairs of elements of a and b at the same index, as long as the shorter",
+		},
+	},
+	{
+		"reverse",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ, STRING_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			switch arg := args[0].(type) {
+			case *Array:
+				n := len(arg.Elements)
+				elements := make([]Object, n)
+				for i, e := range arg.Elements {
+					elements[n-1-i] = e
+				}
+				return &Array{Elements: elements}
+			default:
+				// strings are bytes, as len counts them, so a string of any bytes reverses back to itself
+				value := arg.(*String).Value
+				n := len(value)
+				reversed := make([]byte, n)
+				for i := 0; i < n; i++ {
+					reversed[n-1-i] = value[i]
+				}
+				return &String{Value: string(reversed)}
+			}
+		},
+			Usage: "reverse(x)",
+			Doc:   "returns a copy of an array or the bytes of a string in reverse order",
+		},
+	},
+	{
+		"take",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			elements := args[0].(*Array).Elements
+			n := clampCount(args[1].(*Integer).Value, len(elements))
+			return &Array{Elements: append([]Object{}, elements[:n]...)}
+		},
+			Usage: "take(array, n)",
+			Doc:   "returns the first n elements of array, or all of them if there are fewer",
+		},
+	},
+	{
+		"drop",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			elements := args[0].(*Array).Elements
+			n := clampCount(args[1].(*Integer).Value, len(elements))
+			return &Array{Elements: append([]Object{}, elements[n:]...)}
+		},
+			Usage: "drop(array, n)",
+			Doc:   "returns the elements of array after the first n, or none if there are fewer",
+		},
+	},
+	{
+		"find",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {}}, Fn: func(host Host, args ...Object) Object {
+			elements := args[0].(*Array).Elements
+			i, err := indexWhere(host, elements, args[1], true)
+			if err != nil {
+				return newError("%s", err)
+			}
+			if i < 0 {
+				return nil
+			}
+			return elements[i]
+		},
+			Usage: "find(array, pred)",
+			Doc:   "returns the first element of array for which pred is truthy, or null if there is none",
+		},
+	},
+	{
+		"findIndex",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {}}, Fn: func(host Host, args ...Object) Object {
+			i, err := indexWhere(host, args[0].(*Array).Elements, args[1], true)
+			if err != nil {
+				return newError("%s", err)
+			}
+			return &Integer{Value: int64(i)}
+		},
+			Usage: "findIndex(array, pred)",
+			Doc:   "returns the index of the first element of array for which pred is truthy, or -1 if there is none",
+		},
+	},
+	{
+		"all",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {}}, Fn: func(host Host, args ...Object) Object {
+			i, err := indexWhere(host, args[0].(*Array).Elements, args[1], false)
+			if err != nil {
+				return newError("%s", err)
+			}
+			if i < 0 {
+				return TRUE
+			}
+			return FALSE
+		},
+			Usage: "all(array, pred)",
+			Doc:   "reports whether pred is truthy for every element of array, stopping at the first for which it isn't",
+		},
+	},
+	{
+		"any",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {}}, Fn: func(host Host, args ...Object) Object {
+			i, err := indexWhere(host, args[0].(*Array).Elements, args[1], true)
+			if err != nil {
+				return newError("%s", err)
+			}
+			if i >= 0 {
+				return TRUE
+			}
+			return FALSE
+		},
+			Usage: "any(array, pred)",
+			Doc:   "reports whether pred is truthy for some element of array, stopping at the first for which it is",
+		},
+	},
+	{
+		"flatten",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			var elements []Object
+			for _, e := range args[0].(*Array).Elements {
+				if inner, ok := e.(*Array); ok {
+					elements = append(elements, inner.Elements...)
+				} else {
+					elements = append(elements, e)
+				}
+			}
+			return &Array{Elements: elements}
+		},
+			Usage: "flatten(array)",
+			Doc:   "returns the elements of array with those that are arrays replaced by their elements",
+		},
+	},
+	{
+		"flattenDeep",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			elements, err := flattenDeep(nil, args[0].(*Array), map[*Array]bool{})
+			if err != nil {
+				return err
+			}
+			return &Array{Elements: elements}
+		},
+			Usage: "flattenDeep(array)",
+			Doc:   "returns the elements of array and of the arrays nested in it at any depth that aren't arrays",
+		},
+	},
+	{
+		"groupBy",
+		&Builtin{Params: []ParamType{{ARRAY_OBJ}, {}}, Fn: func(host Host, args ...Object) Object {
+			groups := &Hash{Pairs: make(map[HashKey]HashPair)}
+			for _, e := range args[0].(*Array).Elements {
+				key, err := host.Call(args[1], e)
+				if err != nil {
+					return newError("%s", err)
+				}
+				hashable, ok := key.(Hashable)
+				if !ok {
+					return newError("unusable as hash key: %s", key.Type())
+				}
+
+				hashKey := hashable.HashKey()
+				group, ok := groups.Pairs[hashKey]
+				if !ok {
+					group = HashPair{Key: key, Value: &Array{}}
+				}
+				group.Value.(*Array).Elements = append(group.Value.(*Array).Elements, e)
+				groups.Pairs[hashKey] = group
+			}
+			return groups
+		},
+			Usage: "groupBy(array, key)",
+			Doc:   "returns a hash of the elements of array in arrays by the value key returns for them",
+		},
+	},
+	{
+		"newBuilder",
+		&Builtin{Params: []ParamType{}, Fn: func(host Host, args ...Object) Object {
+			return &StringBuilder{}
+		},
+			Usage: "newBuilder()",
+			Doc:   "returns an empty builder to append the pieces of a string to",
+		},
+	},
+	{
+		"toString",
+		&Builtin{Params: []ParamType{{STRING_BUILDER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			return &String{Value: args[0].(*StringBuilder).Builder.String()}
+		},
+			Usage: "toString(builder)",
+			Doc:   "returns the string appended to builder so far",
+		},
+	},
+	{
+		"ord",
+		&Builtin{Params: []ParamType{{STRING_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			// strings are bytes, as for len, so a character is a single byte
+			s := args[0].(*String).Value
+			if len(s) != 1 {
+				return newError("argument to `ord` must be a single byte, got %d bytes", len(s))
+			}
+			return &Integer{Value: int64(s[0])}
+		},
+			Usage: "ord(s)",
+			Doc:   "returns the code, 0 to 255, of the single byte of a string",
+		},
+	},
+	{
+		"chr",
+		&Builtin{Params: []ParamType{{INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			n := args[0].(*Integer).Value
+			if n < 0 || n > math.MaxUint8 {
+				return newError("argument to `chr` must be 0 to 255, got %d", n)
+			}
+			return &String{Value: string([]byte{byte(n)})}
+		},
+			Usage: "chr(n)",
+			Doc:   "returns the string of the single byte with code n, 0 to 255",
+		},
+	},
+	{
+		"substr",
+		&Builtin{Params: []ParamType{{STRING_OBJ}, {INTEGER_OBJ}, {INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+			s := args[0].(*String).Value
+			start := args[1].(*Integer).Value
+			if start < 0 {
+				// counted from the end: substr(s, -1, 1) is the last byte
+				start += int64(len(s))
+			}
+			from := clampCount(start, len(s))
+			n := clampCount(args[2].(*Integer).Value, len(s)-from)
+			return &String{Value: s[from : from+n]}
+		},
+			Usage: "substr(s, start, n)",
+			Doc:   "returns the n bytes of s from start, counted from the end if negative, or as many as there are",
+		},
+	},
+}
+
+func init() {
+	for _, def := range builtins {
+		def.Builtin.Name = def.Name
+	}
+}
+
+// RegisterBuiltin adds builtin under name and returns its index.
+// Compilers created afterwards resolve name to it; byte code compiled before stays valid,
+// since the indices of the builtins registered before never change.
+func RegisterBuiltin(name string, builtin *Builtin) (int, error) {
+	builtinsMu.Lock()
+	defer builtinsMu.Unlock()
+
+	for _, def := range builtins {
+		if def.Name == name {
+			return 0, fmt.Errorf("builtin %s is already registered", name)
+		}
+	}
+	if len(builtins) >= MaxBuiltins {
+		return 0, fmt.Errorf("too many builtins")
+	}
+
+	builtin.Name = name
+	builtins = append(builtins, BuiltinDefinition{Name: name, Builtin: builtin})
+	return len(builtins) - 1, nil
+}
+
+// BuiltinDefinitions returns the builtins registered so far, in index order
+func BuiltinDefinitions() []BuiltinDefinition {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+
+	return append([]BuiltinDefinition{}, builtins...)
+}
+
+// BuiltinAt returns the builtin with index
+func BuiltinAt(index int) *Builtin {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+
+	return builtins[index].Builtin
+}
+
+// Call calls the builtin with args, after checking them against Params if there are any
+func (b *Builtin) Call(host Host, args ...Object) Object {
+	if b.Params != nil {
+		if err := b.checkArguments(args); err != nil {
+			return err
+		}
+	}
+
+	return b.Fn(host, args...)
+}
+
+func (b *Builtin) checkArguments(args []Object) *Error {
+	if len(args) != len(b.Params) {
+		return newError("wrong number of arguments. got=%d, want=%d",
+			len(args), len(b.Params))
+	}
+
+	for i, arg := range args {
+		if !b.Params[i].accepts(arg.Type()) {
+			return newError("argument %d to `%s` must be %s, got %s",
+				i+1, b.Name, b.Params[i], arg.Type())
+		}
+	}
+
+	return nil
+}
+
+// extremum returns the number for which better holds against every other one, given how
+// the two compare. The numbers are either args themselves or the elements of a single array argument.
+func extremum(name string, args []Object, better func(cmp int) bool) Object {
+	values := args
+	if len(args) == 1 && args[0].Type() == ARRAY_OBJ {
+		values = args[0].(*Array).Elements
+	}
+	if len(values) == 0 {
+		return newError("`%s` needs at least one value", name)
+	}
+
+	var result Object
+	for _, v := range values {
+		if _, ok := FloatValue(v); !ok {
+			return newError("argument to `%s` must be INTEGER or FLOAT, got %s", name, v.Type())
+		}
+		if result == nil || better(compareNumbers(v, result)) {
+			result = v
+		}
+	}
+
+	return result
+}
+
+// compareNumbers returns -1, 0 or 1 as a is less than, equal to or greater than b.
+// Two integers are compared exactly, otherwise both are compared as floats.
+func compareNumbers(a, b Object) int {
+	if a, ok := a.(*Integer); ok {
+		if b, ok := b.(*Integer); ok {
+			switch {
+			case a.Value < b.Value:
+				return -1
+			case a.Value > b.Value:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	aValue, _ := FloatValue(a)
+	bValue, _ := FloatValue(b)
+	switch {
+	case aValue < bValue:
+		return -1
+	case aValue > bValue:
+		return 1
+	}
+	return 0
+}
+
+// GetBuiltinByName returns the builtin named name, or nil if there is none
+func GetBuiltinByName(name string) *Builtin {
+	builtinsMu.RLock()
+	defer builtinsMu.RUnlock()
+
+	for _, def := range builtins {
+		if def.Name == name {
+			return def.Builtin
+		}
+	}
+	return nil
+}
+
+// flattenDeep appends the elements of arr that aren't arrays to elements, and those of the arrays
+// in it likewise. inside holds the arrays being flattened, an array nested in itself is an error.
+func flattenDeep(elements []Object, arr *Array, inside map[*Array]bool) ([]Object, *Error) {
+	if inside[arr] {
+		return nil, newError("cannot flatten an array nested in itself")
+	}
+	inside[arr] = true
+	defer delete(inside, arr)
+
+	for _, e := range arr.Elements {
+		inner, ok := e.(*Array)
+		if !ok {
+			elements = append(elements, e)
+			continue
+		}
+		var err *Error
+		if elements, err = flattenDeep(elements, inner, inside); err != nil {
+			return nil, err
+		}
+	}
+	return elements, nil
+}
+
+// indexWhere returns the index of the first of elements for which pred returns a value
+// whose truthiness is truthy, or -1. It stops at the first error of a call of pred.
+func indexWhere(host Host, elements []Object, pred Object, truthy bool) (int, error) {
+	for i, e := range elements {
+		result, err := host.Call(pred, e)
+		if err != nil {
+			return -1, err
+		}
+		if IsTruthy(result) == truthy {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// clampCount returns n limited to the range from 0 to length
+func clampCount(n int64, length int) int {
+	if n < 0 {
+		return 0
+	}
+	if n > int64(length) {
+		return length
+	}
+	return int(n)
+}
+
+func newError(format string, a ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf(format, a...)}
+}
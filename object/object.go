@@ -4,11 +4,18 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"math/big"
 	"monkey-compiler/ast"
+	"monkey-compiler/code"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-type BuiltinFunction func(args ...Object) Object
+// BuiltinFunction is the implementation of a builtin. args may be backed by the stack of the VM,
+// so a builtin that keeps them beyond the call has to copy them.
+type BuiltinFunction func(host Host, args ...Object) Object
 
 type ObjectType string
 
@@ -16,17 +23,26 @@ const (
 	NULL_OBJ  = "NULL"
 	ERROR_OBJ = "ERROR"
 
-	INTEGER_OBJ = "INTEGER"
-	BOOLEAN_OBJ = "BOOLEAN"
-	STRING_OBJ  = "STRING"
+	INTEGER_OBJ     = "INTEGER"
+	BIG_INTEGER_OBJ = "BIG_INTEGER"
+	FLOAT_OBJ       = "FLOAT"
+	BOOLEAN_OBJ     = "BOOLEAN"
+	STRING_OBJ      = "STRING"
 
 	RETURN_VALUE_OBJ = "RETURN_VALUE"
 
-	FUNCTION_OBJ = "FUNCTION"
-	BUILTIN_OBJ  = "BUILTIN"
+	FUNCTION_OBJ          = "FUNCTION"
+	BUILTIN_OBJ           = "BUILTIN"
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
+	CLOSURE_OBJ           = "CLOSURE"
+	PARTIAL_OBJ           = "PARTIAL"
+	MEMOIZED_OBJ          = "MEMOIZED"
 
-	ARRAY_OBJ = "ARRAY"
-	HASH_OBJ  = "HASH"
+	ARRAY_OBJ         = "ARRAY"
+	HASH_OBJ          = "HASH"
+	ARRAY_BUILDER_OBJ = "ARRAY_BUILDER"
+
+	STRING_BUILDER_OBJ = "STRING_BUILDER"
 )
 
 type HashKey struct {
@@ -53,6 +69,155 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+// BigInt is an integer beyond the range of Integer. Integer literals that don't fit in int64
+// are BigInts. Arithmetic and comparisons with at least one BigInt operand are exact, and
+// their results are BigInts only if they don't fit in an Integer, see NewBigInteger.
+// Arithmetic on two Integers is exact too: a result that overflows int64 is a BigInt,
+// see AddIntegers and the functions after it.
+type BigInt struct {
+	Value *big.Int
+}
+
+func (b *BigInt) Type() ObjectType { return BIG_INTEGER_OBJ }
+func (b *BigInt) Inspect() string  { return b.Value.String() }
+
+// NewBigInteger returns value as an Integer if it fits in int64 and as a BigInt otherwise,
+// so that a BigInt never holds a value an Integer could
+func NewBigInteger(value *big.Int) Object {
+	if value.IsInt64() {
+		return &Integer{Value: value.Int64()}
+	}
+	return &BigInt{Value: value}
+}
+
+// AddIntegers returns a + b, which is a BigInt if it overflows an Integer
+func AddIntegers(a, b int64) Object {
+	sum := a + b
+	if (sum > a) == (b > 0) {
+		return &Integer{Value: sum}
+	}
+	return NewBigInteger(new(big.Int).Add(big.NewInt(a), big.NewInt(b)))
+}
+
+// SubtractIntegers returns a - b, which is a BigInt if it overflows an Integer
+func SubtractIntegers(a, b int64) Object {
+	difference := a - b
+	if (difference < a) == (b > 0) {
+		return &Integer{Value: difference}
+	}
+	return NewBigInteger(new(big.Int).Sub(big.NewInt(a), big.NewInt(b)))
+}
+
+// MultiplyIntegers returns a * b, which is a BigInt if it overflows an Integer
+func MultiplyIntegers(a, b int64) Object {
+	if a == 0 || b == 0 {
+		return &Integer{Value: 0}
+	}
+	product := a * b
+	if product/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64) {
+		return &Integer{Value: product}
+	}
+	return NewBigInteger(new(big.Int).Mul(big.NewInt(a), big.NewInt(b)))
+}
+
+// DivideIntegers returns a / b truncated toward zero, which is a BigInt for the one quotient
+// overflowing an Integer, math.MinInt64 / -1. b must not be zero.
+func DivideIntegers(a, b int64) Object {
+	if a == math.MinInt64 && b == -1 {
+		return NegateInteger(a)
+	}
+	return &Integer{Value: a / b}
+}
+
+// NegateInteger returns -a, which is a BigInt for math.MinInt64
+func NegateInteger(a int64) Object {
+	if a == math.MinInt64 {
+		return &BigInt{Value: new(big.Int).Neg(big.NewInt(a))}
+	}
+	return &Integer{Value: -a}
+}
+
+// BigValue returns the value of an Integer or a BigInt as a big.Int, which the caller may modify.
+// It reports false for any other object.
+func BigValue(obj Object) (*big.Int, bool) {
+	switch obj := obj.(type) {
+	case *Integer:
+		return big.NewInt(obj.Value), true
+	case *BigInt:
+		return new(big.Int).Set(obj.Value), true
+	}
+	return nil, false
+}
+
+// IsBigIntegerOperation reports whether an operation on left and right is done on big integers,
+// which it is if both are integers and at least one of them is a BigInt
+func IsBigIntegerOperation(left, right Object) bool {
+	_, leftBig := left.(*BigInt)
+	_, rightBig := right.(*BigInt)
+	_, leftInteger := left.(*Integer)
+	_, rightInteger := right.(*Integer)
+	return (leftBig || leftInteger) && (rightBig || rightInteger) && (leftBig || rightBig)
+}
+
+// FloatValue returns the value of a float, or of an integer converted to the nearest float
+func FloatValue(obj Object) (float64, bool) {
+	switch obj := obj.(type) {
+	case *Float:
+		return obj.Value, true
+	case *Integer:
+		return float64(obj.Value), true
+	case *BigInt:
+		value, _ := new(big.Float).SetInt(obj.Value).Float64()
+		return value, true
+	}
+	return 0, false
+}
+
+// IsFloatOperation reports whether an operation on left and right is done on floats, which it is
+// if both are numbers and at least one of them is a Float. The other one is converted, see FloatValue.
+func IsFloatOperation(left, right Object) bool {
+	_, leftFloat := left.(*Float)
+	_, rightFloat := right.(*Float)
+	_, leftNumber := FloatValue(left)
+	_, rightNumber := FloatValue(right)
+	return leftNumber && rightNumber && (leftFloat || rightFloat)
+}
+
+// Float is a 64-bit floating point number, made by float literals, the float builtin and
+// arithmetic with at least one float operand.
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
+// Inspect prints the shortest representation which reads back as the value, see FormatFloat
+func (f *Float) Inspect() string { return FormatFloat(f.Value, -1) }
+
+// FormatFloat formats value rounded to precision significant digits, or with the fewest digits
+// which parse back to exactly value if precision is negative. Values from 1e-4 up to 1e16 are
+// written out, 1234.5 or 0.001, others with an exponent, 1e+16 or 1.5e-07. A whole value gets
+// a .0 so that it can't be mistaken for an integer: 1.0, not 1.
+func FormatFloat(value float64, precision int) string {
+	if precision >= 0 {
+		// round first, then print the rounded value like any other
+		if precision == 0 {
+			precision = 1
+		}
+		value, _ = strconv.ParseFloat(strconv.FormatFloat(value, 'e', precision-1, 64), 64)
+	}
+
+	format := byte('f')
+	if abs := math.Abs(value); abs >= 1e16 || abs != 0 && abs < 1e-4 {
+		format = 'e'
+	}
+	s := strconv.FormatFloat(value, format, -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -76,6 +241,27 @@ type Null struct{}
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 func (n *Null) Inspect() string  { return "null" }
 
+// TRUE, FALSE and NULL are the canonical values of their types.
+// The VM and the evaluator tell them apart by identity, so builtins, including those of
+// embedders, should return these instead of allocating booleans or nulls of their own.
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
+// IsTruthy reports whether obj counts as true in a condition: anything but false and null does
+func IsTruthy(obj Object) bool {
+	switch obj := obj.(type) {
+	case nil, *Null:
+		return false
+	case *Boolean:
+		return obj.Value
+	default:
+		return true
+	}
+}
+
 type ReturnValue struct {
 	Value Object
 }
@@ -85,6 +271,7 @@ func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
 type Error struct {
 	Message string
+	Thrown  Object // the value the program threw, if the error is a throw of the evaluator
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
@@ -130,6 +317,40 @@ func (s *String) HashKey() HashKey {
 
 type Builtin struct {
 	Fn BuiltinFunction
+
+	// Name is the name the builtin is called by in error messages
+	Name string
+	// Params lists the types accepted for each argument. Call rejects arguments that
+	// don't match before Fn runs, a nil Params leaves checking the arguments to Fn.
+	Params []ParamType
+
+	// Usage shows how the builtin is called, e.g. push(array, value)
+	Usage string
+	// Doc says in a line what the builtin does
+	Doc string
+}
+
+// ParamType is the set of types accepted for an argument of a builtin. An empty set accepts any type.
+type ParamType []ObjectType
+
+func (p ParamType) accepts(t ObjectType) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, accepted := range p {
+		if accepted == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ParamType) String() string {
+	types := make([]string, len(p))
+	for i, t := range p {
+		types[i] = string(t)
+	}
+	return strings.Join(types, " or ")
 }
 
 func (b *Builtin) Type() ObjectType { return BUILTIN_OBJ }
@@ -137,22 +358,12 @@ func (b *Builtin) Inspect() string  { return "builtin function" }
 
 type Array struct {
 	Elements []Object
+	Frozen   bool // set by freeze, a frozen array can't be assigned to
 }
 
 func (ao *Array) Type() ObjectType { return ARRAY_OBJ }
 func (ao *Array) Inspect() string {
-	var out bytes.Buffer
-
-	elements := make([]string, 0)
-	for _, e := range ao.Elements {
-		elements = append(elements, e.Inspect())
-	}
-
-	out.WriteString("[")
-	out.WriteString(strings.Join(elements, ", "))
-	out.WriteString("]")
-
-	return out.String()
+	return inspect(ao, make(map[Object]bool))
 }
 
 type HashPair struct {
@@ -161,22 +372,417 @@ type HashPair struct {
 }
 
 type Hash struct {
-	Pairs map[HashKey]HashPair
+	Pairs  map[HashKey]HashPair
+	Frozen bool // set by freeze, a frozen hash can't be assigned to
+}
+
+// SortedPairs returns the pairs of the hash in canonical order.
+// Anything iterating a hash should use it instead of ranging over Pairs,
+// whose order is random.
+func (h *Hash) SortedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		pairs = append(pairs, pair)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return hashKeyLess(pairs[i].Key, pairs[j].Key)
+	})
+
+	return pairs
+}
+
+// hashKeyLess orders keys by type name first, then by value within a type
+func hashKeyLess(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value < b.(*Integer).Value
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	}
+
+	return false
 }
 
 func (h *Hash) Type() ObjectType { return HASH_OBJ }
 func (h *Hash) Inspect() string {
+	return inspect(h, make(map[Object]bool))
+}
+
+// inspect is Inspect for obj nested in the arrays and hashes of inside.
+// An array or hash nested in itself is shown as [...] or {...} where it recurs.
+func inspect(obj Object, inside map[Object]bool) string {
 	var out bytes.Buffer
 
-	pairs := make([]string, 0)
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s",
-			pair.Key.Inspect(), pair.Value.Inspect()))
+	switch obj := obj.(type) {
+	case *Array:
+		if inside[obj] {
+			return "[...]"
+		}
+		inside[obj] = true
+		defer delete(inside, obj)
+
+		elements := make([]string, 0)
+		for _, e := range obj.Elements {
+			elements = append(elements, inspect(e, inside))
+		}
+
+		out.WriteString("[")
+		out.WriteString(strings.Join(elements, ", "))
+		out.WriteString("]")
+	case *Hash:
+		if inside[obj] {
+			return "{...}"
+		}
+		inside[obj] = true
+		defer delete(inside, obj)
+
+		pairs := make([]string, 0)
+		for _, pair := range obj.SortedPairs() {
+			pairs = append(pairs, fmt.Sprintf("%s: %s",
+				pair.Key.Inspect(), inspect(pair.Value, inside)))
+		}
+
+		out.WriteString("{")
+		out.WriteString(strings.Join(pairs, ", "))
+		out.WriteString("}")
+	default:
+		return obj.Inspect()
 	}
 
-	out.WriteString("{")
-	out.WriteString(strings.Join(pairs, ", "))
-	out.WriteString("}")
-
 	return out.String()
 }
+
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	NumLocals     int
+	NumParameters int
+	Name          string // the name the function is bound to by a let statement, if any
+	StartLine     int    // the source lines the function literal spans, 0 if unknown
+	EndLine       int
+}
+
+func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
+func (cf *CompiledFunction) Inspect() string {
+	return fmt.Sprintf("CompiledFunction[%p]", cf)
+}
+
+// Closure is a compiled function together with the free variables it captured
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []Object
+}
+
+func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
+
+// Partial is a function with its leading arguments bound, as returned by the partial builtin.
+// Calling it calls Fn with Args followed by the arguments of the call.
+type Partial struct {
+	Fn   Object
+	Args []Object
+}
+
+func (p *Partial) Type() ObjectType { return PARTIAL_OBJ }
+func (p *Partial) Inspect() string {
+	args := make([]string, 0, len(p.Args)+1)
+	args = append(args, p.Fn.Inspect())
+	for _, arg := range p.Args {
+		args = append(args, arg.Inspect())
+	}
+	return "partial(" + strings.Join(args, ", ") + ")"
+}
+
+// Memoized is a function whose results are cached by its arguments, as returned by the memoize builtin.
+// Calling it with arguments it was called with before returns the earlier result without calling Fn.
+type Memoized struct {
+	Fn    Object
+	Cache map[string]Object
+}
+
+func (m *Memoized) Type() ObjectType { return MEMOIZED_OBJ }
+func (m *Memoized) Inspect() string {
+	return "memoize(" + m.Fn.Inspect() + ")"
+}
+
+// Key returns the key of the result of calling m with args in Cache.
+// Results are only cached for hashable arguments: ok is false if any of args is not.
+func (m *Memoized) Key(args []Object) (key string, ok bool) {
+	var b strings.Builder
+	for _, arg := range args {
+		hashable, ok := arg.(Hashable)
+		if !ok {
+			return "", false
+		}
+		hashKey := hashable.HashKey()
+		fmt.Fprintf(&b, "%s:%d,", hashKey.Type, hashKey.Value)
+	}
+	return b.String(), true
+}
+
+// ArrayBuilder collects elements in place, so that building an array of n elements takes O(n)
+// where pushing them one by one takes O(n²)
+type ArrayBuilder struct {
+	Elements []Object
+}
+
+func (ab *ArrayBuilder) Type() ObjectType { return ARRAY_BUILDER_OBJ }
+func (ab *ArrayBuilder) Inspect() string {
+	return fmt.Sprintf("ArrayBuilder[%d]", len(ab.Elements))
+}
+
+// StringBuilder collects strings in place, so that building a string of n bytes takes O(n)
+// where concatenating the pieces with + one by one takes O(n²)
+type StringBuilder struct {
+	Builder strings.Builder
+}
+
+func (sb *StringBuilder) Type() ObjectType { return STRING_BUILDER_OBJ }
+func (sb *StringBuilder) Inspect() string {
+	return fmt.Sprintf("StringBuilder[%d]", sb.Builder.Len())
+}
+
+// Clone returns a deep copy of arrays and hashes, which isn't frozen even if they are.
+// Everything else is returned as is: integers, strings and booleans are immutable
+// and functions are shared. An array or hash nested in itself has no deep copy, so
+// Clone fails for it.
+func Clone(obj Object) (Object, error) {
+	return clone(obj, make(map[Object]bool))
+}
+
+// clone is Clone for obj nested in the arrays and hashes of inside
+func clone(obj Object, inside map[Object]bool) (Object, error) {
+	switch obj := obj.(type) {
+	case *Array:
+		if inside[obj] {
+			return nil, nestedInItself("clone", obj)
+		}
+		inside[obj] = true
+		defer delete(inside, obj)
+
+		elements := make([]Object, len(obj.Elements))
+		for i, e := range obj.Elements {
+			var err error
+			if elements[i], err = clone(e, inside); err != nil {
+				return nil, err
+			}
+		}
+		return &Array{Elements: elements}, nil
+	case *Hash:
+		if inside[obj] {
+			return nil, nestedInItself("clone", obj)
+		}
+		inside[obj] = true
+		defer delete(inside, obj)
+
+		pairs := make(map[HashKey]HashPair, len(obj.Pairs))
+		for key, pair := range obj.Pairs {
+			value, err := clone(pair.Value, inside)
+			if err != nil {
+				return nil, err
+			}
+			pairs[key] = HashPair{Key: pair.Key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+	default:
+		return obj, nil
+	}
+}
+
+// nestedInItself is the error of doing what to the array or hash container, which contains itself
+func nestedInItself(what string, container Object) error {
+	if _, ok := container.(*Hash); ok {
+		return fmt.Errorf("cannot %s a hash nested in itself", what)
+	}
+	return fmt.Errorf("cannot %s an array nested in itself", what)
+}
+
+// SetIndex stores value at index of the array or hash left: a[index] = value
+func SetIndex(left, index, value Object) error {
+	switch left := left.(type) {
+	case *Array:
+		if left.Frozen {
+			return fmt.Errorf("cannot assign to frozen ARRAY")
+		}
+		i, ok := index.(*Integer)
+		if !ok {
+			return fmt.Errorf("array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return fmt.Errorf("index out of range: %d", i.Value)
+		}
+		left.Elements[i.Value] = value
+	case *Hash:
+		if left.Frozen {
+			return fmt.Errorf("cannot assign to frozen HASH")
+		}
+		key, ok := index.(Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = HashPair{Key: index, Value: value}
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+
+	return nil
+}
+
+// Repeat returns the string or array left repeated count times: "ab" * 3 is "ababab".
+// The elements of a repeated array are the same objects, they are not cloned.
+func Repeat(left Object, count int64) (Object, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("negative repeat count: %d", count)
+	}
+
+	switch left := left.(type) {
+	case *String:
+		if len(left.Value) > 0 && count > int64(math.MaxInt/len(left.Value)) {
+			return nil, fmt.Errorf("repeat count too large: %d", count)
+		}
+		return &String{Value: strings.Repeat(left.Value, int(count))}, nil
+	case *Array:
+		if len(left.Elements) > 0 && count > int64(math.MaxInt/len(left.Elements)) {
+			return nil, fmt.Errorf("repeat count too large: %d", count)
+		}
+		elements := make([]Object, 0, len(left.Elements)*int(count))
+		for i := int64(0); i < count; i++ {
+			elements = append(elements, left.Elements...)
+		}
+		return &Array{Elements: elements}, nil
+	default:
+		return nil, fmt.Errorf("cannot repeat %s", left.Type())
+	}
+}
+
+// CompareArrays orders two arrays lexicographically: their elements are compared in turn and the
+// first pair that differs decides, so [1, 2] < [1, 3]. An array which is a prefix of the other
+// is less than it, [1] < [1, 0], and arrays with equal elements are equal. It returns -1, 0 or +1.
+// Only integers and arrays are ordered, comparing elements of any other type is an error, as is
+// comparing an array nested in itself.
+func CompareArrays(left, right *Array) (int, error) {
+	return compareArrays(left, right, make(map[*Array]bool))
+}
+
+// compareArrays is CompareArrays for left nested in the arrays of inside
+func compareArrays(left, right *Array, inside map[*Array]bool) (int, error) {
+	if inside[left] {
+		return 0, nestedInItself("compare", left)
+	}
+	inside[left] = true
+	defer delete(inside, left)
+
+	for i := 0; i < len(left.Elements) && i < len(right.Elements); i++ {
+		cmp, err := compareElements(left.Elements[i], right.Elements[i], inside)
+		if err != nil || cmp != 0 {
+			return cmp, err
+		}
+	}
+
+	switch {
+	case len(left.Elements) < len(right.Elements):
+		return -1, nil
+	case len(left.Elements) > len(right.Elements):
+		return 1, nil
+	default:
+		return 0, nil
+	}
+}
+
+func compareElements(left, right Object, inside map[*Array]bool) (int, error) {
+	leftArray, leftOk := left.(*Array)
+	rightArray, rightOk := right.(*Array)
+	if leftOk && rightOk {
+		return compareArrays(leftArray, rightArray, inside)
+	}
+
+	leftValue, leftOk := BigValue(left)
+	rightValue, rightOk := BigValue(right)
+	if leftOk && rightOk {
+		return leftValue.Cmp(rightValue), nil
+	}
+	return 0, fmt.Errorf("cannot compare %s and %s", left.Type(), right.Type())
+}
+
+// Equals reports whether a and b are structurally equal: values of the same type
+// with equal contents, comparing arrays element-wise and hashes pair-wise.
+// Values without contents to compare, like functions, are only equal to themselves.
+// Comparing the contents of an array or hash nested in itself would never end, so
+// Equals fails when it gets to one.
+func Equals(a, b Object) (bool, error) {
+	return equals(a, b, make(map[Object]bool))
+}
+
+// equals is Equals for a nested in the arrays and hashes of inside. Only a is tracked:
+// while a is nested in itself, b can't be walked further than a.
+func equals(a, b Object, inside map[Object]bool) (bool, error) {
+	if a == b {
+		return true, nil
+	}
+	if a.Type() != b.Type() {
+		return false, nil
+	}
+
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value == b.(*Integer).Value, nil
+	case *BigInt:
+		return a.Value.Cmp(b.(*BigInt).Value) == 0, nil
+	case *Float:
+		return a.Value == b.(*Float).Value, nil
+	case *Boolean:
+		return a.Value == b.(*Boolean).Value, nil
+	case *String:
+		return a.Value == b.(*String).Value, nil
+	case *Null:
+		return true, nil
+	case *Array:
+		other := b.(*Array)
+		if len(a.Elements) != len(other.Elements) {
+			return false, nil
+		}
+		if inside[a] {
+			return false, nestedInItself("compare", a)
+		}
+		inside[a] = true
+		defer delete(inside, a)
+
+		for i, e := range a.Elements {
+			if eq, err := equals(e, other.Elements[i], inside); !eq || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case *Hash:
+		other := b.(*Hash)
+		if len(a.Pairs) != len(other.Pairs) {
+			return false, nil
+		}
+		if inside[a] {
+			return false, nestedInItself("compare", a)
+		}
+		inside[a] = true
+		defer delete(inside, a)
+
+		for key, pair := range a.Pairs {
+			otherPair, ok := other.Pairs[key]
+			if !ok {
+				return false, nil
+			}
+			if eq, err := equals(pair.Value, otherPair.Value, inside); !eq || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
@@ -1,6 +1,10 @@
 package object
 
-import "testing"
+import (
+	"math"
+	"strconv"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -58,3 +62,214 @@ func TestIntegerHashKey(t *testing.T) {
 		t.Errorf("integers with twoerent content have same hash keys")
 	}
 }
+
+func TestHashSortedPairs(t *testing.T) {
+	keys := []Object{
+		&String{Value: "b"},
+		&Integer{Value: 10},
+		&Boolean{Value: true},
+		&String{Value: "a"},
+		&Integer{Value: -1},
+		&Boolean{Value: false},
+	}
+
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	for _, key := range keys {
+		hash.Pairs[key.(Hashable).HashKey()] = HashPair{Key: key, Value: key}
+	}
+
+	expected := []string{"false", "true", "-1", "10", "a", "b"}
+
+	pairs := hash.SortedPairs()
+	if len(pairs) != len(expected) {
+		t.Fatalf("number of pairs wrong. want=%d, got=%d", len(expected), len(pairs))
+	}
+	for i, pair := range pairs {
+		if pair.Key.Inspect() != expected[i] {
+			t.Errorf("pairs[%d] key wrong. want=%s, got=%s", i, expected[i], pair.Key.Inspect())
+		}
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{1, "1.0"},
+		{-2, "-2.0"},
+		{0, "0.0"},
+		{math.Copysign(0, -1), "-0.0"},
+		{3.14, "3.14"},
+		{0.30000000000000004, "0.30000000000000004"},
+		{1e6, "1000000.0"},
+		{123456789.125, "123456789.125"},
+		{1e15, "1000000000000000.0"},
+		{1e16, "1e+16"},
+		{1.5e300, "1.5e+300"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{0.0001, "0.0001"},
+		{0.00001, "1e-05"},
+		{1.5e-7, "1.5e-07"},
+		{5e-324, "5e-324"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tt := range tests {
+		s := (&Float{Value: tt.value}).Inspect()
+		if s != tt.expected {
+			t.Errorf("Inspect of %v wrong. want=%q, got=%q", tt.value, tt.expected, s)
+		}
+		if value, err := strconv.ParseFloat(s, 64); err != nil || value != tt.value && !math.IsNaN(value) {
+			t.Errorf("%q doesn't read back as %v: %v, %v", s, tt.value, value, err)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		value     float64
+		precision int
+		expected  string
+	}{
+		{0.30000000000000004, 15, "0.3"},
+		{3.14159, 3, "3.14"},
+		{1234.5, 2, "1200.0"},
+		{2.7, 0, "3.0"},
+		{0.000123456, 2, "0.00012"},
+		{1.23456e-9, 3, "1.23e-09"},
+		{9.99e20, 1, "1e+21"},
+	}
+
+	for _, tt := range tests {
+		if s := FormatFloat(tt.value, tt.precision); s != tt.expected {
+			t.Errorf("FormatFloat(%v, %d) wrong. want=%q, got=%q", tt.value, tt.precision, tt.expected, s)
+		}
+	}
+}
+
+func TestEquals(t *testing.T) {
+	hash := func(pairs ...Object) *Hash {
+		h := &Hash{Pairs: map[HashKey]HashPair{}}
+		for i := 0; i < len(pairs); i += 2 {
+			h.Pairs[pairs[i].(Hashable).HashKey()] = HashPair{Key: pairs[i], Value: pairs[i+1]}
+		}
+		return h
+	}
+	one := &Integer{Value: 1}
+	two := &Integer{Value: 2}
+	a := &String{Value: "a"}
+
+	tests := []struct {
+		a, b     Object
+		expected bool
+	}{
+		{one, &Integer{Value: 1}, true},
+		{one, two, false},
+		{a, &String{Value: "a"}, true},
+		{&Boolean{Value: true}, &Boolean{Value: true}, true},
+		{&Null{}, &Null{}, true},
+		{one, a, false},
+		{&Array{Elements: []Object{one, &Array{Elements: []Object{a}}}}, &Array{Elements: []Object{one, &Array{Elements: []Object{a}}}}, true},
+		{&Array{Elements: []Object{one}}, &Array{Elements: []Object{two}}, false},
+		{hash(a, &Array{Elements: []Object{one}}), hash(a, &Array{Elements: []Object{one}}), true},
+		{hash(a, one), hash(a, two), false},
+		{hash(a, one), hash(a, one, two, two), false},
+		{&Builtin{}, &Builtin{}, false},
+	}
+
+	for _, tt := range tests {
+		if got, err := Equals(tt.a, tt.b); got != tt.expected || err != nil {
+			t.Errorf("Equals(%s, %s) wrong. want=%t, got=%t (%v)", tt.a.Inspect(), tt.b.Inspect(), tt.expected, got, err)
+		}
+	}
+}
+
+func TestNestedInItself(t *testing.T) {
+	array := &Array{Elements: []Object{&Integer{Value: 1}, nil}}
+	array.Elements[1] = array
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	key := &String{Value: "self"}
+	hash.Pairs[key.HashKey()] = HashPair{Key: key, Value: &Array{Elements: []Object{hash}}}
+	other := &Array{Elements: []Object{&Integer{Value: 1}, nil}}
+	other.Elements[1] = other
+
+	if got := array.Inspect(); got != "[1, [...]]" {
+		t.Errorf("array inspected wrong. want=%q, got=%q", "[1, [...]]", got)
+	}
+	if got := hash.Inspect(); got != "{self: [{...}]}" {
+		t.Errorf("hash inspected wrong. want=%q, got=%q", "{self: [{...}]}", got)
+	}
+	// the same array twice isn't nested in itself
+	shared := &Array{Elements: []Object{&Integer{Value: 2}}}
+	if got := (&Array{Elements: []Object{shared, shared}}).Inspect(); got != "[[2], [2]]" {
+		t.Errorf("shared array inspected wrong. want=%q, got=%q", "[[2], [2]]", got)
+	}
+
+	if _, err := Clone(array); err == nil || err.Error() != "cannot clone an array nested in itself" {
+		t.Errorf("cloning array wrong. got=%v", err)
+	}
+	if _, err := Clone(hash); err == nil || err.Error() != "cannot clone a hash nested in itself" {
+		t.Errorf("cloning hash wrong. got=%v", err)
+	}
+	if eq, err := Equals(array, array); !eq || err != nil {
+		t.Errorf("array not equal to itself. got=%t (%v)", eq, err)
+	}
+	if _, err := Equals(array, other); err == nil || err.Error() != "cannot compare an array nested in itself" {
+		t.Errorf("comparing arrays wrong. got=%v", err)
+	}
+}
+
+func TestRegisterBuiltin(t *testing.T) {
+	if _, err := RegisterBuiltin("len", &Builtin{}); err == nil || err.Error() != "builtin len is already registered" {
+		t.Errorf("registering len again wrong. got=%v", err)
+	}
+
+	double := &Builtin{Params: []ParamType{{INTEGER_OBJ}}, Fn: func(host Host, args ...Object) Object {
+		return &Integer{Value: args[0].(*Integer).Value * 2}
+	}}
+	index, err := RegisterBuiltin("double", double)
+	if err != nil {
+		t.Fatalf("register error: %s", err)
+	}
+	// unregister double again, so that the test can run again and other tests see the builtins as they were
+	t.Cleanup(func() {
+		builtinsMu.Lock()
+		defer builtinsMu.Unlock()
+		builtins = builtins[:index]
+	})
+	if BuiltinAt(index) != double || GetBuiltinByName("double") != double {
+		t.Errorf("registered builtin not found at index %d", index)
+	}
+	if double.Name != "double" {
+		t.Errorf("builtin name wrong. want=%q, got=%q", "double", double.Name)
+	}
+	definitions := BuiltinDefinitions()
+	if last := definitions[len(definitions)-1]; last.Name != "double" || index != len(definitions)-1 {
+		t.Errorf("registered builtin not appended. got=%s at %d", last.Name, index)
+	}
+}
+
+// TestBuiltinIndices pins the index of every builtin. Bytecode refers to builtins by index,
+// so builtins may only be appended: one inserted in the middle would renumber the others.
+func TestBuiltinIndices(t *testing.T) {
+	expected := []string{
+		"len", "puts", "first", "last", "rest", "push", "keys", "values", "min", "max",
+		"abs", "clamp", "equals", "rand", "now", "exit", "assert", "partial", "clone", "freeze",
+		"float", "int", "memoize", "newArrayBuilder", "append", "build", "zip", "reverse", "take", "drop",
+		"find", "findIndex", "all", "any", "flatten", "flattenDeep", "groupBy", "newBuilder", "toString", "ord",
+		"chr", "substr",
+	}
+
+	definitions := BuiltinDefinitions()
+	if len(definitions) < len(expected) {
+		t.Fatalf("number of builtins wrong. want at least %d, got=%d", len(expected), len(definitions))
+	}
+	for i, name := range expected {
+		if definitions[i].Name != name {
+			t.Errorf("builtin %d wrong. want=%s, got=%s", i, name, definitions[i].Name)
+		}
+	}
+}
@@ -1,18 +1,23 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
 	"monkey-compiler/ast"
 	"monkey-compiler/lexer"
 	"monkey-compiler/token"
 	"strconv"
+	"strings"
 )
 
 const (
 	_ int = iota
 	LOWEST
+	NULLISH     // a ?? b
 	EQUALS      // ==
 	LESSGREATER // > or <
+	PIPELINE    // x |> f
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
@@ -21,15 +26,20 @@ const (
 )
 
 var precedences = map[token.TokenType]int{
+	token.PIPELINE: PIPELINE,
+	token.NULLISH:  NULLISH,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSGREATER,
 	token.GT:       LESSGREATER,
+	token.LT_EQ:    LESSGREATER,
+	token.GT_EQ:    LESSGREATER,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
 	token.ASTERISK: PRODUCT,
 	token.LPAREN:   CALL,
+	token.OPTIONAL: CALL,
 	token.LBRACKET: INDEX,
 }
 
@@ -39,14 +49,24 @@ type (
 )
 
 type Parser struct {
-	l      *lexer.Lexer
-	errors []string
+	l         *lexer.Lexer
+	errors    []string
+	positions []Position // of errors
 
 	curToken  token.Token
 	peekToken token.Token
 
+	// comments read by the lexer before curToken and peekToken
+	curComments  []string
+	peekComments []string
+
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
+
+	// newlineEnds is set by SetNewlineEnds
+	newlineEnds bool
+	// grouped is set inside parentheses, brackets and hash literals, where a newline never ends an expression
+	grouped bool
 }
 
 func New(l *lexer.Lexer) *Parser {
@@ -58,16 +78,23 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
+	p.registerPrefix(token.RAW_STRING, p.parseRawStringLiteral)
+	p.registerPrefix(token.PIPE, p.parseLambda)
+	p.registerPrefix(token.ELLIPSIS, p.parseSpreadExpression)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
+	p.registerPrefix(token.NULL, p.parseNull)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
+	p.registerPrefix(token.THROW, p.parseThrowExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
-	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
+	p.registerPrefix(token.LBRACE, p.parseBraceExpression)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -78,9 +105,14 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.PIPELINE, p.parseInfixExpression)
+	p.registerInfix(token.NULLISH, p.parseInfixExpression)
 
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.OPTIONAL, p.parseOptionalExpression)
 
 	// Read two tokens, so curToken and peekToken are both set
 	p.nextToken()
@@ -91,7 +123,9 @@ func New(l *lexer.Lexer) *Parser {
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
+	p.curComments = p.peekComments
 	p.peekToken = p.l.NextToken()
+	p.peekComments = p.l.TakeComments()
 }
 
 func (p *Parser) curTokenIs(t token.TokenType) bool {
@@ -112,19 +146,84 @@ func (p *Parser) expectPeek(t token.TokenType) bool {
 	}
 }
 
+// setGrouped sets whether newlines can end expressions and returns a function restoring the previous setting
+func (p *Parser) setGrouped(grouped bool) (restore func()) {
+	previous := p.grouped
+	p.grouped = grouped
+	return func() { p.grouped = previous }
+}
+
+// SetNewlineEnds sets whether a line starting with (, [ or - starts a new statement instead
+// of continuing the expression on the line before. It is off by default, so that f followed
+// by (1) on the next line is the call f(1) and a followed by - b is a - b, as in programs
+// written before the option existed.
+func (p *Parser) SetNewlineEnds(ends bool) {
+	p.newlineEnds = ends
+}
+
+// endsAtNewline reports whether the expression being parsed ends before peekToken, which
+// is on a new line. It is always false unless SetNewlineEnds was called. Outside of
+// parentheses and brackets a line starting with (, [ or - then starts a new statement
+// rather than calling, indexing or subtracting from the line before. Other operators
+// continue the expression, so 1 + 2 on one line and 3 + 4 on the next are two statements
+// without a semicolon between them either way.
+func (p *Parser) endsAtNewline() bool {
+	if !p.newlineEnds || p.grouped || p.peekToken.Line <= p.curToken.Line {
+		return false
+	}
+
+	switch p.peekToken.Type {
+	case token.LPAREN, token.LBRACKET, token.MINUS:
+		return true
+	}
+	return false
+}
+
 func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// Position is where in the source an error was found
+type Position struct {
+	Line   int // starting at 1
+	Column int // starting at 1
+}
+
+// ErrorPositions returns the position of the token each of Errors was found at, in the same order
+func (p *Parser) ErrorPositions() []Position {
+	return p.positions
+}
+
+// ErrorList is all errors found parsing a program, as a single error
+type ErrorList []string
+
+// Error renders the errors one per line
+func (e ErrorList) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// Err returns the errors found so far as an ErrorList, or nil if there are none
+func (p *Parser) Err() error {
+	if len(p.errors) == 0 {
+		return nil
+	}
+	return ErrorList(p.errors)
+}
+
+// addError records an error found at the token tok, prefixed with its line
+func (p *Parser) addError(tok token.Token, format string, a ...interface{}) {
+	msg := fmt.Sprintf("line %d: ", tok.Line) + fmt.Sprintf(format, a...)
+	p.errors = append(p.errors, msg)
+	p.positions = append(p.positions, Position{Line: tok.Line, Column: tok.Column})
+}
+
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead",
+	p.addError(p.peekToken, "expected next token to be %s, got %s instead",
 		t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.addError(p.curToken, "no prefix parse function for %s found", t)
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -148,19 +247,52 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.DO:
+		return p.parseDoWhileStatement("")
+	case token.BREAK:
+		stmt := &ast.BreakStatement{Token: p.curToken}
+		stmt.Label = p.parseLoopLabel()
+		p.skipSemicolon()
+		return stmt
+	case token.CONTINUE:
+		stmt := &ast.ContinueStatement{Token: p.curToken}
+		stmt.Label = p.parseLoopLabel()
+		p.skipSemicolon()
+		return stmt
+	case token.IDENT:
+		if !p.peekTokenIs(token.COLON) {
+			return p.parseExpressionStatement()
+		}
+		label := p.curToken.Literal
+		p.nextToken()
+		return p.parseLabeledLoop(label)
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
 func (p *Parser) parseLetStatement() *ast.LetStatement {
-	stmt := &ast.LetStatement{Token: p.curToken}
+	stmt := &ast.LetStatement{Token: p.curToken, Comments: p.curComments}
 
 	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
 
 	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Name.Type = p.parseTypeAnnotation()
+
+	if p.peekTokenIs(token.COMMA) {
+		stmt.Names = []*ast.Identifier{stmt.Name}
+		for p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil
+			}
+			name := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			name.Type = p.parseTypeAnnotation()
+			stmt.Names = append(stmt.Names, name)
+		}
+	}
 
 	if !p.expectPeek(token.ASSIGN) {
 		return nil
@@ -170,6 +302,11 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 
 	stmt.Value = p.parseExpression(LOWEST)
 
+	if fl, ok := stmt.Value.(*ast.FunctionLiteral); ok && stmt.Names == nil {
+		fl.Name = stmt.Name.Value
+		fl.Comments = stmt.Comments
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -184,6 +321,17 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 
 	stmt.ReturnValue = p.parseExpression(LOWEST)
 
+	// return a, b returns the array [a, b]
+	if p.peekTokenIs(token.COMMA) {
+		values := &ast.ArrayLiteral{Token: stmt.Token, Elements: []ast.Expression{stmt.ReturnValue}}
+		for p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+			p.nextToken()
+			values.Elements = append(values.Elements, p.parseExpression(LOWEST))
+		}
+		stmt.ReturnValue = values
+	}
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -191,11 +339,86 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
-func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
+// parseLabeledLoop parses a loop after the colon following its label
+func (p *Parser) parseLabeledLoop(label string) ast.Statement {
+	if !p.peekTokenIs(token.DO) {
+		p.addError(p.peekToken, "expected do after label %s, got %s instead", label, p.peekToken.Type)
+		return nil
+	}
+	p.nextToken()
+	return p.parseDoWhileStatement(label)
+}
+
+// parseLoopLabel parses the label after break or continue, which is on the same line
+func (p *Parser) parseLoopLabel() string {
+	if !p.peekTokenIs(token.IDENT) || p.peekToken.Line != p.curToken.Line {
+		return ""
+	}
+	p.nextToken()
+	return p.curToken.Literal
+}
+
+func (p *Parser) parseDoWhileStatement(label string) ast.Statement {
+	stmt := &ast.DoWhileStatement{Token: p.curToken, Label: label}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+
+	if !p.expectPeek(token.WHILE) {
+		return nil
+	}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+
+	restore := p.setGrouped(true)
+	p.nextToken()
+	stmt.Condition = p.parseExpression(LOWEST)
+	restore()
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	p.skipSemicolon()
+
+	return stmt
+}
+
+// skipSemicolon skips the semicolon ending the statement just parsed, if there is one
+func (p *Parser) skipSemicolon() {
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+}
+
+func (p *Parser) parseExpressionStatement() ast.Statement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 
 	stmt.Expression = p.parseExpression(LOWEST)
 
+	if target, ok := stmt.Expression.(*ast.IndexExpression); ok && p.peekTokenIs(token.ASSIGN) {
+		if target.Optional {
+			p.addError(p.peekToken, "cannot assign to optional index %s", target)
+		}
+		return p.parseIndexAssignStatement(target)
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseIndexAssignStatement(target *ast.IndexExpression) *ast.IndexAssignStatement {
+	p.nextToken()
+	stmt := &ast.IndexAssignStatement{Token: p.curToken, Target: target}
+
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
@@ -211,7 +434,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	}
 	leftExp := prefix()
 
-	for !p.peekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
+	for !p.peekTokenIs(token.SEMICOLON) && !p.endsAtNewline() && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
 			return leftExp
@@ -248,10 +471,26 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 
-	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	digits, ok := stripDigitSeparators(p.curToken.Literal)
+	if !ok {
+		p.addError(p.curToken, "could not parse %q as integer: _ must separate two digits", p.curToken.Literal)
+		return nil
+	}
+
+	value, err := strconv.ParseInt(digits, 0, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		// too large for int64, the literal becomes a big integer
+		if value, ok := new(big.Int).SetString(digits, 0); ok {
+			lit.Big = value
+			return lit
+		}
+	}
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		if len(p.curToken.Literal) == 2 && p.curToken.Literal[0] == '0' {
+			p.addError(p.curToken, "could not parse %q as integer: no digits after base prefix", p.curToken.Literal)
+		} else {
+			p.addError(p.curToken, "could not parse %q as integer", p.curToken.Literal)
+		}
 		return nil
 	}
 
@@ -260,10 +499,107 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	return lit
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+
+	whole, fraction, _ := strings.Cut(p.curToken.Literal, ".")
+	wholeDigits, ok := stripDigitSeparators(whole)
+	fractionDigits, fractionOk := stripDigitSeparators(fraction)
+	if !ok || !fractionOk {
+		p.addError(p.curToken, "could not parse %q as float: _ must separate two digits", p.curToken.Literal)
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(wholeDigits+"."+fractionDigits, 64)
+	if err != nil {
+		p.addError(p.curToken, "could not parse %q as float", p.curToken.Literal)
+		return nil
+	}
+
+	lit.Value = value
+
+	return lit
+}
+
+// stripDigitSeparators removes the underscores of an integer literal like 1_000.
+// It reports false if an underscore is leading, trailing or next to another one.
+func stripDigitSeparators(literal string) (string, bool) {
+	prefix, digits := "", literal
+	if len(literal) > 2 && literal[0] == '0' && strings.ContainsRune("xXbBoO", rune(literal[1])) {
+		prefix, digits = literal[:2], literal[2:]
+	}
+
+	for i := 0; i < len(digits); i++ {
+		if digits[i] != '_' {
+			continue
+		}
+		if i == 0 || i == len(digits)-1 || digits[i-1] == '_' {
+			return "", false
+		}
+	}
+
+	return prefix + strings.ReplaceAll(digits, "_", ""), true
+}
+
 func (p *Parser) parseStringLiteral() ast.Expression {
+	value, err := unescape(p.curToken.Literal)
+	if err != nil {
+		p.addError(p.curToken, "could not parse %q as string: %s", p.curToken.Literal, err)
+		return nil
+	}
+
+	return &ast.StringLiteral{Token: p.curToken, Value: value}
+}
+
+// parseRawStringLiteral parses a backquoted string, whose contents are taken as they are
+func (p *Parser) parseRawStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+// unescape decodes the escape sequences \n, \t, \r, \\, \" and \xNN of a string literal.
+// It returns an error describing the first malformed sequence, if any.
+func unescape(literal string) (string, error) {
+	if !strings.ContainsRune(literal, '\\') {
+		return literal, nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(literal); i++ {
+		if literal[i] != '\\' {
+			out.WriteByte(literal[i])
+			continue
+		}
+
+		i++
+		if i == len(literal) {
+			return "", fmt.Errorf("unterminated escape sequence")
+		}
+		switch literal[i] {
+		case 'n':
+			out.WriteByte('\n')
+		case 't':
+			out.WriteByte('\t')
+		case 'r':
+			out.WriteByte('\r')
+		case '\\', '"':
+			out.WriteByte(literal[i])
+		case 'x':
+			if i+3 > len(literal) {
+				return "", fmt.Errorf("\\x needs two hexadecimal digits")
+			}
+			b, err := strconv.ParseUint(literal[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("\\x needs two hexadecimal digits")
+			}
+			out.WriteByte(byte(b))
+			i += 2
+		default:
+			return "", fmt.Errorf("unknown escape sequence \\%c", literal[i])
+		}
+	}
+	return out.String(), nil
+}
+
 func (p *Parser) parsePrefixExpression() ast.Expression {
 	expression := &ast.PrefixExpression{
 		Token:    p.curToken,
@@ -295,7 +631,13 @@ func (p *Parser) parseBoolean() ast.Expression {
 	return &ast.Boolean{Token: p.curToken, Value: p.curTokenIs(token.TRUE)}
 }
 
+func (p *Parser) parseNull() ast.Expression {
+	return &ast.Null{Token: p.curToken}
+}
+
 func (p *Parser) parseGroupedExpression() ast.Expression {
+	defer p.setGrouped(true)()
+
 	p.nextToken()
 
 	exp := p.parseExpression(LOWEST)
@@ -314,8 +656,10 @@ func (p *Parser) parseIfExpression() ast.Expression {
 		return nil
 	}
 
+	restore := p.setGrouped(true)
 	p.nextToken()
 	expression.Condition = p.parseExpression(LOWEST)
+	restore()
 
 	if !p.expectPeek(token.RPAREN) {
 		return nil
@@ -340,10 +684,67 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expression
 }
 
+func (p *Parser) parseTryExpression() ast.Expression {
+	expression := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expression.Body = p.parseBlockStatement()
+
+	// catch may only be left out if there's a finally
+	if !p.peekTokenIs(token.FINALLY) {
+		if !p.expectPeek(token.CATCH) {
+			return nil
+		}
+		if !p.expectPeek(token.LPAREN) {
+			return nil
+		}
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		expression.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Handler = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Finally = p.parseBlockStatement()
+	}
+
+	return expression
+}
+
+// parseThrowExpression parses throw value. The value extends as far as possible, like that of a
+// return: throw "bad " + x throws the concatenation.
+func (p *Parser) parseThrowExpression() ast.Expression {
+	expression := &ast.ThrowExpression{Token: p.curToken}
+
+	p.nextToken()
+	expression.Value = p.parseExpression(LOWEST)
+	if expression.Value == nil {
+		return nil
+	}
+
+	return expression
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
 
+	defer p.setGrouped(false)()
+
 	p.nextToken()
 
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
@@ -364,21 +765,48 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
-	lit.Parameters = p.parseFunctionParameters()
+	lit.Parameters = p.parseFunctionParameters(token.RPAREN)
+	lit.ReturnType = p.parseTypeAnnotation()
 
 	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
 
 	lit.Body = p.parseBlockStatement()
+	lit.EndLine = p.curToken.Line
+
+	return lit
+}
+
+// parseLambda parses the short form |x, y| x + y of fn(x, y) { x + y }.
+// Its body is a single expression. It yields the same function literal as the long form.
+func (p *Parser) parseLambda() ast.Expression {
+	pipe := p.curToken
+	lit := &ast.FunctionLiteral{Token: token.Token{Type: token.FUNCTION, Literal: "fn", Line: pipe.Line, Column: pipe.Column}}
+
+	lit.Parameters = p.parseFunctionParameters(token.PIPE)
+	if lit.Parameters == nil {
+		return nil
+	}
+
+	p.nextToken()
+	stmt := &ast.ExpressionStatement{Token: p.curToken}
+	stmt.Expression = p.parseExpression(LOWEST)
+	if stmt.Expression == nil {
+		return nil
+	}
+
+	lit.Body = &ast.BlockStatement{Token: pipe, Statements: []ast.Statement{stmt}}
+	lit.EndLine = p.curToken.Line
 
 	return lit
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Identifier {
+// parseFunctionParameters parses a comma separated list of parameter names up to the end token
+func (p *Parser) parseFunctionParameters(end token.TokenType) []*ast.Identifier {
 	identifiers := []*ast.Identifier{}
 
-	if p.peekTokenIs(token.RPAREN) {
+	if p.peekTokenIs(end) {
 		p.nextToken()
 		return identifiers
 	}
@@ -386,22 +814,55 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 	p.nextToken()
 
 	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	ident.Type = p.parseTypeAnnotation()
 	identifiers = append(identifiers, ident)
 
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
 		p.nextToken()
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		ident.Type = p.parseTypeAnnotation()
 		identifiers = append(identifiers, ident)
 	}
 
-	if !p.expectPeek(token.RPAREN) {
+	if !p.expectPeek(end) {
 		return nil
 	}
 
 	return identifiers
 }
 
+// parseTypeAnnotation parses the optional ": type" following a name being bound or the
+// parameters of a function, and returns the name of the type. Which types exist is up
+// to the compiler, fn is the one type named by a keyword.
+func (p *Parser) parseTypeAnnotation() string {
+	if !p.peekTokenIs(token.COLON) {
+		return ""
+	}
+	p.nextToken()
+
+	if p.peekTokenIs(token.FUNCTION) {
+		p.nextToken()
+		return p.curToken.Literal
+	}
+	if !p.expectPeek(token.IDENT) {
+		return ""
+	}
+	return p.curToken.Literal
+}
+
+func (p *Parser) parseSpreadExpression() ast.Expression {
+	spread := &ast.SpreadExpression{Token: p.curToken}
+
+	p.nextToken()
+	spread.Value = p.parseExpression(LOWEST)
+	if spread.Value == nil {
+		return nil
+	}
+
+	return spread
+}
+
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments = p.parseExpressionList(token.RPAREN)
@@ -411,6 +872,8 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 	list := []ast.Expression{}
 
+	defer p.setGrouped(true)()
+
 	if p.peekTokenIs(end) {
 		p.nextToken()
 		return list
@@ -443,6 +906,8 @@ func (p *Parser) parseArrayLiteral() ast.Expression {
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	exp := &ast.IndexExpression{Token: p.curToken, Left: left}
 
+	defer p.setGrouped(true)()
+
 	p.nextToken()
 	exp.Index = p.parseExpression(LOWEST)
 
@@ -453,26 +918,104 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	return exp
 }
 
-func (p *Parser) parseHashLiteral() ast.Expression {
-	hash := &ast.HashLiteral{Token: p.curToken}
-	hash.Pairs = make(map[ast.Expression]ast.Expression)
+// parseOptionalExpression parses a?.[k] and f?.(x), which are null instead of an error when a or f is null
+func (p *Parser) parseOptionalExpression(left ast.Expression) ast.Expression {
+	switch {
+	case p.peekTokenIs(token.LBRACKET):
+		p.nextToken()
+		exp, ok := p.parseIndexExpression(left).(*ast.IndexExpression)
+		if !ok {
+			return nil
+		}
+		exp.Optional = true
+		return exp
+	case p.peekTokenIs(token.LPAREN):
+		p.nextToken()
+		exp := p.parseCallExpression(left).(*ast.CallExpression)
+		exp.Optional = true
+		return exp
+	default:
+		p.addError(p.peekToken, "expected [ or ( after ?., got %s instead", p.peekToken.Type)
+		return nil
+	}
+}
 
-	for !p.peekTokenIs(token.RBRACE) {
+// parseBraceExpression parses a hash literal or a block expression. It is a hash literal
+// if it is empty or if its first statement is an expression followed by a colon, other than
+// the label of a loop.
+func (p *Parser) parseBraceExpression() ast.Expression {
+	brace := p.curToken
+	if p.peekTokenIs(token.RBRACE) {
 		p.nextToken()
-		key := p.parseExpression(LOWEST)
+		return &ast.HashLiteral{Token: brace, Pairs: make(map[ast.Expression]ast.Expression)}
+	}
 
-		if !p.expectPeek(token.COLON) {
+	defer p.setGrouped(false)()
+
+	p.nextToken()
+	var first ast.Statement
+	if p.curTokenIs(token.IDENT) && p.peekTokenIs(token.COLON) {
+		key := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		p.nextToken()
+		if !p.peekTokenIs(token.DO) {
+			return p.parseHashLiteral(brace, key)
+		}
+		first = p.parseLabeledLoop(key.Value)
+	} else {
+		first = p.parseStatement()
+		if stmt, ok := first.(*ast.ExpressionStatement); ok && p.peekTokenIs(token.COLON) {
+			p.nextToken()
+			return p.parseHashLiteral(brace, stmt.Expression)
+		}
+	}
+
+	block := &ast.BlockStatement{Token: brace, Statements: []ast.Statement{}}
+	if first != nil {
+		block.Statements = append(block.Statements, first)
+	}
+	p.nextToken()
+
+	for !p.curTokenIs(token.RBRACE) {
+		if p.curTokenIs(token.EOF) {
+			p.addError(p.curToken, "expected } to end block, got EOF instead")
 			return nil
 		}
+		stmt := p.parseStatement()
+		if stmt != nil {
+			block.Statements = append(block.Statements, stmt)
+		}
+		p.nextToken()
+	}
+
+	return &ast.BlockExpression{Token: brace, Block: block}
+}
+
+// parseHashLiteral parses the rest of a hash literal after its first key and the colon following it
+func (p *Parser) parseHashLiteral(brace token.Token, key ast.Expression) ast.Expression {
+	hash := &ast.HashLiteral{Token: brace}
+	hash.Pairs = make(map[ast.Expression]ast.Expression)
 
+	defer p.setGrouped(true)()
+
+	for {
 		p.nextToken()
 		value := p.parseExpression(LOWEST)
 
 		hash.Pairs[key] = value
+		hash.Keys = append(hash.Keys, key)
 
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
 		}
+		if p.peekTokenIs(token.RBRACE) {
+			break
+		}
+
+		p.nextToken()
+		key = p.parseExpression(LOWEST)
+		if !p.expectPeek(token.COLON) {
+			return nil
+		}
 	}
 
 	if !p.expectPeek(token.RBRACE) {
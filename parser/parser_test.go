@@ -1,9 +1,11 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"monkey-compiler/ast"
 	"monkey-compiler/lexer"
+	"strings"
 	"testing"
 )
 
@@ -139,6 +141,146 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestBigIntegerLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"9223372036854775808", "9223372036854775808"},
+		{"100_000_000_000_000_000_000", "100000000000000000000"},
+		{"0xFFFF_FFFF_FFFF_FFFF", "18446744073709551615"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		literal, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.IntegerLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.IntegerLiteral. got=%T", program.Statements[0])
+		}
+		if literal.Big == nil || literal.Big.String() != tt.expected {
+			t.Errorf("literal.Big wrong. want=%s, got=%v", tt.expected, literal.Big)
+		}
+	}
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14", 3.14},
+		{"0.5", 0.5},
+		{"1_000.25", 1000.25},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g. got=%g", tt.expected, literal.Value)
+		}
+	}
+
+	p := New(lexer.New("1.5_"))
+	p.ParseProgram()
+	want := `line 1: could not parse "1.5_" as float: _ must separate two digits`
+	if len(p.Errors()) == 0 || p.Errors()[0] != want {
+		t.Errorf("parser errors wrong. want=%q, got=%q", want, p.Errors())
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a\nb";`, "a\nb"},
+		{`"\x41\x62";`, "Ab"},
+		{`"say \"hi\"";`, `say "hi"`},
+		{`"back\\slash";`, `back\slash`},
+		{"`a\\nb`;", `a\nb`},
+		{"`say \"hi\"`;", `say "hi"`},
+		{"`two\nlines`;", "two\nlines"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		literal, ok := stmt.Expression.(*ast.StringLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.StringLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value of %s wrong. want=%q, got=%q", tt.input, tt.expected, literal.Value)
+		}
+	}
+}
+
+func TestMalformedStringLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"\q";`, `line 1: could not parse "\\q" as string: unknown escape sequence \q`},
+		{`"\x4";`, `line 1: could not parse "\\x4" as string: \x needs two hexadecimal digits`},
+		{`"\xZZ";`, `line 1: could not parse "\\xZZ" as string: \x needs two hexadecimal digits`},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 || errors[0] != tt.expected {
+			t.Errorf("parser errors for %q wrong. want first=%q, got=%q", tt.input, tt.expected, errors)
+		}
+	}
+}
+
+func TestMalformedIntegerLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"0x;", `line 1: could not parse "0x" as integer: no digits after base prefix`},
+		{"0b;", `line 1: could not parse "0b" as integer: no digits after base prefix`},
+		{"0xZZ;", `line 1: could not parse "0xZZ" as integer`},
+		{"0b102;", `line 1: could not parse "0b102" as integer`},
+		{"1__000;", `line 1: could not parse "1__000" as integer: _ must separate two digits`},
+		{"1000_;", `line 1: could not parse "1000_" as integer: _ must separate two digits`},
+		{"0x_FF;", `line 1: could not parse "0x_FF" as integer: _ must separate two digits`},
+		{"0xFFFFFFFFFFFFFFFFFZ;", `line 1: could not parse "0xFFFFFFFFFFFFFFFFFZ" as integer`},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 || errors[0] != tt.expected {
+			t.Errorf("parser errors for %q wrong. want first=%q, got=%q", tt.input, tt.expected, errors)
+		}
+	}
+}
+
 func TestParsingPrefixExpressions(t *testing.T) {
 	prefixTests := []struct {
 		input    string
@@ -285,6 +427,22 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"5 < 4 != 3 > 4",
 			"((5 < 4) != (3 > 4))",
 		},
+		{
+			"5 <= 4 + 1 == 3 >= 4",
+			"((5 <= (4 + 1)) == (3 >= 4))",
+		},
+		{
+			"a + 1 |> f |> g(b) == c",
+			"((((a + 1) |> f) |> g(b)) == c)",
+		},
+		{
+			"a |> f |> g",
+			"((a |> f) |> g)",
+		},
+		{
+			"a ?? b == c ?? null",
+			"((a ?? (b == c)) ?? null)",
+		},
 		{
 			"3 + 4 * 5 == 3 * 1 + 4 * 5",
 			"((3 + (4 * 5)) == ((3 * 1) + (4 * 5)))",
@@ -556,6 +714,227 @@ func TestFunctionLiteralParsing(t *testing.T) {
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
 
+func TestLambdaParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"|x| x + 1", "fn(x) (x + 1)"},
+		{"|| 5", "fn() 5"},
+		{"|x, y| |z| x * y * z", "fn(x, y) fn(z) ((x * y) * z)"},
+		{"map(a, |x| x, 2)", "map(a, fn(x) x, 2)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	l := lexer.New("let inc = |x| x + 1;")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	fn, ok := program.Statements[0].(*ast.LetStatement).Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("let value is not ast.FunctionLiteral. got=%T", program.Statements[0].(*ast.LetStatement).Value)
+	}
+	if fn.Name != "inc" {
+		t.Fatalf("function name wrong. want=%q, got=%q", "inc", fn.Name)
+	}
+}
+
+func TestSpreadParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"f(...args)", "f(...args)"},
+		{"f(1, ...rest(xs))", "f(1, ...rest(xs))"},
+		{"f(...a + b)", "f(...(a + b))"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestMultipleValueParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"return 1, 2;", "return [1, 2];"},
+		{"return a, b + c, d;", "return [a, (b + c), d];"},
+		{"let a, b = f();", "let a, b = f();"},
+		{"let a, b, c = [1, 2, 3];", "let a, b, c = [1, 2, 3];"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestIndexAssignParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a[0] = 1", "a[0] = 1;"},
+		{"a[i + 1] = b * 2;", "a[(i + 1)] = (b * 2);"},
+		{`h["k"][0] = f(x);`, "(h[k])[0] = f(x);"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestOptionalAccessParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a?.[0]", "(a?.[0])"},
+		{"f?.(1, 2)", "f?.(1, 2)"},
+		{"h?.[k]?.(x)[1]", "((h?.[k])?.(x)[1])"},
+		{"a?.[0] ?? 1", "((a?.[0]) ?? 1)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	for input, want := range map[string]string{
+		"a?.b":       "line 1: expected [ or ( after ?., got IDENT instead",
+		"a?.[0] = 1": "line 1: cannot assign to optional index (a?.[0])",
+	} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 || p.Errors()[0] != want {
+			t.Errorf("parser errors for %q wrong. want=%q, got=%q", input, want, p.Errors())
+		}
+	}
+}
+
+func TestNewlineSeparatedStatements(t *testing.T) {
+	tests := []struct {
+		input      string
+		statements int
+		expected   string
+	}{
+		{"1 + 2\n3 + 4", 2, "(1 + 2)(3 + 4)"},
+		{"1 +\n2", 1, "(1 + 2)"},
+		{"let a = 1\nlet b = 2", 2, "let a = 1;let b = 2;"},
+		{"f\n(1)", 2, "f1"},
+		{"a\n[1]", 2, "a[1]"},
+		{"a\n-1", 2, "a(-1)"},
+		{"f(a\n-1)", 1, "f((a - 1))"},
+		{"[a\n[0]]", 1, "[(a[0])]"},
+		{"(a\n-1)", 1, "(a - 1)"},
+		{"f(fn() { a\n-1 })", 1, "f(fn() a(-1))"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.SetNewlineEnds(true)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != tt.statements {
+			t.Errorf("%q: program has wrong number of statements. want=%d, got=%d",
+				tt.input, tt.statements, len(program.Statements))
+		}
+		if program.String() != tt.expected {
+			t.Errorf("program wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestNewlinesContinueExpressionsByDefault(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = a\n- b", "let x = (a - b);"},
+		{"f\n(1)", "f(1)"},
+		{"a\n[1]", "(a[1])"},
+		{"1 + 2\n3 + 4", "(1 + 2)(3 + 4)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("%q: program wrong. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestErrorList(t *testing.T) {
+	p := New(lexer.New("let x 1;\nlet y 2;"))
+	p.ParseProgram()
+
+	err := p.Err()
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("error is not an ErrorList. got=%T (%v)", err, err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("ErrorList has wrong length. want=2, got=%d: %q", len(list), list)
+	}
+	if list[1] != "line 2: expected next token to be =, got INT instead" {
+		t.Errorf("second error wrong. got=%q", list[1])
+	}
+	if err.Error() != list[0]+"\n"+list[1] {
+		t.Errorf("Error() wrong. got=%q", err.Error())
+	}
+
+	p = New(lexer.New("let x = 1;"))
+	p.ParseProgram()
+	if err := p.Err(); err != nil {
+		t.Errorf("Err() of a valid program wrong. want=nil, got=%v", err)
+	}
+}
+
 func TestFunctionParameterParsing(t *testing.T) {
 	tests := []struct {
 		input          string
@@ -936,6 +1315,385 @@ func TestParsingHashLiteralsWithExpressions(t *testing.T) {
 	}
 }
 
+func TestHashLiteralKeyOrder(t *testing.T) {
+	input := `{"b": 1, 2 + 2: 2, "a": 3}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	hash, ok := stmt.Expression.(*ast.HashLiteral)
+	if !ok {
+		t.Fatalf("exp is not ast.HashLiteral. got=%T", stmt.Expression)
+	}
+
+	expected := []string{"b", "(2 + 2)", "a"}
+	if len(hash.Keys) != len(expected) {
+		t.Fatalf("hash.Keys has wrong length. want=%d, got=%d", len(expected), len(hash.Keys))
+	}
+	for i, key := range hash.Keys {
+		if key.String() != expected[i] {
+			t.Errorf("hash.Keys[%d] wrong. want=%q, got=%q", i, expected[i], key.String())
+		}
+	}
+	if hash.String() != "{b:1, (2 + 2):2, a:3}" {
+		t.Errorf("hash.String() wrong. got=%q", hash.String())
+	}
+}
+
+func TestBlockExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"{ let a = 1; a + 1 }", "{let a = 1;(a + 1)}"},
+		{"{ a }", "{a}"},
+		{"{ a[0] = 1; a }", "{a[0] = 1;a}"},
+		{"{\n  f(a);\n  -1\n}", "{f(a)(-1)}"},
+		{"{ return 1; }", "{return 1;}"},
+		{"{ { 1 } }", "{{1}}"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		block, ok := stmt.Expression.(*ast.BlockExpression)
+		if !ok {
+			t.Fatalf("exp is not ast.BlockExpression. got=%T", stmt.Expression)
+		}
+		if block.String() != tt.expected {
+			t.Errorf("block.String() wrong. want=%q, got=%q", tt.expected, block.String())
+		}
+	}
+
+	// braces around a key followed by a colon are still a hash
+	for _, input := range []string{"{}", "{a: 1}", "{\n  f(a): 1,\n}"} {
+		l := lexer.New(input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		if _, ok := stmt.Expression.(*ast.HashLiteral); !ok {
+			t.Errorf("%q is not ast.HashLiteral. got=%T", input, stmt.Expression)
+		}
+	}
+
+	p := New(lexer.New("let x = { let a = 1;"))
+	p.ParseProgram()
+	if len(p.Errors()) != 1 || p.Errors()[0] != "line 1: expected } to end block, got EOF instead" {
+		t.Errorf("wrong errors for unterminated block. got=%q", p.Errors())
+	}
+}
+
+func TestLetStatementComments(t *testing.T) {
+	input := `
+// add returns
+// the sum
+let add = fn(a, b) { a + b }; // not a doc comment
+let x = 1;
+`
+
+	l := lexer.NewWithComments(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d",
+			len(program.Statements))
+	}
+
+	add := program.Statements[0].(*ast.LetStatement)
+	if strings.Join(add.Comments, "\n") != "add returns\nthe sum" {
+		t.Errorf("comments of add wrong. got=%q", add.Comments)
+	}
+	fn := add.Value.(*ast.FunctionLiteral)
+	if strings.Join(fn.Comments, "\n") != "add returns\nthe sum" {
+		t.Errorf("comments of function wrong. got=%q", fn.Comments)
+	}
+
+	x := program.Statements[1].(*ast.LetStatement)
+	if len(x.Comments) != 0 {
+		t.Errorf("x has comments. got=%q", x.Comments)
+	}
+}
+
+func TestCommentsIgnoredByDefault(t *testing.T) {
+	input := `// doc
+let x = 1; // trailing
+// dangling`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if program.String() != "let x = 1;" {
+		t.Fatalf("program wrong. got=%q", program.String())
+	}
+	if comments := program.Statements[0].(*ast.LetStatement).Comments; len(comments) != 0 {
+		t.Fatalf("comments kept without lexer.NewWithComments: %q", comments)
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	p := New(lexer.New("let x 1;\n  let = 2;"))
+	p.ParseProgram()
+
+	expected := []Position{{Line: 1, Column: 7}, {Line: 2, Column: 7}, {Line: 2, Column: 7}}
+	positions := p.ErrorPositions()
+	if len(positions) != len(expected) || len(p.Errors()) != len(expected) {
+		t.Fatalf("wrong number of positions. want=%d, got=%d for %q", len(expected), len(positions), p.Errors())
+	}
+	for i, want := range expected {
+		if positions[i] != want {
+			t.Errorf("position of %q wrong. want=%+v, got=%+v", p.Errors()[i], want, positions[i])
+		}
+	}
+}
+
+func TestTypeAnnotations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x: int = 5;", "let x: int = 5;"},
+		{"let a: int, b = [1, 2];", "let a: int, b = [1, 2];"},
+		{"let f: fn = fn(a: int, b): string { b };", "let f: fn = fn(a: int, b): string b;"},
+		{"let g = |x: float| x;", "let g = fn(x: float) x;"},
+		// a hash literal isn't affected
+		{"{a: 1}", "{a:1}"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program of %q wrong. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("fn(a: int, b): string { b }"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	fn, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("expression is not *ast.FunctionLiteral. got=%T", program.Statements[0])
+	}
+	if fn.Parameters[0].Type != "int" || fn.Parameters[1].Type != "" || fn.ReturnType != "string" {
+		t.Errorf("wrong types. want int, none and string, got %q, %q and %q",
+			fn.Parameters[0].Type, fn.Parameters[1].Type, fn.ReturnType)
+	}
+}
+
+func TestTypeAnnotationErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x: = 5;", "line 1: expected next token to be IDENT, got = instead"},
+		{"fn(a:) { a }", "line 1: expected next token to be IDENT, got ) instead"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 || p.Errors()[0] != tt.expected {
+			t.Errorf("wrong errors for %q. want first %q, got=%q", tt.input, tt.expected, p.Errors())
+		}
+	}
+}
+
+func TestTryExpression(t *testing.T) {
+	input := `try { 1 / x } catch (e) { e }`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+	exp, ok := stmt.Expression.(*ast.TryExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.TryExpression. got=%T", stmt.Expression)
+	}
+
+	if len(exp.Body.Statements) != 1 {
+		t.Fatalf("body is not 1 statement. got=%d", len(exp.Body.Statements))
+	}
+	body := exp.Body.Statements[0].(*ast.ExpressionStatement)
+	if !testInfixExpression(t, body.Expression, 1, "/", "x") {
+		return
+	}
+	if exp.Name.Value != "e" {
+		t.Errorf("name is not e. got=%s", exp.Name.Value)
+	}
+	if len(exp.Handler.Statements) != 1 {
+		t.Fatalf("handler is not 1 statement. got=%d", len(exp.Handler.Statements))
+	}
+	handler := exp.Handler.Statements[0].(*ast.ExpressionStatement)
+	if !testIdentifier(t, handler.Expression, "e") {
+		return
+	}
+
+	if program.String() != "try {(1 / x)} catch (e) {e}" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+}
+
+func TestThrowExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`throw "bad " + x`, "throw (bad  + x)"},
+		{`x ?? throw "missing"`, `(x ?? throw missing)`},
+		{"try { throw e } catch (e) { throw e }", "try {throw e} catch (e) {throw e}"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong program for %q. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestFinally(t *testing.T) {
+	p := New(lexer.New("try { a } finally { b }; try { a } catch (e) { e } finally { b }"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+	withoutCatch := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.TryExpression)
+	if withoutCatch.Name != nil || withoutCatch.Handler != nil {
+		t.Errorf("try without catch has a handler: %s", withoutCatch)
+	}
+	if withoutCatch.Finally == nil || withoutCatch.Finally.String() != "b" {
+		t.Errorf("finally wrong. got=%v", withoutCatch.Finally)
+	}
+
+	if program.String() != "try {a} finally {b}try {a} catch (e) {e} finally {b}" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+}
+
+func TestDoWhileStatement(t *testing.T) {
+	p := New(lexer.New("do { x; break; continue } while (x < 3); y"))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.DoWhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.DoWhileStatement. got=%T", program.Statements[0])
+	}
+	if !testInfixExpression(t, stmt.Condition, "x", "<", 3) {
+		return
+	}
+	if len(stmt.Body.Statements) != 3 {
+		t.Fatalf("body is not 3 statements. got=%d", len(stmt.Body.Statements))
+	}
+	if _, ok := stmt.Body.Statements[1].(*ast.BreakStatement); !ok {
+		t.Errorf("body.Statements[1] is not ast.BreakStatement. got=%T", stmt.Body.Statements[1])
+	}
+	if _, ok := stmt.Body.Statements[2].(*ast.ContinueStatement); !ok {
+		t.Errorf("body.Statements[2] is not ast.ContinueStatement. got=%T", stmt.Body.Statements[2])
+	}
+
+	if program.String() != "do {xbreak;continue;} while ((x < 3))y" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+
+	for input, expected := range map[string]string{
+		"do { x }":          "line 1: expected next token to be WHILE, got EOF instead",
+		"do { x } while x":  "line 1: expected next token to be (, got IDENT instead",
+		"do x while (true)": "line 1: expected next token to be {, got IDENT instead",
+		"do { x } while (y": "line 1: expected next token to be ), got EOF instead",
+	} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 || p.Errors()[0] != expected {
+			t.Errorf("wrong errors for %q. want first %q, got=%q", input, expected, p.Errors())
+		}
+	}
+}
+
+func TestLabeledLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"outer: do { break outer; continue outer } while (x)", "outer: do {break outer;continue outer;} while (x)"},
+		{"a: do { b: do { break a } while (y) } while (x)", "a: do {b: do {break a;} while (y)} while (x)"},
+		{"do { break\nouter } while (x)", "do {break;outer} while (x)"},
+		{"let f = fn() { outer: do { continue } while (x) }", "let f = fn() outer: do {continue;} while (x);"},
+		{"{ outer: do { break outer } while (x) }", "{outer: do {break outer;} while (x)}"},
+		{"{ outer: 1 }", "{outer:1}"},
+		{"{ a: 1, b: 2 }", "{a:1, b:2}"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program wrong for %q. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("outer: x"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || p.Errors()[0] != "line 1: expected do after label outer, got IDENT instead" {
+		t.Errorf("wrong errors for a label without a loop. got=%q", p.Errors())
+	}
+}
+
+func TestTryExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { 1 }", "line 1: expected next token to be CATCH, got EOF instead"},
+		{"try { 1 } catch { 2 }", "line 1: expected next token to be (, got { instead"},
+		{"try { 1 } catch (1) { 2 }", "line 1: expected next token to be IDENT, got INT instead"},
+		{"try 1 catch (e) { 2 }", "line 1: expected next token to be {, got INT instead"},
+		{"try { 1 } finally 2", "line 1: expected next token to be {, got INT instead"},
+		{"try { 1 } finally { 2 } catch (e) { 3 }", "line 1: no prefix parse function for CATCH found"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 || p.Errors()[0] != tt.expected {
+			t.Errorf("wrong errors for %q. want first %q, got=%q", tt.input, tt.expected, p.Errors())
+		}
+	}
+}
+
 func testLetStatement(t *testing.T, s ast.Statement, name string) bool {
 	if s.TokenLiteral() != "let" {
 		t.Errorf("s.TokenLiteral not 'let'. got=%q", s.TokenLiteral())
@@ -0,0 +1,103 @@
+package repl
+
+import (
+	"fmt"
+	"io"
+	"monkey-compiler/parser"
+	"os"
+)
+
+const (
+	parserErrorKind  = "parser error"
+	compileErrorKind = "compile error"
+	runtimeErrorKind = "runtime error"
+	fileErrorKind    = "file error"
+)
+
+const (
+	colorRed   = "\x1b[1;31m"
+	colorFaint = "\x1b[2m"
+	colorReset = "\x1b[0m"
+)
+
+// errorPrinter writes errors as a kind, a message and the offending source line
+type errorPrinter struct {
+	out   io.Writer
+	color bool
+}
+
+func newErrorPrinter(out io.Writer) *errorPrinter {
+	return &errorPrinter{out: out, color: isTerminal(out)}
+}
+
+// print writes every message of one kind followed by the source line they refer to
+func (p *errorPrinter) print(kind string, messages []string, source string) {
+	p.printAt(kind, messages, source, nil)
+}
+
+// printAt is print with a caret under each of the columns of source the messages were found at
+func (p *errorPrinter) printAt(kind string, messages []string, source string, columns []int) {
+	for _, msg := range messages {
+		fmt.Fprintf(p.out, "%s: %s\n", p.paint(colorRed, kind), msg)
+	}
+	fmt.Fprintf(p.out, "%s %s\n", p.paint(colorFaint, "  |"), source)
+	if len(columns) != 0 {
+		fmt.Fprintf(p.out, "%s %s\n", p.paint(colorFaint, "  |"), p.paint(colorRed, carets(source, columns)))
+	}
+}
+
+// carets puts a ^ under each of the columns of source, keeping its tabs so that they line up
+func carets(source string, columns []int) string {
+	width := 0
+	for _, c := range columns {
+		if c > width {
+			width = c
+		}
+	}
+
+	line := make([]byte, width)
+	for i := range line {
+		if i < len(source) && source[i] == '\t' {
+			line[i] = '\t'
+		} else {
+			line[i] = ' '
+		}
+	}
+	for _, c := range columns {
+		line[c-1] = '^'
+	}
+	return string(line)
+}
+
+// firstLineColumns returns the columns of the positions on the first line
+func firstLineColumns(positions []parser.Position) []int {
+	var columns []int
+	for _, pos := range positions {
+		if pos.Line == 1 {
+			columns = append(columns, pos.Column)
+		}
+	}
+	return columns
+}
+
+func (p *errorPrinter) paint(color, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// isTerminal reports whether out is a character device, so that escape sequences are not written to files or pipes
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
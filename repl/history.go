@@ -0,0 +1,63 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// history is the lines entered in a REPL run, optionally kept in a file across runs
+type history struct {
+	lines []string
+
+	// file is where new lines are appended to, if the history is kept
+	file *os.File
+}
+
+// openHistory returns the history kept in the file at path, which is created if it doesn't exist
+func openHistory(path string) (*history, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &history{file: file}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		h.lines = append(h.lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// add records line, writing it to the file of the history if it is kept.
+// Failing to write only stops the history from being kept, it doesn't stop the REPL.
+func (h *history) add(line string) {
+	h.lines = append(h.lines, line)
+
+	if h.file == nil {
+		return
+	}
+	if _, err := io.WriteString(h.file, line+"\n"); err != nil {
+		h.close()
+	}
+}
+
+// print lists the lines of the history, numbered from the oldest
+func (h *history) print(out io.Writer) {
+	for i, line := range h.lines {
+		fmt.Fprintf(out, "%5d  %s\n", i+1, line)
+	}
+}
+
+func (h *history) close() {
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+}
@@ -2,63 +2,331 @@ package repl
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"monkey-compiler/compiler"
 	"monkey-compiler/object"
 	"monkey-compiler/vm"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"monkey-compiler/ast"
 	"monkey-compiler/lexer"
 	"monkey-compiler/parser"
 )
 
 const prompt = ">> "
 
+const (
+	resetCommand    = ":reset"
+	timeCommand     = ":time"
+	typeCommand     = ":type"
+	builtinsCommand = ":builtins"
+	historyCommand  = ":history"
+	loadCommand     = ":load"
+)
+
+// Option changes how Start and RunFile read programs
+type Option func(*options)
+
+type options struct {
+	newlineEnds bool
+}
+
+// NewlineEnds makes a line starting with (, [ or - start a new statement, as described
+// at parser.SetNewlineEnds
+func NewlineEnds() Option {
+	return func(o *options) { o.newlineEnds = true }
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// parse parses src with the parser set up as o asks for
+func (o options) parse(src string) (*ast.Program, *parser.Parser) {
+	p := parser.New(lexer.New(src))
+	p.SetNewlineEnds(o.newlineEnds)
+	return p.ParseProgram(), p
+}
+
+// session holds the state shared between inputs of a REPL run
+type session struct {
+	constants   []object.Object
+	symbolTable *compiler.SymbolTable
+	globals     []object.Object
+
+	// timing reports how long compilation and execution took for each input
+	timing  bool
+	options options
+}
+
+func newSession(o options) *session {
+	symbolTable := compiler.NewSymbolTable()
+	for i, b := range object.BuiltinDefinitions() {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+
+	return &session{
+		constants:   make([]object.Object, 0),
+		symbolTable: symbolTable,
+		globals:     vm.NewGlobals(),
+		options:     o,
+	}
+}
+
+// sandbox returns a copy of the session, which inputs can be evaluated in without affecting it.
+// The arrays and hashes of the globals are deep copies, so that index assignments in the sandbox
+// don't reach the session's values. Globals sharing an array get copies of their own.
+// It fails if a global can't be copied, because it is nested in itself.
+func (s *session) sandbox() (*session, error) {
+	globals := vm.NewGlobals()
+	for i, global := range s.globals {
+		if global == nil {
+			continue
+		}
+		copied, err := object.Clone(global)
+		if err != nil {
+			return nil, fmt.Errorf("cannot copy the session: %w", err)
+		}
+		globals[i] = copied
+	}
+
+	return &session{
+		constants:   append([]object.Object{}, s.constants...),
+		symbolTable: s.symbolTable.Clone(),
+		globals:     globals,
+		timing:      s.timing,
+		options:     s.options,
+	}, nil
+}
+
+// evaluation is the outcome of an input that compiled and ran
+type evaluation struct {
+	result      object.Object
+	compileTime time.Duration
+	runTime     time.Duration
+}
+
+// evaluate compiles and runs line in the session. It prints the errors of a line which
+// fails and returns a nil evaluation, with exited set if the program called exit.
+func (s *session) evaluate(line string, out io.Writer, printer *errorPrinter) (ev *evaluation, exited bool) {
+	return s.evaluateSource(line, line, out, printer)
+}
+
+// evaluateSource is evaluate for src, which errors refer to as source
+func (s *session) evaluateSource(src, source string, out io.Writer, printer *errorPrinter) (ev *evaluation, exited bool) {
+	program, p := s.options.parse(src)
+	if len(p.Errors()) != 0 {
+		// the carets only line up with source if it is what was parsed
+		var columns []int
+		if src == source {
+			columns = firstLineColumns(p.ErrorPositions())
+		}
+		printer.printAt(parserErrorKind, p.Errors(), source, columns)
+		return nil, false
+	}
+
+	compileStart := time.Now()
+	comp := compiler.NewWithState(s.symbolTable, s.constants)
+	if err := comp.Compile(program); err != nil {
+		printer.print(compileErrorKind, []string{err.Error()}, source)
+		return nil, false
+	}
+	compileTime := time.Since(compileStart)
+
+	byteCode := comp.ByteCode()
+	s.constants = byteCode.Constants
+
+	runStart := time.Now()
+	machine := vm.NewWithGlobals(byteCode, s.globals)
+	machine.SetOutput(out)
+	if err := machine.Run(); err != nil {
+		var exit *vm.ExitError
+		if errors.As(err, &exit) {
+			return nil, true
+		}
+		printer.print(runtimeErrorKind, []string{err.Error()}, source)
+		return nil, false
+	}
+
+	return &evaluation{
+		result:      machine.LastPopped(),
+		compileTime: compileTime,
+		runTime:     time.Since(runStart),
+	}, false
+}
+
 // Start starts REPL of monkey
-func Start(in io.Reader, out io.Writer) {
+func Start(in io.Reader, out io.Writer, opts ...Option) {
+	run(in, out, &history{}, newOptions(opts))
+}
+
+// StartWithHistory starts REPL of monkey, keeping the lines entered in the file at path.
+// The lines from earlier runs are listed by :history, followed by those of this run.
+// It returns an error without starting if the file can't be read or created.
+func StartWithHistory(in io.Reader, out io.Writer, path string, opts ...Option) error {
+	h, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+
+	run(in, out, h, newOptions(opts))
+	return nil
+}
+
+func run(in io.Reader, out io.Writer, h *history, o options) {
 	scanner := bufio.NewScanner(in)
 
-	constants := make([]object.Object, 0)
-	symbolTable := compiler.NewSymbolTable()
-	globals := make([]object.Object, vm.GlobalsSize)
+	s := newSession(o)
+	printer := newErrorPrinter(out)
 
 	for {
-		fmt.Printf(prompt)
+		io.WriteString(out, prompt)
 		scanned := scanner.Scan()
 		if !scanned {
 			return
 		}
 
 		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
+		if line == historyCommand {
+			h.print(out)
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			h.add(line)
+		}
+
+		switch line {
+		case resetCommand:
+			timing := s.timing
+			s = newSession(s.options)
+			s.timing = timing
+			continue
+		case builtinsCommand:
+			printBuiltins(out)
+			continue
+		case timeCommand:
+			s.timing = !s.timing
+			if s.timing {
+				io.WriteString(out, "timing on\n")
+			} else {
+				io.WriteString(out, "timing off\n")
+			}
+			continue
+		}
+
+		// :type <expr> prints the type of the value of expr, evaluated without affecting the session
+		if strings.HasPrefix(line, typeCommand+" ") {
+			sandbox, err := s.sandbox()
+			if err != nil {
+				printer.print(runtimeErrorKind, []string{err.Error()}, line)
+				continue
+			}
+			ev, exited := sandbox.evaluate(strings.TrimPrefix(line, typeCommand+" "), out, printer)
+			if exited {
+				return
+			}
+			if ev != nil && ev.result != nil {
+				io.WriteString(out, string(ev.result.Type()))
+				io.WriteString(out, "\n")
+			}
+			continue
+		}
 
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		// :load <path> runs the file at path in the session, so that its definitions can be used
+		if strings.HasPrefix(line, loadCommand+" ") {
+			if s.load(strings.TrimSpace(strings.TrimPrefix(line, loadCommand+" ")), line, out, printer) {
+				return
+			}
 			continue
 		}
 
-		comp := compiler.NewWithState(symbolTable, constants)
-		if err := comp.Compile(program); err != nil {
-			io.WriteString(out, fmt.Sprintf("error during compilation: %v", err))
+		ev, exited := s.evaluate(line, out, printer)
+		if exited {
+			return
+		}
+		if ev == nil {
+			continue
+		}
+
+		if ev.result != nil {
+			io.WriteString(out, ev.result.Inspect())
+			io.WriteString(out, "\n")
 		}
 
-		machine := vm.NewWithGlobals(comp.ByteCode(), globals)
-		if err := machine.Run(); err != nil {
-			io.WriteString(out, fmt.Sprintf("error during execution: %v", err))
+		if s.timing {
+			io.WriteString(out, fmt.Sprintf("compile: %s, run: %s\n", ev.compileTime, ev.runTime))
 		}
+	}
+}
+
+// load runs the program in the file at path in the session, printing its errors with the
+// command line, and reports whether the program called exit
+func (s *session) load(path, line string, out io.Writer, printer *errorPrinter) (exited bool) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		printer.print(fileErrorKind, []string{err.Error()}, line)
+		return false
+	}
+
+	_, exited = s.evaluateSource(string(src), line, out, printer)
+	return exited
+}
 
-		result := machine.LastPopped()
-		io.WriteString(out, result.Inspect())
-		io.WriteString(out, "\n")
+// printBuiltins lists every builtin with how it is called and what it does
+func printBuiltins(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, def := range object.BuiltinDefinitions() {
+		usage := def.Builtin.Usage
+		if usage == "" {
+			usage = def.Name + "(...)"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", usage, def.Builtin.Doc)
 	}
+	w.Flush()
 }
 
-func printParserErrors(out io.Writer, errors []string) {
-	io.WriteString(out, "Woops! We ran into some monkey business here!\n")
-	io.WriteString(out, " parser errors:\n")
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+// RunFile compiles and runs the monkey program in the file at path.
+// Output of puts is written to out. Errors are prefixed with path,
+// except the *vm.ExitError returned when the program called exit.
+func RunFile(path string, out io.Writer, opts ...Option) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	program, p := newOptions(opts).parse(string(src))
+	var parseErrors parser.ErrorList
+	if errors.As(p.Err(), &parseErrors) {
+		msgs := make([]string, len(parseErrors))
+		for i, msg := range parseErrors {
+			msgs[i] = fmt.Sprintf("%s: %s: %s", path, parserErrorKind, msg)
+		}
+		return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	}
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		return fmt.Errorf("%s: %s: %v", path, compileErrorKind, err)
+	}
+
+	machine := vm.New(comp.ByteCode())
+	machine.SetOutput(out)
+	if err := machine.Run(); err != nil {
+		var exit *vm.ExitError
+		if errors.As(err, &exit) {
+			return exit
+		}
+		return fmt.Errorf("%s: %s: %v", path, runtimeErrorKind, err)
 	}
+
+	return nil
 }
@@ -0,0 +1,400 @@
+package repl
+
+import (
+	"bytes"
+	"monkey-compiler/vm"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	input := `let a = 1;
+a
+:reset
+a
+let a = 2;
+a
+puts(a)
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	expected := []string{
+		">> 1",
+		">> 1",
+		">> >> compile error: undefined variable: a",
+		"  | a",
+		">> 2",
+		">> 2",
+		">> 2",
+		"null",
+		">> ",
+	}
+
+	if out.String() != strings.Join(expected, "\n") {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", strings.Join(expected, "\n"), out.String())
+	}
+}
+
+func TestRedefineFunction(t *testing.T) {
+	input := `let f = fn() { 1 };
+let g = fn() { f() + 10 };
+g()
+let f = fn() { 2 };
+g()
+f()
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	// the lets print the closures they define
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("number of output lines wrong. want=7, got=%d\n%q", len(lines), out.String())
+	}
+	for i, want := range map[int]string{2: ">> 11", 4: ">> 12", 5: ">> 2"} {
+		if lines[i] != want {
+			t.Errorf("output line %d wrong. want=%q, got=%q", i, want, lines[i])
+		}
+	}
+}
+
+func TestTiming(t *testing.T) {
+	input := `1 + 2
+:time
+1 + 2
+:time
+1 + 2
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("number of output lines wrong. want=7, got=%d\n%q", len(lines), out.String())
+	}
+
+	expected := []string{">> 3", ">> timing on", ">> 3", "", ">> timing off", ">> 3", ">> "}
+	for i, line := range lines {
+		if i == 3 {
+			if !strings.HasPrefix(line, "compile: ") || !strings.Contains(line, ", run: ") {
+				t.Errorf("timing line wrong. got=%q", line)
+			}
+			continue
+		}
+		if line != expected[i] {
+			t.Errorf("line %d wrong. want=%q, got=%q", i, expected[i], line)
+		}
+	}
+}
+
+func TestType(t *testing.T) {
+	input := `:type [1,2,3]
+:type 1 + 2
+:type let a = 1; a
+a
+:type fn(x) { x }
+:type -true
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	expected := []string{
+		">> ARRAY",
+		">> INTEGER",
+		">> INTEGER",
+		">> compile error: undefined variable: a",
+		"  | a",
+		">> CLOSURE",
+		">> runtime error: unsupported type for negation by minus: BOOLEAN",
+		"  | -true",
+		">> ",
+	}
+
+	if out.String() != strings.Join(expected, "\n") {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", strings.Join(expected, "\n"), out.String())
+	}
+}
+
+func TestTypeDoesNotChangeGlobals(t *testing.T) {
+	input := `let a = [1];
+let h = {"k": [2]};
+:type let f = fn() { a[0] = 5; h["k"][0] = 7; a }; f()
+a
+h
+let c = [0];
+c[0] = c;
+:type 1
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	expected := []string{
+		">> [1]",
+		">> {k: [2]}",
+		">> ARRAY",
+		">> [1]",
+		">> {k: [2]}",
+		">> [0]",
+		">> [[...]]",
+		">> runtime error: cannot copy the session: cannot clone an array nested in itself",
+		"  | :type 1",
+		">> ",
+	}
+
+	if out.String() != strings.Join(expected, "\n") {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", strings.Join(expected, "\n"), out.String())
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	var out bytes.Buffer
+	Start(strings.NewReader(":builtins\n"), &out)
+
+	lines := strings.Split(strings.TrimPrefix(out.String(), prompt), "\n")
+	for _, want := range [][]string{
+		{"len(x) ", "returns the number of elements of an array or bytes of a string"},
+		{"puts(values...) ", "prints each value on a line of its own"},
+	} {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, want[0]) && strings.HasSuffix(line, want[1]) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no line for %s.\ngot=%q", strings.TrimSpace(want[0]), out.String())
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	input := `let a = 1;
+
+a + 1
+:reset
+:history
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	expected := []string{
+		">> 1",
+		">> >> 2",
+		">> >>     1  let a = 1;",
+		"    2  a + 1",
+		"    3  :reset",
+		">> ",
+	}
+
+	if out.String() != strings.Join(expected, "\n") {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", strings.Join(expected, "\n"), out.String())
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	var out bytes.Buffer
+	if err := StartWithHistory(strings.NewReader("let a = 1;\na\n"), &out, path); err != nil {
+		t.Fatalf("StartWithHistory error: %s", err)
+	}
+
+	out.Reset()
+	if err := StartWithHistory(strings.NewReader("puts(2)\n:history\n"), &out, path); err != nil {
+		t.Fatalf("StartWithHistory error: %s", err)
+	}
+	expected := ">> 2\nnull\n>>     1  let a = 1;\n    2  a\n    3  puts(2)\n>> "
+	if out.String() != expected {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", expected, out.String())
+	}
+
+	kept, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+	if string(kept) != "let a = 1;\na\nputs(2)\n" {
+		t.Fatalf("history file wrong. got=%q", kept)
+	}
+
+	if err := StartWithHistory(strings.NewReader(""), &out, t.TempDir()); err == nil {
+		t.Fatalf("expected error for a directory as history file")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	input := `:load testdata/script.monkey
+add(three, 4)
+:load testdata/missing.monkey
+:load testdata/parse_error.monkey
+a
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	expected := []string{
+		">> 3",
+		"6",
+		">> 7",
+		">> file error: open testdata/missing.monkey: no such file or directory",
+		"  | :load testdata/missing.monkey",
+		">> parser error: line 3: expected next token to be IDENT, got = instead",
+		"parser error: line 3: no prefix parse function for = found",
+		"  | :load testdata/parse_error.monkey",
+		">> compile error: undefined variable: a",
+		"  | a",
+		">> ",
+	}
+
+	if out.String() != strings.Join(expected, "\n") {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", strings.Join(expected, "\n"), out.String())
+	}
+}
+
+func TestLoadNewlineEnds(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, ">> 1\n4\n>> "},
+		{[]Option{NewlineEnds()}, ">> 5\n>> "},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		Start(strings.NewReader(":load testdata/newlines.monkey\n"), &out, tt.opts...)
+		if out.String() != tt.expected {
+			t.Errorf("output wrong. want=%q, got=%q", tt.expected, out.String())
+		}
+	}
+}
+
+func TestErrorOutput(t *testing.T) {
+	input := `let = 1;
+	let x 1; (2
+b
+-true
+let c = 1 / 0;
+c
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	expected := []string{
+		">> parser error: line 1: expected next token to be IDENT, got = instead",
+		"parser error: line 1: no prefix parse function for = found",
+		"  | let = 1;",
+		"  |     ^",
+		">> parser error: line 1: expected next token to be =, got INT instead",
+		"parser error: line 1: expected next token to be ), got EOF instead",
+		"  | \tlet x 1; (2",
+		"  | \t      ^    ^",
+		">> compile error: undefined variable: b",
+		"  | b",
+		">> runtime error: unsupported type for negation by minus: BOOLEAN",
+		"  | -true",
+		">> runtime error: division by zero",
+		"  | let c = 1 / 0;",
+		">> runtime error: use of uninitialized variable",
+		"  | c",
+		">> ",
+	}
+
+	if out.String() != strings.Join(expected, "\n") {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", strings.Join(expected, "\n"), out.String())
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	var out bytes.Buffer
+	if err := RunFile("testdata/script.monkey", &out); err != nil {
+		t.Fatalf("RunFile returned error: %s", err)
+	}
+
+	expected := "3\n6\n"
+	if out.String() != expected {
+		t.Fatalf("output wrong. want=%q, got=%q", expected, out.String())
+	}
+}
+
+func TestRunFileNewlineEnds(t *testing.T) {
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, "1\n4\n"},
+		{[]Option{NewlineEnds()}, "5\n"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := RunFile("testdata/newlines.monkey", &out, tt.opts...); err != nil {
+			t.Fatalf("RunFile returned error: %s", err)
+		}
+		if out.String() != tt.expected {
+			t.Errorf("output wrong. want=%q, got=%q", tt.expected, out.String())
+		}
+	}
+}
+
+func TestRunFileErrors(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{
+			"testdata/parse_error.monkey",
+			"testdata/parse_error.monkey: parser error: line 3: expected next token to be IDENT, got = instead\n" +
+				"testdata/parse_error.monkey: parser error: line 3: no prefix parse function for = found",
+		},
+		{
+			"testdata/runtime_error.monkey",
+			"testdata/runtime_error.monkey: runtime error: unsupported type for negation by minus: BOOLEAN",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			var out bytes.Buffer
+			err := RunFile(tc.path, &out)
+			if err == nil {
+				t.Fatalf("expected error but got none")
+			}
+			if err.Error() != tc.expected {
+				t.Fatalf("error wrong.\nwant=%q\ngot=%q", tc.expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestRunFileExit(t *testing.T) {
+	var out bytes.Buffer
+	err := RunFile("testdata/exit.monkey", &out)
+
+	exit, ok := err.(*vm.ExitError)
+	if !ok {
+		t.Fatalf("RunFile did not return ExitError. got=%T (%v)", err, err)
+	}
+	if exit.Code != 3 {
+		t.Fatalf("exit code wrong. want=3, got=%d", exit.Code)
+	}
+	if out.String() != "1\n" {
+		t.Fatalf("output wrong. want=%q, got=%q", "1\n", out.String())
+	}
+}
+
+func TestExitEndsSession(t *testing.T) {
+	input := `1
+exit(0)
+2
+`
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out)
+
+	expected := ">> 1\n>> "
+	if out.String() != expected {
+		t.Fatalf("output wrong.\nwant=%q\ngot=%q", expected, out.String())
+	}
+}
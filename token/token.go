@@ -7,9 +7,11 @@ const (
 	EOF     = "EOF"
 
 	// Identifiers + literals
-	IDENT  = "IDENT"  // add, foobar, x, y, ...
-	INT    = "INT"    // 1343456
-	STRING = "STRING" // "foobar"
+	IDENT      = "IDENT"      // add, foobar, x, y, ...
+	INT        = "INT"        // 1343456
+	FLOAT      = "FLOAT"      // 3.14
+	STRING     = "STRING"     // "foobar"
+	RAW_STRING = "RAW_STRING" // `foobar`
 
 	// Operators
 	ASSIGN   = "="
@@ -19,16 +21,24 @@ const (
 	ASTERISK = "*"
 	SLASH    = "/"
 
-	LT = "<"
-	GT = ">"
+	LT    = "<"
+	GT    = ">"
+	LT_EQ = "<="
+	GT_EQ = ">="
 
 	EQ     = "=="
 	NOT_EQ = "!="
 
+	PIPELINE = "|>"
+	NULLISH  = "??"
+
 	// Delimiters
 	COMMA     = ","
 	SEMICOLON = ";"
 	COLON     = ":"
+	PIPE      = "|" // encloses the parameters of a lambda
+	ELLIPSIS  = "..."
+	OPTIONAL  = "?." // a?.[k] and f?.(x)
 
 	LPAREN   = "("
 	RPAREN   = ")"
@@ -45,21 +55,41 @@ const (
 	IF       = "IF"
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
+	NULL     = "NULL"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	THROW    = "THROW"
+	FINALLY  = "FINALLY"
+	DO       = "DO"
+	WHILE    = "WHILE"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
 )
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Line    int // line of the first character of the token, starting at 1
+	Column  int // column of the first character of the token on its line, starting at 1
 }
 
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
+	"fn":       FUNCTION,
+	"let":      LET,
+	"true":     TRUE,
+	"false":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"null":     NULL,
+	"try":      TRY,
+	"catch":    CATCH,
+	"throw":    THROW,
+	"finally":  FINALLY,
+	"do":       DO,
+	"while":    WHILE,
+	"break":    BREAK,
+	"continue": CONTINUE,
 }
 
 func LookupIdent(ident string) TokenType {
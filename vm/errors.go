@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"fmt"
+	"monkey-compiler/object"
+)
+
+// ExitError is the error Run returns when the program stopped itself by calling exit
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// AssertionError is the error Run returns when the program stopped because an assert failed
+type AssertionError struct {
+	Message string
+}
+
+func (e *AssertionError) Error() string { return e.Message }
+
+// TypeError is the error Run returns when an operation is applied to values of the wrong type
+type TypeError struct {
+	Message string
+}
+
+func (e *TypeError) Error() string { return e.Message }
+
+// IndexError is the error Run returns when an index or a number of elements is out of range
+type IndexError struct {
+	Message string
+}
+
+func (e *IndexError) Error() string { return e.Message }
+
+// ArgumentError is the error Run returns when a function is called with the wrong number of arguments
+type ArgumentError struct {
+	Message string
+}
+
+func (e *ArgumentError) Error() string { return e.Message }
+
+// DivideByZeroError is the error Run returns when a number is divided by zero
+type DivideByZeroError struct{}
+
+func (e *DivideByZeroError) Error() string { return "division by zero" }
+
+// ThrowError is the error Run returns when the program threw Value with throw and no try caught it
+type ThrowError struct {
+	Value object.Object
+}
+
+func (e *ThrowError) Error() string { return "uncaught throw: " + e.Value.Inspect() }
+
+// DisabledBuiltinError is the error Run returns when the program uses a builtin disabled by DisableBuiltins
+type DisabledBuiltinError struct {
+	Name string
+}
+
+func (e *DisabledBuiltinError) Error() string { return "builtin disabled: " + e.Name }
+
+// BuiltinPanicError is the error Run returns when a builtin function panicked.
+// Value is what the builtin panicked with.
+type BuiltinPanicError struct {
+	Name  string
+	Value interface{}
+}
+
+func (e *BuiltinPanicError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("builtin panicked: %v", e.Value)
+	}
+	return fmt.Sprintf("builtin `%s` panicked: %v", e.Name, e.Value)
+}
+
+func newTypeError(format string, a ...interface{}) error {
+	return &TypeError{Message: fmt.Sprintf(format, a...)}
+}
+
+func newIndexError(format string, a ...interface{}) error {
+	return &IndexError{Message: fmt.Sprintf(format, a...)}
+}
+
+func newArgumentError(format string, a ...interface{}) error {
+	return &ArgumentError{Message: fmt.Sprintf(format, a...)}
+}
@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"monkey-compiler/code"
+	"monkey-compiler/object"
+)
+
+// EventKind is what happened in the VM an Event reports
+type EventKind int
+
+const (
+	// InstructionEvent is sent before an instruction is executed
+	InstructionEvent EventKind = iota
+	// FramePushedEvent is sent when a function is called, with the frame of the function
+	FramePushedEvent
+	// FramePoppedEvent is sent when a function returns, with the frame it returns from
+	FramePoppedEvent
+	// ErrorEvent is sent when the program stops with an error, before Run returns it
+	ErrorEvent
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case InstructionEvent:
+		return "instruction"
+	case FramePushedEvent:
+		return "frame pushed"
+	case FramePoppedEvent:
+		return "frame popped"
+	case ErrorEvent:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened in the VM, for a debugger to follow the program.
+// Fn, IP and Depth locate it: Fn is the function of the frame it happened in, which is
+// the main program's for the frame the VM starts with, IP the offset of the instruction
+// in Fn's instructions and Depth the number of frames, 1 in the main program.
+type Event struct {
+	Kind  EventKind
+	Fn    *object.CompiledFunction
+	IP    int
+	Depth int
+
+	Op  code.Opcode // the instruction of an InstructionEvent
+	Err error       // the error of an ErrorEvent
+}
+
+// SetEvents makes the VM send an Event to events for every instruction it executes, every
+// function call and return and the error it stops with, if any. Passing nil stops the events.
+//
+// The VM never waits for events to be received: an event which doesn't fit in the channel's
+// buffer is dropped and counted by DroppedEvents. A debugger which needs every event has to
+// give the channel enough room or receive events as fast as the VM runs.
+func (vm *VM) SetEvents(events chan<- Event) {
+	vm.events = events
+}
+
+// DroppedEvents returns the number of events the VM dropped because the channel was full
+func (vm *VM) DroppedEvents() int {
+	return vm.droppedEvents
+}
+
+// sendEvent sends an event of kind located in the current frame
+func (vm *VM) sendEvent(kind EventKind, op code.Opcode, err error) {
+	frame := vm.currentFrame()
+	ip := frame.ip
+	if ip < 0 {
+		// a frame just pushed is before its first instruction
+		ip = 0
+	}
+	event := Event{Kind: kind, Fn: frame.cl.Fn, IP: ip, Depth: vm.framesIndex, Op: op, Err: err}
+
+	select {
+	case vm.events <- event:
+	default:
+		vm.droppedEvents++
+	}
+}
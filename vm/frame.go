@@ -0,0 +1,25 @@
+package vm
+
+import (
+	"monkey-compiler/code"
+	"monkey-compiler/object"
+)
+
+// Frame is a call frame of a closure being executed
+type Frame struct {
+	cl          *object.Closure
+	ip          int
+	basePointer int // stack pointer before the call. locals are stored from here
+
+	// memo caches the value returned from the frame under memoKey, if it is a call of a memoized function
+	memo    *object.Memoized
+	memoKey string
+}
+
+func NewFrame(cl *object.Closure, basePointer int) *Frame {
+	return &Frame{cl: cl, ip: -1, basePointer: basePointer}
+}
+
+func (f *Frame) Instructions() code.Instructions {
+	return f.cl.Fn.Instructions
+}
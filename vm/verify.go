@@ -0,0 +1,97 @@
+package vm
+
+import (
+	"fmt"
+	"monkey-compiler/code"
+	"monkey-compiler/compiler"
+	"monkey-compiler/object"
+)
+
+// Verify checks that byteCode is well-formed, so that running it can't make the VM read
+// past its instructions or constants. The compiler only produces well-formed bytecode;
+// Verify is for bytecode that comes from anywhere else.
+//
+// It checks the top-level instructions and those of every compiled function among the
+// constants: that every opcode is defined, that operands don't run past the end, that
+// jumps and handlers land on the start of an instruction, that constants exist and closures are made
+// of compiled functions, and that builtins and locals exist.
+// It returns an error describing the first problem found.
+func Verify(byteCode *compiler.ByteCode) error {
+	if err := verifyInstructions(byteCode.Instructions, 0, byteCode.Constants); err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+
+	for i, constant := range byteCode.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		if err := verifyInstructions(fn.Instructions, fn.NumLocals, byteCode.Constants); err != nil {
+			return fmt.Errorf("function in constant %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// verifyInstructions checks the instructions of one function, which has numLocals locals
+func verifyInstructions(ins code.Instructions, numLocals int, constants []object.Object) error {
+	starts := make(map[int]bool)
+	var jumps []int // offsets of the jump instructions, checked once all starts are known
+
+	for offset := 0; offset < len(ins); {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return fmt.Errorf("%04d: %s", offset, err)
+		}
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if offset+1+width > len(ins) {
+			return fmt.Errorf("%04d: %s needs %d bytes of operands, %d left",
+				offset, def.Name, width, len(ins)-offset-1)
+		}
+		operands, _ := code.ReadOperands(def, ins[offset+1:])
+
+		switch code.Opcode(ins[offset]) {
+		case code.OpJump, code.OpJumpNotTruthy, code.OpJumpNotNull, code.OpSetupCatch, code.OpSetupFinally:
+			// the operand of OpSetupCatch and OpSetupFinally is where its handler starts
+			jumps = append(jumps, offset)
+		case code.OpConstant:
+			if operands[0] >= len(constants) {
+				return fmt.Errorf("%04d: constant %d out of range, there are %d", offset, operands[0], len(constants))
+			}
+		case code.OpClosure:
+			if operands[0] >= len(constants) {
+				return fmt.Errorf("%04d: constant %d out of range, there are %d", offset, operands[0], len(constants))
+			}
+			if _, ok := constants[operands[0]].(*object.CompiledFunction); !ok {
+				return fmt.Errorf("%04d: closure of constant %d, which is %s, not a function",
+					offset, operands[0], constants[operands[0]].Type())
+			}
+		case code.OpGetBuiltin:
+			if operands[0] >= len(object.BuiltinDefinitions()) {
+				return fmt.Errorf("%04d: builtin %d is not defined", offset, operands[0])
+			}
+		case code.OpGetLocal, code.OpSetLocal:
+			if operands[0] >= numLocals {
+				return fmt.Errorf("%04d: local %d out of range, there are %d", offset, operands[0], numLocals)
+			}
+		}
+
+		starts[offset] = true
+		offset += 1 + width
+	}
+
+	for _, offset := range jumps {
+		target := int(code.ReadUint16(ins[offset+1:]))
+		// jumping to the very end is fine, it finishes the function
+		if target != len(ins) && !starts[target] {
+			return fmt.Errorf("%04d: jump target %d is not the start of an instruction", offset, target)
+		}
+	}
+
+	return nil
+}
@@ -1,48 +1,303 @@
 package vm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
 	"monkey-compiler/code"
 	"monkey-compiler/compiler"
 	"monkey-compiler/object"
+	"os"
+	"sync"
+	"time"
 )
 
 const StackSize = 2048
 const GlobalsSize = 65536
+const MaxFrames = 1024
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+// CancelCheckInterval is the number of instructions RunContext executes between checks of its context
+const CancelCheckInterval = 1024
+
+// zero, one and minusOne are pushed by OpZero, OpOne and OpMinusOne.
+// Integers are never modified, so every push can share them.
+var (
+	zero     = &object.Integer{Value: 0}
+	one      = &object.Integer{Value: 1}
+	minusOne = &object.Integer{Value: -1}
+)
 
 type VM struct {
-	constants    []object.Object
-	instructions code.Instructions
+	constants []object.Object
 
 	globals []object.Object
 
 	stack []object.Object
 	sp    int // stack pointer. top of the stack is stack[sp-1]
+
+	frames      []*Frame
+	framesIndex int
+
+	out   io.Writer
+	rand  *rand.Rand
+	clock func() time.Time
+
+	// halt is the error Run returns once a builtin stopped the program, e.g. by calling exit
+	halt error
+
+	// ctx is the context of the running RunContext, which functions called by builtins run in too
+	ctx context.Context
+
+	// disabledBuiltins are the names of the builtins the program may not use
+	disabledBuiltins map[string]bool
+
+	// resumeOnError makes type and index errors results of the program instead of stopping it
+	resumeOnError bool
+
+	// events receives the events of the program for a debugger, if set
+	events        chan<- Event
+	droppedEvents int
+
+	// handlers are the catch blocks of the try expressions being run, the innermost last
+	handlers []handler
+}
+
+// handler is where OpSetupCatch or OpSetupFinally makes a recoverable error jump to
+type handler struct {
+	framesIndex int // the frames when it was set up, the top one runs the handler
+	sp          int
+	ip          int  // the first instruction of the handler
+	finally     bool // whether the handler runs a finally block and gets the error itself
+}
+
+// pendingError is the error a finally block runs for. It is on the stack below the block,
+// and never seen by the program, until OpRethrow fails with it again.
+type pendingError struct {
+	err error
 }
 
+func (p *pendingError) Type() object.ObjectType { return "PENDING_ERROR" }
+func (p *pendingError) Inspect() string         { return "pending error: " + p.err.Error() }
+
+// New returns a VM ready to run byteCode with empty globals.
+// The VM never modifies byteCode, so compiled byte code can be run any number of times,
+// each time by a new VM, without compiling it again.
 func New(byteCode *compiler.ByteCode) *VM {
+	mainFn := &object.CompiledFunction{Instructions: byteCode.Instructions}
+	mainClosure := &object.Closure{Fn: mainFn}
+	mainFrame := NewFrame(mainClosure, 0)
+
+	frames := make([]*Frame, MaxFrames)
+	frames[0] = mainFrame
+
 	return &VM{
-		constants:    byteCode.Constants,
-		instructions: byteCode.Instructions,
+		constants: byteCode.Constants,
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: NewGlobals(),
 
 		stack: make([]object.Object, StackSize),
 		sp:    0,
+
+		frames:      frames,
+		framesIndex: 1,
+
+		out:   os.Stdout,
+		clock: time.Now,
 	}
 }
 
+// NewIsolated returns a VM that shares no mutable state with any other VM, so that any number
+// of them can run byteCode concurrently: its globals, stack and frames are its own, and byteCode
+// is only ever read. It is what New does; use it to make that guarantee explicit at the call site.
+func NewIsolated(byteCode *compiler.ByteCode) *VM {
+	return New(byteCode)
+}
+
+// NewWithGlobals returns a VM running byteCode against globals, which it reads and writes in place.
+// It is the way to reuse compiled byte code with different global state: pass a slice from
+// NewGlobals, filled at the indexes the compiler's symbol table assigned, or the globals of a
+// previous run to continue from its state, as the REPL does.
+//
+// Only one VM may run against the same globals at a time. Run fails with ErrGlobalsInUse
+// instead of racing with another VM which is still running against them.
 func NewWithGlobals(byteCode *compiler.ByteCode, globals []object.Object) *VM {
 	vm := New(byteCode)
 	vm.globals = globals
 	return vm
 }
 
+// ErrGlobalsInUse is the error Run returns when another VM is running against the same globals
+var ErrGlobalsInUse = errors.New("globals are in use by another running VM")
+
+// runningGlobals holds the globals of every running VM, by the address of their first element
+var runningGlobals = struct {
+	sync.Mutex
+	m map[*object.Object]bool
+}{m: map[*object.Object]bool{}}
+
+func claimGlobals(globals []object.Object) error {
+	if len(globals) == 0 {
+		return nil
+	}
+
+	runningGlobals.Lock()
+	defer runningGlobals.Unlock()
+
+	if runningGlobals.m[&globals[0]] {
+		return ErrGlobalsInUse
+	}
+	runningGlobals.m[&globals[0]] = true
+	return nil
+}
+
+func releaseGlobals(globals []object.Object) {
+	if len(globals) == 0 {
+		return
+	}
+
+	runningGlobals.Lock()
+	defer runningGlobals.Unlock()
+
+	delete(runningGlobals.m, &globals[0])
+}
+
+// NewGlobals returns an empty globals slice for NewWithGlobals
+func NewGlobals() []object.Object {
+	return make([]object.Object, GlobalsSize)
+}
+
+// SetOutput sets the writer builtins such as puts print to. It defaults to os.Stdout
+func (vm *VM) SetOutput(out io.Writer) {
+	vm.out = out
+}
+
+// Out implements object.Host
+func (vm *VM) Out() io.Writer {
+	return vm.out
+}
+
+// Seed makes rand produce the sequence of numbers determined by seed.
+// Unless seeded, the VM seeds its source from the time it is first needed.
+func (vm *VM) Seed(seed int64) {
+	vm.rand = rand.New(rand.NewSource(seed))
+}
+
+// Rand implements object.Host
+func (vm *VM) Rand() *rand.Rand {
+	if vm.rand == nil {
+		vm.Seed(time.Now().UnixNano())
+	}
+	return vm.rand
+}
+
+// SetClock sets the clock now reads the time from. It defaults to time.Now
+func (vm *VM) SetClock(clock func() time.Time) {
+	vm.clock = clock
+}
+
+// Now implements object.Host
+func (vm *VM) Now() time.Time {
+	return vm.clock()
+}
+
+// Exit implements object.Host. Run returns an *ExitError with code after the current builtin call.
+func (vm *VM) Exit(code int) {
+	vm.halt = &ExitError{Code: code}
+}
+
+// Fail implements object.Host. Run returns an *AssertionError with message after the current
+// builtin call.
+func (vm *VM) Fail(message string) {
+	vm.halt = &AssertionError{Message: message}
+}
+
+// DisableBuiltins makes Run fail with a *DisabledBuiltinError when the program gets any of the
+// builtins named by names. Together with DisableBuiltins of the compiler and the cancellation
+// of RunContext it is for running programs which aren't trusted.
+func (vm *VM) DisableBuiltins(names ...string) {
+	if vm.disabledBuiltins == nil {
+		vm.disabledBuiltins = make(map[string]bool)
+	}
+	for _, name := range names {
+		vm.disabledBuiltins[name] = true
+	}
+}
+
+// SetResumeOnError sets whether the program goes on after a *TypeError or an *IndexError.
+// By default Run stops and returns the error. Resuming, the failed operation results in an
+// *object.Error with the message of the error instead, so that for instance the rest of a line
+// entered interactively still runs. Other errors, and type errors of index assignments, which
+// have no result, still stop the program. Errors inside a try are caught by it instead.
+func (vm *VM) SetResumeOnError(resume bool) {
+	vm.resumeOnError = resume
+}
+
+// Call implements object.Host. It runs fn with args on top of the stack of the builtin calling it,
+// and returns the value fn returned. If fn fails, Run returns the error after the current builtin call.
+func (vm *VM) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	result, err := vm.call(fn, args)
+	if err != nil {
+		vm.halt = err
+	}
+	return result, err
+}
+
+func (vm *VM) call(fn object.Object, args []object.Object) (object.Object, error) {
+	if err := vm.push(fn); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if err := vm.push(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	base := vm.framesIndex
+	if err := vm.executeCall(len(args)); err != nil {
+		return nil, err
+	}
+	if vm.framesIndex > base {
+		ctx := vm.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		if err := vm.run(ctx, base); err != nil {
+			return nil, err
+		}
+	}
+
+	return vm.pop(), nil
+}
+
+func (vm *VM) currentFrame() *Frame {
+	return vm.frames[vm.framesIndex-1]
+}
+
+func (vm *VM) pushFrame(f *Frame) {
+	vm.frames[vm.framesIndex] = f
+	vm.framesIndex++
+
+	if vm.events != nil {
+		vm.sendEvent(FramePushedEvent, 0, nil)
+	}
+}
+
+func (vm *VM) popFrame() *Frame {
+	if vm.events != nil {
+		vm.sendEvent(FramePoppedEvent, 0, nil)
+	}
+
+	vm.framesIndex--
+	for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].framesIndex > vm.framesIndex {
+		// the function returned from inside a try
+		vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	}
+	return vm.frames[vm.framesIndex]
+}
+
 func (vm *VM) StackTop() object.Object {
 	if vm.sp == 0 {
 		return nil
@@ -50,27 +305,167 @@ func (vm *VM) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
+// StackSnapshot returns a copy of the top n values of the stack, the top one last.
+// It returns fewer than n values if there are fewer on the stack.
+func (vm *VM) StackSnapshot(n int) []object.Object {
+	if n > vm.sp {
+		n = vm.sp
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	return append([]object.Object{}, vm.stack[vm.sp-n:vm.sp]...)
+}
+
 func (vm *VM) Run() error {
-	for ip := 0; ip < len(vm.instructions); ip++ {
-		opcode := code.Opcode(vm.instructions[ip])
+	return vm.RunContext(context.Background())
+}
+
+// RunContext is Run, except that it stops and returns ctx.Err() once ctx is done.
+// ctx is checked every CancelCheckInterval instructions.
+func (vm *VM) RunContext(ctx context.Context) error {
+	if err := claimGlobals(vm.globals); err != nil {
+		return err
+	}
+	defer releaseGlobals(vm.globals)
+
+	vm.ctx = ctx
+	err := vm.run(ctx, 0)
+	if err != nil && vm.events != nil {
+		vm.sendEvent(ErrorEvent, 0, err)
+	}
+	return err
+}
+
+// run executes instructions until the program ends or, if a function was called above the first
+// base frames, until that function returns. Errors caught by a try are handled on the way.
+func (vm *VM) run(ctx context.Context, base int) error {
+	for {
+		err := vm.execute(ctx, base)
+		if err == nil || !vm.catch(err, base) {
+			return err
+		}
+	}
+}
+
+// catch jumps to the innermost handler set up above the first base frames, unwinding the frames
+// and the stack to where it was set up and pushing the error, if err is catchable. The error is the
+// value thrown by throw, or an error object with the message of any other error. A finally block
+// gets err itself instead, to fail with it again. catch reports whether it jumped.
+//
+// The errors a program can recover from are those of its own operations: type, index and
+// argument errors, divisions by zero and throws. Exiting and failed assertions skip the catch
+// blocks but still run the finally blocks on their way out. Overflows, cancellation and the
+// errors of the VM itself stop the program at once, whether or not it is in a try.
+func (vm *VM) catch(err error, base int) bool {
+	var caught object.Object
+	finallyOnly := false
+	switch e := err.(type) {
+	case *ThrowError:
+		caught = e.Value
+	case *TypeError, *IndexError, *ArgumentError, *DivideByZeroError:
+		caught = &object.Error{Message: err.Error()}
+	case *ExitError, *AssertionError:
+		finallyOnly = true
+	default:
+		return false
+	}
+
+	i := len(vm.handlers) - 1
+	for finallyOnly && i >= 0 && !vm.handlers[i].finally {
+		i--
+	}
+	if i < 0 {
+		return false
+	}
+	h := vm.handlers[i]
+	if h.framesIndex <= base || h.sp >= StackSize {
+		// set up by the caller of the builtin which called the failing function, or no room for err
+		return false
+	}
+	if h.finally {
+		caught = &pendingError{err: err}
+	}
+
+	vm.handlers = vm.handlers[:i]
+	for vm.framesIndex > h.framesIndex {
+		vm.popFrame()
+	}
+	if err == vm.halt {
+		// the error of a function called by a builtin
+		vm.halt = nil
+	}
+
+	vm.sp = h.sp
+	vm.stack[vm.sp] = caught
+	vm.sp++
+	vm.currentFrame().ip = h.ip - 1
+	return true
+}
+
+// execute executes instructions like run, stopping at the first error
+func (vm *VM) execute(ctx context.Context, base int) error {
+	var ip int
+	var ins code.Instructions
+	var opcode code.Opcode
+
+	done := ctx.Done()
+	untilCheck := CancelCheckInterval
+
+	for vm.framesIndex > base && vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		if done != nil {
+			untilCheck--
+			if untilCheck == 0 {
+				untilCheck = CancelCheckInterval
+				select {
+				case <-done:
+					return ctx.Err()
+				default:
+				}
+			}
+		}
+
+		vm.currentFrame().ip++
+
+		ip = vm.currentFrame().ip
+		ins = vm.currentFrame().Instructions()
+		opcode = code.Opcode(ins[ip])
+
+		if vm.events != nil {
+			vm.sendEvent(InstructionEvent, opcode, nil)
+		}
 
 		switch opcode {
 		case code.OpConstant:
-			index := code.ReadUint16(vm.instructions[ip+1:])
+			index := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
 			if err := vm.push(vm.constants[index]); err != nil {
 				return err
 			}
-			ip += 2
 		case code.OpTrue:
-			if err := vm.push(True); err != nil {
+			if err := vm.push(object.TRUE); err != nil {
+				return err
+			}
+		case code.OpZero:
+			if err := vm.push(zero); err != nil {
+				return err
+			}
+		case code.OpOne:
+			if err := vm.push(one); err != nil {
+				return err
+			}
+		case code.OpMinusOne:
+			if err := vm.push(minusOne); err != nil {
 				return err
 			}
 		case code.OpFalse:
-			if err := vm.push(False); err != nil {
+			if err := vm.push(object.FALSE); err != nil {
 				return err
 			}
 		case code.OpNull:
-			if err := vm.push(Null); err != nil {
+			if err := vm.push(object.NULL); err != nil {
 				return err
 			}
 		case code.OpBang:
@@ -79,47 +474,515 @@ func (vm *VM) Run() error {
 			}
 		case code.OpMinus:
 			if err := vm.executeMinusOperator(); err != nil {
-				return err
+				if err := vm.recoverError(err, 1); err != nil {
+					return err
+				}
 			}
 		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
 			if err := vm.executeBinaryOperation(opcode); err != nil {
-				return err
+				if err := vm.recoverError(err, 1); err != nil {
+					return err
+				}
 			}
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanOrEqual,
+			code.OpLessThan, code.OpLessThanOrEqual:
 			if err := vm.executeComparison(opcode); err != nil {
-				return err
+				if err := vm.recoverError(err, 1); err != nil {
+					return err
+				}
 			}
 		case code.OpPop:
 			vm.pop()
+		case code.OpDup:
+			if err := vm.push(vm.stack[vm.sp-1]); err != nil {
+				return err
+			}
 		case code.OpJump:
-			pos := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip = pos - 1
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip = pos - 1
+		case code.OpSetupCatch, code.OpSetupFinally:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			vm.handlers = append(vm.handlers, handler{
+				framesIndex: vm.framesIndex,
+				sp:          vm.sp,
+				ip:          pos,
+				finally:     opcode == code.OpSetupFinally,
+			})
+		case code.OpPopCatch:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case code.OpThrow:
+			return &ThrowError{Value: vm.pop()}
+		case code.OpRethrow:
+			pending, ok := vm.pop().(*pendingError)
+			if !ok {
+				return errors.New("no error to rethrow")
+			}
+			return pending.err
 		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
 
 			condition := vm.pop()
-			if !isTruthy(condition) {
-				ip = pos - 1
+			if !object.IsTruthy(condition) {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpJumpNotNull:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			if _, isNull := vm.stack[vm.sp-1].(*object.Null); isNull {
+				vm.pop()
+			} else {
+				vm.currentFrame().ip = pos - 1
 			}
 		case code.OpSetGlobal:
-			index := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			index := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
 
 			vm.globals[index] = vm.pop()
 		case code.OpGetGlobal:
-			index := int(code.ReadUint16(vm.instructions[ip+1:]))
-			ip += 2
+			index := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
 
+			// a global is unset if the program defining it failed before its let ran,
+			// or if it was defined in the symbol table but not given a value in globals
+			if vm.globals[index] == nil {
+				return errors.New("use of uninitialized variable")
+			}
 			if err := vm.push(vm.globals[index]); err != nil {
 				return err
 			}
+		case code.OpSetLocal:
+			index := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			vm.stack[frame.basePointer+index] = vm.pop()
+		case code.OpGetLocal:
+			index := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			if err := vm.push(vm.stack[frame.basePointer+index]); err != nil {
+				return err
+			}
+		case code.OpGetBuiltin:
+			index := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			builtin := object.BuiltinAt(index)
+			if vm.disabledBuiltins[builtin.Name] {
+				return &DisabledBuiltinError{Name: builtin.Name}
+			}
+			if err := vm.push(builtin); err != nil {
+				return err
+			}
+		case code.OpGetFree:
+			index := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			if err := vm.push(vm.currentFrame().cl.Free[index]); err != nil {
+				return err
+			}
+		case code.OpCurrentClosure:
+			if err := vm.push(vm.currentFrame().cl); err != nil {
+				return err
+			}
+		case code.OpClosure:
+			index := int(code.ReadUint16(ins[ip+1:]))
+			numFree := int(code.ReadUint8(ins[ip+3:]))
+			vm.currentFrame().ip += 3
+
+			if err := vm.pushClosure(index, numFree); err != nil {
+				return err
+			}
+		case code.OpArray:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			array := vm.buildArray(vm.sp-numElements, vm.sp)
+			vm.sp = vm.sp - numElements
+
+			if err := vm.push(array); err != nil {
+				return err
+			}
+		case code.OpHash:
+			numElements := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
+			vm.sp = vm.sp - numElements
+			if err != nil {
+				if err := vm.recoverError(err, 1); err != nil {
+					return err
+				}
+				break
+			}
+
+			if err := vm.push(hash); err != nil {
+				return err
+			}
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+
+			if err := vm.executeIndexExpression(left, index); err != nil {
+				if err := vm.recoverError(err, 1); err != nil {
+					return err
+				}
+			}
+		case code.OpUnpack:
+			count := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			if err := vm.executeUnpack(count); err != nil {
+				// every name is bound to the error
+				if err := vm.recoverError(err, count); err != nil {
+					return err
+				}
+			}
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			if err := vm.executeSetIndex(left, index, value); err != nil {
+				return err
+			}
+		case code.OpCall:
+			numArgs := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			if err := vm.executeCall(numArgs); err != nil {
+				return err
+			}
+		case code.OpSpreadCall:
+			numArgs := int(code.ReadUint8(ins[ip+1:]))
+			vm.currentFrame().ip += 1
+
+			spreadArgs, err := vm.spreadLastArgument(numArgs)
+			if err != nil {
+				// the call results in the error, drop the callee and the other arguments
+				vm.sp = vm.sp - numArgs
+				if err := vm.recoverError(err, 1); err != nil {
+					return err
+				}
+				break
+			}
+			if err := vm.executeCall(spreadArgs); err != nil {
+				return err
+			}
+		case code.OpReturnValue:
+			returnValue := vm.pop()
+
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1 // also drop the callee
+			if frame.memo != nil {
+				frame.memo.Cache[frame.memoKey] = returnValue
+			}
+
+			if err := vm.push(returnValue); err != nil {
+				return err
+			}
+		case code.OpReturn:
+			frame := vm.popFrame()
+			vm.sp = frame.basePointer - 1
+			if frame.memo != nil {
+				frame.memo.Cache[frame.memoKey] = object.NULL
+			}
+
+			if err := vm.push(object.NULL); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildArray makes an array from the stack values in [startIndex, endIndex)
+func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
+	elements := make([]object.Object, endIndex-startIndex)
+	copy(elements, vm.stack[startIndex:endIndex])
+
+	return &object.Array{Elements: elements}
+}
+
+// buildHash builds a hash from the keys and values alternating on the stack.
+// A key that occurs more than once ends up with the last of its values.
+func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
+	pairs := make(map[object.HashKey]object.HashPair)
+
+	for i := startIndex; i < endIndex; i += 2 {
+		key := vm.stack[i]
+		value := vm.stack[i+1]
+
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, newTypeError("unusable as hash key: %s", key.Type())
+		}
+
+		pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+
+	return &object.Hash{Pairs: pairs}, nil
+}
+
+func (vm *VM) executeIndexExpression(left, index object.Object) error {
+	switch {
+	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.HASH_OBJ:
+		return vm.executeHashIndex(left, index)
+	default:
+		return newTypeError("index operator not supported: %s", left.Type())
+	}
+}
+
+func (vm *VM) executeArrayIndex(array, index object.Object) error {
+	elements := array.(*object.Array).Elements
+	i := index.(*object.Integer).Value
+
+	if i < 0 || i >= int64(len(elements)) {
+		return vm.push(object.NULL)
+	}
+
+	return vm.push(elements[i])
+}
+
+func (vm *VM) executeHashIndex(hash, index object.Object) error {
+	key, ok := index.(object.Hashable)
+	if !ok {
+		return newTypeError("unusable as hash key: %s", index.Type())
+	}
+
+	pair, ok := hash.(*object.Hash).Pairs[key.HashKey()]
+	if !ok {
+		return vm.push(object.NULL)
+	}
+
+	return vm.push(pair.Value)
+}
+
+// executeSetIndex checks the index of an assignment so that it fails with the right kind of error,
+// object.SetIndex then only fails on frozen collections
+func (vm *VM) executeSetIndex(left, index, value object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return newTypeError("array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return newIndexError("index out of range: %d", i.Value)
+		}
+	case *object.Hash:
+		if _, ok := index.(object.Hashable); !ok {
+			return newTypeError("unusable as hash key: %s", index.Type())
+		}
+	default:
+		return newTypeError("index assignment not supported: %s", left.Type())
+	}
+
+	if err := object.SetIndex(left, index, value); err != nil {
+		return &TypeError{Message: err.Error()}
+	}
+	return nil
+}
+
+func (vm *VM) executeUnpack(count int) error {
+	value := vm.pop()
+	array, ok := value.(*object.Array)
+	if !ok {
+		return newTypeError("cannot destructure %s", value.Type())
+	}
+	if len(array.Elements) != count {
+		return newIndexError("cannot destructure ARRAY of length %d into %d names",
+			len(array.Elements), count)
+	}
+
+	for _, el := range array.Elements {
+		if err := vm.push(el); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// spreadLastArgument replaces the array on top of the stack with its elements
+// and returns the resulting number of arguments
+func (vm *VM) spreadLastArgument(numArgs int) (int, error) {
+	last := vm.pop()
+	array, ok := last.(*object.Array)
+	if !ok {
+		return 0, newTypeError("spread argument must be ARRAY, got %s", last.Type())
+	}
+
+	for _, el := range array.Elements {
+		if err := vm.push(el); err != nil {
+			return 0, err
+		}
+	}
+
+	return numArgs - 1 + len(array.Elements), nil
+}
+
+func (vm *VM) executeCall(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee := callee.(type) {
+	case *object.Closure:
+		return vm.callClosure(callee, numArgs)
+	case *object.Builtin:
+		return vm.callBuiltin(callee, numArgs)
+	case *object.Partial:
+		return vm.callPartial(callee, numArgs)
+	case *object.Memoized:
+		return vm.callMemoized(callee, numArgs)
+	default:
+		vm.sp = vm.sp - numArgs - 1
+		return vm.recoverError(newTypeError("calling non-function: %s", callee.Type()), 1)
+	}
+}
+
+// recoverError returns err, unless the VM resumes after err. Then it pushes err as an error
+// object in place of each of the results of the failed operation, whose operands must be
+// off the stack already.
+func (vm *VM) recoverError(err error, results int) error {
+	if !vm.resumeOnError || len(vm.handlers) > 0 {
+		// a try catches the error instead
+		return err
+	}
+	switch err.(type) {
+	case *TypeError, *IndexError:
+	default:
+		return err
+	}
+
+	errObj := &object.Error{Message: err.Error()}
+	for i := 0; i < results; i++ {
+		if err := vm.push(errObj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// callPartial calls the function of p, with the arguments p binds inserted before those on the stack
+func (vm *VM) callPartial(p *object.Partial, numArgs int) error {
+	numBound := len(p.Args)
+	if vm.sp+numBound >= StackSize {
+		return errors.New("stack overflow")
+	}
+
+	calleeIndex := vm.sp - 1 - numArgs
+	copy(vm.stack[calleeIndex+1+numBound:], vm.stack[calleeIndex+1:vm.sp])
+	copy(vm.stack[calleeIndex+1:], p.Args)
+	vm.stack[calleeIndex] = p.Fn
+	vm.sp += numBound
+
+	return vm.executeCall(numArgs + numBound)
+}
+
+// callMemoized returns the cached result of calling m with the arguments on the stack,
+// or calls the function of m and caches its result once it returns
+func (vm *VM) callMemoized(m *object.Memoized, numArgs int) error {
+	key, ok := m.Key(vm.stack[vm.sp-numArgs : vm.sp])
+	if ok {
+		if result, cached := m.Cache[key]; cached {
+			vm.sp = vm.sp - numArgs - 1
+			return vm.push(result)
 		}
 	}
 
+	vm.stack[vm.sp-1-numArgs] = m.Fn
+	framesIndex := vm.framesIndex
+	if err := vm.executeCall(numArgs); err != nil || !ok {
+		return err
+	}
+
+	if vm.framesIndex > framesIndex {
+		// a closure was called, its result is cached when its frame returns
+		frame := vm.currentFrame()
+		frame.memo, frame.memoKey = m, key
+	} else {
+		m.Cache[key] = vm.stack[vm.sp-1]
+	}
 	return nil
 }
 
+func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
+	if numArgs != cl.Fn.NumParameters {
+		return newArgumentError("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+
+	if vm.framesIndex >= MaxFrames {
+		return errors.New("frame overflow")
+	}
+
+	// arguments already on the stack become the first locals of the frame
+	frame := NewFrame(cl, vm.sp-numArgs)
+	vm.pushFrame(frame)
+
+	if frame.basePointer+cl.Fn.NumLocals >= StackSize {
+		return errors.New("stack overflow")
+	}
+	vm.sp = frame.basePointer + cl.Fn.NumLocals
+
+	return nil
+}
+
+func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
+	args := vm.stack[vm.sp-numArgs : vm.sp]
+
+	result, err := vm.safeCall(builtin, args)
+	if err != nil {
+		return err
+	}
+	vm.sp = vm.sp - numArgs - 1
+
+	if vm.halt != nil {
+		return vm.halt
+	}
+
+	switch result := result.(type) {
+	case nil:
+		return vm.push(object.NULL)
+	case *object.Boolean:
+		// a builtin may allocate its own booleans instead of returning object.TRUE and object.FALSE
+		return vm.push(nativeBoolToBooleanObject(result.Value))
+	default:
+		return vm.push(result)
+	}
+}
+
+// safeCall calls builtin, turning a panic in it into a *BuiltinPanicError
+func (vm *VM) safeCall(builtin *object.Builtin, args []object.Object) (result object.Object, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &BuiltinPanicError{Name: builtin.Name, Value: r}
+		}
+	}()
+
+	return builtin.Call(vm, args...), nil
+}
+
+func (vm *VM) pushClosure(constIndex int, numFree int) error {
+	constant := vm.constants[constIndex]
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return fmt.Errorf("not a function: %+v", constant)
+	}
+
+	free := make([]object.Object, numFree)
+	copy(free, vm.stack[vm.sp-numFree:vm.sp])
+	vm.sp = vm.sp - numFree
+
+	return vm.push(&object.Closure{Fn: function, Free: free})
+}
+
 func (vm *VM) push(o object.Object) error {
 	if vm.sp >= StackSize {
 		return errors.New("stack overflow")
@@ -143,24 +1006,23 @@ func (vm *VM) pop() object.Object {
 
 func (vm *VM) executeBangOperator() error {
 	operand := vm.pop()
-	switch operand {
-	case True:
-		return vm.push(False)
-	case False, Null:
-		return vm.push(True)
-	default:
-		return vm.push(False)
+	if object.IsTruthy(operand) {
+		return vm.push(object.FALSE)
 	}
+	return vm.push(object.TRUE)
 }
 
 func (vm *VM) executeMinusOperator() error {
-	operand := vm.pop()
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation by minus: %s", operand.Type())
+	switch operand := vm.pop().(type) {
+	case *object.Integer:
+		return vm.push(object.NegateInteger(operand.Value))
+	case *object.BigInt:
+		return vm.push(object.NewBigInteger(new(big.Int).Neg(operand.Value)))
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
+		return newTypeError("unsupported type for negation by minus: %s", operand.Type())
 	}
-
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
 }
 
 func (vm *VM) executeBinaryOperation(opcode code.Opcode) error {
@@ -173,29 +1035,84 @@ func (vm *VM) executeBinaryOperation(opcode code.Opcode) error {
 	if rightType == object.INTEGER_OBJ && leftType == object.INTEGER_OBJ {
 		return vm.executeBinaryIntegerOperation(opcode, left, right)
 	}
+	if object.IsBigIntegerOperation(left, right) {
+		return vm.executeBinaryBigIntegerOperation(opcode, left, right)
+	}
+	if object.IsFloatOperation(left, right) {
+		return vm.executeBinaryFloatOperation(opcode, left, right)
+	}
+	if rightType == object.STRING_OBJ && leftType == object.STRING_OBJ {
+		return vm.executeBinaryStringOperation(opcode, left, right)
+	}
+	if opcode == code.OpMul && rightType == object.INTEGER_OBJ &&
+		(leftType == object.STRING_OBJ || leftType == object.ARRAY_OBJ) {
+		repeated, err := object.Repeat(left, right.(*object.Integer).Value)
+		if err != nil {
+			return &IndexError{Message: err.Error()}
+		}
+		return vm.push(repeated)
+	}
 
-	return fmt.Errorf("unsupported types for binary operation: %s and %s", leftType, rightType)
+	return newTypeError("unsupported types for binary operation: %s and %s", leftType, rightType)
 }
 
 func (vm *VM) executeBinaryIntegerOperation(opcode code.Opcode, left, right object.Object) error {
 	leftValue := left.(*object.Integer).Value
 	rightValue := right.(*object.Integer).Value
 
-	var result int64
+	// results overflowing int64 are promoted to big integers
+	var result object.Object
 	switch opcode {
 	case code.OpAdd:
-		result = leftValue + rightValue
+		result = object.AddIntegers(leftValue, rightValue)
 	case code.OpSub:
-		result = leftValue - rightValue
+		result = object.SubtractIntegers(leftValue, rightValue)
 	case code.OpMul:
-		result = leftValue * rightValue
+		result = object.MultiplyIntegers(leftValue, rightValue)
 	case code.OpDiv:
-		result = leftValue / rightValue
+		if rightValue == 0 {
+			return &DivideByZeroError{}
+		}
+		result = object.DivideIntegers(leftValue, rightValue)
+	default:
+		return fmt.Errorf("unknown integer operator: %d", opcode)
+	}
+
+	return vm.push(result)
+}
+
+func (vm *VM) executeBinaryBigIntegerOperation(opcode code.Opcode, left, right object.Object) error {
+	leftValue, _ := object.BigValue(left)
+	rightValue, _ := object.BigValue(right)
+
+	switch opcode {
+	case code.OpAdd:
+		leftValue.Add(leftValue, rightValue)
+	case code.OpSub:
+		leftValue.Sub(leftValue, rightValue)
+	case code.OpMul:
+		leftValue.Mul(leftValue, rightValue)
+	case code.OpDiv:
+		if rightValue.Sign() == 0 {
+			return &DivideByZeroError{}
+		}
+		// Quo truncates toward zero like the division of Integers
+		leftValue.Quo(leftValue, rightValue)
 	default:
 		return fmt.Errorf("unknown integer operator: %d", opcode)
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(object.NewBigInteger(leftValue))
+}
+
+func (vm *VM) executeBinaryStringOperation(opcode code.Opcode, left, right object.Object) error {
+	if opcode != code.OpAdd {
+		return newTypeError("unknown string operator: %d", opcode)
+	}
+
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+	return vm.push(&object.String{Value: leftValue + rightValue})
 }
 
 func (vm *VM) executeComparison(opcode code.Opcode) error {
@@ -208,14 +1125,109 @@ func (vm *VM) executeComparison(opcode code.Opcode) error {
 	if rightType == object.INTEGER_OBJ && leftType == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(opcode, left, right)
 	}
+	if object.IsBigIntegerOperation(left, right) {
+		return vm.executeBigIntegerComparison(opcode, left, right)
+	}
+	if object.IsFloatOperation(left, right) {
+		return vm.executeFloatComparison(opcode, left, right)
+	}
+	if rightType == object.STRING_OBJ && leftType == object.STRING_OBJ &&
+		(opcode == code.OpEqual || opcode == code.OpNotEqual) {
+		return vm.executeStringComparison(opcode, left, right)
+	}
+	if rightType == object.BOOLEAN_OBJ && leftType == object.BOOLEAN_OBJ {
+		// compare by value, booleans other than object.TRUE and object.FALSE may still turn up
+		left = nativeBoolToBooleanObject(left.(*object.Boolean).Value)
+		right = nativeBoolToBooleanObject(right.(*object.Boolean).Value)
+	}
+	if rightType == object.ARRAY_OBJ && leftType == object.ARRAY_OBJ &&
+		opcode != code.OpEqual && opcode != code.OpNotEqual {
+		return vm.executeArrayComparison(opcode, left, right)
+	}
+
+	switch opcode {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(left == right))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(left != right))
+	case code.OpGreaterThan:
+		return newTypeError("unsupported types for > operation: %s and %s", leftType, rightType)
+	case code.OpGreaterThanOrEqual:
+		return newTypeError("unsupported types for >= operation: %s and %s", leftType, rightType)
+	case code.OpLessThan:
+		return newTypeError("unsupported types for < operation: %s and %s", leftType, rightType)
+	case code.OpLessThanOrEqual:
+		return newTypeError("unsupported types for <= operation: %s and %s", leftType, rightType)
+	}
+	return newTypeError("unsupported types for binary operation: %s and %s", leftType, rightType)
+}
+
+// executeStringComparison compares two strings by value, as equal strings are often distinct objects
+func (vm *VM) executeStringComparison(opcode code.Opcode, left, right object.Object) error {
+	leftValue := left.(*object.String).Value
+	rightValue := right.(*object.String).Value
+
+	var result bool
+	switch opcode {
+	case code.OpEqual:
+		result = leftValue == rightValue
+	case code.OpNotEqual:
+		result = leftValue != rightValue
+	default:
+		return fmt.Errorf("unknown string operator: %d", opcode)
+	}
+
+	return vm.push(nativeBoolToBooleanObject(result))
+}
+
+func (vm *VM) executeBinaryFloatOperation(opcode code.Opcode, left, right object.Object) error {
+	leftValue, _ := object.FloatValue(left)
+	rightValue, _ := object.FloatValue(right)
+
+	var result float64
+	switch opcode {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		// like integers, floats don't divide by zero instead of making infinities
+		if rightValue == 0 {
+			return &DivideByZeroError{}
+		}
+		result = leftValue / rightValue
+	default:
+		return fmt.Errorf("unknown float operator: %d", opcode)
+	}
+
+	return vm.push(&object.Float{Value: result})
+}
+
+func (vm *VM) executeFloatComparison(opcode code.Opcode, left, right object.Object) error {
+	leftValue, _ := object.FloatValue(left)
+	rightValue, _ := object.FloatValue(right)
 
+	var result bool
 	switch opcode {
 	case code.OpEqual:
-		return vm.push(&object.Boolean{Value: left == right})
+		result = leftValue == rightValue
 	case code.OpNotEqual:
-		return vm.push(&object.Boolean{Value: left != right})
+		result = leftValue != rightValue
+	case code.OpGreaterThan:
+		result = leftValue > rightValue
+	case code.OpGreaterThanOrEqual:
+		result = leftValue >= rightValue
+	case code.OpLessThan:
+		result = leftValue < rightValue
+	case code.OpLessThanOrEqual:
+		result = leftValue <= rightValue
+	default:
+		return fmt.Errorf("unknown float operator: %d", opcode)
 	}
-	return fmt.Errorf("unsupported types for binary operation: %s and %s", leftType, rightType)
+
+	return vm.push(nativeBoolToBooleanObject(result))
 }
 
 func (vm *VM) executeIntegerComparison(opcode code.Opcode, left, right object.Object) error {
@@ -230,24 +1242,77 @@ func (vm *VM) executeIntegerComparison(opcode code.Opcode, left, right object.Ob
 		result = leftValue != rightValue
 	case code.OpGreaterThan:
 		result = leftValue > rightValue
+	case code.OpGreaterThanOrEqual:
+		result = leftValue >= rightValue
+	case code.OpLessThan:
+		result = leftValue < rightValue
+	case code.OpLessThanOrEqual:
+		result = leftValue <= rightValue
 	default:
 		return fmt.Errorf("unknown integer operator: %d", opcode)
 	}
 
-	return vm.push(&object.Boolean{Value: result})
+	return vm.push(nativeBoolToBooleanObject(result))
 }
 
-func (vm *VM) LastPopped() object.Object {
-	return vm.stack[vm.sp]
+func (vm *VM) executeBigIntegerComparison(opcode code.Opcode, left, right object.Object) error {
+	leftValue, _ := object.BigValue(left)
+	rightValue, _ := object.BigValue(right)
+	cmp := leftValue.Cmp(rightValue)
+
+	var result bool
+	switch opcode {
+	case code.OpEqual:
+		result = cmp == 0
+	case code.OpNotEqual:
+		result = cmp != 0
+	case code.OpGreaterThan:
+		result = cmp > 0
+	case code.OpGreaterThanOrEqual:
+		result = cmp >= 0
+	case code.OpLessThan:
+		result = cmp < 0
+	case code.OpLessThanOrEqual:
+		result = cmp <= 0
+	default:
+		return fmt.Errorf("unknown integer operator: %d", opcode)
+	}
+
+	return vm.push(nativeBoolToBooleanObject(result))
 }
 
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
-	case *object.Boolean:
-		return obj.Value
-	case *object.Null:
-		return false
+// executeArrayComparison orders two arrays lexicographically, see object.CompareArrays.
+// Arrays are still only equal to themselves.
+func (vm *VM) executeArrayComparison(opcode code.Opcode, left, right object.Object) error {
+	cmp, err := object.CompareArrays(left.(*object.Array), right.(*object.Array))
+	if err != nil {
+		return newTypeError("%s", err)
+	}
+
+	var result bool
+	switch opcode {
+	case code.OpGreaterThan:
+		result = cmp > 0
+	case code.OpGreaterThanOrEqual:
+		result = cmp >= 0
+	case code.OpLessThan:
+		result = cmp < 0
+	case code.OpLessThanOrEqual:
+		result = cmp <= 0
 	default:
-		return true
+		return fmt.Errorf("unknown array operator: %d", opcode)
+	}
+
+	return vm.push(nativeBoolToBooleanObject(result))
+}
+
+func nativeBoolToBooleanObject(input bool) *object.Boolean {
+	if input {
+		return object.TRUE
 	}
+	return object.FALSE
+}
+
+func (vm *VM) LastPopped() object.Object {
+	return vm.stack[vm.sp]
 }
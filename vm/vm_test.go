@@ -1,12 +1,21 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
 	"monkey-compiler/ast"
+	"monkey-compiler/code"
 	"monkey-compiler/compiler"
 	"monkey-compiler/lexer"
 	"monkey-compiler/object"
 	"monkey-compiler/parser"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -27,64 +36,2049 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"2 * 2 + 3", 7},
 		{"-1", -1},
 		{"-10 + 30 + -10", 10},
+		{"0", 0},
+		{"-1 * -1", 1},
+		{"let x = 5; x + 1 - 0", 6},
 	}
 
 	runVmTests(t, testCases)
 }
 
+func TestBigIntegers(t *testing.T) {
+	testCases := []vmTestCase{
+		{"100000000000000000000", bigInteger("100000000000000000000")},
+		{"0x1_0000_0000_0000_0000", bigInteger("18446744073709551616")},
+		{"100000000000000000000 * 100000000000000000000", bigInteger("10000000000000000000000000000000000000000")},
+		{"9223372036854775807 * 10", bigInteger("92233720368547758070")},
+		{"100000000000000000000 + 1", bigInteger("100000000000000000001")},
+		{"1 - 100000000000000000000", bigInteger("-99999999999999999999")},
+		{"100000000000000000000 / 10", bigInteger("10000000000000000000")},
+		{"100000000000000000000 / 100000000000000000000", 1},
+		{"100000000000000000000 - 99999999999999999999", 1},
+		{"-9223372036854775808", -9223372036854775808},
+		{"-100000000000000000000 / 3", bigInteger("-33333333333333333333")},
+		{"100000000000000000000 > 9223372036854775807", true},
+		{"1 < 100000000000000000000 < 100000000000000000001", true},
+		{"100000000000000000000 == 100000000000000000000", true},
+		{"100000000000000000000 == 1", false},
+		{"100000000000000000000 != 100000000000000000001", true},
+		{"equals([100000000000000000000], [100000000000000000000])", true},
+		// arithmetic on two integers promotes exactly when the result leaves int64
+		{"9223372036854775807 + 1", bigInteger("9223372036854775808")},
+		{"9223372036854775807 + 0", 9223372036854775807},
+		{"9223372036854775807 + 1 - 1", 9223372036854775807},
+		{"-9223372036854775807 - 1", -9223372036854775808},
+		{"-9223372036854775807 - 2", bigInteger("-9223372036854775809")},
+		{"1 - -9223372036854775807", bigInteger("9223372036854775808")},
+		{"3037000499 * 3037000499", 9223372030926249001},
+		{"3037000500 * 3037000500", bigInteger("9223372037000250000")},
+		{"4294967296 * -4294967296", bigInteger("-18446744073709551616")},
+		{"(-9223372036854775807 - 1) * -1", bigInteger("9223372036854775808")},
+		{"-1 * (-9223372036854775807 - 1)", bigInteger("9223372036854775808")},
+		{"(-9223372036854775807 - 1) * 1", -9223372036854775808},
+		{"(-9223372036854775807 - 1) / -1", bigInteger("9223372036854775808")},
+		{"-(-9223372036854775807 - 1)", bigInteger("9223372036854775808")},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"100000000000000000000 / 0", "division by zero"},
+		{`100000000000000000000 + "a"`, "unsupported types for binary operation: BIG_INTEGER and STRING"},
+	})
+}
+
+func bigInteger(s string) *object.BigInt {
+	value, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big integer " + s)
+	}
+	return &object.BigInt{Value: value}
+}
+
 func TestBooleanExpression(t *testing.T) {
 	testCases := []vmTestCase{
-		{"true;", true},
-		{"false;", false},
-		{"5 > 3;", true},
-		{"5 < 3;", false},
-		{"3 > 5;", false},
-		{"3 < 5;", true},
-		{"3 == 3;", true},
-		{"3 != 3;", false},
-		{"3 == 5;", false},
-		{"3 != 5;", true},
-		{"true == true;", true},
-		{"true != true;", false},
-		{"true == false;", false},
-		{"true != false;", true},
-		{"!true;", false},
-		{"!false;", true},
-		{"!!true;", true},
-		{"!(if (false) { 10; })", true},
+		{"true;", true},
+		{"false;", false},
+		{"5 > 3;", true},
+		{"5 < 3;", false},
+		{"3 > 5;", false},
+		{"3 < 5;", true},
+		{"3 <= 3;", true},
+		{"3 >= 3;", true},
+		{"3 >= 4;", false},
+		{"4 >= 3;", true},
+		{"3 <= 4;", true},
+		{"4 <= 3;", false},
+		{"3 == 3;", true},
+		{"3 != 3;", false},
+		{"3 == 5;", false},
+		{"3 != 5;", true},
+		{"true == true;", true},
+		{"true != true;", false},
+		{"true == false;", false},
+		{"true != false;", true},
+		{"false == false;", true},
+		{"false != false;", false},
+		{"false == true;", false},
+		{"false != true;", true},
+		{"(1 < 2) == true;", true},
+		{"(1 > 2) == false;", true},
+		{"(1 > 2) != true;", true},
+		{"(1 == 1) == (2 == 2);", true},
+		{"1 + 2 <= 3 == true;", true},
+		{"!(1 > 2);", true},
+		{"!true;", false},
+		{"!false;", true},
+		{"!!true;", true},
+		{"!(if (false) { 10; })", true},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestComparingBooleansByValue(t *testing.T) {
+	// booleans other than object.TRUE and object.FALSE, as an embedder might put into the constants
+	constants := []object.Object{&object.Boolean{Value: true}, &object.Boolean{Value: true}, &object.Boolean{Value: false}}
+
+	testCases := []struct {
+		left, right int
+		op          code.Opcode
+		expected    bool
+	}{
+		{0, 1, code.OpEqual, true},
+		{0, 1, code.OpNotEqual, false},
+		{0, 2, code.OpEqual, false},
+		{0, 2, code.OpNotEqual, true},
+	}
+
+	for _, tc := range testCases {
+		instructions := concatInstructions([]code.Instructions{
+			code.Make(code.OpConstant, tc.left),
+			code.Make(code.OpConstant, tc.right),
+			code.Make(tc.op),
+			code.Make(code.OpPop),
+		})
+
+		vm := New(&compiler.ByteCode{Instructions: instructions, Constants: constants})
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testBooleanObject(t, tc.expected, vm.LastPopped())
+		if vm.LastPopped() != object.TRUE && vm.LastPopped() != object.FALSE {
+			t.Fatalf("result is not a singleton: %p", vm.LastPopped())
+		}
+	}
+}
+
+func TestComparisonChains(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let x = 5; 1 < x < 10", true},
+		{"let x = 0; 1 < x < 10", false},
+		{"let x = 10; 1 < x < 10", false},
+		{"let x = 10; 1 < x <= 10", true},
+		{"let x = 10; 10 >= x > 1", true},
+		{"1 < 2 < 3 < 4", true},
+		{"1 < 2 < 3 > 4", false},
+		{"1 < 2 > 1", true},
+		{"let inRange = fn(x) { 1 < x < 10 }; inRange(5)", true},
+		{"let inRange = fn(x) { 1 < x < 10 }; inRange(10)", false},
+		{"fn(a) { fn(b) { 1 < a < b } }(2)(3)", true},
+		{"let x = 1 < 2 < 3; x == true", true},
+		{"1 < len([1 < 2 < 3, 2 < 1 < 0]) + 1 < 4", true},
+		{"2 < 1 < 1()", false},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestArrayComparison(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		{"[1, 2] < [1, 3]", true},
+		{"[1, 3] < [1, 2]", false},
+		{"[1] < [1, 0]", true},
+		{"[1, 0] > [1]", true},
+		{"[] < [1]", true},
+		{"[1, 2] <= [1, 2]", true},
+		{"[1, 2] >= [1, 2]", true},
+		{"[1, 2] < [1, 2]", false},
+		{"[2] > [1, 5]", true},
+		{"[[1, 2], 3] < [[1, 3], 0]", true},
+		{"[1, 99999999999999999999] < [1, 100000000000000000000]", true},
+		{"[1, true] < [2, false]", true},
+		{"[1, 2] == [1, 2]", false},
+		{"let a = [1]; a == a", true},
+	})
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"[true] < [false]", "cannot compare BOOLEAN and BOOLEAN"},
+		{`[1, "a"] < [1, "b"]`, "cannot compare STRING and STRING"},
+		{"[[1]] < [1]", "cannot compare ARRAY and INTEGER"},
+		{"let a = [0]; a[0] = a; a < a", "cannot compare an array nested in itself"},
+		{"[1] < 1", "unsupported types for < operation: ARRAY and INTEGER"},
+	})
+}
+
+func TestEmbedderBuiltinReturningBoolean(t *testing.T) {
+	isPositive := &object.Builtin{Fn: func(host object.Host, args ...object.Object) object.Object {
+		if args[0].(*object.Integer).Value > 0 {
+			return object.TRUE
+		}
+		return object.FALSE
+	}}
+	constants := []object.Object{isPositive, &object.Integer{Value: 5}}
+
+	instructions := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpTrue),
+		code.Make(code.OpEqual),
+		code.Make(code.OpPop),
+	})
+
+	vm := New(&compiler.ByteCode{Instructions: instructions, Constants: constants})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if vm.LastPopped() != object.TRUE {
+		t.Fatalf("isPositive(5) == true wrong. want=%s, got=%s", object.TRUE.Inspect(), vm.LastPopped().Inspect())
+	}
+}
+
+func TestPanickingBuiltin(t *testing.T) {
+	explode := &object.Builtin{Name: "explode", Fn: func(host object.Host, args ...object.Object) object.Object {
+		panic("boom")
+	}}
+	constants := []object.Object{explode, &object.Integer{Value: 1}}
+
+	instructions := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpPop),
+	})
+
+	vm := New(&compiler.ByteCode{Instructions: instructions, Constants: constants})
+	err := vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but got none")
+	}
+
+	var panicErr *BuiltinPanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("VM error has wrong kind. want=*BuiltinPanicError, got=%T (%s)", err, err)
+	}
+	if panicErr.Value != "boom" {
+		t.Errorf("panic value wrong. want=%q, got=%v", "boom", panicErr.Value)
+	}
+	if err.Error() != "builtin `explode` panicked: boom" {
+		t.Errorf("wrong VM error. got=%q", err)
+	}
+}
+
+func TestRunContextCancellation(t *testing.T) {
+	inputs := []string{
+		// makes 2^60 calls, which doesn't end before the deadline
+		"let f = fn(n) { if (n > 0) { f(n - 1); f(n - 1) } }; f(60)",
+		"do { } while (true)",
+	}
+
+	for _, input := range inputs {
+		comp := compiler.New()
+		if err := comp.Compile(parse(input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := New(comp.ByteCode()).RunContext(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("wrong VM error for %q. want=%v, got=%v", input, context.DeadlineExceeded, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	function := &object.CompiledFunction{
+		Instructions: concatInstructions([]code.Instructions{code.Make(code.OpGetLocal, 1), code.Make(code.OpReturnValue)}),
+		NumLocals:    1,
+	}
+
+	tests := []struct {
+		desc      string
+		byteCode  *compiler.ByteCode
+		expectErr string
+	}{
+		{
+			desc: "well-formed",
+			byteCode: &compiler.ByteCode{
+				Instructions: concatInstructions([]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 7), code.Make(code.OpConstant, 0), code.Make(code.OpPop)}),
+				Constants:    []object.Object{&object.Integer{Value: 1}},
+			},
+		},
+		{
+			desc:      "jump into an operand",
+			byteCode:  &compiler.ByteCode{Instructions: concatInstructions([]code.Instructions{code.Make(code.OpConstant, 0), code.Make(code.OpJump, 1)}), Constants: []object.Object{&object.Integer{Value: 1}}},
+			expectErr: "main: 0003: jump target 1 is not the start of an instruction",
+		},
+		{
+			desc:      "jump past the end",
+			byteCode:  &compiler.ByteCode{Instructions: code.Make(code.OpJump, 9)},
+			expectErr: "main: 0000: jump target 9 is not the start of an instruction",
+		},
+		{
+			desc:      "catch handler inside an operand",
+			byteCode:  &compiler.ByteCode{Instructions: concatInstructions([]code.Instructions{code.Make(code.OpSetupCatch, 5), code.Make(code.OpConstant, 0)}), Constants: []object.Object{&object.Integer{Value: 1}}},
+			expectErr: "main: 0000: jump target 5 is not the start of an instruction",
+		},
+		{
+			desc:      "finally handler past the end",
+			byteCode:  &compiler.ByteCode{Instructions: concatInstructions([]code.Instructions{code.Make(code.OpSetupFinally, 9), code.Make(code.OpPopCatch)})},
+			expectErr: "main: 0000: jump target 9 is not the start of an instruction",
+		},
+		{
+			desc:      "constant out of range",
+			byteCode:  &compiler.ByteCode{Instructions: code.Make(code.OpConstant, 2), Constants: []object.Object{&object.Integer{Value: 1}}},
+			expectErr: "main: 0000: constant 2 out of range, there are 1",
+		},
+		{
+			desc:      "unknown opcode",
+			byteCode:  &compiler.ByteCode{Instructions: code.Instructions{255}},
+			expectErr: "main: 0000: opcode 255 is not defined",
+		},
+		{
+			desc:      "truncated operand",
+			byteCode:  &compiler.ByteCode{Instructions: code.Make(code.OpConstant, 0)[:2]},
+			expectErr: "main: 0000: OpConstant needs 2 bytes of operands, 1 left",
+		},
+		{
+			desc:      "closure of a non-function",
+			byteCode:  &compiler.ByteCode{Instructions: code.Make(code.OpClosure, 0, 0), Constants: []object.Object{&object.Integer{Value: 1}}},
+			expectErr: "main: 0000: closure of constant 0, which is INTEGER, not a function",
+		},
+		{
+			desc:      "local out of range in a function",
+			byteCode:  &compiler.ByteCode{Instructions: code.Make(code.OpClosure, 0, 0), Constants: []object.Object{function}},
+			expectErr: "function in constant 0: 0000: local 1 out of range, there are 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := Verify(tt.byteCode)
+			if tt.expectErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected verifier error: %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.expectErr {
+				t.Fatalf("wrong verifier error. want=%q, got=%v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestRunContextFinishing(t *testing.T) {
+	program := parse("let f = fn(n) { if (n > 0) { f(n - 1) } else { 7 } }; f(500)")
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	vm := New(comp.ByteCode())
+	if err := vm.RunContext(ctx); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testIntegerObject(t, 7, vm.LastPopped())
+}
+
+func TestStackSnapshot(t *testing.T) {
+	var snapshots [][]object.Object
+	spy := &object.Builtin{Fn: func(host object.Host, args ...object.Object) object.Object {
+		vm := host.(*VM)
+		snapshots = append(snapshots, vm.StackSnapshot(3), vm.StackSnapshot(10), vm.StackSnapshot(0))
+		return nil
+	}}
+	constants := []object.Object{spy, &object.Integer{Value: 1}, &object.Integer{Value: 2}, &object.Integer{Value: 3}}
+
+	instructions := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpConstant, 2),
+		code.Make(code.OpConstant, 3),
+		code.Make(code.OpCall, 3),
+		code.Make(code.OpPop),
+	})
+
+	vm := New(&compiler.ByteCode{Instructions: instructions, Constants: constants})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := [][]object.Object{
+		{constants[1], constants[2], constants[3]},
+		{spy, constants[1], constants[2], constants[3]},
+		{},
+	}
+	for i, want := range expected {
+		got := snapshots[i]
+		if len(got) != len(want) {
+			t.Fatalf("snapshot %d has wrong length. want=%d, got=%d", i, len(want), len(got))
+		}
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("snapshot %d wrong at %d. want=%s, got=%s", i, j, want[j].Inspect(), got[j].Inspect())
+			}
+		}
+	}
+
+	if snapshot := vm.StackSnapshot(5); len(snapshot) != 0 {
+		t.Errorf("snapshot after run not empty. got=%d values", len(snapshot))
+	}
+}
+
+func TestDup(t *testing.T) {
+	constants := []object.Object{&object.Integer{Value: 21}}
+
+	instructions := concatInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpDup),
+		code.Make(code.OpAdd),
+		code.Make(code.OpPop),
+	})
+
+	vm := New(&compiler.ByteCode{Instructions: instructions, Constants: constants})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testIntegerObject(t, 42, vm.LastPopped())
+}
+
+func TestComparisonOperandOrder(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let log = [0]; let f = fn(x) { log[0] = log[0] * 10 + x; x }; f(1) < f(2); log[0]", 12},
+		{"let log = [0]; let f = fn(x) { log[0] = log[0] * 10 + x; x }; f(1) <= f(2); log[0]", 12},
+		{"let log = [0]; let f = fn(x) { log[0] = log[0] * 10 + x; x }; f(1) < f(2) > f(0); log[0]", 120},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestConditionals(t *testing.T) {
+	testCases := []vmTestCase{
+		{"if (true) { 10 }", 10},
+		{"if (true) { 10 } else { 20 }", 10},
+		{"if (false) { 10 } else { 20 }", 20},
+		{"if (1) { 10 } else { 20 }", 10},
+		{"if (1 < 2) { 10 }", 10},
+		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (1 > 2) { 10 }", object.NULL},
+		{"if (false) { 10 }", object.NULL},
+		{"let x = if (false) { 1 }; x", object.NULL},
+		{"let x = if (1 > 2) { 1 }; x", object.NULL},
+		{"fn() { let x = if (false) { 1 }; x }()", object.NULL},
+		{"if (true) { }", object.NULL},
+		{"if (false) { 1 } else { }", object.NULL},
+		{"if (true) { let a = 1; }", object.NULL},
+		{"let x = if (true) { let a = 1; }; x", object.NULL},
+		{"fn() { if (true) { return 1; } }()", 1},
+		{"if (if (false) { 5 }) { 10 } else { 20 }", 20},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestBlockExpressions(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let x = { let a = 1; a + 1 }; x", 2},
+		{"{ 1; 2 }", 2},
+		{"{ let a = 1; }", object.NULL},
+		{"let a = 5; { let a = 1; a } + a", 6},
+		{"let a = 5; { let b = a * 2; { let c = b + 1; c } }", 11},
+		{"[{ 1 }, { let z = 2; z }]", []int{1, 2}},
+		{"fn(n) { let y = { let m = n * 2; m + 1 }; y }(3)", 7},
+		{"fn(n) { let f = { let m = n * 2; fn() { m + n } }; f() }(3)", 9},
+		{"fn() { { return 7; }; 8 }()", 7},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestGlobalLetStatements(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let one = 1; one", 1},
+		{"let one = 1; let two = 2; one + two", 3},
+		{"let one = 1; let two = one + one; one + two", 3},
+		{"let a = 1; let a = a + 1; a", 2},
+		{"let a = 1; let f = fn() { let a = a + 10; a }; [f(), a]", []int{11, 1}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestStringExpressions(t *testing.T) {
+	testCases := []vmTestCase{
+		{`"monkey"`, "monkey"},
+		{`"\x41"`, "A"},
+		{"`\\n`", `\n`},
+		{`"mon" + "key"`, "monkey"},
+		{`"\x41" + ` + "`\\n`", `A\n`},
+		{`"mon" + "key" == "monkey"`, true},
+		{`"a" == "a"`, true},
+		{`"a" == "b"`, false},
+		{`"a" != "a"`, false},
+		{`"a" != "b"`, true},
+		{`let s = "a"; s + "b" != "ab"`, false},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestRepetition(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		{`"ab" * 3`, "ababab"},
+		{`"ab" * 0`, ""},
+		{`"" * 5`, ""},
+		{"[0] * 3", []int{0, 0, 0}},
+		{"[1, 2] * 2", []int{1, 2, 1, 2}},
+		{"[1, 2] * 0", []int{}},
+		{"let a = [1]; let b = a * 2; b[0] = 3; a", []int{1}},
+	})
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{`"ab" * -1`, "negative repeat count: -1"},
+		{"[0] * -2", "negative repeat count: -2"},
+		{`3 * "ab"`, "unsupported types for binary operation: INTEGER and STRING"},
+		{`"ab" + 3`, "unsupported types for binary operation: STRING and INTEGER"},
+		{"[0] * [1]", "unsupported types for binary operation: ARRAY and ARRAY"},
+	})
+}
+
+func TestArrayLiterals(t *testing.T) {
+	testCases := []vmTestCase{
+		{"[]", []int{}},
+		{"[1, 2, 3]", []int{1, 2, 3}},
+		{"[1 + 2, 3 * 4, 5 + 6]", []int{3, 12, 11}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestHashLiterals(t *testing.T) {
+	testCases := []vmTestCase{
+		{"{}", map[object.HashKey]int64{}},
+		{"{1: 2, 3: 4}", map[object.HashKey]int64{
+			(&object.Integer{Value: 1}).HashKey(): 2,
+			(&object.Integer{Value: 3}).HashKey(): 4,
+		}},
+		{"{1 + 1: 2 * 2, 3 + 3: 4 * 4}", map[object.HashKey]int64{
+			(&object.Integer{Value: 2}).HashKey(): 4,
+			(&object.Integer{Value: 6}).HashKey(): 16,
+		}},
+		{`let k = "b"; {"a" + k: 1, 1 > 0: 2}`, map[object.HashKey]int64{
+			(&object.String{Value: "ab"}).HashKey(): 1,
+			object.TRUE.HashKey():                   2,
+		}},
+		{"{1 + 1: 1, 2: 2}", map[object.HashKey]int64{
+			(&object.Integer{Value: 2}).HashKey(): 2,
+		}},
+		{"{2: 1, 1 + 1: 2}", map[object.HashKey]int64{
+			(&object.Integer{Value: 2}).HashKey(): 2,
+		}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestIndexExpressions(t *testing.T) {
+	testCases := []vmTestCase{
+		{"[1, 2, 3][1]", 2},
+		{"[1, 2, 3][0 + 2]", 3},
+		{"[[1, 1, 1]][0][0]", 1},
+		{"[][0]", object.NULL},
+		{"[1, 2, 3][99]", object.NULL},
+		{"[1][-1]", object.NULL},
+		{"{1: 1, 2: 2}[1]", 1},
+		{"{1: 1, 2: 2}[2]", 2},
+		{"{1: 1}[0]", object.NULL},
+		{"{}[0]", object.NULL},
+		{`{"a" + "b": 5}["ab"]`, 5},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestCallingIndexedFunctions(t *testing.T) {
+	testCases := []vmTestCase{
+		{`let h = {"f": fn(x) { x + 1 }}; h["f"](2)`, 3},
+		{`{"f": |x| x * 2, "g": |x| x * 3}["g"](2)`, 6},
+		{"[fn() { 1 }, fn() { 2 }][1]()", 2},
+		{`let ops = {"add": fn(a, b) { a + b }}; let apply = fn(name, a, b) { ops[name](a, b) }; apply("add", 2, 3)`, 5},
+		{`let h = {"make": fn(n) { fn(x) { x + n } }}; h["make"](10)(5)`, 15},
+		{`{"len": len}["len"]([1, 2])`, 2},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{`{"f": fn() { 1 }}["g"]()`, "calling non-function: NULL"},
+	})
+}
+
+func TestIndexAssignment(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let a = [1, 2, 3]; a[1] = 5; a", []int{1, 5, 3}},
+		{"let a = [[1], [2]]; a[1][0] = 7; a[1][0]", 7},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3; h["a"] + h["b"]`, 5},
+		{"let a = [1]; let b = a; b[0] = 9; a[0]", 9},
+		{"let set = fn(a) { a[0] = 4 }; let a = [1]; set(a); a[0]", 4},
+		{"let set = fn(a) { a[0] = 4 }; set([1])", object.NULL},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"let a = [1]; a[1] = 2", "index out of range: 1"},
+		{`let a = [1]; a["x"] = 2`, "array index must be INTEGER, got STRING"},
+		{"let h = {}; h[[1]] = 2", "unusable as hash key: ARRAY"},
+		{"let s = 1; s[0] = 2", "index assignment not supported: INTEGER"},
+	})
+}
+
+func TestHashIndexAssignment(t *testing.T) {
+	testCases := []vmTestCase{
+		{`let h = {"a": 1}; h["a"] = 2; h["a"]`, 2},
+		{`let h = {"a": 1}; h["a"] = 2; len(keys(h))`, 1},
+		{`let h = {"a": 1}; h["b"] = 3; h["a"] + h["b"]`, 4},
+		{`let h = {}; h[1] = "one"; h[true] = "yes"; h[1] + h[true]`, "oneyes"},
+		{`let h = {"a": 1}; let g = h; g["a"] = 5; h["a"]`, 5},
+		{`let h = {"a": {"b": 1}}; h["a"]["b"] = 7; h["a"]["b"]`, 7},
+		{`let h = {"a": 1}; let g = clone(h); g["a"] = 5; h["a"]`, 1},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{`let h = {}; h[{}] = 1`, "unusable as hash key: HASH"},
+		{`let h = {}; h[fn() { 1 }] = 1`, "unusable as hash key: CLOSURE"},
+	})
+}
+
+func TestFreeze(t *testing.T) {
+	testCases := []vmTestCase{
+		{"freeze([1, 2])", []int{1, 2}},
+		{"let a = [1, 2]; a[0] = 3; a", []int{3, 2}},
+		{"let a = freeze([[1]]); a[0][0] = 2; a[0][0]", 2},
+		{"let a = freeze([1]); let b = clone(a); b[0] = 2; b[0] + a[0]", 3},
+		{"freeze(1)", &object.Error{Message: "argument 1 to `freeze` must be ARRAY or HASH, got INTEGER"}},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"let a = freeze([1, 2]); a[0] = 3", "cannot assign to frozen ARRAY"},
+		{"let a = [1, 2]; freeze(a); a[0] = 3", "cannot assign to frozen ARRAY"},
+		{`let h = freeze({"a": 1}); h["b"] = 2`, "cannot assign to frozen HASH"},
+	})
+}
+
+func TestHashAndIndexErrors(t *testing.T) {
+	testCases := []vmErrorTestCase{
+		{"{[1]: 2}", "unusable as hash key: ARRAY"},
+		{"{1: 2}[[1]]", "unusable as hash key: ARRAY"},
+		{"1[0]", "index operator not supported: INTEGER"},
+	}
+
+	runVmErrorTests(t, testCases)
+}
+
+func TestCallingFunctions(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let f = fn() { 5 + 10 }; f()", 15},
+		{"let one = fn() { 1 }; let two = fn() { one() + one() }; two()", 2},
+		{"let f = fn() { return 1; 2 }; f()", 1},
+		{"let f = fn() { }; f()", object.NULL},
+		{"let sum = fn(a, b) { let c = a + b; c }; sum(1, 2) + sum(3, 4)", 10},
+		{"let g = 10; let f = fn(a) { let b = 1; a + b + g }; f(2)", 13},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestClosures(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let adder = fn(a) { fn(b) { a + b } }; let addTwo = adder(2); addTwo(3)", 5},
+		{"let f = fn(a) { fn(b) { fn(c) { a + b + c } } }; f(1)(2)(3)", 6},
+		{"let countDown = fn(x) { if (x == 0) { return 0; } countDown(x - 1) }; countDown(5)", 0},
+		{"let wrapper = fn() { let inner = fn(x) { if (x == 0) { 0 } else { inner(x - 1) } }; inner(3) }; wrapper()", 0},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestLambdas(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let inc = |x| x + 1; inc(1)", 2},
+		{"(|a, b| a * b)(3, 4)", 12},
+		{"(|| 5)()", 5},
+		{"let adder = |a| |b| a + b; adder(1)(2)", 3},
+		{"let apply = fn(f, x) { f(x) }; apply(|x| x * x, 3)", 9},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestPipelines(t *testing.T) {
+	testCases := []vmTestCase{
+		{"[1, 2, 3] |> len", 3},
+		{"[1, 2, 3] |> rest |> len", 2},
+		{"[1, 2] |> push(3) |> last", 3},
+		{"let double = |x| x * 2; 1 + 2 |> double |> double", 12},
+		{"let sub = fn(a, b) { a - b }; 10 |> sub(3)", 7},
+		{"5 |> |x| x * x", 25},
+		{"[1, 2, 3] |> len == 3", true},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestNullish(t *testing.T) {
+	testCases := []vmTestCase{
+		{"null ?? 5", 5},
+		{"3 ?? 5", 3},
+		{"false ?? 5", false},
+		{"[][0] ?? 1", 1},
+		{"null ?? null", object.NULL},
+		{"null ?? null ?? 7", 7},
+		{"let calls = [0]; let f = fn() { calls[0] = 1; 5 }; 3 ?? f(); calls[0]", 0},
+		{"let calls = [0]; let f = fn() { calls[0] = 1; 5 }; null ?? f(); calls[0]", 1},
+		{"let get = fn(h, k) { h[k] ?? 0 }; get({1: 2}, 1) + get({}, 1)", 2},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestOptionalAccess(t *testing.T) {
+	testCases := []vmTestCase{
+		{"null?.[0]", object.NULL},
+		{"[1, 2]?.[1]", 2},
+		{`let h = {"a": {"b": 1}}; h["a"]?.["b"]`, 1},
+		{`let h = {"a": {"b": 1}}; h["x"]?.["b"]`, object.NULL},
+		{`let h = {"a": {"b": 1}}; h["x"]?.["b"] ?? 0`, 0},
+		{"null?.(1)", object.NULL},
+		{"let f = fn(x) { x * 2 }; f?.(4)", 8},
+		{`let h = {"f": fn() { 1 }}; h["g"]?.()`, object.NULL},
+		{"let max = fn(a, b) { a }; max?.(...[1, 2])", 1},
+		{"let calls = [0]; let f = fn() { calls[0] = 1; 0 }; null?.[f()]; calls[0]", 0},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"1?.[0]", "index operator not supported: INTEGER"},
+		{"1?.()", "calling non-function: INTEGER"},
+	})
+}
+
+func TestSpreadCalls(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let add = fn(a, b) { a + b }; add(...[1, 2])", 3},
+		{"let add = fn(a, b) { a + b }; add(1, ...[2])", 3},
+		{"let add = fn(a, b) { a + b }; let args = [1, 2]; add(...args)", 3},
+		{"let f = fn() { 5 }; f(...[])", 5},
+		{"len(...[[1, 2, 3]])", 3},
+		{"max(...[3, 9, 4])", 9},
+		{"[1, 2] |> push(...[3]) |> len", 3},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"let f = fn(a) { a }; f(...1)", "spread argument must be ARRAY, got INTEGER"},
+		{"let add = fn(a, b) { a + b }; add(...[1, 2, 3])", "wrong number of arguments: want=2, got=3"},
+	})
+}
+
+func TestMultipleValues(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let f = fn() { return 1, 2 }; let a, b = f(); a", 1},
+		{"let f = fn() { return 1, 2 }; let a, b = f(); b", 2},
+		{"let f = fn() { return 1, 2 }; f()", []int{1, 2}},
+		{"let divmod = fn(a, b) { return a / b, a - a / b * b }; let q, r = divmod(7, 2); q * 10 + r", 31},
+		{"let swap = fn(a, b) { let x, y = [b, a]; x - y }; swap(1, 5)", 4},
+		{"let a, b, c = [1, 2, 3]; c - b - a", 0},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"let a, b = [1, 2, 3]", "cannot destructure ARRAY of length 3 into 2 names"},
+		{"let a, b = 1", "cannot destructure INTEGER"},
+	})
+}
+
+func TestPartial(t *testing.T) {
+	testCases := []vmTestCase{
+		{"let add = fn(a, b) { a + b }; let addFive = partial(add, 5); addFive(3)", 8},
+		{"let sub = fn(a, b, c) { a - b - c }; partial(sub, 10)(3, 2)", 5},
+		{"let sub = fn(a, b, c) { a - b - c }; partial(sub, 10, 3)(2)", 5},
+		{"let sub = fn(a, b, c) { a - b - c }; partial(partial(sub, 10), 3)(2)", 5},
+		{"let sub = fn(a, b, c) { a - b - c }; partial(sub, 10, 3, 2)()", 5},
+		{"let f = fn() { 1 }; partial(f)()", 1},
+		{"partial(max, 3)(1, 7)", 7},
+		{"partial(push, [1])(2)", []int{1, 2}},
+		{"let mul = |a, b| a * b; let triple = partial(mul, 3); 4 |> triple", 12},
+		{"let add = fn(a, b) { a + b }; fn(x) { partial(add, x) }(1)(2)", 3},
+		{"partial(1)", &object.Error{Message: "argument 1 to `partial` must be a function, got INTEGER"}},
+		{"partial()", &object.Error{Message: "wrong number of arguments. got=0, want at least 1"}},
+		{"partial(fn(a) { a }, 1, 2)", &object.Error{Message: "too many arguments to bind: want at most 1, got 2"}},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"let add = fn(a, b) { a + b }; partial(add, 1)(2, 3)", "wrong number of arguments: want=2, got=3"},
+	})
+}
+
+func TestArrayBuilder(t *testing.T) {
+	testCases := []vmTestCase{
+		{"build(newArrayBuilder())", []int{}},
+		{"let b = newArrayBuilder(); append(b, 1); append(b, 2); build(b)", []int{1, 2}},
+		{"build(append(append(newArrayBuilder(), 1), 2))", []int{1, 2}},
+		{"let b = append(newArrayBuilder(), 1); let a = build(b); append(b, 2); [a, build(b)]", []interface{}{[]int{1}, []int{1, 2}}},
+		{"let b = append(newArrayBuilder(), 1); let a = build(b); a[0] = 5; build(b)", []int{1}},
+		{"let a = [1]; let b = newArrayBuilder(); append(b, a); push(a, 2); len(build(b)[0])", 1},
+		{"append([], 1)", &object.Error{Message: "argument 1 to `append` must be ARRAY_BUILDER or STRING_BUILDER, got ARRAY"}},
+		{"build([])", &object.Error{Message: "argument 1 to `build` must be ARRAY_BUILDER, got ARRAY"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestStringBuilder(t *testing.T) {
+	testCases := []vmTestCase{
+		{"toString(newBuilder())", ""},
+		{`let b = newBuilder(); append(b, "ab"); append(b, ""); append(b, "c"); toString(b)`, "abc"},
+		{`toString(append(append(newBuilder(), "a"), "b"))`, "ab"},
+		{`let b = append(newBuilder(), "a"); let s = toString(b); append(b, "b"); [s, toString(b)]`, []interface{}{"a", "ab"}},
+		{`append(newBuilder(), 1)`, &object.Error{Message: "argument 2 to `append` must be STRING for a STRING_BUILDER, got INTEGER"}},
+		{`toString("a")`, &object.Error{Message: "argument 1 to `toString` must be STRING_BUILDER, got STRING"}},
+		{`build(newBuilder())`, &object.Error{Message: "argument 1 to `build` must be ARRAY_BUILDER, got STRING_BUILDER"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestOrdAndChr(t *testing.T) {
+	testCases := []vmTestCase{
+		{`ord("A")`, 65},
+		{`chr(66)`, "B"},
+		{`ord(chr(0))`, 0},
+		{`ord(chr(255))`, 255},
+		{`len(chr(200))`, 1},
+		{`ord("é")`, &object.Error{Message: "argument to `ord` must be a single byte, got 2 bytes"}},
+		{`ord("")`, &object.Error{Message: "argument to `ord` must be a single byte, got 0 bytes"}},
+		{`ord("ab")`, &object.Error{Message: "argument to `ord` must be a single byte, got 2 bytes"}},
+		{`chr(256)`, &object.Error{Message: "argument to `chr` must be 0 to 255, got 256"}},
+		{`chr(-1)`, &object.Error{Message: "argument to `chr` must be 0 to 255, got -1"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestSubstr(t *testing.T) {
+	testCases := []vmTestCase{
+		{`substr("hello", 1, 3)`, "ell"},
+		{`substr("hello", 0, 5)`, "hello"},
+		{`substr("hello", -3, 2)`, "ll"},
+		{`substr("hello", -1, 1)`, "o"},
+		{`substr("hello", 3, 10)`, "lo"},
+		{`substr("hello", -10, 2)`, "he"},
+		{`substr("hello", 5, 1)`, ""},
+		{`substr("hello", 9, 1)`, ""},
+		{`substr("hello", 1, 0)`, ""},
+		{`substr("hello", 1, -2)`, ""},
+		{`substr("", 0, 1)`, ""},
+		{`substr("hello", "1", 2)`, &object.Error{Message: "argument 2 to `substr` must be INTEGER, got STRING"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestZip(t *testing.T) {
+	testCases := []vmTestCase{
+		{"zip([1, 2], [3, 4])", []interface{}{[]int{1, 3}, []int{2, 4}}},
+		{`zip([1, 2, 3], ["a", "b"])`, []interface{}{[]interface{}{1, "a"}, []interface{}{2, "b"}}},
+		{"zip([1], [3, 4, 5])", []interface{}{[]int{1, 3}}},
+		{"zip([], [1])", []int{}},
+		{"zip([], [])", []int{}},
+		{"zip(1, [])", &object.Error{Message: "argument 1 to `zip` must be ARRAY, got INTEGER"}},
+		{`zip([], "ab")`, &object.Error{Message: "argument 2 to `zip` must be ARRAY, got STRING"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestReverse(t *testing.T) {
+	testCases := []vmTestCase{
+		{"reverse([1, 2, 3])", []int{3, 2, 1}},
+		{"reverse([])", []int{}},
+		{"let a = [1, 2]; reverse(a); a", []int{1, 2}},
+		{`reverse("abc")`, "cba"},
+		{`reverse("")`, ""},
+		{`reverse("\xff\x00a")`, "a\x00\xff"},
+		{`reverse(reverse("héllo"))`, "héllo"},
+		{"reverse(1)", &object.Error{Message: "argument 1 to `reverse` must be ARRAY or STRING, got INTEGER"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestTakeAndDrop(t *testing.T) {
+	testCases := []vmTestCase{
+		{"take([1, 2, 3], 2)", []int{1, 2}},
+		{"take([1, 2, 3], 0)", []int{}},
+		{"take([1, 2, 3], 5)", []int{1, 2, 3}},
+		{"take([1, 2, 3], -1)", []int{}},
+		{"take([], 1)", []int{}},
+		{"drop([1, 2, 3], 2)", []int{3}},
+		{"drop([1, 2, 3], 0)", []int{1, 2, 3}},
+		{"drop([1, 2, 3], 5)", []int{}},
+		{"drop([1, 2, 3], -1)", []int{1, 2, 3}},
+		{"let a = [1, 2, 3]; let b = take(a, 2); b[0] = 9; a", []int{1, 2, 3}},
+		{"let a = [1, 2, 3]; let b = drop(a, 1); b[0] = 9; a", []int{1, 2, 3}},
+		{"take(1, 1)", &object.Error{Message: "argument 1 to `take` must be ARRAY, got INTEGER"}},
+		{`drop([1], "a")`, &object.Error{Message: "argument 2 to `drop` must be INTEGER, got STRING"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestFlatten(t *testing.T) {
+	testCases := []vmTestCase{
+		{"flatten([[1], [2, 3]])", []int{1, 2, 3}},
+		{"flatten([1, [2], [], 3])", []int{1, 2, 3}},
+		{"flatten([[1, [2, [3]]]])", []interface{}{1, []interface{}{2, []int{3}}}},
+		{"flatten([])", []int{}},
+		{"flattenDeep([1, [2, [3, [4, [5]]]], [[[]]], 6])", []int{1, 2, 3, 4, 5, 6}},
+		{"flattenDeep([])", []int{}},
+		{"let a = [1]; flattenDeep([a, [a]])", []int{1, 1}},
+		{"let a = [1]; flattenDeep([a])[0] = 2; a", []int{1}},
+		{"let a = [1, 2]; a[1] = [a]; flattenDeep(a)", &object.Error{Message: "cannot flatten an array nested in itself"}},
+		{"flatten(1)", &object.Error{Message: "argument 1 to `flatten` must be ARRAY, got INTEGER"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestGroupBy(t *testing.T) {
+	parity := `let parity = fn(x) { if (x / 2 * 2 == x) { "even" } else { "odd" } };`
+	testCases := []vmTestCase{
+		{parity + `let g = groupBy([1, 2, 3, 4, 5], parity); [g["even"], g["odd"], len(keys(g))]`,
+			[]interface{}{[]int{2, 4}, []int{1, 3, 5}, 2}},
+		{parity + `let g = groupBy([2, 4], parity); [g["even"], g["odd"]]`, []interface{}{[]int{2, 4}, object.NULL}},
+		{parity + "len(keys(groupBy([], parity)))", 0},
+		{"let g = groupBy([1, 2, 3], |x| x > 1); [g[true], g[false]]", []interface{}{[]int{2, 3}, []int{1}}},
+		{"let g = groupBy([[1], [2, 3], [4]], len); g[1]", []interface{}{[]int{1}, []int{4}}},
+		{"groupBy([1], |x| [x])", &object.Error{Message: "unusable as hash key: ARRAY"}},
+		{"groupBy(1, len)", &object.Error{Message: "argument 1 to `groupBy` must be ARRAY, got INTEGER"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestFind(t *testing.T) {
+	testCases := []vmTestCase{
+		{"find([1, 3, 4, 6], fn(x) { x / 2 * 2 == x })", 4},
+		{"findIndex([1, 3, 4, 6], fn(x) { x / 2 * 2 == x })", 2},
+		{"find([1, 3, 5], fn(x) { x / 2 * 2 == x })", object.NULL},
+		{"findIndex([1, 3, 5], fn(x) { x / 2 * 2 == x })", -1},
+		{"find([], fn(x) { true })", object.NULL},
+		{"findIndex([], fn(x) { true })", -1},
+		{"find([null, 0, 1], |x| x)", 0},
+		{"let limit = 2; find([1, 2, 3], |x| x > limit)", 3},
+		{"find([[], [1], [2, 3]], partial(fn(n, a) { len(a) == n }, 2))", []int{2, 3}},
+		{"fn() { let a = find([1, 2], |x| x > 1); a * 10 }()", 20},
+		{"find([1, 2, 3], fn(x) { find([x], |y| y == 2) })", 2},
+		{"find(1, |x| x)", &object.Error{Message: "argument 1 to `find` must be ARRAY, got INTEGER"}},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"find([1], 1)", "calling non-function: INTEGER"},
+		{"find([1, 2], fn(x) { x + true })", "unsupported types for binary operation: INTEGER and BOOLEAN"},
+		{"findIndex([1], fn(a, b) { a })", "wrong number of arguments: want=2, got=1"},
+		{"find([1, 2], fn(x) { exit(3) }); 4", "exit status 3"},
+	})
+}
+
+func TestAllAndAny(t *testing.T) {
+	// seen records the elements the predicate was called with
+	pred := "let seen = newArrayBuilder(); let positive = fn(x) { append(seen, x); x > 0 };"
+	testCases := []vmTestCase{
+		{pred + "[all([1, 2, 3], positive), build(seen)]", []interface{}{true, []int{1, 2, 3}}},
+		{pred + "[all([1, -2, 3], positive), build(seen)]", []interface{}{false, []int{1, -2}}},
+		{pred + "[any([-1, 2, 3], positive), build(seen)]", []interface{}{true, []int{-1, 2}}},
+		{pred + "[any([-1, -2, -3], positive), build(seen)]", []interface{}{false, []int{-1, -2, -3}}},
+		{pred + "[all([], positive), any([], positive), build(seen)]", []interface{}{true, false, []int{}}},
+		{"all([1, 2], |x| x)", true},
+		{"all([1, null], |x| x)", false},
+		{"any([false, null], |x| x)", false},
+		{"any(1, |x| x)", &object.Error{Message: "argument 1 to `any` must be ARRAY, got INTEGER"}},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"all([1, 2], fn(x) { x + true })", "unsupported types for binary operation: INTEGER and BOOLEAN"},
+	})
+}
+
+// BenchmarkArrayBuilding builds an array of 10000 elements with push and with a builder.
+// Frames are limited, so both recurse by halving the range instead of element by element.
+func BenchmarkArrayBuilding(b *testing.B) {
+	inputs := map[string]string{
+		"push": `let fill = fn(arr, lo, hi) {
+			if (hi - lo == 1) { push(arr, lo) } else { let mid = (lo + hi) / 2; fill(fill(arr, lo, mid), mid, hi) }
+		};
+		len(fill([], 0, 10000))`,
+		"builder": `let fill = fn(b, lo, hi) {
+			if (hi - lo == 1) { append(b, lo) } else { let mid = (lo + hi) / 2; fill(fill(b, lo, mid), mid, hi) }
+		};
+		len(build(fill(newArrayBuilder(), 0, 10000)))`,
+	}
+
+	for _, name := range []string{"push", "builder"} {
+		c := compiler.New()
+		if err := c.Compile(parse(inputs[name])); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+		byteCode := c.ByteCode()
+
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				vm := New(byteCode)
+				if err := vm.Run(); err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+				if result, ok := vm.LastPopped().(*object.Integer); !ok || result.Value != 10000 {
+					b.Fatalf("wrong result: %s", vm.LastPopped().Inspect())
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStringBuilding builds a string of 10000 bytes with + and with a builder,
+// recursing by halving the range like BenchmarkArrayBuilding.
+func BenchmarkStringBuilding(b *testing.B) {
+	inputs := map[string]string{
+		"concatenation": `let fill = fn(s, lo, hi) {
+			if (hi - lo == 1) { s + "x" } else { let mid = (lo + hi) / 2; fill(fill(s, lo, mid), mid, hi) }
+		};
+		len(fill("", 0, 10000))`,
+		"builder": `let fill = fn(b, lo, hi) {
+			if (hi - lo == 1) { append(b, "x") } else { let mid = (lo + hi) / 2; fill(fill(b, lo, mid), mid, hi) }
+		};
+		len(toString(fill(newBuilder(), 0, 10000)))`,
+	}
+
+	for _, name := range []string{"concatenation", "builder"} {
+		c := compiler.New()
+		if err := c.Compile(parse(inputs[name])); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+		byteCode := c.ByteCode()
+
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				vm := New(byteCode)
+				if err := vm.Run(); err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+				if result, ok := vm.LastPopped().(*object.Integer); !ok || result.Value != 10000 {
+					b.Fatalf("wrong result: %s", vm.LastPopped().Inspect())
+				}
+			}
+		})
+	}
+}
+
+func TestMemoize(t *testing.T) {
+	// only a function literal bound by let can refer to itself, so fib recurses through self
+	fib := `let calls = [0];
+	let self = [null];
+	let fib = memoize(fn(n) { calls[0] = calls[0] + 1; if (n < 2) { n } else { self[0](n - 1) + self[0](n - 2) } });
+	self[0] = fib;
+	`
+	testCases := []vmTestCase{
+		// without memoize, fib(30) would make 2692537 calls
+		{fib + "[fib(30), calls[0]]", []int{832040, 31}},
+		{fib + "fib(30); fib(20); fib(30); calls[0]", 31},
+		{"let calls = [0]; let f = memoize(fn() { calls[0] = calls[0] + 1; }); f(); f(); [f() == null, calls[0]]", []interface{}{true, 1}},
+		{`let calls = [0]; let f = memoize(fn(a, b) { calls[0] = calls[0] + 1; a }); f(1, "x"); f(1, "y"); f(1, "x"); calls[0]`, 2},
+		{"let calls = [0]; let f = memoize(fn(a) { calls[0] = calls[0] + 1; len(a) }); f([1]); f([1]); calls[0]", 2},
+		{"memoize(max)(3, 7)", 7},
+		{"memoize(partial(max, 3))(1)", 3},
+		{"partial(memoize(max), 3)(1)", 3},
+		{"memoize(1)", &object.Error{Message: "argument to `memoize` must be a function, got INTEGER"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestRuntimeErrorKinds(t *testing.T) {
+	tests := []struct {
+		input   string
+		message string
+		target  interface{}
+	}{
+		{"1 + true", "unsupported types for binary operation: INTEGER and BOOLEAN", new(*TypeError)},
+		{"-true", "unsupported type for negation by minus: BOOLEAN", new(*TypeError)},
+		{"1[0]", "index operator not supported: INTEGER", new(*TypeError)},
+		{"let a = 1; a()", "calling non-function: INTEGER", new(*TypeError)},
+		{"let a = freeze([1]); a[0] = 2", "cannot assign to frozen ARRAY", new(*TypeError)},
+		{"let a = [1]; a[1] = 2", "index out of range: 1", new(*IndexError)},
+		{"let a, b = [1]", "cannot destructure ARRAY of length 1 into 2 names", new(*IndexError)},
+		{"fn(a) { a }()", "wrong number of arguments: want=1, got=0", new(*ArgumentError)},
+		{"1 / 0", "division by zero", new(*DivideByZeroError)},
+		{"let f = fn(a) { 10 / a }; f(0)", "division by zero", new(*DivideByZeroError)},
+		{"exit(2)", "exit status 2", new(*ExitError)},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		if err := comp.Compile(program); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err := New(comp.ByteCode()).Run()
+		if err == nil {
+			t.Fatalf("expected VM error for %q but got none", tt.input)
+		}
+		if err.Error() != tt.message {
+			t.Errorf("wrong VM error for %q. want=%q, got=%q", tt.input, tt.message, err)
+		}
+		if !errors.As(err, tt.target) {
+			t.Errorf("VM error for %q has wrong kind. want=%T, got=%T", tt.input, tt.target, err)
+		}
+	}
+}
+
+func TestCallingFunctionsWithWrongArguments(t *testing.T) {
+	testCases := []vmErrorTestCase{
+		{"fn() { 1 }(1)", "wrong number of arguments: want=0, got=1"},
+		{"fn(a, b) { a + b }(1)", "wrong number of arguments: want=2, got=1"},
+		{"let a = 1; a()", "calling non-function: INTEGER"},
+	}
+
+	runVmErrorTests(t, testCases)
+}
+
+func TestOrderingTypeErrors(t *testing.T) {
+	testCases := []vmErrorTestCase{
+		{"5 > true", "unsupported types for > operation: INTEGER and BOOLEAN"},
+		{"true > 5", "unsupported types for > operation: BOOLEAN and INTEGER"},
+		{"true > false", "unsupported types for > operation: BOOLEAN and BOOLEAN"},
+		{"5 >= true", "unsupported types for >= operation: INTEGER and BOOLEAN"},
+		{"5 < true", "unsupported types for < operation: INTEGER and BOOLEAN"},
+		{"5 <= true", "unsupported types for <= operation: INTEGER and BOOLEAN"},
+		{"1 < 2 < true", "unsupported types for < operation: INTEGER and BOOLEAN"},
+		{`"a" > "b"`, "unsupported types for > operation: STRING and STRING"},
+		{"[1] >= 1", "unsupported types for >= operation: ARRAY and INTEGER"},
+	}
+
+	runVmErrorTests(t, testCases)
+}
+
+type vmErrorTestCase struct {
+	input    string
+	expected string
+}
+
+func runVmErrorTests(t *testing.T, testCases []vmErrorTestCase) {
+	t.Helper()
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			c := compiler.New()
+			if err := c.Compile(parse(tc.input)); err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+
+			vm := New(c.ByteCode())
+			err := vm.Run()
+			if err == nil {
+				t.Fatalf("expected VM error but resulted in none")
+			}
+			if err.Error() != tc.expected {
+				t.Fatalf("wrong VM error. want=%q, got=%q", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestBuiltinFunctions(t *testing.T) {
+	testCases := []vmTestCase{
+		{"len(1)", &object.Error{Message: "argument 1 to `len` must be ARRAY or STRING, got INTEGER"}},
+		{"first(1)", &object.Error{Message: "argument 1 to `first` must be ARRAY, got INTEGER"}},
+		{"puts(1)", object.NULL},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestBuiltinArgumentErrors(t *testing.T) {
+	testCases := []vmTestCase{
+		{"len()", &object.Error{Message: "wrong number of arguments. got=0, want=1"}},
+		{"len(true)", &object.Error{Message: "argument 1 to `len` must be ARRAY or STRING, got BOOLEAN"}},
+		{"rest(1)", &object.Error{Message: "argument 1 to `rest` must be ARRAY, got INTEGER"}},
+		{"push(1, 2)", &object.Error{Message: "argument 1 to `push` must be ARRAY, got INTEGER"}},
+		{"push([], 1, 2)", &object.Error{Message: "wrong number of arguments. got=3, want=2"}},
+		{"values([])", &object.Error{Message: "argument 1 to `values` must be HASH, got ARRAY"}},
+		{"clamp(1, 2, true)", &object.Error{Message: "argument 3 to `clamp` must be INTEGER, got BOOLEAN"}},
+		{"exit(true)", &object.Error{Message: "argument 1 to `exit` must be INTEGER, got BOOLEAN"}},
+		{"now(1)", &object.Error{Message: "wrong number of arguments. got=1, want=0"}},
+		{"equals(1, [])", false},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestMinMax(t *testing.T) {
+	testCases := []vmTestCase{
+		{"max(1, 5, 3)", 5},
+		{"min(1, 5, 3)", 1},
+		{"max([1, 5, 3])", 5},
+		{"min([4, -2, 3])", -2},
+		{"max(7)", 7},
+		{"max([])", &object.Error{Message: "`max` needs at least one value"}},
+		{"min()", &object.Error{Message: "`min` needs at least one value"}},
+		{"max(1, 2.5, 2)", 2.5},
+		{"min([1.5, -2, 3])", -2},
+		{"min(0.5, 0.25)", 0.25},
+		{"max(1, true)", &object.Error{Message: "argument to `max` must be INTEGER or FLOAT, got BOOLEAN"}},
+		{"min([1, [2]])", &object.Error{Message: "argument to `min` must be INTEGER or FLOAT, got ARRAY"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestAbsClamp(t *testing.T) {
+	testCases := []vmTestCase{
+		{"abs(-5)", 5},
+		{"abs(5)", 5},
+		{"abs(0)", 0},
+		{"abs(-9223372036854775807 - 1)", bigInteger("9223372036854775808")},
+		{"clamp(10, 0, 5)", 5},
+		{"clamp(-3, 0, 5)", 0},
+		{"clamp(3, 0, 5)", 3},
+		{"abs(-2.5)", 2.5},
+		{"abs(1.5)", 1.5},
+		{"abs(true)", &object.Error{Message: "argument 1 to `abs` must be INTEGER or FLOAT, got BOOLEAN"}},
+		{"abs(1, 2)", &object.Error{Message: "wrong number of arguments. got=2, want=1"}},
+		{"clamp(1, [0], 5)", &object.Error{Message: "argument 2 to `clamp` must be INTEGER, got ARRAY"}},
+		{"clamp(1, 5)", &object.Error{Message: "wrong number of arguments. got=2, want=3"}},
+		{"clamp(1, 5, 0)", &object.Error{Message: "lower bound of `clamp` is greater than upper bound: 5 > 0"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestEquals(t *testing.T) {
+	testCases := []vmTestCase{
+		{"equals(1, 1)", true},
+		{"equals(1, 2)", false},
+		{`equals("monkey", "mon" + "key")`, true},
+		{"equals([1, [2, 3]], [1, [2, 3]])", true},
+		{"equals([1, [2, 3]], [1, [2, 4]])", false},
+		{"equals([1, [2, 3]], [1, [2]])", false},
+		{"equals([[true], [false]], [[true], [false]])", true},
+		{"equals([1], 1)", false},
+		{"equals(1, true)", false},
+		{"let f = fn() { 1 }; equals(f, f)", true},
+		{"equals(fn() { 1 }, fn() { 1 })", false},
+		{"!equals([1], [2])", true},
+		{"equals([1], [1]) == true", true},
+		{"if (equals([], [1])) { 1 } else { 2 }", 2},
+		{"equals(1)", &object.Error{Message: "wrong number of arguments. got=1, want=2"}},
+		{"let a = [0]; a[0] = a; equals(a, a)", true},
+		{"let a = [0]; a[0] = a; let b = [0]; b[0] = b; equals(a, b)", &object.Error{Message: "cannot compare an array nested in itself"}},
+		{"let a = [0]; a[0] = a; equals(a, [1])", false},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestClone(t *testing.T) {
+	testCases := []vmTestCase{
+		{"clone(5)", 5},
+		{`clone("monkey")`, "monkey"},
+		{"clone([1, [2, 3]])[1]", []int{2, 3}},
+		{`let h = {"a": [1]}; equals(clone(h), h)`, true},
+		{"let f = fn() { 7 }; clone(f)()", 7},
+		{"let a = [[1], [2]]; let b = clone(a); b[0][0] = 100; a[0][0]", 1},
+		{`let a = {"k": [2]}; let b = clone(a); b["k"][0] = 200; a["k"][0]`, 2},
+		{`let a = {"k": 2}; let b = clone(a); b["j"] = 3; len(keys(a))`, 1},
+		{"clone()", &object.Error{Message: "wrong number of arguments. got=0, want=1"}},
+		{"let a = [0]; a[0] = a; clone(a)", &object.Error{Message: "cannot clone an array nested in itself"}},
+		{`let h = {}; h["h"] = [h]; clone(h)`, &object.Error{Message: "cannot clone a hash nested in itself"}},
+		{"let a = [1]; clone([a, a])", []interface{}{[]int{1}, []int{1}}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	testCases := []vmTestCase{
+		{"1.5 + 2.0", 3.5},
+		{"0.5 - 2.0", -1.5},
+		{"1.5 * 4.0", 6.0},
+		{"1.0 / 4.0", 0.25},
+		{"1 + 0.5", 1.5},
+		{"3.0 / 2", 1.5},
+		{"-1.5 * 2", -3.0},
+		{"9223372036854775808 * 0.5", 4611686018427387904.0},
+		{"1.5 < 2.0", true},
+		{"2.0 <= 2.0", true},
+		{"1.5 > 2", false},
+		{"1 >= 1.0", true},
+		{"1.0 == 1.0", true},
+		{"1.0 != 1.0", false},
+		{"1 == 1.0", true},
+		{"0.1 + 0.2 == 0.3", false},
+		{"let x = 2.5; x == 2.5", true},
+		{"[1.0 == 1.0, 1.0 == true]", []interface{}{true, false}},
+	}
+
+	runVmTests(t, testCases)
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"1.5 / 0", "division by zero"},
+		{"1.5 / 0.0", "division by zero"},
+		{"1.5 + true", "unsupported types for binary operation: FLOAT and BOOLEAN"},
+		{`1.5 < "a"`, "unsupported types for < operation: FLOAT and STRING"},
+	})
+}
+
+func TestNumericConversions(t *testing.T) {
+	testCases := []vmTestCase{
+		{"1.5", 1.5},
+		{"float(3)", 3.0},
+		{"float(-7)", -7.0},
+		{`float("2.25")`, 2.25},
+		{"float(0.5)", 0.5},
+		{"int(3.9)", 3},
+		{"int(-3.9)", -3},
+		{"int(float(7))", 7},
+		{`int("42")`, 42},
+		{`int("-42")`, -42},
+		{"int(5)", 5},
+		{`int("nope")`, &object.Error{Message: `could not parse "nope" as integer`}},
+		{`int("4.2")`, &object.Error{Message: `could not parse "4.2" as integer`}},
+		{`float("nope")`, &object.Error{Message: `could not parse "nope" as float`}},
+		{`int(float("1e19"))`, &object.Error{Message: "float 1e+19 out of range of INTEGER"}},
+		{"int(true)", &object.Error{Message: "argument 1 to `int` must be INTEGER or FLOAT or STRING, got BOOLEAN"}},
+	}
+
+	runVmTests(t, testCases)
+}
+
+func TestPutsOutput(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("puts(1, 2); let f = fn(x) { puts(x) }; f(3);")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(c.ByteCode())
+	vm.SetOutput(&out)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	if out.String() != "1\n2\n3\n" {
+		t.Fatalf("output wrong. want=%q, got=%q", "1\n2\n3\n", out.String())
+	}
+}
+
+func TestSeededRand(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("let r = fn() { rand(1000) }; [r(), r(), r(), r(), r(), r(), r(), r()]")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	run := func(seed int64) *object.Array {
+		vm := New(c.ByteCode())
+		vm.Seed(seed)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		return vm.LastPopped().(*object.Array)
+	}
+
+	first := run(42)
+	for _, e := range first.Elements {
+		if n := e.(*object.Integer).Value; n < 0 || n >= 1000 {
+			t.Fatalf("rand(1000) out of range: %d", n)
+		}
+	}
+	if again := run(42); again.Inspect() != first.Inspect() {
+		t.Fatalf("same seed gave different sequences: %s and %s", first.Inspect(), again.Inspect())
+	}
+	if other := run(43); other.Inspect() == first.Inspect() {
+		t.Fatalf("different seeds gave the same sequence: %s", first.Inspect())
+	}
+}
+
+func TestRandArguments(t *testing.T) {
+	testCases := []vmTestCase{
+		{"rand(1)", 0},
+		{"rand(0)", &object.Error{Message: "argument to `rand` must be positive, got 0"}},
+		{"rand(-5)", &object.Error{Message: "argument to `rand` must be positive, got -5"}},
+		{"rand(true)", &object.Error{Message: "argument 1 to `rand` must be INTEGER, got BOOLEAN"}},
 	}
 
 	runVmTests(t, testCases)
 }
 
-func TestConditionals(t *testing.T) {
+func TestNow(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("let start = now(); let end = now(); [start, end - start]")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	clock := time.UnixMilli(1700000000000)
+	vm := New(c.ByteCode())
+	vm.SetClock(func() time.Time {
+		now := clock
+		clock = clock.Add(250 * time.Millisecond)
+		return now
+	})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testObject(t, []int{1700000000000, 250}, vm.LastPopped())
+}
+
+func TestExit(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("puts(1); let f = fn() { exit(2); puts(2) }; f(); puts(3)")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	vm := New(c.ByteCode())
+	vm.SetOutput(&out)
+	err := vm.Run()
+
+	exit, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("Run did not return ExitError. got=%T (%v)", err, err)
+	}
+	if exit.Code != 2 {
+		t.Fatalf("exit code wrong. want=2, got=%d", exit.Code)
+	}
+	if out.String() != "1\n" {
+		t.Fatalf("output wrong. want=%q, got=%q", "1\n", out.String())
+	}
+}
+
+func TestAssert(t *testing.T) {
 	testCases := []vmTestCase{
-		{"if (true) { 10 }", 10},
-		{"if (true) { 10 } else { 20 }", 10},
-		{"if (false) { 10 } else { 20 }", 20},
-		{"if (1) { 10 } else { 20 }", 10},
-		{"if (1 < 2) { 10 }", 10},
-		{"if (1 < 2) { 10 } else { 20 }", 10},
-		{"if (1 > 2) { 10 } else { 20 }", 20},
-		{"if (1 > 2) { 10 }", Null},
-		{"if (false) { 10 }", Null},
-		{"if (false) { 10 }", Null},
-		{"if (if (false) { 5 }) { 10 } else { 20 }", 20},
+		{"assert(true)", object.NULL},
+		{"assert(1 < 2, \"ordered\")", object.NULL},
+		{"assert([])", object.NULL},
+		{"assert(1, 2)", &object.Error{Message: "argument 2 to `assert` must be STRING, got INTEGER"}},
+		{"assert()", &object.Error{Message: "wrong number of arguments. got=0, want=1 or 2"}},
 	}
 
 	runVmTests(t, testCases)
 }
 
-func TestGlobalLetStatements(t *testing.T) {
+func TestFailingAssert(t *testing.T) {
+	testCases := []vmErrorTestCase{
+		{"assert(false)", "assertion failed"},
+		{"assert(if (false) { 1 })", "assertion failed"},
+		{`let f = fn(x) { assert(x > 1, "x too small"); x }; f(2); f(1); f(3)`, "assertion failed: x too small"},
+	}
+
+	runVmErrorTests(t, testCases)
+}
+
+func TestModifyingClonedByteCode(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("let f = fn() { 3 }; f() + 2")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	byteCode := c.ByteCode()
+
+	// constants are [3, fn, 2]; make the clone compute f() + 100 where f returns the last constant
+	clone := byteCode.Clone()
+	clone.Constants[2] = &object.Integer{Value: 100}
+	copy(clone.Constants[1].(*object.CompiledFunction).Instructions, code.Make(code.OpConstant, 2))
+
+	constants := byteCode.ConstantsCopy()
+	constants[0] = &object.Integer{Value: 200}
+
+	instructions := byteCode.InstructionsCopy()
+	instructions[0] = byte(code.OpNull)
+
+	vm := New(byteCode)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testIntegerObject(t, 5, vm.LastPopped())
+
+	cloneVM := New(clone)
+	if err := cloneVM.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testIntegerObject(t, 200, cloneVM.LastPopped())
+}
+
+func TestDisableBuiltins(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"len([1, 2])", 2},
+		{"exit(1)", "exit"},
+		{"let f = fn() { puts(1) }; 2", 2},
+		{"let f = fn() { puts(1) }; f()", "puts"},
+		{"find([1], fn(x) { exit(1) })", "exit"},
+	}
+
+	for _, tt := range tests {
+		c := compiler.New()
+		if err := c.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(c.ByteCode())
+		var out bytes.Buffer
+		vm.SetOutput(&out)
+		vm.DisableBuiltins("exit", "puts")
+		err := vm.Run()
+
+		name, disabled := tt.expected.(string)
+		if !disabled {
+			if err != nil {
+				t.Fatalf("vm error for %q: %s", tt.input, err)
+			}
+			testObject(t, tt.expected, vm.LastPopped())
+			continue
+		}
+
+		var disabledErr *DisabledBuiltinError
+		if !errors.As(err, &disabledErr) || disabledErr.Name != name {
+			t.Fatalf("wrong error for %q. want builtin disabled: %s, got=%v", tt.input, name, err)
+		}
+		if out.Len() != 0 {
+			t.Fatalf("disabled builtin ran for %q, output=%q", tt.input, out.String())
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		{"try { 1 / 0 } catch (e) { e }", &object.Error{Message: "division by zero"}},
+		{"try { 1 / 0 } catch (e) { 5 }", 5},
+		{"try { 10 / 2 } catch (e) { 0 }", 5},
+		{"try { } catch (e) { 1 }", object.NULL},
+		{"try { 1 / 0 } catch (e) { }", object.NULL},
+		{"1 + try { [1 + true] } catch (e) { 2 } + 3", 6},
+		{"let f = fn(x) { try { 10 / x } catch (e) { -1 } }; f(0) + f(5)", 1},
+		{"let div = fn(a, b) { a / b }; let f = fn() { div(1, 0) }; try { f() } catch (e) { 7 }", 7},
+		{"try { try { 1 / 0 } catch (e) { 1 + true } } catch (e) { e }",
+			&object.Error{Message: "unsupported types for binary operation: INTEGER and BOOLEAN"}},
+		{"try { fn(a) { a }() } catch (e) { e }",
+			&object.Error{Message: "wrong number of arguments: want=1, got=0"}},
+		{"try { let a = 1; a } catch (e) { 0 }", 1},
+		{"let e = 1; try { 1 / 0 } catch (e) { e }; e", 1},
+		{"let f = fn() { let a = 2; try { a / 0 } catch (e) { a } }; f()", 2},
+		{"let f = fn() { try { return 1 } catch (e) { 2 } }; f() + try { f() / 0 } catch (e) { 3 }", 4},
+		// an error in a function called by a builtin unwinds through the builtin
+		{"let r = try { find([1, 2], fn(x) { x / 0 }) } catch (e) { e }; [r, 3]",
+			[]interface{}{&object.Error{Message: "division by zero"}, 3}},
+		{"find([0, 1], fn(x) { try { 1 / x; true } catch (e) { false } })", 1},
+	})
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"try { 1 / 0 } catch (e) { 1 + true }", "unsupported types for binary operation: INTEGER and BOOLEAN"},
+		{"try { 1 } catch (e) { 2 }; 1 / 0", "division by zero"},
+		{"let f = fn() { try { return 1 } catch (e) { 2 } }; f(); 1 / 0", "division by zero"},
+		{"try { exit(3) } catch (e) { 1 }", "exit status 3"},
+		{"let f = fn() { f() }; try { f() } catch (e) { 1 }", "frame overflow"},
+	})
+
+	c := compiler.New()
+	if err := c.Compile(parse("try { 1 + true } catch (e) { 5 }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(c.ByteCode())
+	vm.SetResumeOnError(true)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testObject(t, 5, vm.LastPopped())
+}
+
+func TestThrow(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		{`try { throw "boom" } catch (e) { e }`, "boom"},
+		{"try { throw [1, 2] } catch (e) { e[1] }", 2},
+		{`let check = fn(x) { if (x < 0) { throw "negative" } x }; try { check(-1) } catch (e) { e + "!" }`, "negative!"},
+		{`let f = fn(x) { x ?? throw "missing" }; [f(1), try { f(null) } catch (e) { e }]`, []interface{}{1, "missing"}},
+		{"try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e }", 2},
+		{"try { try { 1 / 0 } catch (e) { throw e } } catch (e) { e }", &object.Error{Message: "division by zero"}},
+		{`try { find([1], fn(x) { throw "found" }) } catch (e) { e }`, "found"},
+		{"try { throw null } catch (e) { e }", object.NULL},
+	})
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{`throw "boom"`, "uncaught throw: boom"},
+		{`let f = fn() { throw [1] }; f()`, "uncaught throw: [1]"},
+		{`try { throw 1 } catch (e) { throw "again" }`, "uncaught throw: again"},
+	})
+
+	c := compiler.New()
+	if err := c.Compile(parse(`1 + throw {"code": 2}`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err := New(c.ByteCode()).Run()
+	var throwErr *ThrowError
+	if !errors.As(err, &throwErr) {
+		t.Fatalf("wrong error. want *ThrowError, got=%T (%v)", err, err)
+	}
+	if _, ok := throwErr.Value.(*object.Hash); !ok {
+		t.Errorf("thrown value is not a hash. got=%T (%+v)", throwErr.Value, throwErr.Value)
+	}
+}
+
+func TestFinally(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		// the normal path
+		{`let h = {"ran": false}; let r = try { 1 } finally { h["ran"] = true }; [r, h["ran"]]`, []interface{}{1, true}},
+		{"try { 1 } finally { 2 }", 1},
+		{"let f = fn() { try { 5 } finally { 6 } }; f()", 5},
+		// the caught path
+		{`let h = {"ran": false}; let r = try { 1 / 0 } catch (e) { 2 } finally { h["ran"] = true }; [r, h["ran"]]`, []interface{}{2, true}},
+		{`let h = {}; try { try { 1 / 0 } catch (e) { throw "again" } finally { h["ran"] = true } } catch (e) { [e, h["ran"]] }`,
+			[]interface{}{"again", true}},
+		// the uncaught path, rethrown to an enclosing try
+		{`let h = {"ran": false}; let r = try { try { 1 / 0 } finally { h["ran"] = true } } catch (e) { e }; [r, h["ran"]]`,
+			[]interface{}{&object.Error{Message: "division by zero"}, true}},
+		{`try { try { throw "x" } finally { 1 } } catch (e) { e }`, "x"},
+		{`try { try { 1 / 0 } finally { throw "finally" } } catch (e) { e }`, "finally"},
+		// returns
+		{`let h = {"n": 0}; let f = fn() { try { return 1 } finally { h["n"] = h["n"] + 1 }; 2 }; [f(), h["n"]]`, []interface{}{1, 1}},
+		{`let h = {}; let f = fn() { try { 1 / 0 } catch (e) { return 2 } finally { h["n"] = 10 } }; [f(), h["n"]]`, []interface{}{2, 10}},
+		{`let h = {}; let f = fn() { try { try { return 1 } finally { h["a"] = 1 } } finally { h["b"] = h["a"] + 1 } }; [f(), h["b"]]`,
+			[]interface{}{1, 2}},
+		{"let f = fn() { try { return 1 } finally { return 2 } }; f()", 2},
+		{"let f = fn() { try { return 1 } finally { } }; f(); try { 1 / 0 } catch (e) { 3 }", 3},
+	})
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"try { 1 / 0 } finally { 1 }", "division by zero"},
+		{"try { 1 / 0 } catch (e) { 1 + true } finally { 1 }", "unsupported types for binary operation: INTEGER and BOOLEAN"},
+		{"let f = fn() { try { return 1 } catch (e) { 2 } finally { } }; f(); 1 / 0", "division by zero"},
+		{"try { exit(2) } finally { 1 / 0 }", "division by zero"},
+	})
+
+	// finally blocks run before the errors try doesn't catch, too
+	tests := []struct {
+		input     string
+		expectErr error
+	}{
+		{`try { throw "x" } finally { puts("cleanup") }`, &ThrowError{}},
+		{`try { exit(3) } catch (e) { puts("caught") } finally { puts("cleanup") }`, &ExitError{}},
+		{`try { assert(false) } catch (e) { puts("caught") } finally { puts("cleanup") }`, &AssertionError{}},
+		{`find([1], fn(x) { try { exit(4) } finally { puts("cleanup") } })`, &ExitError{}},
+	}
+
+	for _, tt := range tests {
+		c := compiler.New()
+		if err := c.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		var out bytes.Buffer
+		vm := New(c.ByteCode())
+		vm.SetOutput(&out)
+		err := vm.Run()
+		if reflect.TypeOf(err) != reflect.TypeOf(tt.expectErr) {
+			t.Fatalf("wrong error for %q. want %T, got=%T (%v)", tt.input, tt.expectErr, err, err)
+		}
+		if out.String() != "cleanup\n" {
+			t.Errorf("finally didn't run before the error of %q. output=%q", tt.input, out.String())
+		}
+	}
+}
+
+func TestDoWhile(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1 } while (false); h["n"]`, 1},
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1 } while (h["n"] < 5); h["n"]`, 5},
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1; if (h["n"] == 3) { break } } while (true); h["n"]`, 3},
+		{`let h = {"n": 0, "odd": 0}; do { h["n"] = h["n"] + 1; if (h["n"] / 2 * 2 == h["n"]) { continue }; h["odd"] = h["odd"] + 1 } while (h["n"] < 10); h["odd"]`, 5},
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1; continue; h["n"] = 100 } while (false); h["n"]`, 1},
+		{`let h = {"i": 0, "total": 0}; do { h["i"] = h["i"] + 1; let j = {"v": 0}; do { j["v"] = j["v"] + 1; if (j["v"] > 2) { break }; h["total"] = h["total"] + 1 } while (true) } while (h["i"] < 3); h["total"]`, 6},
+		{`let f = fn() { let h = {"n": 0}; do { h["n"] = h["n"] + 1; if (h["n"] == 4) { return h["n"] * 10 } } while (true) }; f()`, 40},
+		// the stack doesn't grow with the iterations
+		{`let h = {"n": 0}; do { h["n"] = h["n"] + 1; h["n"] * 2 } while (h["n"] < 10000); h["n"]`, 10000},
+		{`let h = {"n": 0, "f": 0}; do { try { h["n"] = h["n"] + 1; if (h["n"] == 3) { break } } finally { h["f"] = h["f"] + 1 } } while (true); [h["n"], h["f"]]`,
+			[]interface{}{3, 3}},
+		{`let h = {"n": 0}; do { try { h["n"] = h["n"] + 1; continue } catch (e) { 1 } } while (h["n"] < 3); try { 1 / 0 } catch (e) { h["n"] }`, 3},
+	})
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"do { try { break } catch (e) { 1 } } while (true); 1 / 0", "division by zero"},
+		{"do { 1 } while (1 + true)", "unsupported types for binary operation: INTEGER and BOOLEAN"},
+	})
+}
+
+func TestLabeledLoops(t *testing.T) {
+	runVmTests(t, []vmTestCase{
+		// two levels: the break and continue of the inner loop end or go on with the outer one
+		{`let h = {"i": 0, "n": 0}; outer: do { h["i"] = h["i"] + 1; let j = {"v": 0}; do { j["v"] = j["v"] + 1; h["n"] = h["n"] + 1; if (h["i"] == 2) { if (j["v"] == 2) { break outer } } } while (j["v"] < 3) } while (h["i"] < 5); [h["i"], h["n"]]`,
+			[]interface{}{2, 5}},
+		{`let h = {"i": 0, "n": 0}; outer: do { h["i"] = h["i"] + 1; let j = {"v": 0}; do { j["v"] = j["v"] + 1; if (j["v"] == 2) { continue outer }; h["n"] = h["n"] + 1 } while (true) } while (h["i"] < 3); [h["i"], h["n"]]`,
+			[]interface{}{3, 3}},
+		// a label of the innermost loop is the same as none
+		{`let h = {"i": 0, "n": 0}; do { h["i"] = h["i"] + 1; inner: do { h["n"] = h["n"] + 1; break inner } while (true) } while (h["i"] < 3); [h["i"], h["n"]]`,
+			[]interface{}{3, 3}},
+		// without a label the innermost loop is left, even inside a labeled one
+		{`let h = {"i": 0, "n": 0}; outer: do { h["i"] = h["i"] + 1; do { h["n"] = h["n"] + 1; break } while (true) } while (h["i"] < 3); [h["i"], h["n"]]`,
+			[]interface{}{3, 3}},
+		// three levels: the innermost loop continues the middle one and ends the outer one
+		{`let h = {"a": 0, "b": 0, "c": 0}; a: do { h["a"] = h["a"] + 1; b: do { h["b"] = h["b"] + 1; do { h["c"] = h["c"] + 1; if (h["c"] == 5) { break a }; if (h["b"] < 3) { continue b } } while (false) } while (h["b"] < 3) } while (true); [h["a"], h["b"], h["c"]]`,
+			[]interface{}{3, 5, 5}},
+		// of loops with the same label the innermost one is meant
+		{`let h = {"i": 0, "n": 0}; l: do { h["i"] = h["i"] + 1; l: do { h["n"] = h["n"] + 1; break l } while (true) } while (h["i"] < 2); [h["i"], h["n"]]`,
+			[]interface{}{2, 2}},
+		// the finally blocks of every try left run, innermost first
+		{`let h = {"log": []}; outer: do { try { do { try { break outer } finally { h["log"] = push(h["log"], 1) } } while (true) } finally { h["log"] = push(h["log"], 2) } } while (true); h["log"]`,
+			[]interface{}{1, 2}},
+		{`let f = fn() { let h = {"n": 0}; outer: do { do { h["n"] = h["n"] + 1; if (h["n"] == 4) { return h["n"] * 10 }; continue outer } while (true) } while (true) }; f()`, 40},
+	})
+
+	runVmErrorTests(t, []vmErrorTestCase{
+		{"outer: do { do { try { break outer } catch (e) { 1 } } while (true) } while (true); 1 / 0", "division by zero"},
+	})
+}
+
+func TestResumeOnError(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{} // the result when resuming
+	}{
+		{"1 + true; 2", 2},
+		{"let a = -true; let b = 3; [a, b]", []interface{}{
+			&object.Error{Message: "unsupported type for negation by minus: BOOLEAN"}, 3}},
+		{"1 < true", &object.Error{Message: "unsupported types for < operation: INTEGER and BOOLEAN"}},
+		{"5[0]", &object.Error{Message: "index operator not supported: INTEGER"}},
+		{"{[1]: 2}", &object.Error{Message: "unusable as hash key: ARRAY"}},
+		{"let f = fn(x) { x(2) + 3 }; f(4)", &object.Error{
+			Message: "unsupported types for binary operation: ERROR and INTEGER"}},
+		{"let add = fn(a, b) { a + b }; add(1, ...2)", &object.Error{
+			Message: "spread argument must be ARRAY, got INTEGER"}},
+		{"let a, b = [1]; [a, b]", []interface{}{
+			&object.Error{Message: "cannot destructure ARRAY of length 1 into 2 names"},
+			&object.Error{Message: "cannot destructure ARRAY of length 1 into 2 names"}}},
+		// the error the predicate results in is truthy
+		{"find([1, 2], fn(x) { x + true })", 1},
+	}
+
+	for _, tt := range tests {
+		c := compiler.New()
+		if err := c.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		aborting := New(c.ByteCode())
+		err := aborting.Run()
+		var typeErr *TypeError
+		var indexErr *IndexError
+		if !errors.As(err, &typeErr) && !errors.As(err, &indexErr) {
+			t.Fatalf("wrong error for %q without resuming. want type or index error, got=%v", tt.input, err)
+		}
+
+		resuming := New(c.ByteCode())
+		resuming.SetResumeOnError(true)
+		if err := resuming.Run(); err != nil {
+			t.Fatalf("vm error for %q when resuming: %s", tt.input, err)
+		}
+		testObject(t, tt.expected, resuming.LastPopped())
+	}
+}
+
+func TestResumeOnErrorStopsOnOtherErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0; 2", "division by zero"},
+		{"let a = [1]; a[5] = 2; 3", "index out of range: 5"},
+		{"fn(x) { x }(1, 2); 3", "wrong number of arguments: want=1, got=2"},
+	}
+
+	for _, tt := range tests {
+		c := compiler.New()
+		if err := c.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(c.ByteCode())
+		vm.SetResumeOnError(true)
+		err := vm.Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Fatalf("wrong error for %q. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("let add = fn(a, b) { a + b }; add(1, 2)")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	type event struct {
+		kind  EventKind
+		fn    string
+		ip    int
+		depth int
+		op    code.Opcode
+	}
+	expected := []event{
+		{InstructionEvent, "", 0, 1, code.OpClosure},
+		{InstructionEvent, "", 4, 1, code.OpSetGlobal},
+		{InstructionEvent, "", 7, 1, code.OpGetGlobal},
+		{InstructionEvent, "", 10, 1, code.OpOne},
+		{InstructionEvent, "", 11, 1, code.OpConstant},
+		{InstructionEvent, "", 14, 1, code.OpCall},
+		{FramePushedEvent, "add", 0, 2, 0},
+		{InstructionEvent, "add", 0, 2, code.OpGetLocal},
+		{InstructionEvent, "add", 2, 2, code.OpGetLocal},
+		{InstructionEvent, "add", 4, 2, code.OpAdd},
+		{InstructionEvent, "add", 5, 2, code.OpReturnValue},
+		{FramePoppedEvent, "add", 5, 2, 0},
+		{InstructionEvent, "", 16, 1, code.OpPop},
+	}
+
+	events := make(chan Event, 100)
+	vm := New(c.ByteCode())
+	vm.SetEvents(events)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	close(events)
+
+	var got []event
+	for e := range events {
+		got = append(got, event{e.Kind, e.Fn.Name, e.IP, e.Depth, e.Op})
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("wrong number of events. want=%d, got=%d: %v", len(expected), len(got), got)
+	}
+	for i, e := range expected {
+		if got[i] != e {
+			t.Errorf("wrong event %d. want=%+v, got=%+v", i, e, got[i])
+		}
+	}
+	if vm.DroppedEvents() != 0 {
+		t.Fatalf("dropped %d events", vm.DroppedEvents())
+	}
+}
+
+func TestErrorEvent(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("let f = fn() { 1 + true }; f()")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	events := make(chan Event, 100)
+	vm := New(c.ByteCode())
+	vm.SetEvents(events)
+	err := vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none")
+	}
+	close(events)
+
+	var last Event
+	for e := range events {
+		last = e
+	}
+	if last.Kind != ErrorEvent || last.Err != err || last.Fn.Name != "f" || last.Depth != 2 {
+		t.Fatalf("wrong last event. want error %q in f, got=%+v", err, last)
+	}
+}
+
+func TestEventsDontBlock(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("let add = fn(a, b) { a + b }; add(1, 2)")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(c.ByteCode())
+	vm.SetEvents(make(chan Event, 2))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testIntegerObject(t, 3, vm.LastPopped())
+	if vm.DroppedEvents() != 11 {
+		t.Fatalf("wrong number of dropped events. want=11, got=%d", vm.DroppedEvents())
+	}
+}
+
+func TestUninitializedGlobal(t *testing.T) {
+	symbolTable := compiler.NewSymbolTable()
+	if _, err := symbolTable.Define("x"); err != nil {
+		t.Fatalf("define error: %s", err)
+	}
+
+	c := compiler.NewWithState(symbolTable, []object.Object{})
+	if err := c.Compile(parse("x + 1")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	err := NewWithGlobals(c.ByteCode(), NewGlobals()).Run()
+	if err == nil || err.Error() != "use of uninitialized variable" {
+		t.Fatalf("wrong error. want=%q, got=%v", "use of uninitialized variable", err)
+	}
+}
+
+func TestRunningByteCodeWithDifferentGlobals(t *testing.T) {
+	symbolTable := compiler.NewSymbolTable()
+	x, err := symbolTable.Define("x")
+	if err != nil {
+		t.Fatalf("define error: %s", err)
+	}
+
+	c := compiler.NewWithState(symbolTable, []object.Object{})
+	if err := c.Compile(parse("let double = fn(n) { n * 2 }; double(x) + 1")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	byteCode := c.ByteCode()
+
+	for _, tc := range []struct{ x, expected int64 }{{1, 3}, {10, 21}, {1, 3}} {
+		globals := NewGlobals()
+		globals[x.Index] = &object.Integer{Value: tc.x}
+
+		vm := NewWithGlobals(byteCode, globals)
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testIntegerObject(t, tc.expected, vm.LastPopped())
+	}
+}
+
+// TestConcurrentIsolatedVMs is meant to be run with -race
+func TestConcurrentIsolatedVMs(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("let xs = [0, 0]; xs[1] = rand(1000000); let f = fn() { xs[1] * 2 }; f()")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	byteCode := c.ByteCode()
+
+	run := func(seed int64) (object.Object, error) {
+		vm := NewIsolated(byteCode)
+		vm.Seed(seed)
+		if err := vm.Run(); err != nil {
+			return nil, err
+		}
+		return vm.LastPopped(), nil
+	}
+
+	expected := make([]object.Object, 8)
+	for i := range expected {
+		result, err := run(int64(i))
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		expected[i] = result
+	}
+
+	results := make([]object.Object, len(expected))
+	errs := make([]error, len(expected))
+	var wg sync.WaitGroup
+	for i := range expected {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = run(int64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range expected {
+		if errs[i] != nil {
+			t.Fatalf("vm error: %s", errs[i])
+		}
+		if eq, _ := object.Equals(results[i], expected[i]); !eq {
+			t.Errorf("result with seed %d wrong. want=%s, got=%s", i, expected[i].Inspect(), results[i].Inspect())
+		}
+	}
+}
+
+func TestSharingRunningGlobals(t *testing.T) {
+	c := compiler.New()
+	if err := c.Compile(parse("1")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	globals := NewGlobals()
+	// stand in for another VM running against globals
+	if err := claimGlobals(globals); err != nil {
+		t.Fatalf("claim error: %s", err)
+	}
+	if err := NewWithGlobals(c.ByteCode(), globals).Run(); err != ErrGlobalsInUse {
+		t.Fatalf("wrong VM error. want=%v, got=%v", ErrGlobalsInUse, err)
+	}
+
+	releaseGlobals(globals)
+	if err := NewWithGlobals(c.ByteCode(), globals).Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+}
+
+func TestRedefineGlobal(t *testing.T) {
 	testCases := []vmTestCase{
-		{"let one = 1; one", 1},
-		{"let one = 1; let two = 2; one + two", 3},
-		{"let one = 1; let two = one + one; one + two", 3},
+		{"let f = fn() { 1 }; let g = fn() { f() }; let f = fn() { 2 }; g()", 2},
+		{"let x = 1; let f = fn() { x }; let x = x + 1; f()", 2},
+		{"let x = 1; let y = { let x = 2; x }; [x, y]", []int{1, 2}},
 	}
 
 	runVmTests(t, testCases)
 }
 
+func TestModule(t *testing.T) {
+	module := compiler.NewModule()
+	for _, part := range []string{"let a = 1;", "let f = fn(x) { if (x > a) { x } else { a } };", "f(5) + a"} {
+		if err := module.Add(parse(part)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+	}
+
+	vm := New(module.ByteCode())
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testObject(t, 6, vm.LastPopped())
+}
+
 func runVmTests(t *testing.T, testCases []vmTestCase) {
 	t.Helper()
 
@@ -96,6 +2090,9 @@ func runVmTests(t *testing.T, testCases []vmTestCase) {
 			if err := c.Compile(program); err != nil {
 				t.Fatalf("compiler error: %s", err)
 			}
+			if err := Verify(c.ByteCode()); err != nil {
+				t.Fatalf("verifier error: %s", err)
+			}
 
 			vm := New(c.ByteCode())
 			if err := vm.Run(); err != nil {
@@ -114,18 +2111,97 @@ func parse(input string) *ast.Program {
 	return p.ParseProgram()
 }
 
+func concatInstructions(instructions []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range instructions {
+		out = append(out, ins...)
+	}
+	return out
+}
+
 func testObject(t *testing.T, expected interface{}, actual object.Object) {
 	t.Helper()
 
 	switch expected := expected.(type) {
 	case int:
 		testIntegerObject(t, int64(expected), actual)
+	case float64:
+		float, ok := actual.(*object.Float)
+		if !ok {
+			t.Fatalf("could not convert to Float: %+v", actual)
+		}
+		if float.Value != expected {
+			t.Fatalf("Float value wrong. want=%g, got=%g", expected, float.Value)
+		}
+	case *object.BigInt:
+		bigInt, ok := actual.(*object.BigInt)
+		if !ok {
+			t.Fatalf("could not convert to BigInt: %+v", actual)
+		}
+		if bigInt.Value.Cmp(expected.Value) != 0 {
+			t.Fatalf("BigInt value wrong. want=%s, got=%s", expected.Value, bigInt.Value)
+		}
 	case bool:
 		testBooleanObject(t, expected, actual)
+	case string:
+		str, ok := actual.(*object.String)
+		if !ok {
+			t.Fatalf("could not convert to String: %+v", actual)
+		}
+		if str.Value != expected {
+			t.Fatalf("String value wrong. want=%q, got=%q", expected, str.Value)
+		}
+	case []int:
+		array, ok := actual.(*object.Array)
+		if !ok {
+			t.Fatalf("could not convert to Array: %+v", actual)
+		}
+		if len(array.Elements) != len(expected) {
+			t.Fatalf("wrong num of elements. want=%d, got=%d", len(expected), len(array.Elements))
+		}
+		for i, e := range expected {
+			testIntegerObject(t, int64(e), array.Elements[i])
+		}
+	case []interface{}:
+		array, ok := actual.(*object.Array)
+		if !ok {
+			t.Fatalf("could not convert to Array: %+v", actual)
+		}
+		if len(array.Elements) != len(expected) {
+			t.Fatalf("wrong num of elements. want=%d, got=%d", len(expected), len(array.Elements))
+		}
+		for i, e := range expected {
+			testObject(t, e, array.Elements[i])
+		}
+	case map[object.HashKey]int64:
+		hash, ok := actual.(*object.Hash)
+		if !ok {
+			t.Fatalf("could not convert to Hash: %+v", actual)
+		}
+		if len(hash.Pairs) != len(expected) {
+			t.Fatalf("wrong num of pairs. want=%d, got=%d", len(expected), len(hash.Pairs))
+		}
+		for key, value := range expected {
+			pair, ok := hash.Pairs[key]
+			if !ok {
+				t.Fatalf("no pair for given key in pairs")
+			}
+			testIntegerObject(t, value, pair.Value)
+		}
 	case *object.Null:
-		if actual != Null {
+		if actual != object.NULL {
 			t.Fatalf("not null. got=%+v", actual)
 		}
+	case *object.Error:
+		actualError, ok := actual.(*object.Error)
+		if !ok {
+			t.Fatalf("could not convert to Error: %+v", actual)
+		}
+		if actualError.Message != expected.Message {
+			t.Fatalf("Error message wrong. want=%q, got=%q", expected.Message, actualError.Message)
+		}
+	default:
+		t.Fatalf("no check for expected value of type %T", expected)
 	}
 }
 
@@ -154,3 +2230,89 @@ func testBooleanObject(t *testing.T, expected bool, actual object.Object) {
 		t.Fatalf("Boolean valud wrong. want=%t, got=%t", expected, actualBoolean.Value)
 	}
 }
+
+func TestFoldingKeepsResults(t *testing.T) {
+	inputs := []string{
+		"60 * 60 * 24",
+		"-5 + 3 * -2",
+		"7 / 2 - -7 / 2",
+		"9223372036854775807 + 1",
+		"-9223372036854775807 - 1 / -1",
+		"(-9223372036854775807 - 1) / -1",
+		"-(-9223372036854775807 - 1)",
+		"3037000500 * 3037000500 - 1",
+		"let x = 4; x * 1 + 0",
+		`let s = "a"; s + 0`,
+		"1 / 0",
+		"1 + 2 * (10 / 0)",
+		"100000000000000000000 * 1",
+		"let f = fn(n) { n * (2 + 2) / 4 }; f(-7)",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			var results [2]string
+			for i, level := range []compiler.OptimizationLevel{compiler.NoOptimization, compiler.FoldConstants} {
+				c := compiler.New()
+				c.SetOptimizationLevel(level)
+				if err := c.Compile(parse(input)); err != nil {
+					t.Fatalf("compiler error: %s", err)
+				}
+				vm := New(c.ByteCode())
+				if err := vm.Run(); err != nil {
+					results[i] = "error: " + err.Error()
+				} else {
+					results[i] = vm.LastPopped().Inspect()
+				}
+			}
+			if results[0] != results[1] {
+				t.Fatalf("folding changed the result. want=%s, got=%s", results[0], results[1])
+			}
+		})
+	}
+}
+
+func TestKeepResult(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		c := compiler.New()
+		c.SetKeepResult(keep)
+		if err := c.Compile(parse("1 + 2")); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(c.ByteCode())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		if keep {
+			testIntegerObject(t, 3, vm.StackTop())
+		} else {
+			if top := vm.StackTop(); top != nil {
+				t.Errorf("stack not empty, top is %s", top.Inspect())
+			}
+			testIntegerObject(t, 3, vm.LastPopped())
+		}
+	}
+}
+
+// BenchmarkFoldConstants compares a function doing arithmetic on literals with and without folding
+func BenchmarkFoldConstants(b *testing.B) {
+	input := "let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + 60 * 60 * 24 * 7 / 1 + 0 } }; f(100)"
+
+	for _, level := range []compiler.OptimizationLevel{compiler.NoOptimization, compiler.FoldConstants} {
+		c := compiler.New()
+		c.SetOptimizationLevel(level)
+		if err := c.Compile(parse(input)); err != nil {
+			b.Fatalf("compiler error: %s", err)
+		}
+		byteCode := c.ByteCode()
+
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := New(byteCode).Run(); err != nil {
+					b.Fatalf("vm error: %s", err)
+				}
+			}
+		})
+	}
+}